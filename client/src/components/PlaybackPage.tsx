@@ -23,6 +23,13 @@ interface PlaybackPageProps {
   onGoDashboard?: () => void;
 }
 
+interface VideoComment {
+  id: string;
+  userId?: string;
+  text: string;
+  createdAt: string;
+}
+
 const PlaybackPage: React.FC<PlaybackPageProps> = ({
   video,
   onGoBack,
@@ -31,16 +38,32 @@ const PlaybackPage: React.FC<PlaybackPageProps> = ({
   console.log("🎬 Video prop:", video);
   const videoRef = useRef<HTMLVideoElement | null>(null);
   const [likes, setLikes] = useState<number>(0);
-  const [comments, setComments] = useState<string[]>([]);
+  const [comments, setComments] = useState<VideoComment[]>([]);
   const [newComment, setNewComment] = useState("");
+  const [src, setSrc] = useState(video.src);
 
   // ✅ Fetch like/comment data
   useEffect(() => {
-    fetch(`http://98.70.25.253:3002/video/${video.id}`)
+    setSrc(video.src);
+    const token = localStorage.getItem("auth_token");
+    fetch(`http://98.70.25.253:3002/video/${video.id}`, {
+      headers: token ? { Authorization: `Bearer ${token}` } : {},
+    })
       .then((res) => res.json())
-      .then((data) => {
+      .then(async (data) => {
         if (data.likes !== undefined) setLikes(data.likes);
         if (data.comments) setComments(data.comments);
+        // Private videos only play with a media token for their owner.
+        if (data.visibility === "private" && token) {
+          const res = await fetch(`http://98.70.25.253:3001/videos/${video.id}/media-token`, {
+            method: "POST",
+            headers: { Authorization: `Bearer ${token}` },
+          });
+          if (!res.ok) return;
+          const { token: mediaToken } = await res.json();
+          const sep = video.src.includes("?") ? "&" : "?";
+          setSrc(`${video.src}${sep}token=${encodeURIComponent(mediaToken)}`);
+        }
       })
       .catch(() => {});
   }, [video]);
@@ -114,8 +137,12 @@ const PlaybackPage: React.FC<PlaybackPageProps> = ({
   const handleLike = () => {
     fetch(`http://98.70.25.253:3002/videos/${video.id}/like`, {
       method: "POST",
+      headers: { Authorization: `Bearer ${localStorage.getItem("auth_token")}` },
     })
-      .then(() => setLikes((prev) => prev + 1))
+      .then((res) => res.json())
+      .then((data) => {
+        if (data.message === "Like added") setLikes((prev) => prev + 1);
+      })
       .catch(() => {});
   };
 
@@ -125,11 +152,16 @@ const PlaybackPage: React.FC<PlaybackPageProps> = ({
 
     fetch(`http://98.70.25.253:3002/videos/${video.id}/comment`, {
       method: "POST",
-      headers: { "Content-Type": "application/json" },
+      headers: {
+        "Content-Type": "application/json",
+        Authorization: `Bearer ${localStorage.getItem("auth_token")}`,
+      },
       body: JSON.stringify({ text: newComment }),
     })
-      .then(() => {
-        setComments((prev) => [...prev, newComment]);
+      .then((res) => (res.ok ? res.json() : null))
+      .then((data) => {
+        if (!data?.comment) return;
+        setComments((prev) => [...prev, data.comment]);
         setNewComment("");
       })
       .catch(() => {});
@@ -156,7 +188,7 @@ const PlaybackPage: React.FC<PlaybackPageProps> = ({
           <AspectRatio ratio={16 / 9} bg="black" mb={4}>
             <video
               ref={videoRef}
-              src={video.src}
+              src={src}
               controls
               style={{ width: "100%", height: "100%", backgroundColor: "black" }}
             />
@@ -191,9 +223,9 @@ const PlaybackPage: React.FC<PlaybackPageProps> = ({
             <Text fontWeight="bold">Comments:</Text>
 
             {comments.length ? (
-              comments.map((c, idx) => (
-                <Box key={idx} p={2} bg="gray.800" borderRadius="md">
-                  {c}
+              comments.map((c) => (
+                <Box key={c.id} p={2} bg="gray.800" borderRadius="md">
+                  {c.text}
                 </Box>
               ))
             ) : (
@@ -9,6 +9,7 @@ import {
   SimpleGrid,
   Image,
   Input,
+  Progress,
   useToast,
 } from "@chakra-ui/react";
 import { FormControl, FormLabel } from "@chakra-ui/react";
@@ -26,7 +27,8 @@ interface UploadedVideo {
   likes: number;
   views: number;
   comments: Array<{
-    user: string;
+    id: string;
+    userId?: string;
     text: string;
     createdAt: string;
   }>;
@@ -41,6 +43,17 @@ interface User {
   lastLogin: string;
 }
 
+interface ProcessingStatus {
+  videoId: string;
+  status: "queued" | "running" | "succeeded" | "failed";
+  error?: string;
+  progress?: {
+    stage: string;
+    percent: number;
+    etaSeconds?: number;
+  };
+}
+
 interface UploadProps {
   user: User;
   onGoBack: () => void;
@@ -52,6 +65,62 @@ const UploadPage: React.FC<UploadProps> = ({ user, onGoBack }) => {
   const [title, setTitle] = useState("");
   const [description, setDescription] = useState("");
   const [duration, setDuration] = useState<number | null>(null);
+  const [processing, setProcessing] = useState<ProcessingStatus | null>(null);
+
+  // Follow transcoding of the last upload until it succeeds or fails.
+  useEffect(() => {
+    if (!processing || processing.status === "succeeded" || processing.status === "failed") return;
+    const videoId = processing.videoId;
+    let events: EventSource | null = null;
+    let retry: ReturnType<typeof setTimeout> | undefined;
+    let stopped = false;
+
+    // EventSource can't send the auth header, so the stream takes a
+    // short-lived token instead; get a fresh one whenever reconnecting.
+    const connect = async () => {
+      let token: string;
+      try {
+        const res = await fetch(`http://98.70.25.253:3001/videos/${videoId}/events/token`, {
+          method: "POST",
+          headers: { Authorization: `Bearer ${localStorage.getItem("auth_token")}` },
+        });
+        if (!res.ok) return;
+        token = (await res.json()).token;
+      } catch (err) {
+        console.error("Error following processing:", err);
+        if (!stopped) retry = setTimeout(connect, 5000);
+        return;
+      }
+      if (stopped) return;
+      const source = new EventSource(
+        `http://98.70.25.253:3001/videos/${videoId}/events?token=${encodeURIComponent(token)}`
+      );
+      events = source;
+      source.addEventListener("status", (e) => {
+        const status: ProcessingStatus = JSON.parse((e as MessageEvent).data);
+        setProcessing(status);
+        if (status.status === "succeeded" || status.status === "failed") {
+          stopped = true;
+          source.close();
+        }
+      });
+      // The stream ends after a while or on a network error. The browser
+      // would reconnect with the same, by then expired, token, so close it
+      // and connect again with a fresh one.
+      source.onerror = () => {
+        source.close();
+        if (!stopped) retry = setTimeout(connect, 1000);
+      };
+    };
+    connect();
+    return () => {
+      stopped = true;
+      clearTimeout(retry);
+      events?.close();
+    };
+    // Only (re)connect when a new video starts processing.
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [processing?.videoId]);
 
   useEffect(() => {
     fetch("http://98.70.25.253:3001/videos")
@@ -141,7 +210,6 @@ const UploadPage: React.FC<UploadProps> = ({ user, onGoBack }) => {
     formData.append("video", selectedFile!);
     formData.append("title", cleanTitle);
     formData.append("description", cleanDescription);
-    formData.append("uploader", user.username);
 
     if (duration !== null) {
       formData.append("duration", duration.toString());
@@ -150,10 +218,19 @@ const UploadPage: React.FC<UploadProps> = ({ user, onGoBack }) => {
     try {
       const res = await fetch("http://98.70.25.253:3001/", {
         method: "POST",
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem("auth_token")}`,
+        },
         body: formData,
       });
 
-      if (!res.ok) throw new Error("Upload failed");
+      const data = await res.json().catch(() => null);
+      if (!res.ok) {
+        throw new Error(data?.error || "Upload failed");
+      }
+      if (data?.jobId && !data.duplicate) {
+        setProcessing({ videoId: data.id, status: "queued" });
+      }
 
       toast({
         title: "Video uploaded successfully!",
@@ -168,6 +245,7 @@ const UploadPage: React.FC<UploadProps> = ({ user, onGoBack }) => {
     } catch (err) {
       toast({
         title: "Upload failed",
+        description: err instanceof Error ? err.message : undefined,
         status: "error",
         duration: 2000,
         isClosable: true,
@@ -235,6 +313,32 @@ const UploadPage: React.FC<UploadProps> = ({ user, onGoBack }) => {
               >
                 Upload Video
               </Button>
+
+              {processing && (
+                <Box>
+                  <Text fontSize="sm" mb={1}>
+                    {processing.status === "succeeded"
+                      ? "Processing complete"
+                      : processing.status === "failed"
+                      ? `Processing failed: ${processing.error ?? "unknown error"}`
+                      : processing.status === "queued"
+                      ? "Waiting to process…"
+                      : `Processing (${processing.progress?.stage ?? "starting"}) ${Math.round(
+                          processing.progress?.percent ?? 0
+                        )}%` +
+                        (processing.progress?.etaSeconds
+                          ? `, about ${Math.ceil(processing.progress.etaSeconds / 60)} min left`
+                          : "")}
+                  </Text>
+                  <Progress
+                    value={processing.status === "succeeded" ? 100 : processing.progress?.percent ?? 0}
+                    colorScheme={processing.status === "failed" ? "red" : "blue"}
+                    isIndeterminate={processing.status === "queued"}
+                    size="sm"
+                    borderRadius="md"
+                  />
+                </Box>
+              )}
             </VStack>
 
             <Heading size="md" mt={8}>
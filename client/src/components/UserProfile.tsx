@@ -26,7 +26,7 @@ interface Video {
   thumbnail: string;
   likesCount: number;
   viewsCount: number;
-  comments?: string[];
+  comments?: Array<{ id: string; userId?: string; text: string; createdAt: string }>;
 }
 
 interface LikedVideo extends Video {
@@ -86,7 +86,7 @@ const UserProfile: React.FC<UserProfileProps> = ({ user, onGoBack }) => {
           likesCount: v.likes || 0,
           viewsCount: v.views || 0,
           likedByUser: v.likes && v.likes > 0,
-          userComment: v.comments?.[0] || "",
+          userComment: v.comments?.[0]?.text || "",
         }));
         setLikedVideos(mapped);
       })
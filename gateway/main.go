@@ -23,6 +23,9 @@ func getEnv(key, fallback string) string {
 func forward(prefix, target string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		trimmed := strings.TrimPrefix(c.OriginalURL(), prefix)
+		// We are the edge: replace whatever the client claimed with the
+		// address it connected from, for the services' logs and rate limits
+		c.Request().Header.Set(fiber.HeaderXForwardedFor, c.IP())
 		return proxy.Do(c, target+trimmed)
 	}
 }
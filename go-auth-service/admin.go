@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+// userListProjection is the set of fields admins see in listings. Anything
+// not listed here (password hash, pending email, ...) never leaves Mongo.
+var userListProjection = bson.M{
+	"username":             1,
+	"email":                1,
+	"emailVerified":        1,
+	"displayName":          1,
+	"avatarUrl":            1,
+	"role":                 1,
+	"status":               1,
+	"deletionScheduledFor": 1,
+	"createdAt":            1,
+	"lastLogin":            1,
+}
+
+// UserListParams are the query parameters accepted by GET /api/users.
+type UserListParams struct {
+	Sort     string // createdAt or lastLogin
+	Desc     bool
+	Limit    int
+	Cursor   string
+	Role     string
+	Status   string
+	Verified *bool
+	Query    string
+}
+
+// UserPage is one page of a cursor-paginated user listing.
+type UserPage struct {
+	Users      []User `json:"users"`
+	Count      int    `json:"count"`
+	NextCursor string `json:"nextCursor,omitempty"`
+	HasMore    bool   `json:"hasMore"`
+}
+
+// timeCursor marks the last row of a page: the sort key and the _id that
+// breaks ties between rows with the same timestamp.
+type timeCursor struct {
+	Value time.Time `json:"v"`
+	ID    string    `json:"id"`
+}
+
+func encodeTimeCursor(value time.Time, id primitive.ObjectID) string {
+	data, _ := json.Marshal(timeCursor{Value: value, ID: id.Hex()})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeTimeCursor(raw string) (time.Time, primitive.ObjectID, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, fmt.Errorf("invalid cursor")
+	}
+	var cur timeCursor
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return time.Time{}, primitive.NilObjectID, fmt.Errorf("invalid cursor")
+	}
+	id, err := primitive.ObjectIDFromHex(cur.ID)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, fmt.Errorf("invalid cursor")
+	}
+	return cur.Value, id, nil
+}
+
+func parseUserListParams(c *fiber.Ctx) (*UserListParams, error) {
+	params := &UserListParams{
+		Sort:   c.Query("sort", "createdAt"),
+		Desc:   c.Query("order", "desc") != "asc",
+		Limit:  defaultUserPageSize,
+		Cursor: c.Query("cursor"),
+		Role:   c.Query("role"),
+		Status: c.Query("status"),
+		Query:  strings.TrimSpace(c.Query("q")),
+	}
+	if params.Sort != "createdAt" && params.Sort != "lastLogin" {
+		return nil, fmt.Errorf("invalid sort: must be createdAt or lastLogin")
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxUserPageSize {
+			return nil, fmt.Errorf("invalid limit: must be between 1 and %d", maxUserPageSize)
+		}
+		params.Limit = n
+	}
+	if params.Role != "" && params.Role != roleUser && params.Role != roleAdmin {
+		return nil, fmt.Errorf("invalid role")
+	}
+	if params.Status != "" && params.Status != "active" && params.Status != userStatusPendingDeletion {
+		return nil, fmt.Errorf("invalid status")
+	}
+	if v := c.Query("verified"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verified: must be true or false")
+		}
+		params.Verified = &b
+	}
+	return params, nil
+}
+
+// listUsers returns one page of users using keyset pagination on
+// (sort field, _id), so every page is an index range scan no matter how deep
+// into the collection it is.
+func (db *DatabaseService) listUsers(params *UserListParams) (*UserPage, error) {
+	filter := bson.D{}
+	switch params.Role {
+	case roleAdmin:
+		filter = append(filter, bson.E{Key: "role", Value: roleAdmin})
+	case roleUser:
+		filter = append(filter, bson.E{Key: "role", Value: bson.M{"$ne": roleAdmin}})
+	}
+	switch params.Status {
+	case "active":
+		filter = append(filter, bson.E{Key: "status", Value: bson.M{"$exists": false}})
+	case userStatusPendingDeletion:
+		filter = append(filter, bson.E{Key: "status", Value: userStatusPendingDeletion})
+	}
+	if params.Verified != nil {
+		if *params.Verified {
+			filter = append(filter, bson.E{Key: "emailVerified", Value: true})
+		} else {
+			filter = append(filter, bson.E{Key: "emailVerified", Value: bson.M{"$ne": true}})
+		}
+	}
+	if params.Query != "" {
+		// Anchored, case-sensitive prefixes can use the username/email indexes.
+		prefix := "^" + regexp.QuoteMeta(params.Query)
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.M{"username": primitive.Regex{Pattern: prefix}},
+			bson.M{"email": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(strings.ToLower(params.Query))}},
+		}})
+	}
+
+	order := 1
+	cmp := "$gt"
+	if params.Desc {
+		order = -1
+		cmp = "$lt"
+	}
+	if params.Cursor != "" {
+		value, id, err := decodeTimeCursor(params.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, bson.E{Key: "$and", Value: bson.A{bson.M{"$or": bson.A{
+			bson.M{params.Sort: bson.M{cmp: value}},
+			bson.M{params.Sort: value, "_id": bson.M{cmp: id}},
+		}}}})
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: params.Sort, Value: order}, {Key: "_id", Value: order}}).
+		SetLimit(int64(params.Limit + 1)).
+		SetProjection(userListProjection)
+	cursor, err := db.usersCollection.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error finding users: %w", err)
+	}
+	users := []User{}
+	if err := cursor.All(context.Background(), &users); err != nil {
+		return nil, fmt.Errorf("error finding users: %w", err)
+	}
+
+	page := &UserPage{}
+	if len(users) > params.Limit {
+		users = users[:params.Limit]
+		last := users[len(users)-1]
+		value := last.CreatedAt
+		if params.Sort == "lastLogin" {
+			value = last.LastLogin
+		}
+		page.HasMore = true
+		page.NextCursor = encodeTimeCursor(value, last.ID)
+	}
+	page.Users = users
+	page.Count = len(users)
+	return page, nil
+}
+
+// bootstrapAdmins grants the admin role to the usernames in ADMIN_USERNAMES
+// so a fresh deployment has someone who can use the admin endpoints.
+func (db *DatabaseService) bootstrapAdmins() {
+	var usernames []string
+	for _, name := range strings.Split(os.Getenv("ADMIN_USERNAMES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			usernames = append(usernames, name)
+		}
+	}
+	if len(usernames) == 0 {
+		return
+	}
+	// Grant one user at a time so each grant is audited like one made
+	// through the admin endpoint.
+	cursor, err := db.usersCollection.Find(context.Background(),
+		bson.M{"username": bson.M{"$in": usernames}, "role": bson.M{"$ne": roleAdmin}},
+		options.Find().SetProjection(bson.M{"role": 1}),
+	)
+	if err != nil {
+		db.logger.WithError(err).Error("Failed to bootstrap admin users")
+		return
+	}
+	var users []User
+	if err := cursor.All(context.Background(), &users); err != nil {
+		db.logger.WithError(err).Error("Failed to bootstrap admin users")
+		return
+	}
+	granted := 0
+	for _, user := range users {
+		previous, err := db.setUserRole(user.ID.Hex(), roleAdmin)
+		if err != nil {
+			db.logger.WithError(err).WithField("user_id", user.ID.Hex()).Error("Failed to bootstrap admin user")
+			continue
+		}
+		db.recordAudit(nil, AuditEvent{
+			Type:     auditRoleChange,
+			ActorID:  auditActorSystem,
+			TargetID: user.ID.Hex(),
+			Details:  map[string]interface{}{"from": previous, "to": roleAdmin, "reason": "ADMIN_USERNAMES"},
+		})
+		granted++
+	}
+	db.logger.WithField("modified", granted).Info("Admin users bootstrapped")
+}
+
+// adminMiddleware must run after authMiddleware. The role is read from the
+// database rather than the token so a demotion takes effect immediately.
+func adminMiddleware(c *fiber.Ctx) error {
+	user, err := dbService.getUserByID(c.Locals("user_id").(string))
+	if err != nil {
+		if strings.Contains(err.Error(), "user not found") || strings.Contains(err.Error(), "invalid user ID") {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Admin access required",
+			})
+		}
+		logger.WithError(err).Error("Failed to load user for admin check")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify permissions",
+		})
+	}
+	if user.Role != roleAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Admin access required",
+		})
+	}
+	c.Locals("role", user.Role)
+	return c.Next()
+}
+
+func (db *DatabaseService) setUserRole(userID, role string) (string, error) {
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return "", fmt.Errorf("invalid user ID")
+	}
+	var before User
+	err = db.usersCollection.FindOneAndUpdate(context.Background(),
+		bson.M{"_id": objectID},
+		bson.M{"$set": bson.M{"role": role}},
+		options.FindOneAndUpdate().SetProjection(bson.M{"role": 1}),
+	).Decode(&before)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", fmt.Errorf("user not found")
+		}
+		return "", fmt.Errorf("error updating role: %w", err)
+	}
+	previous := before.Role
+	if previous == "" {
+		previous = roleUser
+	}
+	return previous, nil
+}
+
+func changeRoleHandler(c *fiber.Ctx) error {
+	userID := c.Params("id")
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := c.BodyParser(&body); err != nil || (body.Role != roleUser && body.Role != roleAdmin) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role must be user or admin",
+		})
+	}
+	if userID == c.Locals("user_id").(string) && body.Role != roleAdmin {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "You cannot remove your own admin role",
+		})
+	}
+	previous, err := dbService.setUserRole(userID, body.Role)
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid user ID") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid user ID",
+			})
+		}
+		if strings.Contains(err.Error(), "user not found") {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		logger.WithError(err).Error("Failed to change role")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to change role",
+		})
+	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditRoleChange,
+		TargetID: userID,
+		Details:  map[string]interface{}{"from": previous, "to": body.Role},
+	})
+	return c.JSON(fiber.Map{"message": "Role updated", "role": body.Role})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Security audit trail. Events are only ever inserted; nothing in the
+// service updates or deletes them, and old entries age out through the TTL
+// index on createdAt (AUDIT_RETENTION).
+const (
+	auditRegister          = "auth.register"
+	auditLogin             = "auth.login"
+	auditTokenRefresh      = "auth.token_refresh"
+	auditPasswordChange    = "auth.password_change"
+	auditRoleChange        = "user.role_change"
+	auditDeletionRequested = "user.deletion_requested"
+	auditDeletionCancelled = "user.deletion_cancelled"
+	auditDeletionCompleted = "user.deleted"
+
+	auditSuccess = "success"
+	auditFailure = "failure"
+
+	// auditActorSystem marks events triggered by the service itself.
+	auditActorSystem = "system"
+
+	recentActivityLimit = 20
+	defaultAuditPage    = 50
+	maxAuditPage        = 200
+)
+
+var auditRetention = 365 * 24 * time.Hour
+
+type AuditEvent struct {
+	ID        primitive.ObjectID     `json:"id" bson:"_id"`
+	Type      string                 `json:"type" bson:"type"`
+	Outcome   string                 `json:"outcome" bson:"outcome"`
+	ActorID   string                 `json:"actorId,omitempty" bson:"actorId,omitempty"`
+	TargetID  string                 `json:"targetId,omitempty" bson:"targetId,omitempty"`
+	IP        string                 `json:"ip,omitempty" bson:"ip,omitempty"`
+	UserAgent string                 `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+	RequestID string                 `json:"requestId,omitempty" bson:"requestId,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty" bson:"details,omitempty"`
+	CreatedAt time.Time              `json:"createdAt" bson:"createdAt"`
+}
+
+// AuditPage is one page of audit events, newest first.
+type AuditPage struct {
+	Events     []AuditEvent `json:"events"`
+	Count      int          `json:"count"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+	HasMore    bool         `json:"hasMore"`
+}
+
+// recordAudit stores an event. Request metadata is taken from c when given;
+// background jobs pass nil. Failures are logged and never fail the request.
+func (db *DatabaseService) recordAudit(c *fiber.Ctx, event AuditEvent) {
+	event.ID = primitive.NewObjectID()
+	event.CreatedAt = time.Now()
+	if event.Outcome == "" {
+		event.Outcome = auditSuccess
+	}
+	if c != nil {
+		event.IP = c.IP()
+		event.UserAgent = c.Get(fiber.HeaderUserAgent)
+		if id, ok := c.Locals("requestid").(string); ok {
+			event.RequestID = id
+		}
+		if event.ActorID == "" {
+			if userID, ok := c.Locals("user_id").(string); ok {
+				event.ActorID = userID
+			}
+		}
+	}
+	if _, err := db.auditEvents.InsertOne(context.Background(), event); err != nil {
+		db.logger.WithError(err).WithFields(logrus.Fields{
+			"type":      event.Type,
+			"target_id": event.TargetID,
+		}).Error("Failed to record audit event")
+	}
+}
+
+// ensureAuditIndexes creates the query indexes and the retention TTL index.
+// If the retention changed since the TTL index was created, it is updated in
+// place with collMod.
+func (db *DatabaseService) ensureAuditIndexes() error {
+	_, err := db.auditEvents.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "targetId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "actorId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "createdAt", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating audit indexes: %w", err)
+	}
+
+	ttl := int32(auditRetention.Seconds())
+	_, err = db.auditEvents.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetName("createdAt_ttl").SetExpireAfterSeconds(ttl),
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 85 { // IndexOptionsConflict
+		err = db.auditEvents.Database().RunCommand(context.Background(), bson.D{
+			{Key: "collMod", Value: db.auditEvents.Name()},
+			{Key: "index", Value: bson.D{
+				{Key: "name", Value: "createdAt_ttl"},
+				{Key: "expireAfterSeconds", Value: ttl},
+			}},
+		}).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("error creating audit TTL index: %w", err)
+	}
+	return nil
+}
+
+// AuditQuery filters the admin audit listing. Empty fields match anything.
+type AuditQuery struct {
+	Type     string
+	Outcome  string
+	ActorID  string
+	TargetID string
+	Since    time.Time
+	Until    time.Time
+	Cursor   string
+	Limit    int
+}
+
+func (db *DatabaseService) queryAudit(q *AuditQuery) (*AuditPage, error) {
+	filter := bson.D{}
+	if q.Type != "" {
+		filter = append(filter, bson.E{Key: "type", Value: q.Type})
+	}
+	if q.Outcome != "" {
+		filter = append(filter, bson.E{Key: "outcome", Value: q.Outcome})
+	}
+	if q.ActorID != "" {
+		filter = append(filter, bson.E{Key: "actorId", Value: q.ActorID})
+	}
+	if q.TargetID != "" {
+		filter = append(filter, bson.E{Key: "targetId", Value: q.TargetID})
+	}
+	createdAt := bson.M{}
+	if !q.Since.IsZero() {
+		createdAt["$gte"] = q.Since
+	}
+	if !q.Until.IsZero() {
+		createdAt["$lt"] = q.Until
+	}
+	if len(createdAt) > 0 {
+		filter = append(filter, bson.E{Key: "createdAt", Value: createdAt})
+	}
+	if q.Cursor != "" {
+		value, id, err := decodeTimeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.M{"createdAt": bson.M{"$lt": value}},
+			bson.M{"createdAt": value, "_id": bson.M{"$lt": id}},
+		}})
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(q.Limit + 1))
+	cursor, err := db.auditEvents.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error finding audit events: %w", err)
+	}
+	events := []AuditEvent{}
+	if err := cursor.All(context.Background(), &events); err != nil {
+		return nil, fmt.Errorf("error finding audit events: %w", err)
+	}
+
+	page := &AuditPage{}
+	if len(events) > q.Limit {
+		events = events[:q.Limit]
+		last := events[len(events)-1]
+		page.HasMore = true
+		page.NextCursor = encodeTimeCursor(last.CreatedAt, last.ID)
+	}
+	page.Events = events
+	page.Count = len(events)
+	return page, nil
+}
+
+func parseAuditTime(name, raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: must be an RFC 3339 timestamp", name)
+	}
+	return t, nil
+}
+
+func getAuditEvents(c *fiber.Ctx) error {
+	q := &AuditQuery{
+		Type:     c.Query("type"),
+		Outcome:  c.Query("outcome"),
+		ActorID:  c.Query("actor"),
+		TargetID: c.Query("target"),
+		Cursor:   c.Query("cursor"),
+		Limit:    defaultAuditPage,
+	}
+	var err error
+	if q.Since, err = parseAuditTime("since", c.Query("since")); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if q.Until, err = parseAuditTime("until", c.Query("until")); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditPage {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("invalid limit: must be between 1 and %d", maxAuditPage),
+			})
+		}
+		q.Limit = n
+	}
+
+	page, err := dbService.queryAudit(q)
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid cursor") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid cursor",
+			})
+		}
+		logger.WithError(err).Error("Failed to query audit events")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retrieve audit events",
+		})
+	}
+	return c.JSON(page)
+}
+
+// getSecurityActivity shows users the recent security events on their own
+// account: logins, token refreshes, password and role changes, deletion
+// requests.
+func getSecurityActivity(c *fiber.Ctx) error {
+	page, err := dbService.queryAudit(&AuditQuery{
+		TargetID: c.Locals("user_id").(string),
+		Limit:    recentActivityLimit,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to get security activity")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retrieve security activity",
+		})
+	}
+	return c.JSON(fiber.Map{"events": page.Events})
+}
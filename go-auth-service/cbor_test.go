@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Vectors from RFC 8949 appendix A.
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"fa47c35000", float64(100000)},
+		{"fb3ff199999999999a", 1.1},
+		{"40", []byte(nil)},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"80", []interface{}{}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"c11a514b67b0", int64(1363896240)}, // tag 1, value returned untagged
+	}
+	for _, tt := range tests {
+		t.Run(tt.hex, func(t *testing.T) {
+			data := mustHex(t, tt.hex)
+			got, n, err := decodeCBOR(data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n != len(data) {
+				t.Fatalf("used %d bytes, want %d", n, len(data))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORTrailingData(t *testing.T) {
+	// A COSE key followed by extension data, as in authenticator data.
+	data := mustHex(t, "a10102"+"a0ff")
+	v, n, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("used %d bytes, want 3", n)
+	}
+	if !reflect.DeepEqual(v, map[interface{}]interface{}{int64(1): int64(2)}) {
+		t.Fatalf("unexpected value %#v", v)
+	}
+}
+
+func TestDecodeCBORDoesNotAlias(t *testing.T) {
+	data := mustHex(t, "420102")
+	v, _, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[1] = 0xff
+	if !bytes.Equal(v.([]byte), []byte{1, 2}) {
+		t.Fatalf("decoded byte string aliases the input")
+	}
+}
+
+func TestDecodeCBORErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"empty", nil, "unexpected end"},
+		{"truncated argument", mustHex(t, "1903"), "unexpected end"},
+		{"truncated byte string", mustHex(t, "4401"), "unexpected end"},
+		{"truncated text string", mustHex(t, "6449"), "unexpected end"},
+		{"array longer than input", mustHex(t, "9bffffffffffffffff"), "unexpected end"},
+		{"map longer than input", mustHex(t, "bbffffffffffffffff"), "unexpected end"},
+		{"map missing value", mustHex(t, "a101"), "unexpected end"},
+		{"indefinite length", mustHex(t, "5f"), "unsupported additional information"},
+		{"reserved additional information", mustHex(t, "1c"), "unsupported additional information"},
+		{"integer overflow", mustHex(t, "1bffffffffffffffff"), "integer overflow"},
+		{"negative overflow", mustHex(t, "3bffffffffffffffff"), "integer overflow"},
+		{"byte string map key", mustHex(t, "a1410001"), "unsupported map key type"},
+		{"half float", mustHex(t, "f93c00"), "unsupported simple value"},
+		{"too deep", bytes.Repeat([]byte{0x81}, maxCBORDepth+2), "nesting too deep"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeCBOR(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
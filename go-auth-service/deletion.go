@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Account deletion runs as a saga: the request soft-deletes the account and
+// schedules a job; once the grace period is over a worker walks through the
+// steps below, calling each service in turn. Every step is idempotent and
+// its completion is persisted, so a crashed or failed run resumes where it
+// stopped.
+const (
+	deletionStatusScheduled = "scheduled"
+	deletionStatusRunning   = "running"
+	deletionStatusRetrying  = "retrying"
+	deletionStatusCompleted = "completed"
+	deletionStatusCancelled = "cancelled"
+
+	deletionStepCollectVideos = "collect_videos"
+	deletionStepDeleteMedia   = "delete_media"
+	deletionStepDeleteSearch  = "delete_search"
+	deletionStepDeleteSocial  = "delete_social"
+	deletionStepDeleteAccount = "delete_account"
+
+	userStatusPendingDeletion = "pending_deletion"
+
+	deletionLease       = 10 * time.Minute
+	deletionPollEvery   = 30 * time.Second
+	deletionMaxBackoff  = time.Hour
+	deletionBaseBackoff = time.Minute
+)
+
+var deletionSteps = []string{
+	deletionStepCollectVideos,
+	deletionStepDeleteMedia,
+	deletionStepDeleteSearch,
+	deletionStepDeleteSocial,
+	deletionStepDeleteAccount,
+}
+
+var accountDeletionGracePeriod = 7 * 24 * time.Hour
+
+type DeletionStep struct {
+	Name      string    `json:"name" bson:"name"`
+	Done      bool      `json:"done" bson:"done"`
+	Attempts  int       `json:"attempts" bson:"attempts"`
+	LastError string    `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+}
+
+type AccountDeletion struct {
+	UserID        primitive.ObjectID `json:"userId" bson:"_id"`
+	VideoIDs      []string           `json:"-" bson:"videoIds"`
+	Status        string             `json:"status" bson:"status"`
+	RequestedAt   time.Time          `json:"requestedAt" bson:"requestedAt"`
+	ExecuteAfter  time.Time          `json:"executeAfter" bson:"executeAfter"`
+	NextAttemptAt time.Time          `json:"nextAttemptAt,omitempty" bson:"nextAttemptAt"`
+	LeaseUntil    time.Time          `json:"-" bson:"leaseUntil"`
+	Attempts      int                `json:"attempts" bson:"attempts"`
+	LastError     string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Steps         []DeletionStep     `json:"steps" bson:"steps"`
+	CompletedAt   time.Time          `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+}
+
+// requestAccountDeletion soft-deletes the user and schedules the saga to run
+// once the grace period has passed. Until then the user's videos are hidden
+// and the account can only be used to cancel the deletion. Requesting again
+// while a deletion is pending returns the existing job.
+func (db *DatabaseService) requestAccountDeletion(ctx context.Context, userID string) (*AccountDeletion, error) {
+	user, err := db.getUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Status == userStatusPendingDeletion {
+		return db.getAccountDeletion(userID)
+	}
+
+	// Hiding is idempotent, so if anything below fails the request can
+	// simply be repeated.
+	target := fmt.Sprintf("%s/internal/owners/%s/hide", uploadServiceURL, url.PathEscape(userID))
+	if err := callService(ctx, http.MethodPost, target, nil, nil); err != nil {
+		return nil, fmt.Errorf("error hiding videos: %w", err)
+	}
+
+	now := time.Now()
+	job := &AccountDeletion{
+		UserID:        user.ID,
+		Status:        deletionStatusScheduled,
+		RequestedAt:   now,
+		ExecuteAfter:  now.Add(accountDeletionGracePeriod),
+		NextAttemptAt: now.Add(accountDeletionGracePeriod),
+	}
+	for _, name := range deletionSteps {
+		job.Steps = append(job.Steps, DeletionStep{Name: name})
+	}
+	_, err = db.accountDeletions.ReplaceOne(context.Background(),
+		bson.M{"_id": user.ID}, job, options.Replace().SetUpsert(true))
+	if err != nil {
+		return nil, fmt.Errorf("error scheduling deletion: %w", err)
+	}
+	_, err = db.usersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"status": userStatusPendingDeletion, "deletionScheduledFor": job.ExecuteAfter}},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error updating user: %w", err)
+	}
+
+	db.logger.WithFields(logrus.Fields{
+		"user_id":       userID,
+		"execute_after": job.ExecuteAfter,
+	}).Info("Account deletion scheduled")
+	return job, nil
+}
+
+func (db *DatabaseService) getAccountDeletion(userID string) (*AccountDeletion, error) {
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID")
+	}
+	var job AccountDeletion
+	err = db.accountDeletions.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("deletion not found")
+		}
+		return nil, fmt.Errorf("error finding deletion: %w", err)
+	}
+	return &job, nil
+}
+
+// cancelAccountDeletion restores the account and its videos. Only deletions
+// still inside their grace period can be cancelled; once the saga has
+// started it runs to completion. The job is marked cancelled before anything
+// is restored, so the worker cannot claim it while the videos are back; if
+// restoring fails, cancelling again retries it.
+func (db *DatabaseService) cancelAccountDeletion(ctx context.Context, userID string) (*AccountDeletion, error) {
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID")
+	}
+	var job AccountDeletion
+	err = db.accountDeletions.FindOneAndUpdate(context.Background(),
+		bson.M{"_id": objectID, "status": deletionStatusScheduled},
+		bson.M{"$set": bson.M{"status": deletionStatusCancelled}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		cancelled, err := db.getAccountDeletion(userID)
+		if err != nil || cancelled.Status != deletionStatusCancelled {
+			return nil, fmt.Errorf("deletion cannot be cancelled")
+		}
+		job = *cancelled
+	} else if err != nil {
+		return nil, fmt.Errorf("error cancelling deletion: %w", err)
+	}
+	_, err = db.usersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": objectID},
+		bson.M{"$unset": bson.M{"status": "", "deletionScheduledFor": ""}},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error updating user: %w", err)
+	}
+	target := fmt.Sprintf("%s/internal/owners/%s/restore", uploadServiceURL, url.PathEscape(userID))
+	if err := callService(ctx, http.MethodPost, target, nil, nil); err != nil {
+		return nil, fmt.Errorf("error restoring videos: %w", err)
+	}
+	db.logger.WithField("user_id", userID).Info("Account deletion cancelled")
+	return &job, nil
+}
+
+// runDeletionWorker periodically claims due deletion jobs and advances them.
+func (db *DatabaseService) runDeletionWorker(ctx context.Context) {
+	ticker := time.NewTicker(deletionPollEvery)
+	defer ticker.Stop()
+	for {
+		for {
+			job, err := db.claimDeletionJob()
+			if err != nil {
+				if err != mongo.ErrNoDocuments {
+					db.logger.WithError(err).Error("Failed to claim deletion job")
+				}
+				break
+			}
+			db.processDeletionJob(ctx, job)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimDeletionJob leases one due job. Jobs left "running" by a crashed
+// worker become claimable again once their lease expires.
+func (db *DatabaseService) claimDeletionJob() (*AccountDeletion, error) {
+	now := time.Now()
+	var job AccountDeletion
+	err := db.accountDeletions.FindOneAndUpdate(context.Background(),
+		bson.M{
+			"status":        bson.M{"$in": []string{deletionStatusScheduled, deletionStatusRetrying, deletionStatusRunning}},
+			"executeAfter":  bson.M{"$lte": now},
+			"nextAttemptAt": bson.M{"$lte": now},
+			"leaseUntil":    bson.M{"$lte": now},
+		},
+		bson.M{"$set": bson.M{"status": deletionStatusRunning, "leaseUntil": now.Add(deletionLease)}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (db *DatabaseService) processDeletionJob(ctx context.Context, job *AccountDeletion) {
+	log := db.logger.WithField("user_id", job.UserID.Hex())
+	for i, step := range job.Steps {
+		if step.Done {
+			continue
+		}
+		stepErr := db.runDeletionStep(ctx, job, step.Name)
+		now := time.Now()
+		prefix := fmt.Sprintf("steps.%d.", i)
+		if stepErr != nil {
+			job.Attempts++
+			backoff := deletionBaseBackoff << uint(min(job.Attempts-1, 10))
+			if backoff > deletionMaxBackoff {
+				backoff = deletionMaxBackoff
+			}
+			_, err := db.accountDeletions.UpdateOne(context.Background(),
+				bson.M{"_id": job.UserID},
+				bson.M{
+					"$set": bson.M{
+						"status":             deletionStatusRetrying,
+						"lastError":          step.Name + ": " + stepErr.Error(),
+						"nextAttemptAt":      now.Add(backoff),
+						"leaseUntil":         time.Time{},
+						prefix + "lastError": stepErr.Error(),
+						prefix + "updatedAt": now,
+					},
+					"$inc": bson.M{"attempts": 1, prefix + "attempts": 1},
+				},
+			)
+			if err != nil {
+				log.WithError(err).Error("Failed to record deletion step failure")
+			}
+			log.WithError(stepErr).WithFields(logrus.Fields{
+				"step":  step.Name,
+				"retry": now.Add(backoff),
+			}).Warn("Account deletion step failed")
+			return
+		}
+		_, err := db.accountDeletions.UpdateOne(context.Background(),
+			bson.M{"_id": job.UserID},
+			bson.M{
+				"$set":   bson.M{prefix + "done": true, prefix + "updatedAt": now},
+				"$unset": bson.M{prefix + "lastError": ""},
+				"$inc":   bson.M{prefix + "attempts": 1},
+			},
+		)
+		if err != nil {
+			log.WithError(err).Error("Failed to record deletion step")
+			return
+		}
+		log.WithField("step", step.Name).Info("Account deletion step completed")
+	}
+
+	_, err := db.accountDeletions.UpdateOne(context.Background(),
+		bson.M{"_id": job.UserID},
+		bson.M{
+			"$set":   bson.M{"status": deletionStatusCompleted, "completedAt": time.Now(), "leaseUntil": time.Time{}},
+			"$unset": bson.M{"lastError": ""},
+		},
+	)
+	if err != nil {
+		log.WithError(err).Error("Failed to mark account deletion completed")
+		return
+	}
+	db.recordAudit(nil, AuditEvent{
+		Type:     auditDeletionCompleted,
+		ActorID:  auditActorSystem,
+		TargetID: job.UserID.Hex(),
+	})
+	log.Info("Account deletion completed")
+}
+
+func (db *DatabaseService) runDeletionStep(ctx context.Context, job *AccountDeletion, step string) error {
+	switch step {
+	case deletionStepCollectVideos:
+		// Deleted videos awaiting purge and private ones belong to the
+		// account too; the upload service lists them all.
+		owner := url.PathEscape(job.UserID.Hex())
+		var ids []string
+		target := fmt.Sprintf("%s/internal/owners/%s/videos", uploadServiceURL, owner)
+		if err := callService(ctx, http.MethodGet, target, nil, &ids); err != nil {
+			return fmt.Errorf("listing videos: %w", err)
+		}
+		job.VideoIDs = ids
+		_, err := db.accountDeletions.UpdateOne(ctx, bson.M{"_id": job.UserID}, bson.M{"$set": bson.M{"videoIds": ids}})
+		return err
+
+	case deletionStepDeleteMedia:
+		for _, id := range job.VideoIDs {
+			target := fmt.Sprintf("%s/internal/videos/%s", uploadServiceURL, url.PathEscape(id))
+			if err := callService(ctx, http.MethodDelete, target, nil, nil); err != nil && !isNotFound(err) {
+				return fmt.Errorf("deleting media for %s: %w", id, err)
+			}
+		}
+		return nil
+
+	case deletionStepDeleteSearch:
+		for _, id := range job.VideoIDs {
+			target := fmt.Sprintf("%s/index/%s", searchServiceURL, url.PathEscape(id))
+			if err := callService(ctx, http.MethodDelete, target, nil, nil); err != nil && !isNotFound(err) {
+				return fmt.Errorf("deleting search document %s: %w", id, err)
+			}
+		}
+		// Catch documents indexed after the video list was collected.
+		target := fmt.Sprintf("%s/delete-by-owner", searchServiceURL)
+		if err := callService(ctx, http.MethodPost, target, map[string]string{"ownerId": job.UserID.Hex()}, nil); err != nil {
+			return fmt.Errorf("deleting search documents: %w", err)
+		}
+		return nil
+
+	case deletionStepDeleteSocial:
+		owner := url.PathEscape(job.UserID.Hex())
+		target := fmt.Sprintf("%s/owners/%s/videos", socialServiceURL, owner)
+		if err := callService(ctx, http.MethodDelete, target, nil, nil); err != nil {
+			return fmt.Errorf("deleting social records: %w", err)
+		}
+		// Likes and comments on other people's videos.
+		target = fmt.Sprintf("%s/users/%s/engagement", socialServiceURL, owner)
+		if err := callService(ctx, http.MethodDelete, target, nil, nil); err != nil {
+			return fmt.Errorf("deleting likes and comments: %w", err)
+		}
+		return nil
+
+	case deletionStepDeleteAccount:
+		if err := db.deleteUserExports(ctx, job.UserID); err != nil {
+			return fmt.Errorf("deleting exports: %w", err)
+		}
+		if _, err := db.emailVerifications.DeleteMany(ctx, bson.M{"userId": job.UserID}); err != nil {
+			return err
+		}
+		if _, err := db.usernameRedirects.DeleteMany(ctx, bson.M{"userId": job.UserID}); err != nil {
+			return err
+		}
+		if _, err := db.usersCollection.DeleteOne(ctx, bson.M{"_id": job.UserID}); err != nil {
+			return err
+		}
+		// Keep the job as a record that the deletion happened, but drop
+		// what identifies the person.
+		_, err := db.accountDeletions.UpdateOne(ctx, bson.M{"_id": job.UserID},
+			bson.M{"$set": bson.M{"videoIds": []string{}}})
+		return err
+	}
+	return fmt.Errorf("unknown deletion step %q", step)
+}
+
+func isNotFound(err error) bool {
+	var se *serviceError
+	return errors.As(err, &se) && se.StatusCode == http.StatusNotFound
+}
+
+func getDeletionStatus(c *fiber.Ctx) error {
+	userID := c.Params("id")
+	if userID != c.Locals("user_id").(string) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You can only view your own account deletion",
+		})
+	}
+	job, err := dbService.getAccountDeletion(userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "deletion not found") {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "No deletion requested for this account",
+			})
+		}
+		if strings.Contains(err.Error(), "invalid user ID") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid user ID",
+			})
+		}
+		logger.WithError(err).Error("Failed to get account deletion")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retrieve account deletion",
+		})
+	}
+	return c.JSON(job)
+}
+
+func cancelDeletion(c *fiber.Ctx) error {
+	userID := c.Params("id")
+	if userID != c.Locals("user_id").(string) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You can only cancel your own account deletion",
+		})
+	}
+	job, err := dbService.cancelAccountDeletion(c.Context(), userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "deletion cannot be cancelled") {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "No deletion pending within its grace period",
+			})
+		}
+		if strings.Contains(err.Error(), "invalid user ID") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid user ID",
+			})
+		}
+		logger.WithError(err).Error("Failed to cancel account deletion")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cancel account deletion",
+		})
+	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditDeletionCancelled,
+		TargetID: userID,
+	})
+	return c.JSON(fiber.Map{"message": "Account deletion cancelled", "deletion": job})
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Data exports ("takeout") are built asynchronously: the request queues a
+// job, a worker collects the user's data from every service into a zip in
+// exportDir, and the user downloads it through a signed, expiring link.
+const (
+	exportStatusQueued  = "queued"
+	exportStatusRunning = "running"
+	exportStatusReady   = "ready"
+	exportStatusFailed  = "failed"
+	exportStatusExpired = "expired"
+
+	exportLease       = 30 * time.Minute
+	exportPollEvery   = 15 * time.Second
+	exportMaxAttempts = 3
+)
+
+var (
+	exportDir       = "./exports"
+	exportRetention = 72 * time.Hour
+	exportLinkTTL   = 24 * time.Hour
+)
+
+type DataExport struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	UserID      primitive.ObjectID `json:"userId" bson:"userId"`
+	Status      string             `json:"status" bson:"status"`
+	Attempts    int                `json:"attempts" bson:"attempts"`
+	Error       string             `json:"error,omitempty" bson:"error,omitempty"`
+	Size        int64              `json:"size,omitempty" bson:"size,omitempty"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	CompletedAt time.Time          `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+	ExpiresAt   time.Time          `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	LeaseUntil  time.Time          `json:"-" bson:"leaseUntil"`
+}
+
+// ExportManifest is written as manifest.json at the root of every export.
+type ExportManifest struct {
+	ExportID    string                `json:"exportId"`
+	UserID      string                `json:"userId"`
+	GeneratedAt time.Time             `json:"generatedAt"`
+	Usernames   []string              `json:"usernames"`
+	Files       []ExportManifestEntry `json:"files"`
+}
+
+type ExportManifestEntry struct {
+	Path        string `json:"path"`
+	Source      string `json:"source"`
+	Description string `json:"description"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+func (e *DataExport) filePath() string {
+	return filepath.Join(exportDir, e.ID.Hex()+".zip")
+}
+
+// requestDataExport queues an export for the user, or returns the one
+// already in progress so repeated clicks don't pile up jobs.
+func (db *DatabaseService) requestDataExport(userID string) (*DataExport, error) {
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID")
+	}
+	var existing DataExport
+	err = db.dataExports.FindOne(context.Background(), bson.M{
+		"userId": objectID,
+		"status": bson.M{"$in": []string{exportStatusQueued, exportStatusRunning}},
+	}).Decode(&existing)
+	if err == nil {
+		return &existing, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("error finding export: %w", err)
+	}
+
+	job := &DataExport{
+		ID:        primitive.NewObjectID(),
+		UserID:    objectID,
+		Status:    exportStatusQueued,
+		CreatedAt: time.Now(),
+	}
+	if _, err := db.dataExports.InsertOne(context.Background(), job); err != nil {
+		return nil, fmt.Errorf("error queueing export: %w", err)
+	}
+	db.logger.WithFields(logrus.Fields{
+		"user_id":   userID,
+		"export_id": job.ID.Hex(),
+	}).Info("Data export queued")
+	return job, nil
+}
+
+func (db *DatabaseService) getDataExport(exportID string) (*DataExport, error) {
+	objectID, err := primitive.ObjectIDFromHex(exportID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid export ID")
+	}
+	var job DataExport
+	err = db.dataExports.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("export not found")
+		}
+		return nil, fmt.Errorf("error finding export: %w", err)
+	}
+	return &job, nil
+}
+
+// runExportWorker builds queued exports and removes expired ones.
+func (db *DatabaseService) runExportWorker(ctx context.Context) {
+	ticker := time.NewTicker(exportPollEvery)
+	defer ticker.Stop()
+	for {
+		for {
+			job, err := db.claimExportJob()
+			if err != nil {
+				if err != mongo.ErrNoDocuments {
+					db.logger.WithError(err).Error("Failed to claim export job")
+				}
+				break
+			}
+			db.processExportJob(ctx, job)
+		}
+		db.expireDataExports()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (db *DatabaseService) claimExportJob() (*DataExport, error) {
+	now := time.Now()
+	var job DataExport
+	err := db.dataExports.FindOneAndUpdate(context.Background(),
+		bson.M{
+			"status":     bson.M{"$in": []string{exportStatusQueued, exportStatusRunning}},
+			"leaseUntil": bson.M{"$lte": now},
+		},
+		bson.M{
+			"$set": bson.M{"status": exportStatusRunning, "leaseUntil": now.Add(exportLease)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetSort(bson.D{{Key: "createdAt", Value: 1}}),
+	).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (db *DatabaseService) processExportJob(ctx context.Context, job *DataExport) {
+	log := db.logger.WithFields(logrus.Fields{
+		"user_id":   job.UserID.Hex(),
+		"export_id": job.ID.Hex(),
+	})
+	size, err := db.buildDataExport(ctx, job)
+	if err != nil {
+		update := bson.M{"error": err.Error(), "leaseUntil": time.Time{}}
+		if job.Attempts >= exportMaxAttempts {
+			update["status"] = exportStatusFailed
+		} else {
+			update["status"] = exportStatusQueued
+		}
+		if _, uerr := db.dataExports.UpdateOne(context.Background(), bson.M{"_id": job.ID}, bson.M{"$set": update}); uerr != nil {
+			log.WithError(uerr).Error("Failed to record export failure")
+		}
+		log.WithError(err).WithField("attempt", job.Attempts).Warn("Data export failed")
+		return
+	}
+
+	now := time.Now()
+	_, err = db.dataExports.UpdateOne(context.Background(), bson.M{"_id": job.ID}, bson.M{
+		"$set": bson.M{
+			"status":      exportStatusReady,
+			"size":        size,
+			"completedAt": now,
+			"expiresAt":   now.Add(exportRetention),
+			"leaseUntil":  time.Time{},
+		},
+		"$unset": bson.M{"error": ""},
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to mark export ready")
+		return
+	}
+	log.WithField("size", size).Info("Data export ready")
+}
+
+// buildDataExport writes the zip for job and returns its size. The archive
+// is written to a temporary file and only renamed into place once complete.
+func (db *DatabaseService) buildDataExport(ctx context.Context, job *DataExport) (int64, error) {
+	user, err := db.getUserByID(job.UserID.Hex())
+	if err != nil {
+		return 0, err
+	}
+	handles, err := db.userHandles(user)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(exportDir, 0700); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(exportDir, job.ID.Hex()+"-*.zip.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := zip.NewWriter(tmp)
+	manifest := ExportManifest{
+		ExportID:    job.ID.Hex(),
+		UserID:      job.UserID.Hex(),
+		GeneratedAt: time.Now(),
+		Usernames:   handles,
+	}
+	add := func(path, source, description string, r io.Reader) error {
+		w, err := zw.Create(path)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w, h), r)
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", path, err)
+		}
+		manifest.Files = append(manifest.Files, ExportManifestEntry{
+			Path:        path,
+			Source:      source,
+			Description: description,
+			Size:        n,
+			SHA256:      hex.EncodeToString(h.Sum(nil)),
+		})
+		return nil
+	}
+	addJSON := func(path, source, description string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(path, source, description, bytes.NewReader(data))
+	}
+
+	if err := addJSON("account.json", "auth", "Your account record and profile", user); err != nil {
+		return 0, err
+	}
+
+	// Videos and their engagement (views, likes, comments) live in social.
+	var videos []map[string]interface{}
+	target := fmt.Sprintf("%s/videos?ownerId=%s&includeDeleted=true&includePrivate=true", socialServiceURL, url.QueryEscape(job.UserID.Hex()))
+	if err := callService(ctx, http.MethodGet, target, nil, &videos); err != nil {
+		return 0, fmt.Errorf("fetching videos: %w", err)
+	}
+	if videos == nil {
+		videos = []map[string]interface{}{}
+	}
+	if err := addJSON("videos.json", "social", "Your videos with their views, likes and comments", videos); err != nil {
+		return 0, err
+	}
+
+	var engagement json.RawMessage
+	target = fmt.Sprintf("%s/users/%s/engagement", socialServiceURL, url.PathEscape(job.UserID.Hex()))
+	if err := callService(ctx, http.MethodGet, target, nil, &engagement); err != nil {
+		return 0, fmt.Errorf("fetching likes and comments: %w", err)
+	}
+	if err := addJSON("engagement.json", "social", "Your likes and comments on any video", engagement); err != nil {
+		return 0, err
+	}
+
+	searchDocs := map[string]json.RawMessage{}
+	for _, v := range videos {
+		id, _ := v["_id"].(string)
+		if id == "" {
+			continue
+		}
+		var doc json.RawMessage
+		target := fmt.Sprintf("%s/index/%s", searchServiceURL, url.PathEscape(id))
+		if err := callService(ctx, http.MethodGet, target, nil, &doc); err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return 0, fmt.Errorf("fetching search document %s: %w", id, err)
+		}
+		searchDocs[id] = doc
+	}
+	if err := addJSON("search.json", "search", "Metadata of your videos as indexed for search", searchDocs); err != nil {
+		return 0, err
+	}
+
+	for _, v := range videos {
+		id, _ := v["_id"].(string)
+		if id == "" {
+			continue
+		}
+		body, err := openService(ctx, fmt.Sprintf("%s/uploads/%s", uploadServiceURL, url.PathEscape(id)))
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return 0, fmt.Errorf("fetching original %s: %w", id, err)
+		}
+		name := filepath.Base(id)
+		if original, _ := v["originalFilename"].(string); original != "" {
+			name += filepath.Ext(filepath.Base(original))
+		}
+		err = add("originals/"+name, "upload", "Original upload of video "+id, body)
+		body.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := addJSON("manifest.json", "auth", "Index of this export", manifest); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), job.filePath()); err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// removeStaleExportFiles deletes partial archives left behind by a crash
+// mid-build. Run it before the worker starts.
+func removeStaleExportFiles() {
+	partial, err := filepath.Glob(filepath.Join(exportDir, "*.zip.tmp"))
+	if err != nil {
+		logger.WithError(err).Error("Failed to list partial exports")
+		return
+	}
+	for _, path := range partial {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.WithError(err).WithField("path", path).Error("Failed to delete partial export")
+		}
+	}
+	if len(partial) > 0 {
+		logger.WithField("count", len(partial)).Info("Deleted partial exports")
+	}
+}
+
+// deleteUserExports removes every export of a user, files and records.
+func (db *DatabaseService) deleteUserExports(ctx context.Context, userID primitive.ObjectID) error {
+	cursor, err := db.dataExports.Find(ctx, bson.M{"userId": userID})
+	if err != nil {
+		return err
+	}
+	var jobs []DataExport
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if err := os.Remove(job.filePath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	_, err = db.dataExports.DeleteMany(ctx, bson.M{"userId": userID})
+	return err
+}
+
+// expireDataExports deletes archives past their retention.
+func (db *DatabaseService) expireDataExports() {
+	cursor, err := db.dataExports.Find(context.Background(), bson.M{
+		"status":    exportStatusReady,
+		"expiresAt": bson.M{"$lte": time.Now()},
+	})
+	if err != nil {
+		db.logger.WithError(err).Error("Failed to find expired exports")
+		return
+	}
+	var expired []DataExport
+	if err := cursor.All(context.Background(), &expired); err != nil {
+		db.logger.WithError(err).Error("Failed to find expired exports")
+		return
+	}
+	for _, job := range expired {
+		if err := os.Remove(job.filePath()); err != nil && !os.IsNotExist(err) {
+			db.logger.WithError(err).WithField("export_id", job.ID.Hex()).Error("Failed to delete expired export")
+			continue
+		}
+		_, err := db.dataExports.UpdateOne(context.Background(), bson.M{"_id": job.ID},
+			bson.M{"$set": bson.M{"status": exportStatusExpired}})
+		if err != nil {
+			db.logger.WithError(err).WithField("export_id", job.ID.Hex()).Error("Failed to mark export expired")
+		}
+	}
+}
+
+func exportSignature(exportID string, expires int64) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	fmt.Fprintf(mac, "export:%s:%d", exportID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// exportDownloadURL returns a signed link valid for exportLinkTTL, or until
+// the export itself expires if that is sooner.
+func exportDownloadURL(job *DataExport) (string, time.Time) {
+	expires := time.Now().Add(exportLinkTTL)
+	if job.ExpiresAt.Before(expires) {
+		expires = job.ExpiresAt
+	}
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", exportSignature(job.ID.Hex(), expires.Unix()))
+	return fmt.Sprintf("/api/exports/%s/download?%s", job.ID.Hex(), q.Encode()), expires
+}
+
+func requestExportHandler(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+	job, err := dbService.requestDataExport(userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid user ID") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid user ID",
+			})
+		}
+		logger.WithError(err).Error("Failed to request data export")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to request data export",
+		})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+func getExportHandler(c *fiber.Ctx) error {
+	job, err := dbService.getDataExport(c.Params("id"))
+	if err == nil && job.UserID.Hex() != c.Locals("user_id").(string) {
+		err = fmt.Errorf("export not found")
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "export not found") || strings.Contains(err.Error(), "invalid export ID") {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Export not found",
+			})
+		}
+		logger.WithError(err).Error("Failed to get data export")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retrieve data export",
+		})
+	}
+	if job.Status != exportStatusReady {
+		return c.JSON(fiber.Map{"export": job})
+	}
+	link, expires := exportDownloadURL(job)
+	return c.JSON(fiber.Map{
+		"export":          job,
+		"downloadUrl":     link,
+		"downloadExpires": expires,
+	})
+}
+
+// downloadExportHandler is deliberately outside authMiddleware: the signed
+// link is the credential, so it can be opened directly by a browser.
+func downloadExportHandler(c *fiber.Ctx) error {
+	exportID := c.Params("id")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Download link expired",
+		})
+	}
+	if !hmac.Equal([]byte(c.Query("sig")), []byte(exportSignature(exportID, expires))) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Invalid download link",
+		})
+	}
+	job, err := dbService.getDataExport(exportID)
+	if err != nil || job.Status != exportStatusReady {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Export not found",
+		})
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Download(job.filePath(), "streamflow-export-"+job.ID.Hex()+".zip")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"stream-flow/objstore/serviceauth"
+)
+
+// Endpoints under /internal are for other StreamFlow services, not browsers.
+// Callers authenticate with HTTP Basic using a client ID and secret from
+// SERVICE_CREDENTIALS ("upload-service:secret,social-service:secret").
+
+const maxLookupIDs = 100
+
+var serviceCredentials serviceauth.Credentials
+
+// PublicProfile is what other services may show about a user.
+type PublicProfile struct {
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	DisplayName   string `json:"displayName,omitempty"`
+	AvatarURL     string `json:"avatarUrl,omitempty"`
+	EmailVerified bool   `json:"verified"`
+}
+
+// IntrospectionResponse follows RFC 7662. Inactive tokens only carry
+// "active": false.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Sub       string `json:"sub,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Status    string `json:"status,omitempty"`
+}
+
+func publicProfile(user *User) PublicProfile {
+	return PublicProfile{
+		ID:            user.ID.Hex(),
+		Username:      user.Username,
+		DisplayName:   user.DisplayName,
+		AvatarURL:     user.AvatarURL,
+		EmailVerified: user.EmailVerified,
+	}
+}
+
+func loadServiceCredentials() serviceauth.Credentials {
+	creds := serviceauth.Parse(os.Getenv("SERVICE_CREDENTIALS"))
+	if len(creds) == 0 {
+		logger.Warn("SERVICE_CREDENTIALS not set, internal endpoints will reject every request")
+	}
+	return creds
+}
+
+func serviceAuthMiddleware(c *fiber.Ctx) error {
+	clientID, _, ok := serviceauth.BasicAuth(c)
+	if !ok {
+		return serviceauth.Challenge(c, "Service credentials required")
+	}
+	if serviceCredentials.Caller(c) == "" {
+		logger.WithField("client_id", clientID).Warn("Invalid service credentials")
+		return serviceauth.Challenge(c, "Invalid service credentials")
+	}
+	c.Locals("client_id", clientID)
+	return c.Next()
+}
+
+// introspectToken reports whether token is one of our JWTs and still
+// belongs to an existing account that may be used. Tokens of accounts
+// scheduled for deletion are inactive, so no service acts on their behalf.
+func (db *DatabaseService) introspectToken(token string) (*IntrospectionResponse, error) {
+	claims, err := parseJWT(token)
+	if err != nil {
+		return &IntrospectionResponse{Active: false}, nil
+	}
+	user, err := db.getUserByID(claims.UserID)
+	if err != nil {
+		if strings.Contains(err.Error(), "user not found") || strings.Contains(err.Error(), "invalid user ID") {
+			return &IntrospectionResponse{Active: false}, nil
+		}
+		return nil, err
+	}
+	if user.Status != "" && user.Status != "active" {
+		return &IntrospectionResponse{Active: false}, nil
+	}
+	resp := &IntrospectionResponse{
+		Active:    true,
+		Sub:       user.ID.Hex(),
+		Username:  user.Username,
+		TokenType: "Bearer",
+		Role:      roleUser,
+		Status:    user.Status,
+	}
+	if user.Role != "" {
+		resp.Role = user.Role
+	}
+	if claims.ExpiresAt != nil {
+		resp.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		resp.Iat = claims.IssuedAt.Unix()
+	}
+	return resp, nil
+}
+
+// lookupUsers resolves user IDs to public profiles. Unknown or malformed IDs
+// are reported in missing rather than failing the whole batch.
+func (db *DatabaseService) lookupUsers(ids []string) (map[string]PublicProfile, []string, error) {
+	var objectIDs []primitive.ObjectID
+	var missing []string
+	for _, id := range ids {
+		objectID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			missing = append(missing, id)
+			continue
+		}
+		objectIDs = append(objectIDs, objectID)
+	}
+
+	profiles := map[string]PublicProfile{}
+	if len(objectIDs) > 0 {
+		cursor, err := db.usersCollection.Find(context.Background(),
+			bson.M{"_id": bson.M{"$in": objectIDs}},
+			options.Find().SetProjection(bson.M{
+				"username": 1, "displayName": 1, "avatarUrl": 1, "emailVerified": 1,
+			}),
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error finding users: %w", err)
+		}
+		var users []User
+		if err := cursor.All(context.Background(), &users); err != nil {
+			return nil, nil, fmt.Errorf("error finding users: %w", err)
+		}
+		for i := range users {
+			profiles[users[i].ID.Hex()] = publicProfile(&users[i])
+		}
+	}
+	for _, id := range objectIDs {
+		if _, found := profiles[id.Hex()]; !found {
+			missing = append(missing, id.Hex())
+		}
+	}
+	return profiles, missing, nil
+}
+
+func introspectHandler(c *fiber.Ctx) error {
+	// RFC 7662 uses a form-encoded body; JSON is accepted for convenience.
+	var body struct {
+		Token string `json:"token" form:"token"`
+	}
+	if err := c.BodyParser(&body); err != nil || body.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid_request",
+		})
+	}
+	resp, err := dbService.introspectToken(body.Token)
+	if err != nil {
+		logger.WithError(err).Error("Failed to introspect token")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to introspect token",
+		})
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(resp)
+}
+
+func lookupUsersHandler(c *fiber.Ctx) error {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if len(body.IDs) == 0 || len(body.IDs) > maxLookupIDs {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Between 1 and %d ids are required", maxLookupIDs),
+		})
+	}
+	profiles, missing, err := dbService.lookupUsers(body.IDs)
+	if err != nil {
+		logger.WithError(err).Error("Failed to look up users")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to look up users",
+		})
+	}
+	if missing == nil {
+		missing = []string{}
+	}
+	return c.JSON(fiber.Map{
+		"users":   profiles,
+		"missing": missing,
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditMagicLinkRequested = "auth.magic_link_requested"
+
+	// Links issued per email address within one magicLinkTTL window.
+	maxMagicLinksPerEmail = 3
+)
+
+var magicLinkTTL = 15 * time.Minute
+
+// magicLink is a single-use login token. Only the hash is stored; used links
+// are kept (with usedAt set) until they expire.
+type magicLink struct {
+	TokenHash string             `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	Email     string             `bson:"email"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+	UsedAt    *time.Time         `bson:"usedAt"`
+}
+
+// magicLinkLimiter limits link requests and redemptions per client IP: the
+// address the gateway forwards, see TRUSTED_PROXIES. Link requests are also
+// limited per email address, in recordMagicLinkRequest.
+func magicLinkLimiter() fiber.Handler {
+	return limiter.New(limiter.Config{
+		Max:        5,
+		Expiration: time.Minute,
+		LimitReached: func(c *fiber.Ctx) error {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Too many requests, please try again later",
+			})
+		},
+	})
+}
+
+// recordMagicLinkRequest counts a link request for email, whether or not it
+// has an account, and fails once the address asked for too many links.
+func (db *DatabaseService) recordMagicLinkRequest(email string) error {
+	now := time.Now()
+	recent, err := db.magicLinkRequests.CountDocuments(context.Background(), bson.M{
+		"email":     email,
+		"createdAt": bson.M{"$gt": now.Add(-magicLinkTTL)},
+	})
+	if err != nil {
+		return fmt.Errorf("error counting login links: %w", err)
+	}
+	if recent >= maxMagicLinksPerEmail {
+		return fmt.Errorf("too many login links requested")
+	}
+	_, err = db.magicLinkRequests.InsertOne(context.Background(), bson.M{
+		"email":     email,
+		"createdAt": now,
+		"expiresAt": now.Add(magicLinkTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("error recording login link request: %w", err)
+	}
+	return nil
+}
+
+// sendMagicLink emails a login link to the account registered with email.
+// An unknown address is not an error and returns no user.
+func (db *DatabaseService) sendMagicLink(email string) (*User, error) {
+	now := time.Now()
+	var user User
+	err := db.usersCollection.FindOne(context.Background(), bson.M{"email": email}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error finding user: %w", err)
+	}
+
+	token, tokenHash, err := generateToken()
+	if err != nil {
+		return nil, fmt.Errorf("error generating login token: %w", err)
+	}
+	_, err = db.magicLinks.InsertOne(context.Background(), magicLink{
+		TokenHash: tokenHash,
+		UserID:    user.ID,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(magicLinkTTL),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error storing login token: %w", err)
+	}
+
+	link := fmt.Sprintf("%s/magic-login?token=%s", appBaseURL, url.QueryEscape(token))
+	err = mailer.Send(context.Background(), MailMessage{
+		To:      email,
+		Subject: "Your StreamFlow login link",
+		Body: "Open the link below to log in to StreamFlow as " + user.Username + ".\n\n" +
+			link + fmt.Sprintf("\n\nThe link works once and expires in %d minutes. If you did not request it, you can ignore this email.\n", int(magicLinkTTL.Minutes())),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error sending login email: %w", err)
+	}
+	db.logger.WithField("user_id", user.ID.Hex()).Info("Magic login link sent")
+	return &user, nil
+}
+
+// redeemMagicLink consumes token and logs its user in.
+func (db *DatabaseService) redeemMagicLink(token string) (*User, error) {
+	now := time.Now()
+	var link magicLink
+	err := db.magicLinks.FindOneAndUpdate(context.Background(),
+		bson.M{
+			"_id":       hashToken(token),
+			"usedAt":    nil,
+			"expiresAt": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	).Decode(&link)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("invalid or expired token")
+		}
+		return nil, fmt.Errorf("error finding login token: %w", err)
+	}
+
+	var user User
+	err = db.usersCollection.FindOneAndUpdate(context.Background(),
+		bson.M{"_id": link.UserID, "email": link.Email},
+		bson.M{"$set": bson.M{"lastLogin": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			// The account was deleted or its email changed after the link was sent.
+			return nil, fmt.Errorf("invalid or expired token")
+		}
+		return nil, fmt.Errorf("error finding user: %w", err)
+	}
+	if user.Status == userStatusPendingDeletion {
+		return &user, fmt.Errorf("account pending deletion")
+	}
+	db.logger.WithFields(logrus.Fields{
+		"user_id":  user.ID.Hex(),
+		"username": user.Username,
+	}).Info("User authenticated with magic link")
+	return &user, nil
+}
+
+func requestMagicLinkHandler(c *fiber.Ctx) error {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+	if err := validateEmail(email); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A valid email address is required",
+		})
+	}
+
+	event := AuditEvent{
+		Type:    auditMagicLinkRequested,
+		Details: map[string]interface{}{"email": email},
+	}
+	// The response is the same whatever happened, and the account lookup
+	// and mail happen after it is sent, so neither its content nor its
+	// timing reveals whether the address has an account.
+	if err := dbService.recordMagicLinkRequest(email); err != nil {
+		event.Outcome = auditFailure
+		event.Details["reason"] = err.Error()
+		if !strings.Contains(err.Error(), "too many login links") {
+			logger.WithError(err).Error("Failed to record magic link request")
+		}
+		dbService.recordAudit(c, event)
+	} else {
+		// c is recycled once the handler returns; keep what the audit
+		// event needs from it.
+		event.IP = c.IP()
+		event.UserAgent = c.Get(fiber.HeaderUserAgent)
+		if id, ok := c.Locals("requestid").(string); ok {
+			event.RequestID = id
+		}
+		go func() {
+			user, err := dbService.sendMagicLink(email)
+			if user != nil {
+				event.TargetID = user.ID.Hex()
+			}
+			if err != nil {
+				event.Outcome = auditFailure
+				event.Details["reason"] = err.Error()
+				logger.WithError(err).Error("Failed to send magic link")
+			} else if user == nil {
+				event.Outcome = auditFailure
+				event.Details["reason"] = "unknown email"
+			}
+			dbService.recordAudit(nil, event)
+		}()
+	}
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "If an account exists for this address, a login link has been sent",
+	})
+}
+
+func redeemMagicLinkHandler(c *fiber.Ctx) error {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := c.BodyParser(&body); err != nil || body.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Token is required",
+		})
+	}
+	user, err := dbService.redeemMagicLink(body.Token)
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid or expired token") {
+			dbService.recordAudit(c, AuditEvent{
+				Type:    auditLogin,
+				Outcome: auditFailure,
+				Details: map[string]interface{}{"method": "magic_link", "reason": "invalid or expired token"},
+			})
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid or expired login link",
+			})
+		}
+		if strings.Contains(err.Error(), "account pending deletion") {
+			dbService.recordAudit(c, AuditEvent{
+				Type:     auditLogin,
+				Outcome:  auditFailure,
+				TargetID: user.ID.Hex(),
+				Details:  map[string]interface{}{"method": "magic_link", "reason": "account pending deletion"},
+			})
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error":                "Account is scheduled for deletion",
+				"deletionScheduledFor": user.DeletionScheduledFor,
+			})
+		}
+		logger.WithError(err).Error("Failed to redeem magic link")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Authentication failed",
+		})
+	}
+	if requiresPasskey(user) {
+		return passkeyChallengeResponse(c, user)
+	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditLogin,
+		ActorID:  user.ID.Hex(),
+		TargetID: user.ID.Hex(),
+		Details:  map[string]interface{}{"method": "magic_link"},
+	})
+	token, err := generateJWT(user)
+	if err != nil {
+		logger.WithError(err).Error("Failed to generate token")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate authentication token",
+		})
+	}
+	return c.JSON(LoginResponse{
+		Token: token,
+		User:  *user,
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MailMessage is a plain-text email sent by the auth service.
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email (verification links, login links, ...).
+type Mailer interface {
+	Send(ctx context.Context, msg MailMessage) error
+}
+
+// logMailer writes messages to the log instead of sending them. It is the
+// default when no SMTP server is configured, which is what local dev wants.
+type logMailer struct {
+	logger *logrus.Logger
+}
+
+func (m *logMailer) Send(ctx context.Context, msg MailMessage) error {
+	m.logger.WithFields(logrus.Fields{
+		"to":      msg.To,
+		"subject": msg.Subject,
+		"body":    msg.Body,
+	}).Info("Mail (not sent, SMTP_ADDR not configured)")
+	return nil
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg MailMessage) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(msg.Body)
+
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, []byte(b.String())); err != nil {
+		return fmt.Errorf("error sending mail: %w", err)
+	}
+	return nil
+}
+
+// newMailerFromEnv returns an SMTP mailer when SMTP_ADDR is set and a
+// logging mailer otherwise.
+func newMailerFromEnv(logger *logrus.Logger) Mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		logger.Warn("SMTP_ADDR not set, emails will only be logged")
+		return &logMailer{logger: logger}
+	}
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@streamflow.local"
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return &smtpMailer{addr: addr, from: from, auth: auth}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log" // <-- Import log
 	"os"
@@ -11,6 +12,7 @@ import (
 	"github.com/bits-and-blooms/bloom/v3"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/golang-jwt/jwt/v4"
 
 	// "github.com/joho/godotenv" // <-- We don't need this
@@ -19,17 +21,30 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // ... (Your User, UserRequest, LoginRequest, Claims, and DatabaseService structs are all PERFECT) ...
 type User struct {
-	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Username  string             `json:"username" bson:"username"`
-	Email     string             `json:"email" bson:"email"`
-	Password  string             `json:"-" bson:"password"` // Hide password in JSON responses
-	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
-	LastLogin time.Time          `json:"lastLogin" bson:"lastLogin"`
+	ID                   primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Username             string             `json:"username" bson:"username"`
+	Email                string             `json:"email" bson:"email"`
+	EmailVerified        bool               `json:"emailVerified" bson:"emailVerified"`
+	PendingEmail         string             `json:"pendingEmail,omitempty" bson:"pendingEmail,omitempty"`
+	Password             string             `json:"-" bson:"password"` // Hide password in JSON responses
+	DisplayName          string             `json:"displayName,omitempty" bson:"displayName,omitempty"`
+	Bio                  string             `json:"bio,omitempty" bson:"bio,omitempty"`
+	AvatarURL            string             `json:"avatarUrl,omitempty" bson:"avatarUrl,omitempty"`
+	BannerURL            string             `json:"bannerUrl,omitempty" bson:"bannerUrl,omitempty"`
+	Links                []ProfileLink      `json:"links,omitempty" bson:"links,omitempty"`
+	Identities           []ExternalIdentity `json:"identities,omitempty" bson:"identities,omitempty"`
+	Passkeys             []Passkey          `json:"passkeys,omitempty" bson:"passkeys,omitempty"`
+	PasskeyRequired      bool               `json:"passkeyRequired,omitempty" bson:"passkeyRequired,omitempty"`
+	UsernameChangedAt    time.Time          `json:"usernameChangedAt,omitempty" bson:"usernameChangedAt,omitempty"`
+	Role                 string             `json:"role,omitempty" bson:"role,omitempty"`
+	Status               string             `json:"status,omitempty" bson:"status,omitempty"`
+	DeletionScheduledFor time.Time          `json:"deletionScheduledFor,omitempty" bson:"deletionScheduledFor,omitempty"`
+	CreatedAt            time.Time          `json:"createdAt" bson:"createdAt"`
+	LastLogin            time.Time          `json:"lastLogin" bson:"lastLogin"`
 }
 type UserRequest struct {
 	Username string `json:"username"`
@@ -50,15 +65,29 @@ type Claims struct {
 	jwt.RegisteredClaims
 }
 type DatabaseService struct {
-	usersCollection *mongo.Collection
-	logger          *logrus.Logger
-	userBloomFilter *bloom.BloomFilter
+	usersCollection    *mongo.Collection
+	emailVerifications *mongo.Collection
+	usernameRedirects  *mongo.Collection
+	accountDeletions   *mongo.Collection
+	dataExports        *mongo.Collection
+	auditEvents        *mongo.Collection
+	magicLinks         *mongo.Collection
+	magicLinkRequests  *mongo.Collection
+	oidcStates         *mongo.Collection
+	webauthnSessions   *mongo.Collection
+	logger             *logrus.Logger
+	userBloomFilter    *bloom.BloomFilter
 }
 
 var (
-	dbService *DatabaseService
-	jwtSecret []byte
-	logger    *logrus.Logger
+	dbService              *DatabaseService
+	jwtSecret              []byte
+	logger                 *logrus.Logger
+	mailer                 Mailer
+	passwordHasher         PasswordHasher
+	passwordPolicy         *PasswordPolicy
+	appBaseURL             string
+	usernameChangeInterval = 30 * 24 * time.Hour
 )
 
 // --- THIS IS THE CORRECTED MAIN FUNCTION ---
@@ -114,12 +143,88 @@ func main() {
 	logger.Info("Connected to MongoDB successfully")
 
 	// Initialize database service
+	database := client.Database("userService_db")
 	dbService = &DatabaseService{
-		usersCollection: client.Database("userService_db").Collection("users"),
-		logger:          logger,
-		userBloomFilter: bloom.NewWithEstimates(1000000, 0.01), // 1M users, 1% false positive rate
+		usersCollection:    database.Collection("users"),
+		emailVerifications: database.Collection("email_verifications"),
+		usernameRedirects:  database.Collection("username_redirects"),
+		accountDeletions:   database.Collection("account_deletions"),
+		dataExports:        database.Collection("data_exports"),
+		auditEvents:        database.Collection("audit_events"),
+		magicLinks:         database.Collection("magic_links"),
+		magicLinkRequests:  database.Collection("magic_link_requests"),
+		oidcStates:         database.Collection("oidc_states"),
+		webauthnSessions:   database.Collection("webauthn_sessions"),
+		logger:             logger,
+		userBloomFilter:    bloom.NewWithEstimates(1000000, 0.01), // 1M users, 1% false positive rate
 	}
 
+	if v := os.Getenv("AUDIT_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			auditRetention = d
+		} else {
+			logger.WithField("value", v).Warn("Invalid AUDIT_RETENTION, using default")
+		}
+	}
+	if err := dbService.ensureIndexes(); err != nil {
+		logger.WithError(err).Warn("Failed to create indexes")
+	}
+
+	mailer = newMailerFromEnv(logger)
+	passwordHasher = newArgon2idHasher(argon2ParamsFromEnv())
+	passwordPolicy = loadPasswordPolicy()
+	serviceCredentials = loadServiceCredentials()
+	loadServiceClientCredentials()
+	appBaseURL = os.Getenv("APP_BASE_URL")
+	if appBaseURL == "" {
+		appBaseURL = "http://localhost:5173"
+	}
+	oidcProviders = loadOIDCProviders()
+	loadWebAuthnConfig()
+	if v := os.Getenv("USERNAME_CHANGE_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			usernameChangeInterval = d
+		} else {
+			logger.WithError(err).Warn("Invalid USERNAME_CHANGE_INTERVAL, using default")
+		}
+	}
+	if v := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			accountDeletionGracePeriod = d
+		} else {
+			logger.WithError(err).Warn("Invalid ACCOUNT_DELETION_GRACE_PERIOD, using default")
+		}
+	}
+
+	if v := os.Getenv("MAGIC_LINK_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			magicLinkTTL = d
+		} else {
+			logger.WithField("value", v).Warn("Invalid MAGIC_LINK_TTL, using default")
+		}
+	}
+
+	exportDir = getEnv("EXPORT_DIR", exportDir)
+	removeStaleExportFiles()
+	if v := os.Getenv("EXPORT_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			exportRetention = d
+		} else {
+			logger.WithError(err).Warn("Invalid EXPORT_RETENTION, using default")
+		}
+	}
+
+	// Other services, called by the account deletion saga and data exports
+	socialServiceURL = getEnv("SOCIAL_SERVICE_URL", "http://localhost:3002")
+	searchServiceURL = getEnv("SEARCH_SERVICE_URL", "http://localhost:8080")
+	uploadServiceURL = getEnv("UPLOAD_SERVICE_URL", "http://localhost:3001")
+
+	go dbService.runDeletionWorker(context.Background())
+	go dbService.runExportWorker(context.Background())
+
+	dbService.bootstrapAdmins()
+	dbService.lowercaseStoredEmails()
+
 	// Initialize bloom filter
 	err = dbService.initializeBloomFilter()
 	if err != nil {
@@ -127,10 +232,25 @@ func main() {
 	}
 
 	// Create Fiber app
+	// Browsers reach us through the gateway, so the client address is the
+	// X-Forwarded-For it sets. The header is only believed from the proxies
+	// in TRUSTED_PROXIES (IPs or CIDRs); anyone else gets their own address.
+	var trustedProxies []string
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			trustedProxies = append(trustedProxies, p)
+		}
+	}
 	app := fiber.New(fiber.Config{
-		ErrorHandler: customErrorHandler,
+		ErrorHandler:            customErrorHandler,
+		ProxyHeader:             fiber.HeaderXForwardedFor,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          trustedProxies,
+		EnableIPValidation:      true,
 	})
 
+	app.Use(requestid.New())
+
 	// Add CORS
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://98.70.25.253,http://98.70.25.253:3000,http://localhost:3000,http://98.70.25.253:5173,http://localhost:5173,http://98.70.25.253:8081,http://localhost:8081",
@@ -146,14 +266,50 @@ func main() {
 	auth := app.Group("/api/auth")
 	auth.Post("/register", registerHandler)
 	auth.Post("/login", loginHandler)
+	auth.Post("/verify-email", verifyEmailHandler)
+	auth.Post("/magic-link", magicLinkLimiter(), requestMagicLinkHandler)
+	auth.Post("/magic-link/redeem", magicLinkLimiter(), redeemMagicLinkHandler)
+	auth.Get("/oidc/providers", listOIDCProvidersHandler)
+	auth.Post("/oidc/:provider/authorize", oidcAuthorizeHandler)
+	auth.Post("/oidc/:provider/callback", oidcCallbackHandler)
+	auth.Post("/passkey/begin", beginPasskeyLogin)
+	auth.Post("/passkey/finish", finishPasskeyLogin)
+
+	// Signed download links carry their own credential
+	app.Get("/api/exports/:id/download", downloadExportHandler)
+
+	// All an account scheduled for deletion can still do
+	app.Get("/api/users/:id/deletion", deletionAuthMiddleware, getDeletionStatus)
+	app.Delete("/api/users/:id/deletion", deletionAuthMiddleware, cancelDeletion)
+
+	// Admin routes
+	admin := app.Group("/api/admin", authMiddleware, adminMiddleware)
+	admin.Get("/audit", getAuditEvents)
+	admin.Patch("/users/:id/role", changeRoleHandler)
+
+	// Internal routes for other services
+	internal := app.Group("/internal", serviceAuthMiddleware)
+	internal.Post("/introspect", introspectHandler)
+	internal.Post("/users/lookup", lookupUsersHandler)
 
 	// Protected routes
 	protected := app.Group("/api", authMiddleware)
-	protected.Get("/users", getUsers)
+	protected.Get("/users", adminMiddleware, getUsers)
 	protected.Get("/users/:id", getUserByID)
+	protected.Get("/users/by-username/:username", getUserByUsername)
 	protected.Patch("/users/:id", updateUsers)
 	protected.Delete("/users/:id", deleteUsers)
 	protected.Get("/profile", getProfile)
+	protected.Post("/profile/password", changePasswordHandler)
+	protected.Get("/profile/security-activity", getSecurityActivity)
+	protected.Get("/profile/passkeys", listPasskeysHandler)
+	protected.Post("/profile/passkeys/register/begin", beginPasskeyRegistration)
+	protected.Post("/profile/passkeys/register/finish", finishPasskeyRegistrationHandler)
+	protected.Patch("/profile/passkeys/settings", updatePasskeySettingsHandler)
+	protected.Delete("/profile/passkeys/:id", deletePasskeyHandler)
+	protected.Post("/auth/refresh", refreshTokenHandler)
+	protected.Post("/profile/export", requestExportHandler)
+	protected.Get("/exports/:id", getExportHandler)
 
 	PORT := os.Getenv("PORT")
 	if PORT == "" {
@@ -189,6 +345,79 @@ func (db *DatabaseService) initializeBloomFilter() error {
 	}
 	return nil
 }
+func (db *DatabaseService) ensureIndexes() error {
+	// Keyset pagination and prefix search in the admin user listing
+	_, err := db.usersCollection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "lastLogin", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "username", Value: 1}}},
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+		{Keys: bson.D{{Key: "role", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating user indexes: %w", err)
+	}
+	_, err = db.emailVerifications.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating email verification TTL index: %w", err)
+	}
+	_, err = db.accountDeletions.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating account deletion index: %w", err)
+	}
+	_, err = db.dataExports.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "status", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating data export index: %w", err)
+	}
+	_, err = db.magicLinks.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating magic link indexes: %w", err)
+	}
+	_, err = db.magicLinkRequests.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating magic link request indexes: %w", err)
+	}
+	_, err = db.oidcStates.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating OIDC state TTL index: %w", err)
+	}
+	_, err = db.usersCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "passkeys.credentialId", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"passkeys.credentialId": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating passkey index: %w", err)
+	}
+	_, err = db.webauthnSessions.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating WebAuthn session TTL index: %w", err)
+	}
+	if err := db.ensureAuditIndexes(); err != nil {
+		return err
+	}
+	return nil
+}
 func (db *DatabaseService) checkUsernameExists(username string) (bool, error) {
 	if !db.userBloomFilter.TestString(username) {
 		return false, nil
@@ -199,6 +428,52 @@ func (db *DatabaseService) checkUsernameExists(username string) (bool, error) {
 	}
 	return count > 0, nil
 }
+
+// normalize trims the request and lowercases the email, as profile updates
+// do, so lookups by email match whatever case the user typed.
+func (req *UserRequest) normalize() {
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+}
+
+func (req *UserRequest) validate() error {
+	if !usernamePattern.MatchString(req.Username) {
+		return &fieldError{"username", "must be 3-30 letters, digits or underscores"}
+	}
+	return validateEmail(req.Email)
+}
+
+// lowercaseStoredEmails lowercases emails stored before registration
+// normalized them, so lookups by email find those accounts too. An address
+// that would then collide with another account's is left alone and logged.
+func (db *DatabaseService) lowercaseStoredEmails() {
+	ctx := context.Background()
+	cursor, err := db.usersCollection.Find(ctx,
+		bson.M{"$expr": bson.M{"$ne": bson.A{"$email", bson.M{"$toLower": "$email"}}}},
+		options.Find().SetProjection(bson.M{"email": 1}),
+	)
+	if err != nil {
+		db.logger.WithError(err).Error("Failed to find mixed-case emails")
+		return
+	}
+	var users []User
+	if err := cursor.All(ctx, &users); err != nil {
+		db.logger.WithError(err).Error("Failed to find mixed-case emails")
+		return
+	}
+	for _, u := range users {
+		lower := strings.ToLower(u.Email)
+		count, err := db.usersCollection.CountDocuments(ctx, bson.M{"email": lower})
+		if err != nil || count > 0 {
+			db.logger.WithField("user_id", u.ID.Hex()).Warn("Cannot lowercase email, another account uses it")
+			continue
+		}
+		if _, err := db.usersCollection.UpdateOne(ctx, bson.M{"_id": u.ID}, bson.M{"$set": bson.M{"email": lower}}); err != nil {
+			db.logger.WithError(err).Error("Failed to lowercase email")
+		}
+	}
+}
+
 func (db *DatabaseService) createUser(userReq *UserRequest) (*User, error) {
 	exists, err := db.checkUsernameExists(userReq.Username)
 	if err != nil {
@@ -207,14 +482,22 @@ func (db *DatabaseService) createUser(userReq *UserRequest) (*User, error) {
 	if exists {
 		return nil, fmt.Errorf("username already exists")
 	}
-	count, err := db.usersCollection.CountDocuments(context.Background(), bson.M{"email": userReq.Email})
+	// Handles given up in a rename stay reserved for their old owner.
+	count, err := db.usernameRedirects.CountDocuments(context.Background(), bson.M{"_id": userReq.Username})
+	if err != nil {
+		return nil, fmt.Errorf("error checking username: %w", err)
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("username already exists")
+	}
+	count, err = db.usersCollection.CountDocuments(context.Background(), bson.M{"email": userReq.Email})
 	if err != nil {
 		return nil, fmt.Errorf("error checking email: %w", err)
 	}
 	if count > 0 {
 		return nil, fmt.Errorf("email already exists")
 	}
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userReq.Password), bcrypt.DefaultCost)
+	hashedPassword, err := passwordHasher.Hash(userReq.Password)
 	if err != nil {
 		return nil, fmt.Errorf("error hashing password: %w", err)
 	}
@@ -222,7 +505,8 @@ func (db *DatabaseService) createUser(userReq *UserRequest) (*User, error) {
 		ID:        primitive.NewObjectID(),
 		Username:  userReq.Username,
 		Email:     userReq.Email,
-		Password:  string(hashedPassword),
+		Password:  hashedPassword,
+		Role:      roleUser,
 		CreatedAt: time.Now(),
 		LastLogin: time.Time{},
 	}
@@ -246,10 +530,16 @@ func (db *DatabaseService) authenticateUser(loginReq *LoginRequest) (*User, erro
 		}
 		return nil, fmt.Errorf("error finding user: %w", err)
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginReq.Password))
+	ok, needsRehash, err := passwordHasher.Verify(loginReq.Password, user.Password)
 	if err != nil {
+		return nil, fmt.Errorf("error verifying password: %w", err)
+	}
+	if !ok {
 		return nil, fmt.Errorf("invalid credentials")
 	}
+	if needsRehash {
+		db.rehashPassword(&user, loginReq.Password)
+	}
 	user.LastLogin = time.Now()
 	_, err = db.usersCollection.UpdateOne(
 		context.Background(),
@@ -265,74 +555,56 @@ func (db *DatabaseService) authenticateUser(loginReq *LoginRequest) (*User, erro
 	}).Info("User authenticated successfully")
 	return &user, nil
 }
-func (db *DatabaseService) getUserByID(userID string) (*User, error) {
-	objectID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		return nil, fmt.Errorf("invalid user ID")
-	}
-	var user User
-	err = db.usersCollection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&user)
+
+// rehashPassword upgrades a stored hash made with an outdated algorithm or
+// parameters. Failures are logged only; the old hash keeps working.
+func (db *DatabaseService) rehashPassword(user *User, password string) {
+	hashed, err := passwordHasher.Hash(password)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, fmt.Errorf("user not found")
-		}
-		return nil, fmt.Errorf("error finding user: %w", err)
+		db.logger.WithError(err).Error("Failed to rehash password")
+		return
 	}
-	return &user, nil
-}
-func (db *DatabaseService) getAllUsers() ([]User, error) {
-	var users []User
-	cursor, err := db.usersCollection.Find(context.Background(), bson.M{})
+	// Match on the old hash so a concurrent password change is not overwritten.
+	_, err = db.usersCollection.UpdateOne(
+		context.Background(),
+		bson.M{"_id": user.ID, "password": user.Password},
+		bson.M{"$set": bson.M{"password": hashed}},
+	)
 	if err != nil {
-		return nil, fmt.Errorf("error finding users: %w", err)
+		db.logger.WithError(err).Error("Failed to store rehashed password")
+		return
 	}
-	defer cursor.Close(context.Background())
-	for cursor.Next(context.Background()) {
-		var user User
-		if err := cursor.Decode(&user); err != nil {
-			db.logger.WithError(err).Error("Error decoding user")
-			continue
-		}
-		users = append(users, user)
-	}
-	return users, nil
+	user.Password = hashed
+	db.logger.WithField("user_id", user.ID.Hex()).Info("Password rehashed")
 }
-func (db *DatabaseService) updateUser(userID string, updates map[string]interface{}) error {
-	objectID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		return fmt.Errorf("invalid user ID")
-	}
-	delete(updates, "password")
-	delete(updates, "_id")
-	delete(updates, "createdAt")
-	if len(updates) == 0 {
-		return fmt.Errorf("no valid fields to update")
+
+// userIDForUsername returns the ID of the user with username, or "" if there
+// is none. Used to attribute failed logins to the account they targeted.
+func (db *DatabaseService) userIDForUsername(username string) string {
+	var user struct {
+		ID primitive.ObjectID `bson:"_id"`
 	}
-	_, err = db.usersCollection.UpdateOne(
-		context.Background(),
-		bson.M{"_id": objectID},
-		bson.M{"$set": updates},
-	)
+	err := db.usersCollection.FindOne(context.Background(), bson.M{"username": username},
+		options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&user)
 	if err != nil {
-		return fmt.Errorf("error updating user: %w", err)
+		return ""
 	}
-	db.logger.WithFields(logrus.Fields{
-		"user_id": userID,
-		"updates": updates,
-	}).Info("User updated successfully")
-	return nil
+	return user.ID.Hex()
 }
-func (db *DatabaseService) deleteUser(userID string) error {
+func (db *DatabaseService) getUserByID(userID string) (*User, error) {
 	objectID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
-		return fmt.Errorf("invalid user ID")
+		return nil, fmt.Errorf("invalid user ID")
 	}
-	_, err = db.usersCollection.DeleteOne(context.Background(), bson.M{"_id": objectID})
+	var user User
+	err = db.usersCollection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&user)
 	if err != nil {
-		return fmt.Errorf("error deleting user: %w", err)
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, fmt.Errorf("error finding user: %w", err)
 	}
-	db.logger.WithField("user_id", userID).Info("User deleted successfully")
-	return nil
+	return &user, nil
 }
 func generateJWT(user *User) (string, error) {
 	claims := &Claims{
@@ -346,7 +618,35 @@ func generateJWT(user *User) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(jwtSecret)
 }
+func parseJWT(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return jwtSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("token validation failed")
+	}
+	return claims, nil
+}
 func authMiddleware(c *fiber.Ctx) error {
+	return authenticate(c, false)
+}
+
+// deletionAuthMiddleware also accepts accounts scheduled for deletion, so
+// their owners can check on or cancel it.
+func deletionAuthMiddleware(c *fiber.Ctx) error {
+	return authenticate(c, true)
+}
+
+// authenticate checks the bearer token and that its account still exists
+// and may be used.
+func authenticate(c *fiber.Ctx, allowPendingDeletion bool) error {
 	authHeader := c.Get("Authorization")
 	if authHeader == "" {
 		logger.Warn("Missing authorization header")
@@ -361,25 +661,34 @@ func authMiddleware(c *fiber.Ctx) error {
 			"error": "Invalid authorization header format",
 		})
 	}
-	tokenString := tokenParts[1]
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	claims, err := parseJWT(tokenParts[1])
 	if err != nil {
 		logger.WithError(err).Warn("Invalid token")
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid token",
 		})
 	}
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		c.Locals("user_id", claims.UserID)
-		c.Locals("username", claims.Username)
-		return c.Next()
+	user, err := dbService.getUserByID(claims.UserID)
+	if err != nil {
+		if strings.Contains(err.Error(), "user not found") || strings.Contains(err.Error(), "invalid user ID") {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid token",
+			})
+		}
+		logger.WithError(err).Error("Failed to load user for token")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Authentication failed",
+		})
 	}
-	logger.Warn("Token validation failed")
-	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-		"error": "Invalid token",
-	})
+	if user.Status == userStatusPendingDeletion && !allowPendingDeletion {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error":                "Account is scheduled for deletion",
+			"deletionScheduledFor": user.DeletionScheduledFor,
+		})
+	}
+	c.Locals("user_id", claims.UserID)
+	c.Locals("username", claims.Username)
+	return c.Next()
 }
 func customErrorHandler(c *fiber.Ctx, err error) error {
 	code := fiber.StatusInternalServerError
@@ -408,14 +717,34 @@ func registerHandler(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
+	userReq.normalize()
 	if userReq.Username == "" || userReq.Email == "" || userReq.Password == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Username, email, and password are required",
 		})
 	}
-	if len(userReq.Password) < 6 {
+	if err := userReq.validate(); err != nil {
+		var fe *fieldError
+		if errors.As(err, &fe) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fe.Message,
+				"field": fe.Field,
+			})
+		}
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Password must be at least 6 characters long",
+			"error": "Invalid request body",
+		})
+	}
+	if err := passwordPolicy.Check(userReq.Password, userReq.Username, userReq.Email); err != nil {
+		var fe *fieldError
+		if errors.As(err, &fe) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Password " + fe.Message,
+				"field": fe.Field,
+			})
+		}
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid password",
 		})
 	}
 	user, err := dbService.createUser(&userReq)
@@ -435,6 +764,15 @@ func registerHandler(c *fiber.Ctx) error {
 			"error": "Failed to create user",
 		})
 	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditRegister,
+		ActorID:  user.ID.Hex(),
+		TargetID: user.ID.Hex(),
+		Details:  map[string]interface{}{"username": user.Username},
+	})
+	if err := dbService.startEmailVerification(user.ID, user.Email); err != nil {
+		logger.WithError(err).Error("Failed to send verification email")
+	}
 	token, err := generateJWT(user)
 	if err != nil {
 		logger.WithError(err).Error("Failed to generate token")
@@ -463,6 +801,12 @@ func loginHandler(c *fiber.Ctx) error {
 	user, err := dbService.authenticateUser(&loginReq)
 	if err != nil {
 		if strings.Contains(err.Error(), "invalid credentials") {
+			dbService.recordAudit(c, AuditEvent{
+				Type:     auditLogin,
+				Outcome:  auditFailure,
+				TargetID: dbService.userIDForUsername(loginReq.Username),
+				Details:  map[string]interface{}{"username": loginReq.Username, "method": "password"},
+			})
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "Invalid username or password",
 			})
@@ -472,6 +816,15 @@ func loginHandler(c *fiber.Ctx) error {
 			"error": "Authentication failed",
 		})
 	}
+	if requiresPasskey(user) {
+		return passkeyChallengeResponse(c, user)
+	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditLogin,
+		ActorID:  user.ID.Hex(),
+		TargetID: user.ID.Hex(),
+		Details:  map[string]interface{}{"method": "password"},
+	})
 	token, err := generateJWT(user)
 	if err != nil {
 		logger.WithError(err).Error("Failed to generate token")
@@ -484,18 +837,56 @@ func loginHandler(c *fiber.Ctx) error {
 		User:  *user,
 	})
 }
+func refreshTokenHandler(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+	user, err := dbService.getUserByID(userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "user not found") {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid token",
+			})
+		}
+		logger.WithError(err).Error("Failed to load user for token refresh")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to refresh token",
+		})
+	}
+	token, err := generateJWT(user)
+	if err != nil {
+		logger.WithError(err).Error("Failed to generate token")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate authentication token",
+		})
+	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditTokenRefresh,
+		TargetID: user.ID.Hex(),
+	})
+	return c.JSON(LoginResponse{
+		Token: token,
+		User:  *user,
+	})
+}
 func getUsers(c *fiber.Ctx) error {
-	users, err := dbService.getAllUsers()
+	params, err := parseUserListParams(c)
 	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	page, err := dbService.listUsers(params)
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid cursor") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid cursor",
+			})
+		}
 		logger.WithError(err).Error("Failed to get users")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to retrieve users",
 		})
 	}
-	return c.JSON(fiber.Map{
-		"users": users,
-		"count": len(users),
-	})
+	return c.JSON(page)
 }
 func getUserByID(c *fiber.Ctx) error {
 	userID := c.Params("id")
@@ -516,7 +907,14 @@ func getUserByID(c *fiber.Ctx) error {
 			"error": "Failed to retrieve user",
 		})
 	}
-	return c.JSON(user)
+	view, err := userView(c, user)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load caller for user lookup")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retrieve user",
+		})
+	}
+	return c.JSON(view)
 }
 func getProfile(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(string)
@@ -537,14 +935,21 @@ func updateUsers(c *fiber.Ctx) error {
 			"error": "You can only update your own profile",
 		})
 	}
-	var updates map[string]interface{}
-	if err := c.BodyParser(&updates); err != nil {
+	req, err := parseProfileUpdate(c.Body())
+	if err != nil {
+		var fe *fieldError
+		if errors.As(err, &fe) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fe.Message,
+				"field": fe.Field,
+			})
+		}
 		logger.WithError(err).Warn("Invalid request body for update")
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
-	err := dbService.updateUser(userID, updates)
+	result, err := dbService.updateProfile(userID, req)
 	if err != nil {
 		if strings.Contains(err.Error(), "no valid fields to update") {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -556,12 +961,37 @@ func updateUsers(c *fiber.Ctx) error {
 				"error": "Invalid user ID",
 			})
 		}
+		if strings.Contains(err.Error(), "user not found") {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		if strings.Contains(err.Error(), "username already exists") {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Username already exists. Please choose a unique username.",
+			})
+		}
+		if strings.Contains(err.Error(), "email already exists") {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Email already exists",
+			})
+		}
+		if strings.Contains(err.Error(), "username changed too recently") {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error":  "Username was changed too recently",
+				"detail": err.Error(),
+			})
+		}
 		logger.WithError(err).Error("Failed to update user")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to update user",
 		})
 	}
-	return c.JSON(fiber.Map{"message": "User updated successfully"})
+	return c.JSON(fiber.Map{
+		"message":                  "User updated successfully",
+		"user":                     result.User,
+		"emailVerificationPending": result.EmailVerificationPending,
+	})
 }
 func deleteUsers(c *fiber.Ctx) error {
 	userID := c.Params("id")
@@ -571,17 +1001,30 @@ func deleteUsers(c *fiber.Ctx) error {
 			"error": "You can only delete your own account",
 		})
 	}
-	err := dbService.deleteUser(userID)
+	job, err := dbService.requestAccountDeletion(c.Context(), userID)
 	if err != nil {
 		if strings.Contains(err.Error(), "invalid user ID") {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "Invalid user ID",
 			})
 		}
+		if strings.Contains(err.Error(), "user not found") {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
 		logger.WithError(err).Error("Failed to delete user")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to delete user",
 		})
 	}
-	return c.JSON(fiber.Map{"message": "User deleted successfully"})
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditDeletionRequested,
+		TargetID: userID,
+		Details:  map[string]interface{}{"executeAfter": job.ExecuteAfter},
+	})
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message":  "Account scheduled for deletion",
+		"deletion": job,
+	})
 }
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// External sign-in through OpenID Connect providers (authorization code flow
+// with PKCE). The browser app drives the redirects:
+//
+//  1. POST /api/auth/oidc/:provider/authorize returns the provider URL.
+//  2. The provider redirects back to the app with ?code=...&state=...
+//  3. The app posts both to /api/auth/oidc/:provider/callback and gets the
+//     same LoginResponse as a password login.
+const (
+	auditIdentityLinked = "auth.identity_linked"
+
+	oidcStateTTL       = 10 * time.Minute
+	oidcDiscoveryTTL   = time.Hour
+	oidcJWKSMinRefresh = time.Minute
+)
+
+// OIDCProviderConfig is one entry of OIDC_PROVIDERS.
+type OIDCProviderConfig struct {
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"displayName"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+	RedirectURL  string   `json:"redirectUrl"`
+}
+
+// ExternalIdentity links a user to an account at an OIDC provider.
+type ExternalIdentity struct {
+	Provider string    `json:"provider" bson:"provider"`
+	Subject  string    `json:"subject" bson:"subject"`
+	Email    string    `json:"email,omitempty" bson:"email,omitempty"`
+	LinkedAt time.Time `json:"linkedAt" bson:"linkedAt"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcProvider struct {
+	config OIDCProviderConfig
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	discoveredAt  time.Time
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+// oidcState is the server side of one authorization request, keyed by the
+// hash of the state parameter and consumed by the callback.
+type oidcState struct {
+	StateHash    string    `bson:"_id"`
+	Provider     string    `bson:"provider"`
+	Nonce        string    `bson:"nonce"`
+	CodeVerifier string    `bson:"codeVerifier"`
+	RedirectURL  string    `bson:"redirectUrl"`
+	ExpiresAt    time.Time `bson:"expiresAt"`
+}
+
+// idTokenClaims are the ID token claims we use. email_verified is a string
+// at some providers, so it is decoded loosely.
+type idTokenClaims struct {
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     interface{} `json:"email_verified"`
+	Name              string      `json:"name"`
+	PreferredUsername string      `json:"preferred_username"`
+	Picture           string      `json:"picture"`
+	jwt.RegisteredClaims
+}
+
+func (c *idTokenClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+var (
+	oidcProviders = map[string]*oidcProvider{}
+	oidcClient    = &http.Client{Timeout: 10 * time.Second}
+)
+
+// loadOIDCProviders reads the provider list from OIDC_PROVIDERS (a JSON
+// array) or, if that is unset, from the file named by OIDC_PROVIDERS_FILE.
+func loadOIDCProviders() map[string]*oidcProvider {
+	providers := map[string]*oidcProvider{}
+	raw := os.Getenv("OIDC_PROVIDERS")
+	if raw == "" {
+		path := os.Getenv("OIDC_PROVIDERS_FILE")
+		if path == "" {
+			return providers
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to read OIDC_PROVIDERS_FILE")
+			return providers
+		}
+		raw = string(data)
+	}
+	var configs []OIDCProviderConfig
+	if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+		logger.WithError(err).Warn("Invalid OIDC provider configuration")
+		return providers
+	}
+	for _, cfg := range configs {
+		if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" {
+			logger.WithField("provider", cfg.Name).Warn("Skipping OIDC provider without name, issuer or clientId")
+			continue
+		}
+		cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"openid", "email", "profile"}
+		}
+		if cfg.RedirectURL == "" {
+			cfg.RedirectURL = appBaseURL + "/oauth/callback/" + cfg.Name
+		}
+		if cfg.DisplayName == "" {
+			cfg.DisplayName = cfg.Name
+		}
+		providers[cfg.Name] = &oidcProvider{config: cfg}
+	}
+	logger.WithField("count", len(providers)).Info("Loaded OIDC providers")
+	return providers
+}
+
+func (p *oidcProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && time.Since(p.discoveredAt) < oidcDiscoveryTTL {
+		return p.discovery, nil
+	}
+	var doc oidcDiscovery
+	if err := oidcGetJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, fmt.Errorf("error fetching provider configuration: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("provider configuration issuer %q does not match %q", doc.Issuer, p.config.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("provider configuration is incomplete")
+	}
+	p.discovery = &doc
+	p.discoveredAt = time.Now()
+	return p.discovery, nil
+}
+
+// key returns the verification key with the given kid, refetching the key
+// set when the kid is unknown (providers rotate keys).
+func (p *oidcProvider) key(ctx context.Context, kid string) (interface{}, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, found := p.lookupKey(kid); found {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < oidcJWKSMinRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := oidcGetJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("error fetching provider keys: %w", err)
+	}
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logger.WithError(err).WithField("kid", jwk.Kid).Warn("Skipping unsupported OIDC signing key")
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	if key, found := p.lookupKey(kid); found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds kid in the cached set. Tokens without a kid are accepted
+// when the provider publishes exactly one key.
+func (p *oidcProvider) lookupKey(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, found := p.keys[kid]
+	return key, found
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func oidcGetJSON(ctx context.Context, rawURL string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &serviceError{StatusCode: resp.StatusCode, Body: string(msg)}
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func randomURLString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// startOIDCLogin stores a new authorization request and returns the URL the
+// browser should be sent to, plus the state the app should check on return.
+func (db *DatabaseService) startOIDCLogin(ctx context.Context, p *oidcProvider) (string, string, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, stateHash, err := generateToken()
+	if err != nil {
+		return "", "", fmt.Errorf("error generating state: %w", err)
+	}
+	nonce, err := randomURLString(32)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating nonce: %w", err)
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating code verifier: %w", err)
+	}
+	_, err = db.oidcStates.InsertOne(ctx, oidcState{
+		StateHash:    stateHash,
+		Provider:     p.config.Name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		RedirectURL:  p.config.RedirectURL,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("error storing state: %w", err)
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	authURL := discovery.AuthorizationEndpoint
+	if strings.Contains(authURL, "?") {
+		authURL += "&" + query.Encode()
+	} else {
+		authURL += "?" + query.Encode()
+	}
+	return authURL, state, nil
+}
+
+// finishOIDCLogin redeems the authorization code and returns the verified
+// ID token claims.
+func (db *DatabaseService) finishOIDCLogin(ctx context.Context, p *oidcProvider, code, state string) (*idTokenClaims, error) {
+	var st oidcState
+	err := db.oidcStates.FindOneAndDelete(ctx, bson.M{
+		"_id":       hashToken(state),
+		"provider":  p.config.Name,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&st)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("invalid or expired state")
+		}
+		return nil, fmt.Errorf("error finding state: %w", err)
+	}
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {st.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {st.CodeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("code exchange failed: %w", &serviceError{StatusCode: resp.StatusCode, Body: string(msg)})
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("error decoding token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("code exchange failed: no id_token in response")
+	}
+	return p.verifyIDToken(ctx, discovery, tokens.IDToken, st.Nonce)
+}
+
+func (p *oidcProvider) verifyIDToken(ctx context.Context, discovery *oidcDiscovery, raw, nonce string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "ES512", "EdDSA"}))
+	_, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	if !claims.VerifyIssuer(discovery.Issuer, true) {
+		return nil, fmt.Errorf("invalid id token: wrong issuer")
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, fmt.Errorf("invalid id token: wrong audience")
+	}
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("invalid id token: missing exp")
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("invalid id token: nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("invalid id token: missing sub")
+	}
+	return claims, nil
+}
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// availableUsername derives a free username from the provider's suggestion,
+// adding a numeric suffix when the plain name is taken.
+func (db *DatabaseService) availableUsername(hint string) (string, error) {
+	base := usernameInvalidChars.ReplaceAllString(hint, "_")
+	base = strings.Trim(base, "_")
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	if len(base) < 3 {
+		base = "user"
+	}
+	candidate := base
+	for attempt := 0; attempt < 10; attempt++ {
+		exists, err := db.checkUsernameExists(candidate)
+		if err != nil {
+			return "", fmt.Errorf("error checking username: %w", err)
+		}
+		if !exists {
+			count, err := db.usernameRedirects.CountDocuments(context.Background(), bson.M{"_id": candidate})
+			if err != nil {
+				return "", fmt.Errorf("error checking username: %w", err)
+			}
+			if count == 0 {
+				return candidate, nil
+			}
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(100000))
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s_%d", base, n.Int64())
+	}
+	return "", fmt.Errorf("could not find a free username")
+}
+
+// resolveExternalUser finds the user for an external identity: an existing
+// link, an account with the same (verified on both sides) email, or a new
+// account. created and linked report what happened.
+func (db *DatabaseService) resolveExternalUser(provider string, claims *idTokenClaims) (user *User, created, linked bool, err error) {
+	var existing User
+	err = db.usersCollection.FindOne(context.Background(), bson.M{
+		"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": claims.Subject}},
+	}).Decode(&existing)
+	if err == nil {
+		return &existing, false, false, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, false, fmt.Errorf("error finding user: %w", err)
+	}
+
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+	if email == "" {
+		return nil, false, false, fmt.Errorf("provider did not return an email address")
+	}
+	identity := ExternalIdentity{
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    email,
+		LinkedAt: time.Now(),
+	}
+
+	err = db.usersCollection.FindOne(context.Background(), bson.M{"email": email}).Decode(&existing)
+	if err == nil {
+		// Only link when both sides have proven ownership of the address;
+		// otherwise whoever registered the address first could take over
+		// the other person's login.
+		if !claims.emailVerified() || !existing.EmailVerified {
+			return nil, false, false, fmt.Errorf("email already registered")
+		}
+		_, err = db.usersCollection.UpdateOne(context.Background(),
+			bson.M{"_id": existing.ID},
+			bson.M{"$push": bson.M{"identities": identity}},
+		)
+		if err != nil {
+			return nil, false, false, fmt.Errorf("error linking identity: %w", err)
+		}
+		existing.Identities = append(existing.Identities, identity)
+		db.logger.WithFields(logrus.Fields{
+			"user_id":  existing.ID.Hex(),
+			"provider": provider,
+		}).Info("External identity linked")
+		return &existing, false, true, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, false, fmt.Errorf("error finding user: %w", err)
+	}
+
+	hint := claims.PreferredUsername
+	if hint == "" {
+		hint, _, _ = strings.Cut(email, "@")
+	}
+	username, err := db.availableUsername(hint)
+	if err != nil {
+		return nil, false, false, err
+	}
+	newUser := &User{
+		ID:            primitive.NewObjectID(),
+		Username:      username,
+		Email:         email,
+		EmailVerified: claims.emailVerified(),
+		DisplayName:   claims.Name,
+		Identities:    []ExternalIdentity{identity},
+		Role:          roleUser,
+		CreatedAt:     time.Now(),
+	}
+	if validateHTTPURL("avatarUrl", claims.Picture) == nil {
+		newUser.AvatarURL = claims.Picture
+	}
+	if _, err := db.usersCollection.InsertOne(context.Background(), newUser); err != nil {
+		return nil, false, false, fmt.Errorf("error inserting user: %w", err)
+	}
+	db.userBloomFilter.AddString(newUser.Username)
+	db.logger.WithFields(logrus.Fields{
+		"user_id":  newUser.ID.Hex(),
+		"username": newUser.Username,
+		"provider": provider,
+	}).Info("User created from external identity")
+	return newUser, true, false, nil
+}
+
+func listOIDCProvidersHandler(c *fiber.Ctx) error {
+	providers := []fiber.Map{}
+	for _, p := range oidcProviders {
+		providers = append(providers, fiber.Map{
+			"name":        p.config.Name,
+			"displayName": p.config.DisplayName,
+		})
+	}
+	return c.JSON(fiber.Map{"providers": providers})
+}
+
+func oidcAuthorizeHandler(c *fiber.Ctx) error {
+	p, found := oidcProviders[c.Params("provider")]
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown identity provider",
+		})
+	}
+	authURL, state, err := dbService.startOIDCLogin(c.Context(), p)
+	if err != nil {
+		logger.WithError(err).WithField("provider", p.config.Name).Error("Failed to start OIDC login")
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Identity provider unavailable",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"authorizationUrl": authURL,
+		"state":            state,
+	})
+}
+
+func oidcCallbackHandler(c *fiber.Ctx) error {
+	p, found := oidcProviders[c.Params("provider")]
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown identity provider",
+		})
+	}
+	var body struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+	if err := c.BodyParser(&body); err != nil || body.Code == "" || body.State == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Code and state are required",
+		})
+	}
+
+	loginFailed := func(reason string) {
+		dbService.recordAudit(c, AuditEvent{
+			Type:    auditLogin,
+			Outcome: auditFailure,
+			Details: map[string]interface{}{"method": "oidc", "provider": p.config.Name, "reason": reason},
+		})
+	}
+	claims, err := dbService.finishOIDCLogin(c.Context(), p, body.Code, body.State)
+	if err != nil {
+		loginFailed(err.Error())
+		if strings.Contains(err.Error(), "invalid or expired state") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Login request expired, please try again",
+			})
+		}
+		if strings.Contains(err.Error(), "code exchange failed") || strings.Contains(err.Error(), "invalid id token") {
+			logger.WithError(err).WithField("provider", p.config.Name).Warn("OIDC login rejected")
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Identity provider login failed",
+			})
+		}
+		logger.WithError(err).WithField("provider", p.config.Name).Error("Failed to finish OIDC login")
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Identity provider unavailable",
+		})
+	}
+
+	user, created, linked, err := dbService.resolveExternalUser(p.config.Name, claims)
+	if err != nil {
+		loginFailed(err.Error())
+		if strings.Contains(err.Error(), "email already registered") {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "An account with this email already exists. Log in with your password and verify your email first.",
+			})
+		}
+		if strings.Contains(err.Error(), "did not return an email") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "The identity provider did not share an email address",
+			})
+		}
+		logger.WithError(err).Error("Failed to resolve external user")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Authentication failed",
+		})
+	}
+
+	userID := user.ID.Hex()
+	if created {
+		dbService.recordAudit(c, AuditEvent{
+			Type:     auditRegister,
+			ActorID:  userID,
+			TargetID: userID,
+			Details:  map[string]interface{}{"method": "oidc", "provider": p.config.Name},
+		})
+	}
+	if linked {
+		dbService.recordAudit(c, AuditEvent{
+			Type:     auditIdentityLinked,
+			ActorID:  userID,
+			TargetID: userID,
+			Details:  map[string]interface{}{"provider": p.config.Name},
+		})
+	}
+	if requiresPasskey(user) {
+		return passkeyChallengeResponse(c, user)
+	}
+	user.LastLogin = time.Now()
+	if _, err := dbService.usersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"lastLogin": user.LastLogin}},
+	); err != nil {
+		logger.WithError(err).Error("Failed to update last login")
+	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditLogin,
+		ActorID:  userID,
+		TargetID: userID,
+		Details:  map[string]interface{}{"method": "oidc", "provider": p.config.Name},
+	})
+
+	token, err := generateJWT(user)
+	if err != nil {
+		logger.WithError(err).Error("Failed to generate token")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate authentication token",
+		})
+	}
+	status := fiber.StatusOK
+	if created {
+		status = fiber.StatusCreated
+	}
+	return c.Status(status).JSON(LoginResponse{
+		Token: token,
+		User:  *user,
+	})
+}
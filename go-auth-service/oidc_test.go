@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bits-and-blooms/bloom/v3"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+const (
+	testClientID    = "streamflow-test"
+	testRedirectURL = "https://app.example/oidc/callback"
+	testKeyID       = "key-1"
+)
+
+// mockIssuer is a minimal OpenID provider: discovery, a one-key JWKS and a
+// token endpoint that checks the PKCE verifier against the challenge sent to
+// the authorization endpoint.
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu        sync.Mutex
+	challenge string
+	nonce     string
+	subject   string
+	email     string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, subject: "subject-1", email: "alice@example.com"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.server.URL,
+			AuthorizationEndpoint: m.server.URL + "/authorize",
+			TokenEndpoint:         m.server.URL + "/token",
+			JWKSURI:               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: testKeyID,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", m.handleToken)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code",
+		r.PostForm.Get("code") != "good-code",
+		r.PostForm.Get("redirect_uri") != testRedirectURL:
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge:
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	idToken := m.sign(m.claims(m.nonce), m.key, testKeyID)
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+// authorize plays the provider's authorization endpoint: it remembers the
+// challenge and nonce the login was started with.
+func (m *mockIssuer) authorize(t *testing.T, authURL string) url.Values {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, m.server.URL+"/authorize?") {
+		t.Fatalf("authorization URL %q does not point at the issuer", authURL)
+	}
+	q := u.Query()
+	m.mu.Lock()
+	m.challenge = q.Get("code_challenge")
+	m.nonce = q.Get("nonce")
+	m.mu.Unlock()
+	return q
+}
+
+func (m *mockIssuer) claims(nonce string) *idTokenClaims {
+	now := time.Now()
+	return &idTokenClaims{
+		Nonce:         nonce,
+		Email:         m.email,
+		EmailVerified: true,
+		Name:          "Alice",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.server.URL,
+			Subject:   m.subject,
+			Audience:  jwt.ClaimStrings{testClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	}
+}
+
+func (m *mockIssuer) sign(claims *idTokenClaims, key *rsa.PrivateKey, kid string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+func (m *mockIssuer) provider() *oidcProvider {
+	return &oidcProvider{config: OIDCProviderConfig{
+		Name:        "mock",
+		Issuer:      m.server.URL,
+		ClientID:    testClientID,
+		Scopes:      []string{"openid", "email", "profile"},
+		RedirectURL: testRedirectURL,
+	}}
+}
+
+func newTestLogger() *logrus.Logger {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return l
+}
+
+// newMockDatabaseService points every collection at the mtest mock
+// deployment, so responses are consumed in the order the code issues
+// commands.
+func newMockDatabaseService(mt *mtest.T) *DatabaseService {
+	logger = newTestLogger()
+	return &DatabaseService{
+		usersCollection:   mt.DB.Collection("users"),
+		usernameRedirects: mt.DB.Collection("username_redirects"),
+		oidcStates:        mt.DB.Collection("oidc_states"),
+		webauthnSessions:  mt.DB.Collection("webauthn_sessions"),
+		auditEvents:       mt.DB.Collection("audit_events"),
+		logger:            logger,
+		userBloomFilter:   bloom.NewWithEstimates(1000, 0.01),
+	}
+}
+
+// sentCommand returns the most recent command sent with the given name.
+func sentCommand(mt *mtest.T, name string) bson.Raw {
+	mt.Helper()
+	events := mt.GetAllStartedEvents()
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].CommandName == name {
+			return events[i].Command
+		}
+	}
+	mt.Fatalf("no %s command was sent", name)
+	return nil
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("PKCE, state and nonce round trip", func(mt *mtest.T) {
+		issuer := newMockIssuer(mt.T)
+		p := issuer.provider()
+		db := newMockDatabaseService(mt)
+		ctx := context.Background()
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		authURL, state, err := db.startOIDCLogin(ctx, p)
+		if err != nil {
+			mt.Fatalf("startOIDCLogin: %v", err)
+		}
+		q := issuer.authorize(mt.T, authURL)
+		if q.Get("state") != state || q.Get("client_id") != testClientID || q.Get("redirect_uri") != testRedirectURL {
+			mt.Fatalf("unexpected authorization parameters: %v", q)
+		}
+		if q.Get("code_challenge_method") != "S256" || q.Get("nonce") == "" {
+			mt.Fatalf("login must use S256 PKCE and a nonce: %v", q)
+		}
+
+		var stored oidcState
+		if err := bson.Unmarshal(sentCommand(mt, "insert").Lookup("documents", "0").Document(), &stored); err != nil {
+			mt.Fatal(err)
+		}
+		if stored.StateHash != hashToken(state) {
+			mt.Fatalf("state must be stored hashed, got %q", stored.StateHash)
+		}
+		if stored.CodeVerifier == "" || stored.CodeVerifier == q.Get("code_challenge") {
+			mt.Fatalf("the verifier must stay server side")
+		}
+		if stored.Nonce != q.Get("nonce") {
+			mt.Fatalf("stored nonce %q does not match the one sent %q", stored.Nonce, q.Get("nonce"))
+		}
+
+		doc, _ := bson.Marshal(stored)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.Raw(doc)}))
+		claims, err := db.finishOIDCLogin(ctx, p, "good-code", state)
+		if err != nil {
+			mt.Fatalf("finishOIDCLogin: %v", err)
+		}
+		if claims.Subject != issuer.subject || claims.Email != issuer.email {
+			mt.Fatalf("unexpected claims: %+v", claims)
+		}
+		filter := sentCommand(mt, "findAndModify").Lookup("query").Document()
+		if id := filter.Lookup("_id").StringValue(); id != hashToken(state) {
+			mt.Fatalf("state lookup used %q", id)
+		}
+		if !sentCommand(mt, "findAndModify").Lookup("remove").Boolean() {
+			mt.Fatalf("state must be consumed on use")
+		}
+	})
+
+	mt.Run("unknown or expired state", func(mt *mtest.T) {
+		issuer := newMockIssuer(mt.T)
+		db := newMockDatabaseService(mt)
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		_, err := db.finishOIDCLogin(context.Background(), issuer.provider(), "good-code", "forged-state")
+		if err == nil || !strings.Contains(err.Error(), "invalid or expired state") {
+			mt.Fatalf("expected invalid state, got %v", err)
+		}
+	})
+
+	mt.Run("wrong code verifier", func(mt *mtest.T) {
+		issuer := newMockIssuer(mt.T)
+		p := issuer.provider()
+		db := newMockDatabaseService(mt)
+		ctx := context.Background()
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		authURL, state, err := db.startOIDCLogin(ctx, p)
+		if err != nil {
+			mt.Fatalf("startOIDCLogin: %v", err)
+		}
+		q := issuer.authorize(mt.T, authURL)
+
+		doc, _ := bson.Marshal(oidcState{
+			StateHash:    hashToken(state),
+			Provider:     p.config.Name,
+			Nonce:        q.Get("nonce"),
+			CodeVerifier: "not-the-verifier",
+			RedirectURL:  testRedirectURL,
+			ExpiresAt:    time.Now().Add(time.Minute),
+		})
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.Raw(doc)}))
+		_, err = db.finishOIDCLogin(ctx, p, "good-code", state)
+		if err == nil || !strings.Contains(err.Error(), "code exchange failed") {
+			mt.Fatalf("expected the token endpoint to reject the verifier, got %v", err)
+		}
+	})
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := newMockIssuer(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger = newTestLogger()
+	p := issuer.provider()
+	ctx := context.Background()
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr string
+	}{
+		{"valid", func() string {
+			return issuer.sign(issuer.claims("n"), issuer.key, testKeyID)
+		}, ""},
+		{"signed by another key", func() string {
+			return issuer.sign(issuer.claims("n"), otherKey, testKeyID)
+		}, "invalid id token"},
+		{"unknown key id", func() string {
+			return issuer.sign(issuer.claims("n"), issuer.key, "key-2")
+		}, "unknown signing key"},
+		{"HMAC with the public key", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, issuer.claims("n"))
+			token.Header["kid"] = testKeyID
+			signed, _ := token.SignedString(issuer.key.N.Bytes())
+			return signed
+		}, "invalid id token"},
+		{"unsigned", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodNone, issuer.claims("n"))
+			signed, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return signed
+		}, "invalid id token"},
+		{"wrong nonce", func() string {
+			return issuer.sign(issuer.claims("other"), issuer.key, testKeyID)
+		}, "nonce mismatch"},
+		{"wrong audience", func() string {
+			claims := issuer.claims("n")
+			claims.Audience = jwt.ClaimStrings{"someone-else"}
+			return issuer.sign(claims, issuer.key, testKeyID)
+		}, "wrong audience"},
+		{"wrong issuer", func() string {
+			claims := issuer.claims("n")
+			claims.Issuer = "https://evil.example"
+			return issuer.sign(claims, issuer.key, testKeyID)
+		}, "wrong issuer"},
+		{"expired", func() string {
+			claims := issuer.claims("n")
+			claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			return issuer.sign(claims, issuer.key, testKeyID)
+		}, "invalid id token"},
+		{"missing exp", func() string {
+			claims := issuer.claims("n")
+			claims.ExpiresAt = nil
+			return issuer.sign(claims, issuer.key, testKeyID)
+		}, "missing exp"},
+		{"missing sub", func() string {
+			claims := issuer.claims("n")
+			claims.Subject = ""
+			return issuer.sign(claims, issuer.key, testKeyID)
+		}, "missing sub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.verifyIDToken(ctx, discovery, tt.token(), "n")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func userCursor(mt *mtest.T, users ...User) bson.D {
+	mt.Helper()
+	batch := make([]bson.D, 0, len(users))
+	for _, u := range users {
+		raw, err := bson.Marshal(u)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		var doc bson.D
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			mt.Fatal(err)
+		}
+		batch = append(batch, doc)
+	}
+	return mtest.CreateCursorResponse(0, "test.users", mtest.FirstBatch, batch...)
+}
+
+func TestResolveExternalUser(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	claims := func(verified bool) *idTokenClaims {
+		return &idTokenClaims{
+			Email:             "Alice@Example.com",
+			EmailVerified:     verified,
+			PreferredUsername: "alice",
+			RegisteredClaims:  jwt.RegisteredClaims{Subject: "subject-1"},
+		}
+	}
+
+	mt.Run("existing link", func(mt *mtest.T) {
+		db := newMockDatabaseService(mt)
+		linked := User{ID: primitive.NewObjectID(), Username: "alice", Email: "alice@example.com",
+			Identities: []ExternalIdentity{{Provider: "mock", Subject: "subject-1"}}}
+		mt.AddMockResponses(userCursor(mt, linked))
+
+		user, created, didLink, err := db.resolveExternalUser("mock", claims(true))
+		if err != nil || created || didLink || user.ID != linked.ID {
+			mt.Fatalf("expected the linked user, got %v created=%v linked=%v err=%v", user, created, didLink, err)
+		}
+	})
+
+	mt.Run("links a verified email", func(mt *mtest.T) {
+		db := newMockDatabaseService(mt)
+		existing := User{ID: primitive.NewObjectID(), Username: "alice", Email: "alice@example.com", EmailVerified: true}
+		mt.AddMockResponses(userCursor(mt), userCursor(mt, existing), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+
+		user, created, didLink, err := db.resolveExternalUser("mock", claims(true))
+		if err != nil || created || !didLink || user.ID != existing.ID {
+			mt.Fatalf("expected a link to the existing user, got %v created=%v linked=%v err=%v", user, created, didLink, err)
+		}
+		if email := sentCommand(mt, "find").Lookup("filter", "email").StringValue(); email != "alice@example.com" {
+			mt.Fatalf("email lookup must be normalized, got %q", email)
+		}
+		pushed := sentCommand(mt, "update").Lookup("updates", "0", "u", "$push", "identities").Document()
+		if pushed.Lookup("provider").StringValue() != "mock" || pushed.Lookup("subject").StringValue() != "subject-1" {
+			mt.Fatalf("unexpected identity pushed: %v", pushed)
+		}
+	})
+
+	for _, tc := range []struct {
+		name             string
+		providerVerified bool
+		accountVerified  bool
+	}{
+		{"refuses an unverified provider email", false, true},
+		{"refuses an unverified account email", true, false},
+	} {
+		mt.Run(tc.name, func(mt *mtest.T) {
+			db := newMockDatabaseService(mt)
+			existing := User{ID: primitive.NewObjectID(), Username: "alice", Email: "alice@example.com", EmailVerified: tc.accountVerified}
+			mt.AddMockResponses(userCursor(mt), userCursor(mt, existing))
+
+			_, _, _, err := db.resolveExternalUser("mock", claims(tc.providerVerified))
+			if err == nil || !strings.Contains(err.Error(), "email already registered") {
+				mt.Fatalf("expected email already registered, got %v", err)
+			}
+			for _, e := range mt.GetAllStartedEvents() {
+				if e.CommandName == "update" {
+					mt.Fatalf("identity must not be linked")
+				}
+			}
+		})
+	}
+
+	mt.Run("creates a new account", func(mt *mtest.T) {
+		db := newMockDatabaseService(mt)
+		mt.AddMockResponses(
+			userCursor(mt),
+			userCursor(mt),
+			mtest.CreateCursorResponse(0, "test.username_redirects", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(),
+		)
+
+		user, created, didLink, err := db.resolveExternalUser("mock", claims(true))
+		if err != nil || !created || didLink {
+			mt.Fatalf("expected a new user, got created=%v linked=%v err=%v", created, didLink, err)
+		}
+		if user.Username != "alice" || user.Email != "alice@example.com" || !user.EmailVerified {
+			mt.Fatalf("unexpected user: %+v", user)
+		}
+		if len(user.Identities) != 1 || user.Identities[0].Subject != "subject-1" {
+			mt.Fatalf("identity not recorded: %+v", user.Identities)
+		}
+		if !db.userBloomFilter.TestString("alice") {
+			mt.Fatalf("new username must be added to the bloom filter")
+		}
+	})
+}
+
+func TestOIDCCallbackRequiresPasskey(t *testing.T) {
+	setTestWebAuthnConfig(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("second factor before a token", func(mt *mtest.T) {
+		issuer := newMockIssuer(mt.T)
+		p := issuer.provider()
+		dbService = newMockDatabaseService(mt)
+		oidcProviders = map[string]*oidcProvider{p.config.Name: p}
+		mt.Cleanup(func() { dbService, oidcProviders = nil, map[string]*oidcProvider{} })
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		authURL, state, err := dbService.startOIDCLogin(context.Background(), p)
+		if err != nil {
+			mt.Fatalf("startOIDCLogin: %v", err)
+		}
+		issuer.authorize(mt.T, authURL)
+		var stored oidcState
+		if err := bson.Unmarshal(sentCommand(mt, "insert").Lookup("documents", "0").Document(), &stored); err != nil {
+			mt.Fatal(err)
+		}
+		doc, _ := bson.Marshal(stored)
+
+		a := newES256Authenticator(mt.T)
+		user := User{
+			ID:              primitive.NewObjectID(),
+			Username:        "alice",
+			Email:           issuer.email,
+			Identities:      []ExternalIdentity{{Provider: p.config.Name, Subject: issuer.subject}},
+			Passkeys:        []Passkey{a.passkey(0)},
+			PasskeyRequired: true,
+		}
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.Raw(doc)}),
+			userCursor(mt, user),
+			mtest.CreateSuccessResponse(),
+		)
+
+		app := fiber.New()
+		app.Post("/api/auth/oidc/:provider/callback", oidcCallbackHandler)
+		body := strings.NewReader(`{"code":"good-code","state":"` + state + `"}`)
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/oidc/mock/callback", body)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		var out map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			mt.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || out["mfaRequired"] != true {
+			mt.Fatalf("expected a passkey challenge, got %d %v", resp.StatusCode, out)
+		}
+		if _, found := out["token"]; found {
+			mt.Fatalf("no token may be issued before the passkey")
+		}
+		if ceremony := sentCommand(mt, "insert").Lookup("documents", "0", "ceremony").StringValue(); ceremony != ceremonyMFA {
+			mt.Fatalf("stored %q challenge, want %q", ceremony, ceremonyMFA)
+		}
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes new passwords and verifies stored ones. Stored
+// hashes are self-describing PHC strings, so Verify also reports whether a
+// hash was made with an outdated algorithm or parameters and should be
+// replaced the next time the plaintext is available.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (ok bool, needsRehash bool, err error)
+}
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the OWASP recommendation for argon2id.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// argon2idHasher produces argon2id hashes and still accepts legacy bcrypt
+// hashes for verification so existing users can log in (and get upgraded).
+type argon2idHasher struct {
+	params Argon2Params
+}
+
+func newArgon2idHasher(params Argon2Params) *argon2idHasher {
+	return &argon2idHasher{params: params}
+}
+
+// argon2ParamsFromEnv reads ARGON2_MEMORY_KIB, ARGON2_ITERATIONS and
+// ARGON2_PARALLELISM, falling back to the defaults for anything unset.
+func argon2ParamsFromEnv() Argon2Params {
+	params := DefaultArgon2Params
+	readUint := func(key string, bits int, apply func(uint64)) {
+		v := os.Getenv(key)
+		if v == "" {
+			return
+		}
+		n, err := strconv.ParseUint(v, 10, bits)
+		if err != nil || n == 0 {
+			logger.WithField("value", v).Warnf("Invalid %s, using default", key)
+			return
+		}
+		apply(n)
+	}
+	readUint("ARGON2_MEMORY_KIB", 32, func(n uint64) { params.Memory = uint32(n) })
+	readUint("ARGON2_ITERATIONS", 32, func(n uint64) { params.Iterations = uint32(n) })
+	readUint("ARGON2_PARALLELISM", 8, func(n uint64) { params.Parallelism = uint8(n) })
+	return params
+}
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *argon2idHasher) Verify(password, encoded string) (bool, bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return h.verifyArgon2id(password, encoded)
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		// bcrypt is only kept for verification; always upgrade.
+		return true, true, nil
+	case encoded == "":
+		// Accounts without a password (e.g. created through an external login).
+		return false, false, nil
+	}
+	return false, false, fmt.Errorf("unknown password hash format")
+}
+
+func (h *argon2idHasher) verifyArgon2id(password, encoded string) (bool, bool, error) {
+	// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false, fmt.Errorf("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, fmt.Errorf("malformed argon2id hash: %w", err)
+	}
+	if version != argon2.Version {
+		return false, false, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return false, false, fmt.Errorf("malformed argon2id hash: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, fmt.Errorf("malformed argon2id hash: %w", err)
+	}
+
+	got := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return false, false, nil
+	}
+	needsRehash := params.Memory != h.params.Memory ||
+		params.Iterations != h.params.Iterations ||
+		params.Parallelism != h.params.Parallelism ||
+		uint32(len(salt)) != h.params.SaltLength ||
+		uint32(len(want)) != h.params.KeyLength
+	return true, needsRehash, nil
+}
+
+// PasswordPolicy is checked whenever a user chooses a new password.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	common    map[string]struct{}
+}
+
+// loadPasswordPolicy builds the policy from PASSWORD_MIN_LENGTH and the
+// newline-separated list in COMMON_PASSWORDS_FILE (breached or otherwise
+// common passwords, compared case-insensitively). A missing list is logged
+// and only disables that check.
+func loadPasswordPolicy() *PasswordPolicy {
+	policy := &PasswordPolicy{MinLength: 8, MaxLength: 128, common: map[string]struct{}{}}
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			policy.MinLength = n
+		} else {
+			logger.WithField("value", v).Warn("Invalid PASSWORD_MIN_LENGTH, using default")
+		}
+	}
+
+	path := os.Getenv("COMMON_PASSWORDS_FILE")
+	if path == "" {
+		path = "common-passwords.txt"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		logger.WithError(err).Warn("Common password list not loaded")
+		return policy
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		policy.common[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.WithError(err).Warn("Error reading common password list")
+	}
+	logger.WithField("count", len(policy.common)).Info("Loaded common password list")
+	return policy
+}
+
+// Check returns a *fieldError describing why password is not acceptable.
+func (p *PasswordPolicy) Check(password, username, email string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return &fieldError{"password", fmt.Sprintf("must be at least %d characters long", p.MinLength)}
+	}
+	if length > p.MaxLength {
+		return &fieldError{"password", fmt.Sprintf("must be at most %d characters long", p.MaxLength)}
+	}
+	lower := strings.ToLower(password)
+	if _, found := p.common[lower]; found {
+		return &fieldError{"password", "is too common, please choose a less predictable password"}
+	}
+	if len(username) >= 3 && strings.Contains(lower, strings.ToLower(username)) {
+		return &fieldError{"password", "must not contain your username"}
+	}
+	if local, _, ok := strings.Cut(email, "@"); ok && len(local) >= 3 && strings.Contains(lower, strings.ToLower(local)) {
+		return &fieldError{"password", "must not contain your email address"}
+	}
+	return nil
+}
+
+// changePassword replaces the user's password after checking the current
+// one. Accounts created without a password (external logins) can set one by
+// leaving currentPassword empty.
+func (db *DatabaseService) changePassword(userID, currentPassword, newPassword string) error {
+	user, err := db.getUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.Password != "" {
+		ok, _, err := passwordHasher.Verify(currentPassword, user.Password)
+		if err != nil {
+			return fmt.Errorf("error verifying password: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("invalid credentials")
+		}
+	}
+	if err := passwordPolicy.Check(newPassword, user.Username, user.Email); err != nil {
+		return err
+	}
+	hashed, err := passwordHasher.Hash(newPassword)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+	_, err = db.usersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"password": hashed}},
+	)
+	if err != nil {
+		return fmt.Errorf("error updating password: %w", err)
+	}
+	db.logger.WithField("user_id", userID).Info("Password changed")
+	return nil
+}
+
+func changePasswordHandler(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+	var body struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := c.BodyParser(&body); err != nil || body.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "New password is required",
+		})
+	}
+	err := dbService.changePassword(userID, body.CurrentPassword, body.NewPassword)
+	if err != nil {
+		var fe *fieldError
+		if errors.As(err, &fe) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Password " + fe.Message,
+				"field": "newPassword",
+			})
+		}
+		if strings.Contains(err.Error(), "invalid credentials") {
+			dbService.recordAudit(c, AuditEvent{
+				Type:     auditPasswordChange,
+				Outcome:  auditFailure,
+				TargetID: userID,
+				Details:  map[string]interface{}{"reason": "wrong current password"},
+			})
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Current password is incorrect",
+			})
+		}
+		logger.WithError(err).Error("Failed to change password")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to change password",
+		})
+	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditPasswordChange,
+		TargetID: userID,
+	})
+	return c.JSON(fiber.Map{"message": "Password changed successfully"})
+}
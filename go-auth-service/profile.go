@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 500
+	maxURLLength         = 2048
+	maxProfileLinks      = 5
+	maxLinkTitleLength   = 40
+	emailVerificationTTL = 24 * time.Hour
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]{3,30}$`)
+
+// ProfileLink is an external link shown on a user's channel page.
+type ProfileLink struct {
+	Title string `json:"title" bson:"title"`
+	URL   string `json:"url" bson:"url"`
+}
+
+// ProfileUpdateRequest lists every field a user may change on their own
+// profile. Nil fields are left untouched; anything else in the request body
+// is rejected.
+type ProfileUpdateRequest struct {
+	Username    *string        `json:"username"`
+	Email       *string        `json:"email"`
+	DisplayName *string        `json:"displayName"`
+	Bio         *string        `json:"bio"`
+	AvatarURL   *string        `json:"avatarUrl"`
+	BannerURL   *string        `json:"bannerUrl"`
+	Links       *[]ProfileLink `json:"links"`
+}
+
+// ProfileUpdateResult tells the caller which parts of an update were applied
+// directly and which are waiting on a follow-up step.
+type ProfileUpdateResult struct {
+	User                     *User `json:"user"`
+	EmailVerificationPending bool  `json:"emailVerificationPending"`
+}
+
+// ChannelProfile is what other users see of an account: the channel page,
+// without contact details, sign-in methods or account state.
+type ChannelProfile struct {
+	ID          primitive.ObjectID `json:"_id"`
+	Username    string             `json:"username"`
+	DisplayName string             `json:"displayName,omitempty"`
+	Bio         string             `json:"bio,omitempty"`
+	AvatarURL   string             `json:"avatarUrl,omitempty"`
+	BannerURL   string             `json:"bannerUrl,omitempty"`
+	Links       []ProfileLink      `json:"links,omitempty"`
+	CreatedAt   time.Time          `json:"createdAt"`
+}
+
+func channelProfile(user *User) *ChannelProfile {
+	return &ChannelProfile{
+		ID:          user.ID,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+		BannerURL:   user.BannerURL,
+		Links:       user.Links,
+		CreatedAt:   user.CreatedAt,
+	}
+}
+
+// userView returns the full document to its owner and to admins, and the
+// channel profile to everyone else.
+func userView(c *fiber.Ctx, user *User) (interface{}, error) {
+	callerID := c.Locals("user_id").(string)
+	if callerID == user.ID.Hex() {
+		return user, nil
+	}
+	caller, err := dbService.getUserByID(callerID)
+	if err != nil {
+		if strings.Contains(err.Error(), "user not found") {
+			return channelProfile(user), nil
+		}
+		return nil, err
+	}
+	if caller.Role == roleAdmin {
+		return user, nil
+	}
+	return channelProfile(user), nil
+}
+
+type fieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *fieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+type emailVerification struct {
+	TokenHash string             `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	Email     string             `bson:"email"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+type usernameRedirect struct {
+	Username  string             `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+// generateToken returns a random URL-safe token and the hash we store for it.
+func generateToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateHTTPURL(field, raw string) error {
+	if raw == "" {
+		return nil
+	}
+	if len(raw) > maxURLLength {
+		return &fieldError{field, fmt.Sprintf("must be at most %d characters", maxURLLength)}
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &fieldError{field, "must be an absolute http(s) URL"}
+	}
+	return nil
+}
+
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return &fieldError{"email", "must be a valid email address"}
+	}
+	return nil
+}
+
+func (req *ProfileUpdateRequest) normalize() {
+	trim := func(s *string) {
+		if s != nil {
+			*s = strings.TrimSpace(*s)
+		}
+	}
+	trim(req.Username)
+	trim(req.Email)
+	trim(req.DisplayName)
+	trim(req.Bio)
+	trim(req.AvatarURL)
+	trim(req.BannerURL)
+	if req.Email != nil {
+		*req.Email = strings.ToLower(*req.Email)
+	}
+	if req.Links != nil {
+		for i := range *req.Links {
+			(*req.Links)[i].Title = strings.TrimSpace((*req.Links)[i].Title)
+			(*req.Links)[i].URL = strings.TrimSpace((*req.Links)[i].URL)
+		}
+	}
+}
+
+func (req *ProfileUpdateRequest) validate() error {
+	if req.Username != nil && !usernamePattern.MatchString(*req.Username) {
+		return &fieldError{"username", "must be 3-30 letters, digits or underscores"}
+	}
+	if req.Email != nil {
+		if err := validateEmail(*req.Email); err != nil {
+			return err
+		}
+	}
+	if req.DisplayName != nil && utf8.RuneCountInString(*req.DisplayName) > maxDisplayNameLength {
+		return &fieldError{"displayName", fmt.Sprintf("must be at most %d characters", maxDisplayNameLength)}
+	}
+	if req.Bio != nil && utf8.RuneCountInString(*req.Bio) > maxBioLength {
+		return &fieldError{"bio", fmt.Sprintf("must be at most %d characters", maxBioLength)}
+	}
+	if req.AvatarURL != nil {
+		if err := validateHTTPURL("avatarUrl", *req.AvatarURL); err != nil {
+			return err
+		}
+	}
+	if req.BannerURL != nil {
+		if err := validateHTTPURL("bannerUrl", *req.BannerURL); err != nil {
+			return err
+		}
+	}
+	if req.Links != nil {
+		if len(*req.Links) > maxProfileLinks {
+			return &fieldError{"links", fmt.Sprintf("at most %d links are allowed", maxProfileLinks)}
+		}
+		for i, link := range *req.Links {
+			field := fmt.Sprintf("links[%d]", i)
+			if link.Title == "" || utf8.RuneCountInString(link.Title) > maxLinkTitleLength {
+				return &fieldError{field + ".title", fmt.Sprintf("must be 1-%d characters", maxLinkTitleLength)}
+			}
+			if link.URL == "" {
+				return &fieldError{field + ".url", "is required"}
+			}
+			if err := validateHTTPURL(field+".url", link.URL); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseProfileUpdate decodes the request body strictly so unknown or
+// protected fields (lastLogin, password, nested documents, ...) are rejected
+// instead of silently ignored.
+func parseProfileUpdate(body []byte) (*ProfileUpdateRequest, error) {
+	var req ProfileUpdateRequest
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+	req.normalize()
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (db *DatabaseService) updateProfile(userID string, req *ProfileUpdateRequest) (*ProfileUpdateResult, error) {
+	user, err := db.getUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	setOrUnset := func(field string, value *string) {
+		if value == nil {
+			return
+		}
+		if *value == "" {
+			unset[field] = ""
+		} else {
+			set[field] = *value
+		}
+	}
+	setOrUnset("displayName", req.DisplayName)
+	setOrUnset("bio", req.Bio)
+	setOrUnset("avatarUrl", req.AvatarURL)
+	setOrUnset("bannerUrl", req.BannerURL)
+	if req.Links != nil {
+		if len(*req.Links) == 0 {
+			unset["links"] = ""
+		} else {
+			set["links"] = *req.Links
+		}
+	}
+
+	emailPending := false
+	if req.Email != nil && *req.Email != user.Email {
+		count, err := db.usersCollection.CountDocuments(context.Background(), bson.M{"email": *req.Email})
+		if err != nil {
+			return nil, fmt.Errorf("error checking email: %w", err)
+		}
+		if count > 0 {
+			return nil, fmt.Errorf("email already exists")
+		}
+		set["pendingEmail"] = *req.Email
+		emailPending = true
+	} else if req.Email != nil && user.PendingEmail != "" {
+		// Switching back to the current address cancels a pending change.
+		unset["pendingEmail"] = ""
+	}
+
+	renaming := req.Username != nil && *req.Username != user.Username
+	if len(set) == 0 && len(unset) == 0 && !renaming {
+		return nil, fmt.Errorf("no valid fields to update")
+	}
+
+	// Rename first: it is the step most likely to be refused, and nothing
+	// else has been written yet if it is.
+	if renaming {
+		if err := db.changeUsername(user, *req.Username); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(set) > 0 || len(unset) > 0 {
+		update := bson.M{}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		if _, err := db.usersCollection.UpdateOne(context.Background(), bson.M{"_id": user.ID}, update); err != nil {
+			return nil, fmt.Errorf("error updating user: %w", err)
+		}
+	}
+
+	if emailPending {
+		if err := db.startEmailVerification(user.ID, *req.Email); err != nil {
+			return nil, err
+		}
+	}
+
+	db.logger.WithFields(logrus.Fields{
+		"user_id": userID,
+		"set":     set,
+		"unset":   unset,
+	}).Info("User profile updated successfully")
+
+	updated, err := db.getUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &ProfileUpdateResult{User: updated, EmailVerificationPending: emailPending}, nil
+}
+
+// changeUsername renames a user if the handle is free and the user has not
+// renamed recently. The old handle is kept as a redirect so existing links
+// keep working and nobody else can claim it.
+func (db *DatabaseService) changeUsername(user *User, newUsername string) error {
+	if !user.UsernameChangedAt.IsZero() && time.Since(user.UsernameChangedAt) < usernameChangeInterval {
+		return fmt.Errorf("username changed too recently, next change allowed after %s",
+			user.UsernameChangedAt.Add(usernameChangeInterval).Format(time.RFC3339))
+	}
+
+	exists, err := db.checkUsernameExists(newUsername)
+	if err != nil {
+		return fmt.Errorf("error checking username: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("username already exists")
+	}
+	var redirect usernameRedirect
+	err = db.usernameRedirects.FindOne(context.Background(), bson.M{"_id": newUsername}).Decode(&redirect)
+	if err == nil && redirect.UserID != user.ID {
+		return fmt.Errorf("username already exists")
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return fmt.Errorf("error checking username: %w", err)
+	}
+
+	now := time.Now()
+	res, err := db.usersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": user.ID, "username": user.Username},
+		bson.M{"$set": bson.M{"username": newUsername, "usernameChangedAt": now}},
+	)
+	if err != nil {
+		return fmt.Errorf("error updating user: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("user not found")
+	}
+	db.userBloomFilter.AddString(newUsername)
+
+	// A user reclaiming one of their own old handles no longer needs its redirect.
+	if _, err := db.usernameRedirects.DeleteOne(context.Background(), bson.M{"_id": newUsername, "userId": user.ID}); err != nil {
+		db.logger.WithError(err).Error("Failed to remove reclaimed username redirect")
+	}
+	_, err = db.usernameRedirects.UpdateOne(context.Background(),
+		bson.M{"_id": user.Username},
+		bson.M{"$set": bson.M{"userId": user.ID, "createdAt": now}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		db.logger.WithError(err).Error("Failed to store username redirect")
+	}
+
+	db.logger.WithFields(logrus.Fields{
+		"user_id":      user.ID.Hex(),
+		"old_username": user.Username,
+		"new_username": newUsername,
+	}).Info("Username changed")
+	user.Username = newUsername
+	user.UsernameChangedAt = now
+	return nil
+}
+
+// startEmailVerification mails a single-use verification link for email.
+// When email differs from the account's current address it is only applied
+// once the link is redeemed.
+func (db *DatabaseService) startEmailVerification(userID primitive.ObjectID, email string) error {
+	token, tokenHash, err := generateToken()
+	if err != nil {
+		return fmt.Errorf("error generating verification token: %w", err)
+	}
+	_, err = db.emailVerifications.InsertOne(context.Background(), emailVerification{
+		TokenHash: tokenHash,
+		UserID:    userID,
+		Email:     email,
+		ExpiresAt: time.Now().Add(emailVerificationTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("error storing verification token: %w", err)
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", appBaseURL, url.QueryEscape(token))
+	err = mailer.Send(context.Background(), MailMessage{
+		To:      email,
+		Subject: "Verify your StreamFlow email address",
+		Body: "Confirm this email address for your StreamFlow account by opening the link below.\n\n" +
+			link + "\n\nThe link expires in 24 hours. If you did not request this, you can ignore this email.\n",
+	})
+	if err != nil {
+		return fmt.Errorf("error sending verification email: %w", err)
+	}
+	return nil
+}
+
+func (db *DatabaseService) verifyEmail(token string) (*User, error) {
+	var v emailVerification
+	err := db.emailVerifications.FindOneAndDelete(context.Background(), bson.M{
+		"_id":       hashToken(token),
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&v)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("invalid or expired token")
+		}
+		return nil, fmt.Errorf("error finding verification token: %w", err)
+	}
+
+	user, err := db.getUserByID(v.UserID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	switch v.Email {
+	case user.Email:
+		_, err = db.usersCollection.UpdateOne(context.Background(),
+			bson.M{"_id": user.ID},
+			bson.M{"$set": bson.M{"emailVerified": true}},
+		)
+	case user.PendingEmail:
+		count, cerr := db.usersCollection.CountDocuments(context.Background(), bson.M{"email": v.Email})
+		if cerr != nil {
+			return nil, fmt.Errorf("error checking email: %w", cerr)
+		}
+		if count > 0 {
+			return nil, fmt.Errorf("email already exists")
+		}
+		_, err = db.usersCollection.UpdateOne(context.Background(),
+			bson.M{"_id": user.ID, "pendingEmail": v.Email},
+			bson.M{
+				"$set":   bson.M{"email": v.Email, "emailVerified": true},
+				"$unset": bson.M{"pendingEmail": ""},
+			},
+		)
+	default:
+		// The user requested another address since this link was sent.
+		return nil, fmt.Errorf("invalid or expired token")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error updating user: %w", err)
+	}
+
+	db.logger.WithFields(logrus.Fields{
+		"user_id": user.ID.Hex(),
+		"email":   v.Email,
+	}).Info("Email verified")
+	return db.getUserByID(user.ID.Hex())
+}
+
+// resolveUsername returns the user currently holding username, following a
+// redirect if the handle used to belong to someone who renamed.
+func (db *DatabaseService) resolveUsername(username string) (*User, bool, error) {
+	var user User
+	err := db.usersCollection.FindOne(context.Background(), bson.M{"username": username}).Decode(&user)
+	if err == nil {
+		return &user, false, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, fmt.Errorf("error finding user: %w", err)
+	}
+
+	var redirect usernameRedirect
+	err = db.usernameRedirects.FindOne(context.Background(), bson.M{"_id": username}).Decode(&redirect)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, false, fmt.Errorf("user not found")
+		}
+		return nil, false, fmt.Errorf("error finding username redirect: %w", err)
+	}
+	target, err := db.getUserByID(redirect.UserID.Hex())
+	if err != nil {
+		return nil, false, err
+	}
+	return target, true, nil
+}
+
+// userHandles returns the user's current username followed by every handle
+// they have renamed away from. Other services attribute videos by handle, so
+// anything acting on "all of a user's videos" has to look at all of them.
+func (db *DatabaseService) userHandles(user *User) ([]string, error) {
+	handles := []string{user.Username}
+	cursor, err := db.usernameRedirects.Find(context.Background(), bson.M{"userId": user.ID})
+	if err != nil {
+		return nil, fmt.Errorf("error finding username redirects: %w", err)
+	}
+	var redirects []usernameRedirect
+	if err := cursor.All(context.Background(), &redirects); err != nil {
+		return nil, fmt.Errorf("error finding username redirects: %w", err)
+	}
+	for _, r := range redirects {
+		handles = append(handles, r.Username)
+	}
+	return handles, nil
+}
+
+func verifyEmailHandler(c *fiber.Ctx) error {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := c.BodyParser(&body); err != nil || body.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Verification token is required",
+		})
+	}
+	user, err := dbService.verifyEmail(body.Token)
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid or expired token") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid or expired verification link",
+			})
+		}
+		if strings.Contains(err.Error(), "email already exists") {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Email already exists",
+			})
+		}
+		logger.WithError(err).Error("Failed to verify email")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify email",
+		})
+	}
+	return c.JSON(fiber.Map{"message": "Email verified successfully", "user": user})
+}
+
+func getUserByUsername(c *fiber.Ctx) error {
+	username := c.Params("username")
+	user, redirected, err := dbService.resolveUsername(username)
+	if err != nil {
+		if strings.Contains(err.Error(), "user not found") {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		logger.WithError(err).Error("Failed to resolve username")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retrieve user",
+		})
+	}
+	if redirected {
+		c.Set(fiber.HeaderLocation, "/api/users/by-username/"+url.PathEscape(user.Username))
+		return c.Status(fiber.StatusMovedPermanently).JSON(fiber.Map{
+			"redirectTo": user.Username,
+		})
+	}
+	view, err := userView(c, user)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load caller for user lookup")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retrieve user",
+		})
+	}
+	return c.JSON(view)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"stream-flow/objstore/serviceauth"
+)
+
+// URLs of the other StreamFlow services the auth service calls.
+var (
+	socialServiceURL string
+	searchServiceURL string
+	uploadServiceURL string
+	serviceClient    = &http.Client{Timeout: 30 * time.Second}
+
+	// What this service presents to the others, from
+	// SERVICE_CLIENT_CREDENTIALS ("auth-service:secret").
+	serviceClientID     string
+	serviceClientSecret string
+)
+
+func loadServiceClientCredentials() {
+	id, secret, ok := serviceauth.ParseClient(os.Getenv("SERVICE_CLIENT_CREDENTIALS"))
+	if !ok {
+		logger.Warn("SERVICE_CLIENT_CREDENTIALS not set, calls to other services will be rejected")
+		return
+	}
+	serviceClientID, serviceClientSecret = id, secret
+}
+
+// Helper function to read Env Vars
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	logger.Infof("%s not set, defaulting to %s", key, fallback)
+	return fallback
+}
+
+// serviceError is returned when another service answers with a non-2xx status.
+type serviceError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *serviceError) Error() string {
+	return fmt.Sprintf("service returned %d: %s", e.StatusCode, e.Body)
+}
+
+// callService sends a JSON request to another service and decodes a JSON
+// response into out (if non-nil).
+func callService(ctx context.Context, method, url string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth(serviceClientID, serviceClientSecret)
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &serviceError{StatusCode: resp.StatusCode, Body: string(msg)}
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// openService issues a GET to another service and returns the response body
+// for streaming. The caller must close it.
+func openService(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(serviceClientID, serviceClientSecret)
+	// Originals can be large; rely on ctx rather than the client timeout.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &serviceError{StatusCode: resp.StatusCode, Body: string(msg)}
+	}
+	return resp.Body, nil
+}
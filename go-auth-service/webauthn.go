@@ -0,0 +1,815 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Passkeys (WebAuthn Level 2). A passkey can replace the password entirely
+// (POST /api/auth/passkey/begin + /finish, with or without a username) or,
+// when the user turns on passkeyRequired, be asked for as a second factor
+// after a correct password.
+const (
+	auditPasskeyAdded   = "auth.passkey_added"
+	auditPasskeyRemoved = "auth.passkey_removed"
+
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+	ceremonyMFA          = "mfa"
+
+	webauthnTimeout = 5 * time.Minute
+	maxPasskeys     = 10
+
+	// COSE algorithm identifiers
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataBackupElig   = 0x08
+	authDataAttested     = 0x40
+)
+
+var (
+	webauthnRPID    string
+	webauthnRPName  string
+	webauthnOrigins []string
+)
+
+// Passkey is a WebAuthn credential registered to a user.
+type Passkey struct {
+	CredentialID   string    `json:"id" bson:"credentialId"` // base64url
+	Name           string    `json:"name" bson:"name"`
+	PublicKey      []byte    `json:"-" bson:"publicKey"` // COSE_Key
+	Algorithm      int64     `json:"algorithm" bson:"algorithm"`
+	SignCount      uint32    `json:"signCount" bson:"signCount"`
+	Transports     []string  `json:"transports,omitempty" bson:"transports,omitempty"`
+	AAGUID         string    `json:"aaguid,omitempty" bson:"aaguid,omitempty"`
+	BackupEligible bool      `json:"backupEligible" bson:"backupEligible"`
+	CreatedAt      time.Time `json:"createdAt" bson:"createdAt"`
+	LastUsedAt     time.Time `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+}
+
+// webauthnSession holds an outstanding challenge, keyed by the challenge
+// itself so the finish step can find it from clientDataJSON.
+type webauthnSession struct {
+	Challenge string             `bson:"_id"`
+	Ceremony  string             `bson:"ceremony"`
+	UserID    primitive.ObjectID `bson:"userId,omitempty"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+// credentialJSON is a PublicKeyCredential as serialized by the browser app,
+// with binary fields base64url encoded.
+type credentialJSON struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+		AuthenticatorData string   `json:"authenticatorData"`
+		Signature         string   `json:"signature"`
+		UserHandle        string   `json:"userHandle"`
+	} `json:"response"`
+}
+
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	raw          []byte
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+// loadWebAuthnConfig reads WEBAUTHN_RP_ID, WEBAUTHN_RP_NAME and
+// WEBAUTHN_ORIGINS (comma separated), defaulting to APP_BASE_URL.
+func loadWebAuthnConfig() {
+	webauthnRPName = os.Getenv("WEBAUTHN_RP_NAME")
+	if webauthnRPName == "" {
+		webauthnRPName = "StreamFlow"
+	}
+	webauthnRPID = os.Getenv("WEBAUTHN_RP_ID")
+	if webauthnRPID == "" {
+		if u, err := url.Parse(appBaseURL); err == nil {
+			webauthnRPID = u.Hostname()
+		}
+	}
+	webauthnOrigins = nil
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			webauthnOrigins = append(webauthnOrigins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	if len(webauthnOrigins) == 0 {
+		webauthnOrigins = []string{strings.TrimSuffix(appBaseURL, "/")}
+	}
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (db *DatabaseService) newWebAuthnSession(ceremony string, userID primitive.ObjectID) (string, error) {
+	challenge, err := randomURLString(32)
+	if err != nil {
+		return "", fmt.Errorf("error generating challenge: %w", err)
+	}
+	_, err = db.webauthnSessions.InsertOne(context.Background(), webauthnSession{
+		Challenge: challenge,
+		Ceremony:  ceremony,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(webauthnTimeout),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error storing challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+func (db *DatabaseService) consumeWebAuthnSession(challenge string, ceremonies ...string) (*webauthnSession, error) {
+	var session webauthnSession
+	err := db.webauthnSessions.FindOneAndDelete(context.Background(), bson.M{
+		"_id":       challenge,
+		"ceremony":  bson.M{"$in": ceremonies},
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&session)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("invalid or expired challenge")
+		}
+		return nil, fmt.Errorf("error finding challenge: %w", err)
+	}
+	return &session, nil
+}
+
+// parseClientData checks the ceremony type and origin of clientDataJSON and
+// returns it with its raw bytes.
+func parseClientData(encoded, wantType string) (*collectedClientData, []byte, error) {
+	raw, err := decodeBase64URL(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid passkey response: bad clientDataJSON")
+	}
+	var cd collectedClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, nil, fmt.Errorf("invalid passkey response: bad clientDataJSON")
+	}
+	if cd.Type != wantType {
+		return nil, nil, fmt.Errorf("invalid passkey response: wrong ceremony type")
+	}
+	originOK := false
+	for _, origin := range webauthnOrigins {
+		if cd.Origin == origin {
+			originOK = true
+			break
+		}
+	}
+	if !originOK {
+		return nil, nil, fmt.Errorf("invalid passkey response: origin %q not allowed", cd.Origin)
+	}
+	return &cd, raw, nil
+}
+
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("invalid passkey response: authenticator data too short")
+	}
+	ad := &authenticatorData{
+		raw:       raw,
+		rpIDHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(webauthnRPID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return nil, fmt.Errorf("invalid passkey response: wrong relying party")
+	}
+	if ad.flags&authDataUserPresent == 0 {
+		return nil, fmt.Errorf("invalid passkey response: user not present")
+	}
+	if ad.flags&authDataAttested == 0 {
+		return ad, nil
+	}
+
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("invalid passkey response: attested credential data too short")
+	}
+	ad.aaguid = rest[:16]
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, fmt.Errorf("invalid passkey response: attested credential data too short")
+	}
+	ad.credentialID = rest[:idLen]
+	rest = rest[idLen:]
+	_, n, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid passkey response: bad credential public key: %w", err)
+	}
+	ad.publicKey = rest[:n]
+	return ad, nil
+}
+
+// parseCOSEKey decodes a COSE_Key into a crypto public key and its algorithm.
+func parseCOSEKey(raw []byte) (int64, crypto.PublicKey, error) {
+	v, _, err := decodeCBOR(raw)
+	if err != nil {
+		return 0, nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, fmt.Errorf("COSE key is not a map")
+	}
+	intParam := func(label int64) int64 {
+		n, _ := m[label].(int64)
+		return n
+	}
+	bytesParam := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+
+	alg := intParam(3)
+	switch intParam(1) {
+	case 2: // EC2
+		if alg != coseES256 || intParam(-1) != 1 {
+			return 0, nil, fmt.Errorf("unsupported EC2 key (alg %d, crv %d)", alg, intParam(-1))
+		}
+		x, y := bytesParam(-2), bytesParam(-3)
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if len(x) != 32 || len(y) != 32 || !key.Curve.IsOnCurve(key.X, key.Y) {
+			return 0, nil, fmt.Errorf("invalid P-256 key")
+		}
+		return alg, key, nil
+	case 3: // RSA
+		if alg != coseRS256 {
+			return 0, nil, fmt.Errorf("unsupported RSA algorithm %d", alg)
+		}
+		n, e := bytesParam(-1), bytesParam(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, fmt.Errorf("invalid RSA key")
+		}
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case 1: // OKP
+		x := bytesParam(-2)
+		if alg != coseEdDSA || intParam(-1) != 6 || len(x) != ed25519.PublicKeySize {
+			return 0, nil, fmt.Errorf("unsupported OKP key")
+		}
+		return alg, ed25519.PublicKey(x), nil
+	}
+	return 0, nil, fmt.Errorf("unsupported COSE key type %d", intParam(1))
+}
+
+func verifyCOSESignature(coseKey, signed, sig []byte) error {
+	_, key, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return fmt.Errorf("bad signature")
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("bad signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, signed, sig) {
+			return fmt.Errorf("bad signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key")
+	}
+	return nil
+}
+
+func credentialDescriptors(passkeys []Passkey) []fiber.Map {
+	descriptors := []fiber.Map{}
+	for _, pk := range passkeys {
+		d := fiber.Map{"type": "public-key", "id": pk.CredentialID}
+		if len(pk.Transports) > 0 {
+			d["transports"] = pk.Transports
+		}
+		descriptors = append(descriptors, d)
+	}
+	return descriptors
+}
+
+// requestOptions builds PublicKeyCredentialRequestOptions for a login or
+// second-factor challenge. An empty allow list lets the authenticator offer
+// any discoverable credential for this site.
+func requestOptions(challenge string, passkeys []Passkey, userVerification string) fiber.Map {
+	return fiber.Map{
+		"challenge":        challenge,
+		"rpId":             webauthnRPID,
+		"timeout":          webauthnTimeout.Milliseconds(),
+		"allowCredentials": credentialDescriptors(passkeys),
+		"userVerification": userVerification,
+	}
+}
+
+func (db *DatabaseService) finishPasskeyRegistration(userID string, name string, cred *credentialJSON) (*Passkey, error) {
+	cd, _, err := parseClientData(cred.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+	session, err := db.consumeWebAuthnSession(cd.Challenge, ceremonyRegistration)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID.Hex() != userID {
+		return nil, fmt.Errorf("invalid or expired challenge")
+	}
+
+	attObjRaw, err := decodeBase64URL(cred.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid passkey response: bad attestationObject")
+	}
+	attObj, _, err := decodeCBOR(attObjRaw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid passkey response: bad attestationObject")
+	}
+	attMap, ok := attObj.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid passkey response: bad attestationObject")
+	}
+	// We ask for attestation "none"; authenticator statements are not
+	// checked, so every passkey provider is accepted.
+	authDataRaw, ok := attMap["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("invalid passkey response: missing authData")
+	}
+	ad, err := parseAuthenticatorData(authDataRaw)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, fmt.Errorf("invalid passkey response: no attested credential")
+	}
+	alg, _, err := parseCOSEKey(ad.publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid passkey response: %w", err)
+	}
+
+	if name == "" {
+		name = "Passkey"
+	}
+	passkey := &Passkey{
+		CredentialID:   base64.RawURLEncoding.EncodeToString(ad.credentialID),
+		Name:           name,
+		PublicKey:      ad.publicKey,
+		Algorithm:      alg,
+		SignCount:      ad.signCount,
+		Transports:     cred.Response.Transports,
+		AAGUID:         hex.EncodeToString(ad.aaguid),
+		BackupEligible: ad.flags&authDataBackupElig != 0,
+		CreatedAt:      time.Now(),
+	}
+	res, err := db.usersCollection.UpdateOne(context.Background(),
+		bson.M{
+			"_id":                   session.UserID,
+			"passkeys.credentialId": bson.M{"$ne": passkey.CredentialID},
+			fmt.Sprintf("passkeys.%d", maxPasskeys-1): bson.M{"$exists": false},
+		},
+		bson.M{"$push": bson.M{"passkeys": passkey}},
+	)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("passkey already registered")
+		}
+		return nil, fmt.Errorf("error storing passkey: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return nil, fmt.Errorf("passkey already registered or limit reached")
+	}
+	return passkey, nil
+}
+
+// finishPasskeyAssertion verifies a login or second-factor assertion and
+// returns the user it belongs to.
+func (db *DatabaseService) finishPasskeyAssertion(cred *credentialJSON) (*User, *webauthnSession, error) {
+	cd, clientDataRaw, err := parseClientData(cred.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := db.consumeWebAuthnSession(cd.Challenge, ceremonyLogin, ceremonyMFA)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	userID := session.UserID
+	if cred.Response.UserHandle != "" {
+		handle, err := decodeBase64URL(cred.Response.UserHandle)
+		if err != nil || len(handle) != 12 {
+			return nil, session, fmt.Errorf("unknown passkey")
+		}
+		var handleID primitive.ObjectID
+		copy(handleID[:], handle)
+		if !userID.IsZero() && handleID != userID {
+			return nil, session, fmt.Errorf("unknown passkey")
+		}
+		userID = handleID
+	}
+	credentialID := strings.TrimRight(cred.RawID, "=")
+	if credentialID == "" {
+		credentialID = strings.TrimRight(cred.ID, "=")
+	}
+
+	var user User
+	filter := bson.M{"passkeys.credentialId": credentialID}
+	if !userID.IsZero() {
+		filter["_id"] = userID
+	}
+	if err := db.usersCollection.FindOne(context.Background(), filter).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, session, fmt.Errorf("unknown passkey")
+		}
+		return nil, session, fmt.Errorf("error finding user: %w", err)
+	}
+	var passkey *Passkey
+	for i := range user.Passkeys {
+		if user.Passkeys[i].CredentialID == credentialID {
+			passkey = &user.Passkeys[i]
+		}
+	}
+	if passkey == nil {
+		return nil, session, fmt.Errorf("unknown passkey")
+	}
+
+	authDataRaw, err := decodeBase64URL(cred.Response.AuthenticatorData)
+	if err != nil {
+		return &user, session, fmt.Errorf("invalid passkey response: bad authenticatorData")
+	}
+	ad, err := parseAuthenticatorData(authDataRaw)
+	if err != nil {
+		return &user, session, err
+	}
+	// Without a password, the passkey is the only factor and must have
+	// verified the user (PIN, biometrics).
+	if session.Ceremony == ceremonyLogin && ad.flags&authDataUserVerified == 0 {
+		return &user, session, fmt.Errorf("invalid passkey response: user not verified")
+	}
+	sig, err := decodeBase64URL(cred.Response.Signature)
+	if err != nil {
+		return &user, session, fmt.Errorf("invalid passkey response: bad signature")
+	}
+	clientDataHash := sha256.Sum256(clientDataRaw)
+	signed := append(append([]byte(nil), authDataRaw...), clientDataHash[:]...)
+	if err := verifyCOSESignature(passkey.PublicKey, signed, sig); err != nil {
+		return &user, session, fmt.Errorf("invalid passkey response: %w", err)
+	}
+	// A counter that does not increase suggests a cloned authenticator.
+	// Synced passkeys always report 0, which is allowed.
+	if (ad.signCount != 0 || passkey.SignCount != 0) && ad.signCount <= passkey.SignCount {
+		return &user, session, fmt.Errorf("invalid passkey response: signature counter did not increase")
+	}
+
+	now := time.Now()
+	_, err = db.usersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": user.ID, "passkeys.credentialId": credentialID},
+		bson.M{"$set": bson.M{
+			"passkeys.$.signCount":  ad.signCount,
+			"passkeys.$.lastUsedAt": now,
+			"lastLogin":             now,
+		}},
+	)
+	if err != nil {
+		db.logger.WithError(err).Error("Failed to update passkey counter")
+	}
+	passkey.SignCount = ad.signCount
+	passkey.LastUsedAt = now
+	user.LastLogin = now
+	db.logger.WithFields(logrus.Fields{
+		"user_id":  user.ID.Hex(),
+		"username": user.Username,
+	}).Info("User authenticated with passkey")
+	return &user, session, nil
+}
+
+// requiresPasskey reports whether a password or login-link sign-in must be
+// completed with a passkey before a token is issued.
+func requiresPasskey(user *User) bool {
+	return user.PasskeyRequired && len(user.Passkeys) > 0
+}
+
+// passkeyChallengeResponse answers a first-factor login for a user who
+// requires a passkey. The app completes it through /api/auth/passkey/finish.
+func passkeyChallengeResponse(c *fiber.Ctx, user *User) error {
+	challenge, err := dbService.newWebAuthnSession(ceremonyMFA, user.ID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to start passkey second factor")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Authentication failed",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"mfaRequired": true,
+		"publicKey":   requestOptions(challenge, user.Passkeys, "preferred"),
+	})
+}
+
+func beginPasskeyRegistration(c *fiber.Ctx) error {
+	user, err := dbService.getUserByID(c.Locals("user_id").(string))
+	if err != nil {
+		if strings.Contains(err.Error(), "user not found") {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+		}
+		logger.WithError(err).Error("Failed to load user for passkey registration")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start passkey registration",
+		})
+	}
+	if len(user.Passkeys) >= maxPasskeys {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": fmt.Sprintf("At most %d passkeys can be registered", maxPasskeys),
+		})
+	}
+	challenge, err := dbService.newWebAuthnSession(ceremonyRegistration, user.ID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to start passkey registration")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start passkey registration",
+		})
+	}
+	displayName := user.DisplayName
+	if displayName == "" {
+		displayName = user.Username
+	}
+	return c.JSON(fiber.Map{"publicKey": fiber.Map{
+		"challenge": challenge,
+		"rp":        fiber.Map{"id": webauthnRPID, "name": webauthnRPName},
+		"user": fiber.Map{
+			"id":          base64.RawURLEncoding.EncodeToString(user.ID[:]),
+			"name":        user.Username,
+			"displayName": displayName,
+		},
+		"pubKeyCredParams": []fiber.Map{
+			{"type": "public-key", "alg": coseES256},
+			{"type": "public-key", "alg": coseEdDSA},
+			{"type": "public-key", "alg": coseRS256},
+		},
+		"timeout":            webauthnTimeout.Milliseconds(),
+		"excludeCredentials": credentialDescriptors(user.Passkeys),
+		"authenticatorSelection": fiber.Map{
+			"residentKey":        "required",
+			"requireResidentKey": true,
+			"userVerification":   "preferred",
+		},
+		"attestation": "none",
+	}})
+}
+
+func finishPasskeyRegistrationHandler(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+	var body struct {
+		Name       string         `json:"name"`
+		Credential credentialJSON `json:"credential"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	name := strings.TrimSpace(body.Name)
+	if len(name) > 64 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Passkey name must be at most 64 characters",
+		})
+	}
+	passkey, err := dbService.finishPasskeyRegistration(userID, name, &body.Credential)
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid passkey response") || strings.Contains(err.Error(), "invalid or expired challenge") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if strings.Contains(err.Error(), "already registered") {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Passkey already registered or passkey limit reached",
+			})
+		}
+		logger.WithError(err).Error("Failed to register passkey")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to register passkey",
+		})
+	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditPasskeyAdded,
+		TargetID: userID,
+		Details:  map[string]interface{}{"credentialId": passkey.CredentialID, "name": passkey.Name},
+	})
+	return c.Status(fiber.StatusCreated).JSON(passkey)
+}
+
+func listPasskeysHandler(c *fiber.Ctx) error {
+	user, err := dbService.getUserByID(c.Locals("user_id").(string))
+	if err != nil {
+		if strings.Contains(err.Error(), "user not found") {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+		}
+		logger.WithError(err).Error("Failed to list passkeys")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list passkeys",
+		})
+	}
+	passkeys := user.Passkeys
+	if passkeys == nil {
+		passkeys = []Passkey{}
+	}
+	return c.JSON(fiber.Map{
+		"passkeys":        passkeys,
+		"passkeyRequired": user.PasskeyRequired,
+	})
+}
+
+func deletePasskeyHandler(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+	user, err := dbService.getUserByID(userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "user not found") {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+		}
+		logger.WithError(err).Error("Failed to load user for passkey removal")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to remove passkey",
+		})
+	}
+	credentialID := c.Params("id")
+	update := bson.M{"$pull": bson.M{"passkeys": bson.M{"credentialId": credentialID}}}
+	if len(user.Passkeys) <= 1 {
+		// Removing the last passkey also turns off the second-factor requirement.
+		update["$unset"] = bson.M{"passkeyRequired": ""}
+	}
+	res, err := dbService.usersCollection.UpdateOne(context.Background(),
+		bson.M{"_id": user.ID, "passkeys.credentialId": credentialID},
+		update,
+	)
+	if err != nil {
+		logger.WithError(err).Error("Failed to remove passkey")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to remove passkey",
+		})
+	}
+	if res.MatchedCount == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Passkey not found"})
+	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditPasskeyRemoved,
+		TargetID: userID,
+		Details:  map[string]interface{}{"credentialId": credentialID},
+	})
+	return c.JSON(fiber.Map{"message": "Passkey removed"})
+}
+
+func updatePasskeySettingsHandler(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+	var body struct {
+		PasskeyRequired *bool `json:"passkeyRequired"`
+	}
+	if err := c.BodyParser(&body); err != nil || body.PasskeyRequired == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "passkeyRequired is required",
+		})
+	}
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+	filter := bson.M{"_id": objectID}
+	update := bson.M{"$unset": bson.M{"passkeyRequired": ""}}
+	if *body.PasskeyRequired {
+		filter["passkeys.0"] = bson.M{"$exists": true}
+		update = bson.M{"$set": bson.M{"passkeyRequired": true}}
+	}
+	res, err := dbService.usersCollection.UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		logger.WithError(err).Error("Failed to update passkey settings")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update passkey settings",
+		})
+	}
+	if res.MatchedCount == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Register a passkey before requiring one",
+		})
+	}
+	return c.JSON(fiber.Map{"passkeyRequired": *body.PasskeyRequired})
+}
+
+func beginPasskeyLogin(c *fiber.Ctx) error {
+	var body struct {
+		Username string `json:"username"`
+	}
+	_ = c.BodyParser(&body)
+
+	var passkeys []Passkey
+	if body.Username != "" {
+		var user User
+		err := dbService.usersCollection.FindOne(context.Background(), bson.M{"username": body.Username}).Decode(&user)
+		if err != nil && err != mongo.ErrNoDocuments {
+			logger.WithError(err).Error("Failed to load user for passkey login")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to start passkey login",
+			})
+		}
+		// Unknown users get an empty allow list, same as usernameless login.
+		passkeys = user.Passkeys
+	}
+	challenge, err := dbService.newWebAuthnSession(ceremonyLogin, primitive.NilObjectID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to start passkey login")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start passkey login",
+		})
+	}
+	return c.JSON(fiber.Map{"publicKey": requestOptions(challenge, passkeys, "required")})
+}
+
+func finishPasskeyLogin(c *fiber.Ctx) error {
+	var body struct {
+		Credential credentialJSON `json:"credential"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	user, session, err := dbService.finishPasskeyAssertion(&body.Credential)
+	method := "passkey"
+	if session != nil && session.Ceremony == ceremonyMFA {
+		method = "passkey_second_factor"
+	}
+	if err != nil {
+		event := AuditEvent{
+			Type:    auditLogin,
+			Outcome: auditFailure,
+			Details: map[string]interface{}{"method": method, "reason": err.Error()},
+		}
+		if user != nil {
+			event.TargetID = user.ID.Hex()
+		}
+		dbService.recordAudit(c, event)
+		if strings.Contains(err.Error(), "invalid passkey response") ||
+			strings.Contains(err.Error(), "invalid or expired challenge") ||
+			strings.Contains(err.Error(), "unknown passkey") {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Passkey login failed",
+			})
+		}
+		logger.WithError(err).Error("Failed to verify passkey")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Authentication failed",
+		})
+	}
+	dbService.recordAudit(c, AuditEvent{
+		Type:     auditLogin,
+		ActorID:  user.ID.Hex(),
+		TargetID: user.ID.Hex(),
+		Details:  map[string]interface{}{"method": method},
+	})
+	token, err := generateJWT(user)
+	if err != nil {
+		logger.WithError(err).Error("Failed to generate token")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate authentication token",
+		})
+	}
+	return c.JSON(LoginResponse{
+		Token: token,
+		User:  *user,
+	})
+}
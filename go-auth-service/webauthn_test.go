@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+const testOrigin = "https://app.example"
+
+func setTestWebAuthnConfig(t *testing.T) {
+	t.Helper()
+	rpID, origins := webauthnRPID, webauthnOrigins
+	webauthnRPID = "app.example"
+	webauthnOrigins = []string{testOrigin}
+	t.Cleanup(func() { webauthnRPID, webauthnOrigins = rpID, origins })
+}
+
+// cborHead encodes a CBOR initial byte and argument.
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	}
+	return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+}
+
+func cborInt(v int64) []byte {
+	if v < 0 {
+		return cborHead(1, uint64(-1-v))
+	}
+	return cborHead(0, uint64(v))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, uint64(len(b))), b...)
+}
+
+// cborIntMap encodes a map with integer keys in the given order, as COSE
+// keys are. Values must already be encoded.
+func cborIntMap(pairs ...interface{}) []byte {
+	out := cborHead(5, uint64(len(pairs)/2))
+	for i := 0; i < len(pairs); i += 2 {
+		out = append(out, cborInt(pairs[i].(int64))...)
+		out = append(out, pairs[i+1].([]byte)...)
+	}
+	return out
+}
+
+// testAuthenticator is a software authenticator holding one credential.
+type testAuthenticator struct {
+	credentialID []byte
+	coseKey      []byte
+	sign         func(data []byte) []byte
+}
+
+func newES256Authenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return &testAuthenticator{
+		credentialID: []byte("es256-credential"),
+		coseKey: cborIntMap(
+			int64(1), cborInt(2),
+			int64(3), cborInt(coseES256),
+			int64(-1), cborInt(1),
+			int64(-2), cborBytes(x),
+			int64(-3), cborBytes(y),
+		),
+		sign: func(data []byte) []byte {
+			digest := sha256.Sum256(data)
+			sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sig
+		},
+	}
+}
+
+func newEd25519Authenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{
+		credentialID: []byte("ed25519-credential"),
+		coseKey: cborIntMap(
+			int64(1), cborInt(1),
+			int64(3), cborInt(coseEdDSA),
+			int64(-1), cborInt(6),
+			int64(-2), cborBytes(pub),
+		),
+		sign: func(data []byte) []byte { return ed25519.Sign(priv, data) },
+	}
+}
+
+func (a *testAuthenticator) passkey(signCount uint32) Passkey {
+	return Passkey{
+		CredentialID: base64.RawURLEncoding.EncodeToString(a.credentialID),
+		PublicKey:    a.coseKey,
+		SignCount:    signCount,
+	}
+}
+
+func authData(rpID string, flags byte, signCount uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	out := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(out, signCount)
+}
+
+func clientData(ceremonyType, challenge, origin string) []byte {
+	raw, _ := json.Marshal(collectedClientData{Type: ceremonyType, Challenge: challenge, Origin: origin})
+	return raw
+}
+
+// assertion is what navigator.credentials.get would return.
+type assertion struct {
+	clientData []byte
+	authData   []byte
+	userHandle []byte
+	tamper     func(signature []byte) []byte
+}
+
+func (a *testAuthenticator) assert(as assertion) *credentialJSON {
+	clientDataHash := sha256.Sum256(as.clientData)
+	sig := a.sign(append(append([]byte(nil), as.authData...), clientDataHash[:]...))
+	if as.tamper != nil {
+		sig = as.tamper(sig)
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	cred := &credentialJSON{ID: enc(a.credentialID), RawID: enc(a.credentialID), Type: "public-key"}
+	cred.Response.ClientDataJSON = enc(as.clientData)
+	cred.Response.AuthenticatorData = enc(as.authData)
+	cred.Response.Signature = enc(sig)
+	if as.userHandle != nil {
+		cred.Response.UserHandle = enc(as.userHandle)
+	}
+	return cred
+}
+
+func sessionResponse(mt *mtest.T, session webauthnSession) bson.D {
+	mt.Helper()
+	raw, err := bson.Marshal(session)
+	if err != nil {
+		mt.Fatal(err)
+	}
+	return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.Raw(raw)})
+}
+
+func TestFinishPasskeyAssertion(t *testing.T) {
+	setTestWebAuthnConfig(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	userID := primitive.NewObjectID()
+	const challenge = "test-challenge"
+	present := byte(authDataUserPresent)
+	verified := byte(authDataUserPresent | authDataUserVerified)
+
+	tests := []struct {
+		name          string
+		authenticator func(t *testing.T) *testAuthenticator
+		ceremony      string
+		storedCount   uint32
+		assertion     func(a *testAuthenticator) assertion
+		wantErr       string
+	}{
+		{
+			name:          "ES256 login",
+			authenticator: newES256Authenticator,
+			ceremony:      ceremonyLogin,
+			storedCount:   4,
+			assertion: func(a *testAuthenticator) assertion {
+				return assertion{
+					clientData: clientData("webauthn.get", challenge, testOrigin),
+					authData:   authData("app.example", verified, 5),
+					userHandle: userID[:],
+				}
+			},
+		},
+		{
+			name:          "Ed25519 synced passkey without counter",
+			authenticator: newEd25519Authenticator,
+			ceremony:      ceremonyLogin,
+			assertion: func(a *testAuthenticator) assertion {
+				return assertion{
+					clientData: clientData("webauthn.get", challenge, testOrigin),
+					authData:   authData("app.example", verified, 0),
+				}
+			},
+		},
+		{
+			name:          "second factor without user verification",
+			authenticator: newES256Authenticator,
+			ceremony:      ceremonyMFA,
+			assertion: func(a *testAuthenticator) assertion {
+				return assertion{
+					clientData: clientData("webauthn.get", challenge, testOrigin),
+					authData:   authData("app.example", present, 1),
+				}
+			},
+		},
+		{
+			name:          "passwordless login requires user verification",
+			authenticator: newES256Authenticator,
+			ceremony:      ceremonyLogin,
+			assertion: func(a *testAuthenticator) assertion {
+				return assertion{
+					clientData: clientData("webauthn.get", challenge, testOrigin),
+					authData:   authData("app.example", present, 1),
+				}
+			},
+			wantErr: "user not verified",
+		},
+		{
+			name:          "user not present",
+			authenticator: newES256Authenticator,
+			ceremony:      ceremonyMFA,
+			assertion: func(a *testAuthenticator) assertion {
+				return assertion{
+					clientData: clientData("webauthn.get", challenge, testOrigin),
+					authData:   authData("app.example", 0, 1),
+				}
+			},
+			wantErr: "user not present",
+		},
+		{
+			name:          "tampered signature",
+			authenticator: newEd25519Authenticator,
+			ceremony:      ceremonyLogin,
+			assertion: func(a *testAuthenticator) assertion {
+				return assertion{
+					clientData: clientData("webauthn.get", challenge, testOrigin),
+					authData:   authData("app.example", verified, 1),
+					tamper:     func(sig []byte) []byte { sig[0] ^= 0xff; return sig },
+				}
+			},
+			wantErr: "bad signature",
+		},
+		{
+			name:          "wrong relying party",
+			authenticator: newES256Authenticator,
+			ceremony:      ceremonyLogin,
+			assertion: func(a *testAuthenticator) assertion {
+				return assertion{
+					clientData: clientData("webauthn.get", challenge, testOrigin),
+					authData:   authData("evil.example", verified, 1),
+				}
+			},
+			wantErr: "wrong relying party",
+		},
+		{
+			name:          "signature counter went backwards",
+			authenticator: newES256Authenticator,
+			ceremony:      ceremonyLogin,
+			storedCount:   7,
+			assertion: func(a *testAuthenticator) assertion {
+				return assertion{
+					clientData: clientData("webauthn.get", challenge, testOrigin),
+					authData:   authData("app.example", verified, 7),
+				}
+			},
+			wantErr: "signature counter did not increase",
+		},
+		{
+			name:          "user handle of another account",
+			authenticator: newES256Authenticator,
+			ceremony:      ceremonyMFA,
+			assertion: func(a *testAuthenticator) assertion {
+				other := primitive.NewObjectID()
+				return assertion{
+					clientData: clientData("webauthn.get", challenge, testOrigin),
+					authData:   authData("app.example", verified, 1),
+					userHandle: other[:],
+				}
+			},
+			wantErr: "unknown passkey",
+		},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			db := newMockDatabaseService(mt)
+			a := tt.authenticator(mt.T)
+			user := User{ID: userID, Username: "alice", Passkeys: []Passkey{a.passkey(tt.storedCount)}}
+			session := webauthnSession{Challenge: challenge, Ceremony: tt.ceremony}
+			if tt.ceremony == ceremonyMFA {
+				session.UserID = userID
+			}
+			mt.AddMockResponses(
+				sessionResponse(mt, session),
+				userCursor(mt, user),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			)
+
+			got, _, err := db.finishPasskeyAssertion(a.assert(tt.assertion(a)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					mt.Fatalf("expected %q, got %v", tt.wantErr, err)
+				}
+				for _, e := range mt.GetAllStartedEvents() {
+					if e.CommandName == "update" {
+						mt.Fatalf("a rejected assertion must not update the passkey")
+					}
+				}
+				return
+			}
+			if err != nil {
+				mt.Fatalf("unexpected error: %v", err)
+			}
+			if got.ID != userID {
+				mt.Fatalf("assertion resolved to user %s", got.ID.Hex())
+			}
+			set := sentCommand(mt, "update").Lookup("updates", "0", "u", "$set").Document()
+			wantCount := int64(binary.BigEndian.Uint32(tt.assertion(a).authData[33:37]))
+			if count, _ := set.Lookup("passkeys.$.signCount").AsInt64OK(); count != wantCount {
+				mt.Fatalf("stored sign count %d, want %d", count, wantCount)
+			}
+		})
+	}
+}
+
+func TestFinishPasskeyAssertionClientData(t *testing.T) {
+	setTestWebAuthnConfig(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	for _, tc := range []struct {
+		name       string
+		clientData []byte
+		wantErr    string
+	}{
+		{"registration response", clientData("webauthn.create", "c", testOrigin), "wrong ceremony type"},
+		{"foreign origin", clientData("webauthn.get", "c", "https://evil.example"), "not allowed"},
+		{"not JSON", []byte("{"), "bad clientDataJSON"},
+	} {
+		mt.Run(tc.name, func(mt *mtest.T) {
+			db := newMockDatabaseService(mt)
+			a := newES256Authenticator(mt.T)
+			cred := a.assert(assertion{clientData: tc.clientData, authData: authData("app.example", authDataUserPresent, 1)})
+			_, session, err := db.finishPasskeyAssertion(cred)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				mt.Fatalf("expected %q, got %v", tc.wantErr, err)
+			}
+			if session != nil || len(mt.GetAllStartedEvents()) != 0 {
+				mt.Fatalf("the challenge must not be consumed for a malformed response")
+			}
+		})
+	}
+
+	mt.Run("unknown challenge", func(mt *mtest.T) {
+		db := newMockDatabaseService(mt)
+		a := newES256Authenticator(mt.T)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		cred := a.assert(assertion{
+			clientData: clientData("webauthn.get", "replayed", testOrigin),
+			authData:   authData("app.example", authDataUserPresent|authDataUserVerified, 1),
+		})
+		_, _, err := db.finishPasskeyAssertion(cred)
+		if err == nil || !strings.Contains(err.Error(), "invalid or expired challenge") {
+			mt.Fatalf("expected invalid challenge, got %v", err)
+		}
+	})
+}
+
+func TestParseCOSEKey(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		key     []byte
+		wantErr string
+	}{
+		{"ES256", newES256Authenticator(t).coseKey, ""},
+		{"EdDSA", newEd25519Authenticator(t).coseKey, ""},
+		{"point not on curve", cborIntMap(
+			int64(1), cborInt(2), int64(3), cborInt(coseES256), int64(-1), cborInt(1),
+			int64(-2), cborBytes(make([]byte, 32)), int64(-3), cborBytes(make([]byte, 32)),
+		), "invalid P-256 key"},
+		{"P-384", cborIntMap(int64(1), cborInt(2), int64(3), cborInt(-35), int64(-1), cborInt(2)), "unsupported EC2 key"},
+		{"short RSA modulus", cborIntMap(
+			int64(1), cborInt(3), int64(3), cborInt(coseRS256),
+			int64(-1), cborBytes(make([]byte, 128)), int64(-2), cborBytes([]byte{1, 0, 1}),
+		), "invalid RSA key"},
+		{"symmetric key", cborIntMap(int64(1), cborInt(4)), "unsupported COSE key type"},
+		{"not a map", cborBytes([]byte{1}), "not a map"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := parseCOSEKey(tc.key)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
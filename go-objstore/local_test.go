@@ -0,0 +1,151 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLocal(t *testing.T) (*Local, string) {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "store")
+	s, err := NewLocal(root, "http://media.test/uploads/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, root
+}
+
+func put(t *testing.T, s Storage, key, data string) {
+	t.Helper()
+	if err := s.Put(context.Background(), key, strings.NewReader(data), int64(len(data)), ContentType(key)); err != nil {
+		t.Fatalf("Put %s: %v", key, err)
+	}
+}
+
+func TestLocalPutGet(t *testing.T) {
+	s, _ := newTestLocal(t)
+	ctx := context.Background()
+	put(t, s, "vid/hls/index.m3u8", "#EXTM3U\n")
+	put(t, s, "vid/hls/index.m3u8", "#EXTM3U\n#EXT-X-ENDLIST\n") // replaces
+
+	r, info, err := s.Get(ctx, "vid/hls/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "#EXTM3U\n#EXT-X-ENDLIST\n" {
+		t.Fatalf("got %q", data)
+	}
+	if info.Size != int64(len(data)) || info.ContentType != "application/vnd.apple.mpegurl" || info.ETag == "" {
+		t.Fatalf("unexpected info %+v", info)
+	}
+
+	if _, _, err := s.Get(ctx, "vid/missing.ts"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing key: %v, want ErrNotFound", err)
+	}
+	if _, err := s.Stat(ctx, "vid/hls"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Stat of a directory: %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalGetRange(t *testing.T) {
+	s, _ := newTestLocal(t)
+	put(t, s, "clip.mp4", "0123456789")
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{3, 4, "3456"},
+		{7, -1, "789"},
+		{8, 10, "89"},
+	}
+	for _, tt := range tests {
+		r, _, err := s.GetRange(context.Background(), "clip.mp4", tt.offset, tt.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if string(data) != tt.want {
+			t.Errorf("GetRange(%d, %d) = %q, want %q", tt.offset, tt.length, data, tt.want)
+		}
+	}
+}
+
+func TestLocalList(t *testing.T) {
+	s, root := newTestLocal(t)
+	put(t, s, "b/hls/index1.ts", "1")
+	put(t, s, "b/hls/index0.ts", "0")
+	put(t, s, "b/original.mp4", "o")
+	put(t, s, "bb/original.mp4", "o")
+	// Leftovers of an interrupted Put are not objects.
+	if err := os.WriteFile(filepath.Join(root, "b", ".put-123"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := s.List(context.Background(), "b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	if got, want := strings.Join(keys, ","), "b/hls/index0.ts,b/hls/index1.ts,b/original.mp4"; got != want {
+		t.Fatalf("List = %s, want %s", got, want)
+	}
+}
+
+func TestLocalDelete(t *testing.T) {
+	s, root := newTestLocal(t)
+	ctx := context.Background()
+	put(t, s, "vid/hls/index0.ts", "0")
+	put(t, s, "vid/original.mp4", "o")
+
+	if err := DeletePrefix(ctx, s, "vid/hls/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "vid", "hls")); !os.IsNotExist(err) {
+		t.Fatalf("empty directory left behind: %v", err)
+	}
+	if err := s.Delete(ctx, "vid/original.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Fatalf("root removed: %v", err)
+	}
+	if err := s.Delete(ctx, "vid/original.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Delete: %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalRejectsEscapingKeys(t *testing.T) {
+	s, _ := newTestLocal(t)
+	ctx := context.Background()
+	for _, key := range []string{"../outside", "/etc/passwd", "a/../../b", `a\b`, "a//b", ""} {
+		if err := s.Put(ctx, key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+		if _, _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) = %v, want ErrNotFound", key, err)
+		}
+	}
+}
+
+func TestLocalPresignGet(t *testing.T) {
+	s, _ := newTestLocal(t)
+	got, err := s.PresignGet(context.Background(), "vid/my clip.mp4", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://media.test/uploads/vid/my%20clip.mp4"; got != want {
+		t.Fatalf("PresignGet = %s, want %s", got, want)
+	}
+}
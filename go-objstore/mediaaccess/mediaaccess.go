@@ -0,0 +1,137 @@
+// Package mediaaccess decides which stored files of a video may be served,
+// for the upload service's /uploads and the playback service.
+//
+// Keys are laid out by the upload service: everything of a video under
+// "<id>/", where the ID is 16 base64url characters. Anything else is a
+// legacy filename key from before the video registry and is served as
+// before. A video's files are served only while the registry has it and it
+// is not deleted: a deleted video stays restorable, so its files are still
+// stored, but it cannot be played. A private video's files also need a
+// media token for it (see videotoken), which its owner gets from the upload
+// service and passes as ?token= (a <video> element cannot send headers).
+//
+// Players fetch a segment every few seconds, so lookups are cached
+// briefly; a deletion or a change of visibility takes up to CacheTTL to
+// apply to playback.
+package mediaaccess
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"stream-flow/objstore/videotoken"
+)
+
+const (
+	// VideoIDLength is the length of the IDs the upload service generates.
+	VideoIDLength = 16
+
+	CacheTTL  = 30 * time.Second
+	cacheSize = 10000
+)
+
+// State is what the registry says about a video.
+type State struct {
+	Live    bool `json:"live"` // recorded and not deleted
+	Private bool `json:"private"`
+}
+
+// Lookup reads the State of a video from the registry.
+type Lookup func(ctx context.Context, videoID string) (State, error)
+
+// Checker answers whether files may be served, caching lookups.
+type Checker struct {
+	lookup Lookup
+	key    videotoken.Key
+
+	mu    sync.Mutex
+	cache map[string]cachedState
+}
+
+type cachedState struct {
+	State
+	expires time.Time
+}
+
+// New returns a Checker reading the registry with lookup and checking
+// media tokens with key.
+func New(lookup Lookup, key videotoken.Key) *Checker {
+	return &Checker{lookup: lookup, key: key, cache: map[string]cachedState{}}
+}
+
+// Allowed reports whether the file at key may be served to a request that
+// came with token.
+func (ch *Checker) Allowed(ctx context.Context, key, token string) (bool, error) {
+	id := VideoIDOf(key)
+	if id == "" {
+		return true, nil
+	}
+	state, err := ch.State(ctx, id)
+	if err != nil || !state.Live {
+		return false, err
+	}
+	if state.Private {
+		_, ok := ch.key.Verify(token, id, videotoken.ForMedia)
+		return ok, nil
+	}
+	return true, nil
+}
+
+// State returns the State of video id, looking it up at most once per
+// CacheTTL.
+func (ch *Checker) State(ctx context.Context, id string) (State, error) {
+	now := time.Now()
+	ch.mu.Lock()
+	if cached, ok := ch.cache[id]; ok && now.Before(cached.expires) {
+		ch.mu.Unlock()
+		return cached.State, nil
+	}
+	ch.mu.Unlock()
+
+	state, err := ch.lookup(ctx, id)
+	if err != nil {
+		return State{}, err
+	}
+
+	ch.mu.Lock()
+	if len(ch.cache) >= cacheSize {
+		for k, v := range ch.cache {
+			if now.After(v.expires) {
+				delete(ch.cache, k)
+			}
+		}
+		if len(ch.cache) >= cacheSize {
+			ch.cache = map[string]cachedState{}
+		}
+	}
+	ch.cache[id] = cachedState{State: state, expires: now.Add(CacheTTL)}
+	ch.mu.Unlock()
+	return state, nil
+}
+
+// VideoIDOf returns the video a storage key belongs to, or "" for a legacy
+// filename key.
+func VideoIDOf(key string) string {
+	id, _, _ := strings.Cut(key, "/")
+	if IsVideoID(id) {
+		return id
+	}
+	return ""
+}
+
+// IsVideoID reports whether id has the shape of a generated video ID.
+func IsVideoID(id string) bool {
+	if len(id) != VideoIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
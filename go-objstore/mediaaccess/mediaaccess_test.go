@@ -0,0 +1,74 @@
+package mediaaccess
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"stream-flow/objstore/videotoken"
+)
+
+func TestVideoIDOf(t *testing.T) {
+	tests := []struct{ key, want string }{
+		{"AbCdEfGhIjKl-_12/hls/index.m3u8", "AbCdEfGhIjKl-_12"},
+		{"AbCdEfGhIjKl-_12", "AbCdEfGhIjKl-_12"},
+		{"clip.mp4", ""},
+		{"clip_hls/index0.ts", ""},
+		{"AbCdEfGhIjKl.mp4/x", ""}, // right length, not base64url
+	}
+	for _, tt := range tests {
+		if got := VideoIDOf(tt.key); got != tt.want {
+			t.Errorf("VideoIDOf(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	const (
+		public  = "publicvideo00000"
+		private = "privatevideo0000"
+		deleted = "deletedvideo0000"
+		broken  = "brokenvideo00000"
+	)
+	key := videotoken.Key("secret")
+	lookups := 0
+	ch := New(func(ctx context.Context, id string) (State, error) {
+		lookups++
+		switch id {
+		case public:
+			return State{Live: true}, nil
+		case private:
+			return State{Live: true, Private: true}, nil
+		case broken:
+			return State{}, errors.New("registry down")
+		}
+		return State{}, nil
+	}, key)
+	token := key.Sign(videotoken.Claims{VideoID: private, Purpose: videotoken.ForMedia, Expires: time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name, key, token string
+		want, wantErr    bool
+	}{
+		{"legacy", "clip.mp4", "", true, false},
+		{"public", public + "/hls/index.m3u8", "", true, false},
+		{"private without token", private + "/original.mp4", "", false, false},
+		{"private with token", private + "/original.mp4", token, true, false},
+		{"token of another video", private + "/original.mp4", key.Sign(videotoken.Claims{VideoID: public, Purpose: videotoken.ForMedia, Expires: time.Now().Add(time.Hour).Unix()}), false, false},
+		{"deleted", deleted + "/original.mp4", "", false, false},
+		{"lookup fails", broken + "/original.mp4", "", false, true},
+	}
+	for _, tt := range tests {
+		got, err := ch.Allowed(context.Background(), tt.key, tt.token)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: Allowed = %v, %v; want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	before := lookups
+	ch.Allowed(context.Background(), public+"/x", "")
+	if lookups != before {
+		t.Errorf("cached state was looked up again")
+	}
+}
@@ -0,0 +1,138 @@
+// Package objstore is the object storage shared by the upload and playback
+// services. Videos and HLS output are stored through Storage so the services
+// can run on several nodes against a shared S3-compatible bucket. Keys are
+// slash separated paths such as "clip.mp4" or "clip_hls/index.m3u8".
+//
+// STORAGE_BACKEND selects the implementation:
+//
+//	local (default)  files under STORAGE_DIR
+//	s3               S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_ACCESS_KEY,
+//	                 S3_SECRET_KEY, S3_PATH_STYLE (default true)
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned for keys that do not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+	ETag         string
+}
+
+// Storage is implemented by Local and S3.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	// GetRange reads length bytes starting at offset; length < 0 reads to
+	// the end of the object.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// PresignGet returns a URL that allows anyone to GET key until expiry.
+	PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// FromEnv creates the storage selected by STORAGE_BACKEND. Local storage
+// keeps files under STORAGE_DIR (defaultDir if unset), served by the caller
+// at publicBaseURL.
+func FromEnv(defaultDir, publicBaseURL string) (Storage, error) {
+	switch backend := getEnv("STORAGE_BACKEND", "local"); backend {
+	case "local":
+		return NewLocal(getEnv("STORAGE_DIR", defaultDir), publicBaseURL)
+	case "s3":
+		pathStyle, _ := strconv.ParseBool(getEnv("S3_PATH_STYLE", "true"))
+		return NewS3(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    getEnv("S3_REGION", "us-east-1"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PathStyle: pathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	log.Printf("INFO: %s not set, defaulting to %s", key, fallback)
+	return fallback
+}
+
+// ContentType guesses the content type of key from its extension.
+func ContentType(key string) string {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".m4s":
+		return "video/iso.segment"
+	}
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// ValidKey rejects keys that could escape the storage root.
+func ValidKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// DeletePrefix removes every object under prefix (e.g. a video's HLS dir).
+func DeletePrefix(ctx context.Context, s Storage, prefix string) error {
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := s.Delete(ctx, obj.Key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutFile uploads a local file.
+func PutFile(ctx context.Context, s Storage, key, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, key, f, info.Size(), ContentType(key))
+}
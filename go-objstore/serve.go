@@ -0,0 +1,169 @@
+package objstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Serve streams key from s to the client with support for single byte
+// ranges, which video players use for seeking.
+func Serve(c *fiber.Ctx, s Storage, key string) error {
+	ctx := c.Context()
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).SendString("Not Found")
+		}
+		log.Printf("❌ Failed to stat %s: %v\n", key, err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	c.Set(fiber.HeaderContentType, info.ContentType)
+	if info.ETag != "" {
+		c.Set(fiber.HeaderETag, info.ETag)
+	}
+	if !info.LastModified.IsZero() {
+		c.Set(fiber.HeaderLastModified, info.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	offset, length := int64(0), info.Size
+	status := fiber.StatusOK
+	if rangeHeader := c.Get(fiber.HeaderRange); rangeHeader != "" {
+		start, end, ok := parseByteRange(rangeHeader, info.Size)
+		if !ok {
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", info.Size))
+			return c.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+		}
+		offset, length = start, end-start+1
+		status = fiber.StatusPartialContent
+		c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, end, info.Size))
+	}
+	if c.Method() == fiber.MethodHead {
+		c.Set(fiber.HeaderContentLength, strconv.FormatInt(length, 10))
+		return c.SendStatus(status)
+	}
+
+	body, _, err := s.GetRange(ctx, key, offset, length)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).SendString("Not Found")
+		}
+		log.Printf("❌ Failed to read %s: %v\n", key, err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	c.Status(status)
+	return c.SendStream(body, int(length))
+}
+
+// maxPlaylistSize bounds the playlists ServeWithQuery reads into memory;
+// real ones are a few kilobytes.
+const maxPlaylistSize = 1 << 20
+
+// ServeWithQuery is Serve for clients that authorize with a query string
+// (such as "token=..."). Players resolve the URIs in an HLS playlist
+// without the playlist's own query, so playlists are rewritten to carry it
+// on every URI. Other files are served as is.
+func ServeWithQuery(c *fiber.Ctx, s Storage, key, query string) error {
+	if query == "" || !strings.HasSuffix(key, ".m3u8") {
+		return Serve(c, s, key)
+	}
+	body, info, err := s.Get(c.Context(), key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).SendString("Not Found")
+		}
+		log.Printf("❌ Failed to read %s: %v\n", key, err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	defer body.Close()
+	playlist, err := io.ReadAll(io.LimitReader(body, maxPlaylistSize))
+	if err != nil {
+		log.Printf("❌ Failed to read %s: %v\n", key, err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	c.Set(fiber.HeaderContentType, info.ContentType)
+	// The rewritten playlist is only good for this query.
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	return c.Send(AddPlaylistQuery(playlist, query))
+}
+
+// AddPlaylistQuery appends query to every URI in an HLS playlist: the lines
+// that are not tags and the URI attributes of tags (keys, maps, media).
+func AddPlaylistQuery(playlist []byte, query string) []byte {
+	withQuery := func(uri []byte) []byte {
+		sep := "?"
+		if bytes.IndexByte(uri, '?') >= 0 {
+			sep = "&"
+		}
+		return append(append(bytes.Clone(uri), sep...), query...)
+	}
+	lines := bytes.Split(playlist, []byte("\n"))
+	for i, line := range lines {
+		trimmed := bytes.TrimRight(line, "\r")
+		switch {
+		case len(bytes.TrimSpace(trimmed)) == 0:
+		case !bytes.HasPrefix(trimmed, []byte("#")):
+			lines[i] = append(withQuery(trimmed), line[len(trimmed):]...)
+		default:
+			start := bytes.Index(line, []byte(`URI="`))
+			if start < 0 {
+				continue
+			}
+			start += len(`URI="`)
+			end := bytes.IndexByte(line[start:], '"')
+			if end < 0 {
+				continue
+			}
+			end += start
+			rewritten := append(bytes.Clone(line[:start]), withQuery(line[start:end])...)
+			lines[i] = append(rewritten, line[end:]...)
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// parseByteRange parses a single "bytes=start-end" range (including the
+// "start-" and "-suffix" forms) against an object of the given size.
+func parseByteRange(header string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if startStr == "" {
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
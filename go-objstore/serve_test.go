@@ -0,0 +1,35 @@
+package objstore
+
+import "testing"
+
+func TestAddPlaylistQuery(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			"master",
+			"#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\n360p/index.m3u8\n",
+			"#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\n360p/index.m3u8?token=t\n",
+		},
+		{
+			"media with CRLF",
+			"#EXTM3U\r\n#EXTINF:6.0,\r\nindex0.ts\r\n#EXT-X-ENDLIST\r\n",
+			"#EXTM3U\r\n#EXTINF:6.0,\r\nindex0.ts?token=t\r\n#EXT-X-ENDLIST\r\n",
+		},
+		{
+			"URI attributes",
+			`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"` + "\n" + `#EXT-X-KEY:METHOD=NONE`,
+			`#EXT-X-MAP:URI="init.mp4?token=t",BYTERANGE="720@0"` + "\n" + `#EXT-X-KEY:METHOD=NONE`,
+		},
+		{
+			"URI with a query",
+			"seg.ts?part=1\n",
+			"seg.ts?part=1&token=t\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(AddPlaylistQuery([]byte(tt.in), "token=t")); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
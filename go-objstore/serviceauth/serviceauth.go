@@ -0,0 +1,75 @@
+// Package serviceauth authenticates calls between StreamFlow services. Each
+// service has a client ID and secret, which it sends with HTTP Basic. A
+// service accepting such calls is configured with the pairs it trusts as
+// "auth-service:secret,upload-service:secret".
+package serviceauth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Credentials maps the client IDs a service trusts to their secrets.
+type Credentials map[string]string
+
+// Parse reads a comma separated list of "id:secret" pairs. Malformed pairs
+// are skipped, so an empty result means no caller will be accepted.
+func Parse(list string) Credentials {
+	creds := Credentials{}
+	for _, pair := range strings.Split(list, ",") {
+		if id, secret, ok := ParseClient(strings.TrimSpace(pair)); ok {
+			creds[id] = secret
+		}
+	}
+	return creds
+}
+
+// ParseClient splits the "id:secret" a service presents to the others.
+func ParseClient(s string) (id, secret string, ok bool) {
+	id, secret, ok = strings.Cut(s, ":")
+	if !ok || id == "" || secret == "" {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+// BasicAuth returns the HTTP Basic credentials sent with c.
+func BasicAuth(c *fiber.Ctx) (id, secret string, ok bool) {
+	scheme, encoded, found := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// Caller returns the client ID c authenticates as, or "" if it does not
+// present credentials listed in creds.
+func (creds Credentials) Caller(c *fiber.Ctx) string {
+	id, secret, ok := BasicAuth(c)
+	known, found := creds[id]
+	if !ok || !found || subtle.ConstantTimeCompare([]byte(known), []byte(secret)) != 1 {
+		return ""
+	}
+	return id
+}
+
+// Require lets through only callers listed in creds.
+func (creds Credentials) Require(c *fiber.Ctx) error {
+	if creds.Caller(c) == "" {
+		return Challenge(c, "Service credentials required")
+	}
+	return c.Next()
+}
+
+// Challenge answers 401 asking for service credentials.
+func Challenge(c *fiber.Ctx, message string) error {
+	c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="streamflow-internal"`)
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": message})
+}
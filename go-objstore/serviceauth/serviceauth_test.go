@@ -0,0 +1,54 @@
+package serviceauth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestParse(t *testing.T) {
+	creds := Parse(" auth-service:a , broken,:nosecret,noid:, upload-service:b:c")
+	want := Credentials{"auth-service": "a", "upload-service": "b:c"}
+	if len(creds) != len(want) {
+		t.Fatalf("Parse = %v, want %v", creds, want)
+	}
+	for id, secret := range want {
+		if creds[id] != secret {
+			t.Errorf("Parse[%q] = %q, want %q", id, creds[id], secret)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	app := fiber.New()
+	app.Get("/", Credentials{"auth-service": "secret"}.Require, func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	tests := []struct {
+		name, user, pass string
+		bearer           bool
+		want             int
+	}{
+		{"trusted", "auth-service", "secret", false, fiber.StatusNoContent},
+		{"wrong secret", "auth-service", "guess", false, fiber.StatusUnauthorized},
+		{"unknown service", "social-service", "secret", false, fiber.StatusUnauthorized},
+		{"bearer token", "", "", true, fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.bearer {
+			req.Header.Set("Authorization", "Bearer token")
+		} else {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Package videotoken signs and checks the tokens that let a user use one
+// video for a while: follow its processing progress, or play it while it is
+// private. The upload service issues them and both it and the playback
+// service check them, so both are given the same STREAM_TOKEN_SECRET.
+//
+// A token is the base64url JSON of its Claims, a ".", and the base64url
+// HMAC-SHA256 of that JSON.
+package videotoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// What a token may be used for.
+const (
+	ForEvents = "events"
+	ForMedia  = "media"
+)
+
+// Claims is what a token vouches for: that UserID may use VideoID for
+// Purpose until Expires.
+type Claims struct {
+	VideoID string `json:"v"`
+	UserID  string `json:"u"`
+	Purpose string `json:"p"`
+	Expires int64  `json:"e"`
+}
+
+// Key signs and checks tokens. An empty Key accepts no token.
+type Key []byte
+
+// Sign returns the token for claims.
+func (k Key) Sign(claims Claims) string {
+	payload, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(k.mac(payload))
+}
+
+// Verify returns the claims of token if it is signed with k, has not
+// expired and is for videoID and purpose.
+func (k Key) Verify(token, videoID, purpose string) (*Claims, bool) {
+	encPayload, encSig, ok := strings.Cut(token, ".")
+	if !ok || len(k) == 0 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil || !hmac.Equal(sig, k.mac(payload)) {
+		return nil, false
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, false
+	}
+	if claims.VideoID != videoID || claims.Purpose != purpose || time.Now().Unix() > claims.Expires {
+		return nil, false
+	}
+	return &claims, true
+}
+
+func (k Key) mac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, k)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
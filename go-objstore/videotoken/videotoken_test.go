@@ -0,0 +1,37 @@
+package videotoken
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	key := Key("secret")
+	valid := Claims{VideoID: "v1", UserID: "u1", Purpose: ForMedia, Expires: time.Now().Add(time.Hour).Unix()}
+	token := key.Sign(valid)
+
+	claims, ok := key.Verify(token, "v1", ForMedia)
+	if !ok || *claims != valid {
+		t.Fatalf("Verify = %+v, %v; want %+v, true", claims, ok, valid)
+	}
+
+	expired := valid
+	expired.Expires = time.Now().Add(-time.Minute).Unix()
+	tests := []struct {
+		name, token, videoID, purpose string
+		key                           Key
+	}{
+		{"other video", token, "v2", ForMedia, key},
+		{"other purpose", token, "v1", ForEvents, key},
+		{"other key", token, "v1", ForMedia, Key("other")},
+		{"empty key", Key("").Sign(valid), "v1", ForMedia, Key("")},
+		{"expired", key.Sign(expired), "v1", ForMedia, key},
+		{"tampered", token[:len(token)-2] + "AA", "v1", ForMedia, key},
+		{"malformed", "nodot", "v1", ForMedia, key},
+	}
+	for _, tt := range tests {
+		if _, ok := tt.key.Verify(tt.token, tt.videoID, tt.purpose); ok {
+			t.Errorf("%s: token accepted", tt.name)
+		}
+	}
+}
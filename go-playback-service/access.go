@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"stream-flow/objstore/mediaaccess"
+)
+
+// --- Which videos can be played ---
+// Files are served by the rules of mediaaccess. The state of a video comes
+// from the upload service, which owns the video registry, through
+// GET /internal/videos/:id/access with this service's SERVICE_CREDENTIALS
+// ("playback-service:secret"). Media tokens of private videos are checked
+// with the STREAM_TOKEN_SECRET both services share.
+
+var (
+	uploadServiceURL    string
+	serviceClientID     string
+	serviceClientSecret string
+	serviceClient       = &http.Client{Timeout: 5 * time.Second}
+)
+
+// fetchAccess asks the upload service whether video id is live and private.
+func fetchAccess(ctx context.Context, id string) (mediaaccess.State, error) {
+	target := fmt.Sprintf("%s/internal/videos/%s/access", uploadServiceURL, url.PathEscape(id))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return mediaaccess.State{}, err
+	}
+	req.SetBasicAuth(serviceClientID, serviceClientSecret)
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return mediaaccess.State{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return mediaaccess.State{}, fmt.Errorf("upload service returned %d: %s", resp.StatusCode, msg)
+	}
+	var state mediaaccess.State
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	return state, err
+}
@@ -3,10 +3,15 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"stream-flow/objstore"
+	"stream-flow/objstore/mediaaccess"
+	"stream-flow/objstore/serviceauth"
+	"stream-flow/objstore/videotoken"
 )
 
 // Helper function to read Env Vars
@@ -28,20 +33,60 @@ func main() {
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     corsOrigins,
 		AllowMethods:     "GET,OPTIONS", // Playback is GET-only
-		AllowHeaders:     "Origin, Content-Type, Accept",
+		AllowHeaders:     "Origin, Content-Type, Accept, Range",
+		ExposeHeaders:    "Content-Range, Content-Length, Accept-Ranges",
 		AllowCredentials: true,
 	}))
 
 	// --- THIS IS THE CRITICAL LOGIC ---
-	// This is the path *inside the container* where the shared volume will be.
-	uploadDir := "/app/uploads"
+	// Everything is read through objstore, like the upload service writes
+	// it: the shared volume by default, or the same S3 bucket.
+	storage, err := objstore.FromEnv("/app/uploads", getEnv("PUBLIC_URL", "http://localhost:8083")+"/uploads")
+	if err != nil {
+		log.Fatalf("Storage setup failed: %v", err)
+	}
+
+	// Ask the upload service which videos may be played, and check media
+	// tokens with the key it signs them with
+	uploadServiceURL = getEnv("UPLOAD_SERVICE_URL", "http://go-upload-service:3001")
+	var ok bool
+	if serviceClientID, serviceClientSecret, ok = serviceauth.ParseClient(os.Getenv("SERVICE_CREDENTIALS")); !ok {
+		log.Println("WARN: SERVICE_CREDENTIALS not set, only legacy videos will play")
+	}
+	videoTokenKey := videotoken.Key(os.Getenv("STREAM_TOKEN_SECRET"))
+	if len(videoTokenKey) == 0 {
+		log.Println("WARN: STREAM_TOKEN_SECRET not set, private videos will not play")
+	}
+	access := mediaaccess.New(fetchAccess, videoTokenKey)
+
+	serve := func(c *fiber.Ctx) error {
+		key, err := url.PathUnescape(c.Params("*"))
+		if err != nil || !objstore.ValidKey(key) {
+			return c.Status(fiber.StatusNotFound).SendString("Not Found")
+		}
+		token := c.Query("token")
+		allowed, err := access.Allowed(c.Context(), key, token)
+		if err != nil {
+			log.Printf("Failed to look up the video of %s: %v", key, err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Failed to load video")
+		}
+		if !allowed {
+			return c.Status(fiber.StatusNotFound).SendString("Not Found")
+		}
+		// Playlists of private videos pass the token on to their segments.
+		var query string
+		if token != "" {
+			query = "token=" + url.QueryEscape(token)
+		}
+		return objstore.ServeWithQuery(c, storage, key, query)
+	}
 
 	// This route serves the master playlist (e.g., /hls/my-video_hls/index.m3u8)
 	// and all the video segments (e.g., /hls/my-video_hls/index0.ts)
-	app.Static("/hls", uploadDir)
+	app.Get("/hls/*", serve)
 
 	// This route serves the original MP4 file (e.g., /uploads/test.mp4)
-	app.Static("/uploads", uploadDir)
+	app.Get("/uploads/*", serve)
 	// --- END OF CRITICAL LOGIC ---
 
 	app.Get("/health", func(c *fiber.Ctx) error {
@@ -60,11 +105,6 @@ func main() {
 	port := 8083
 	fmt.Printf("🚀 Playback service running at http://98.70.25.253:%d\n", port)
 
-	// Ensure the directory exists (it will be the mount point for the volume)
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		log.Printf("Warning: Could not create %s: %v", uploadDir, err)
-	}
-
 	log.Fatal(app.Listen(fmt.Sprintf(":%d", port)))
 
 }
@@ -5,6 +5,7 @@ go 1.25.1
 require (
 	github.com/elastic/go-elasticsearch/v8 v8.19.0
 	github.com/gofiber/fiber/v2 v2.52.9
+	stream-flow/objstore v0.0.0-00010101000000-000000000000
 )
 
 require (
@@ -26,3 +27,5 @@ require (
 	go.opentelemetry.io/otel/trace v1.28.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 )
+
+replace stream-flow/objstore => ../go-objstore
@@ -8,24 +8,61 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"stream-flow/objstore/serviceauth"
 )
 
 type Video struct {
-	ID          string `json:"id"`
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	Author      string `json:"author"`
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Author      string     `json:"author"`
+	OwnerID     string     `json:"ownerId,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Media       *MediaInfo `json:"media,omitempty"`
+}
+
+// MediaInfo is what the upload service found when probing the file
+type MediaInfo struct {
+	Container     string  `json:"container"`
+	Duration      float64 `json:"duration"`
+	Bitrate       int64   `json:"bitrate"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	FrameRate     float64 `json:"frameRate"`
+	Rotation      int     `json:"rotation"`
+	VideoCodec    string  `json:"videoCodec"`
+	AudioCodec    string  `json:"audioCodec,omitempty"`
+	AudioChannels int     `json:"audioChannels,omitempty"`
+	HasAudio      bool    `json:"hasAudio"`
 }
 
 var es *elasticsearch.Client
 
 const indexName = "videos"
 
+// Other services authenticate with HTTP Basic credentials listed in
+// SERVICE_CREDENTIALS ("auth-service:secret,upload-service:secret").
+var serviceCredentials serviceauth.Credentials
+
+func loadServiceCredentials() {
+	serviceCredentials = serviceauth.Parse(os.Getenv("SERVICE_CREDENTIALS"))
+	if len(serviceCredentials) == 0 {
+		log.Println("SERVICE_CREDENTIALS not set, service-only endpoints will reject every request")
+	}
+}
+
+// requireService lets through only other services presenting credentials
+// from SERVICE_CREDENTIALS.
+func requireService(c *fiber.Ctx) error {
+	return serviceCredentials.Require(c)
+}
+
 func main() {
 	var err error
 
@@ -49,6 +86,20 @@ func main() {
 		log.Fatalf("Error creating ES client: %s", err)
 	}
 
+	// Elasticsearch may still be starting
+	for i := 0; i < 10; i++ {
+		if err = ensureIndex(); err == nil {
+			break
+		}
+		log.Printf("Elasticsearch not ready yet (attempt %d/10), retrying in 3s: %s", i+1, err)
+		time.Sleep(3 * time.Second)
+	}
+	if err != nil {
+		log.Fatalf("Error creating index %s: %s", indexName, err)
+	}
+
+	loadServiceCredentials()
+
 	// ✅ Fiber app
 	app := fiber.New()
 
@@ -60,10 +111,10 @@ func main() {
 	}))
 
 	// ✅ ROUTES
-	app.Post("/create-indexes", createIndexesHandler)
-	app.Post("/create-index-with-mapping", createIndexWithMappingHandler)
-	app.Post("/index", indexHandler)
-	app.Post("/bulk", bulkIndexHandler)
+	app.Post("/events", requireService, eventsHandler)
+	app.Get("/index/:id", getDocumentHandler)
+	app.Delete("/index/:id", requireService, deleteHandler)
+	app.Post("/delete-by-owner", requireService, deleteByOwnerHandler)
 	app.Get("/exact-word-search", searchHandler)
 	app.Get("/fuzzy-search", fuzzySearchHandler)
 	app.Get("/sentence-search", sentenceSearchHandler)
@@ -72,7 +123,9 @@ func main() {
 	log.Fatal(app.Listen(":8080"))
 }
 
-func createIndexWithMappingHandler(c *fiber.Ctx) error {
+// ensureIndex creates the videos index with its mapping unless it already
+// exists. Documents are only written by eventsHandler.
+func ensureIndex() error {
 	mapping := `{
 	  "settings": {
 	    "analysis": {
@@ -88,89 +141,210 @@ func createIndexWithMappingHandler(c *fiber.Ctx) error {
 	    "properties": {
 	      "title": { "type": "text", "analyzer": "english_text" },
 	      "description": { "type": "text", "analyzer": "english_text" },
-	      "author": { "type": "keyword" }
+	      "author": { "type": "keyword" },
+	      "ownerId": { "type": "keyword" },
+	      "tags": { "type": "keyword" },
+	      "media": {
+	        "properties": {
+	          "container": { "type": "keyword" },
+	          "duration": { "type": "float" },
+	          "bitrate": { "type": "long" },
+	          "width": { "type": "integer" },
+	          "height": { "type": "integer" },
+	          "frameRate": { "type": "float" },
+	          "rotation": { "type": "integer" },
+	          "videoCodec": { "type": "keyword" },
+	          "audioCodec": { "type": "keyword" },
+	          "audioChannels": { "type": "integer" },
+	          "hasAudio": { "type": "boolean" }
+	        }
+	      }
 	    }
 	  }
 	}`
 
-	// delete old index if exists
-	es.Indices.Delete([]string{indexName})
+	res, err := es.Indices.Exists([]string{indexName})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == 200 {
+		return nil
+	}
 
-	res, err := es.Indices.Create(indexName, es.Indices.Create.WithBody(strings.NewReader(mapping)))
+	res, err = es.Indices.Create(indexName, es.Indices.Create.WithBody(strings.NewReader(mapping)))
 	if err != nil {
-		return c.Status(500).SendString("Error creating index: " + err.Error())
+		return err
 	}
 	defer res.Body.Close()
-
-	return c.SendString("Index created with mapping.")
+	// 400 with resource_already_exists_exception: another replica won the race
+	if res.IsError() && !strings.Contains(res.String(), "resource_already_exists_exception") {
+		return fmt.Errorf("creating index: %s", res.String())
+	}
+	return nil
 }
 
-type CreateIndexesRequest struct {
-	Indexes []string `json:"indexes"`
+// VideoEvent is a change to a video, delivered by the upload service's
+// outbox at least once. Seq grows with every event of a video and is used
+// as the document's external version, so duplicates and stale events are
+// rejected by Elasticsearch itself.
+type VideoEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	VideoID string `json:"videoId"`
+	Seq     int64  `json:"seq"`
+	Data    struct {
+		Title       string     `json:"title"`
+		Description string     `json:"description"`
+		Author      string     `json:"author"`
+		OwnerID     string     `json:"ownerId"`
+		Tags        []string   `json:"tags"`
+		Visibility  string     `json:"visibility"`
+		Media       *MediaInfo `json:"media"`
+		DeletedAt   *string    `json:"deletedAt"`
+	} `json:"data"`
 }
 
-func createIndexesHandler(c *fiber.Ctx) error {
-	var reqPayload CreateIndexesRequest
-	if err := c.BodyParser(&reqPayload); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON"})
+func eventsHandler(c *fiber.Ctx) error {
+	var event VideoEvent
+	if err := c.BodyParser(&event); err != nil || event.VideoID == "" || event.Seq <= 0 {
+		return c.Status(400).SendString("Invalid event")
 	}
 
-	results := make(map[string]string)
-
-	for _, idx := range reqPayload.Indexes {
-		res, err := es.Indices.Create(idx)
-		if err != nil {
-			results[idx] = "Error: " + err.Error()
-			continue
-		}
-		defer res.Body.Close()
+	// Only public videos that are not deleted are searchable.
+	version := int(event.Seq)
+	var res *esapi.Response
+	var err error
+	if event.Type == "video.purged" || event.Data.DeletedAt != nil ||
+		(event.Data.Visibility != "" && event.Data.Visibility != "public") {
+		res, err = esapi.DeleteRequest{
+			Index:       indexName,
+			DocumentID:  event.VideoID,
+			Version:     &version,
+			VersionType: "external",
+			Refresh:     "true",
+		}.Do(context.Background(), es)
+	} else {
+		videoJSON, _ := json.Marshal(Video{
+			ID:          event.VideoID,
+			Title:       event.Data.Title,
+			Description: event.Data.Description,
+			Author:      event.Data.Author,
+			OwnerID:     event.Data.OwnerID,
+			Tags:        event.Data.Tags,
+			Media:       event.Data.Media,
+		})
+		res, err = esapi.IndexRequest{
+			Index:       indexName,
+			DocumentID:  event.VideoID,
+			Body:        bytes.NewReader(videoJSON),
+			Version:     &version,
+			VersionType: "external",
+			Refresh:     "true",
+		}.Do(context.Background(), es)
+	}
+	if err != nil {
+		return c.Status(500).SendString("Event error: " + err.Error())
+	}
+	defer res.Body.Close()
 
-		if res.IsError() {
-			results[idx] = res.String()
-		} else {
-			results[idx] = "Created"
-		}
+	// 409: we already have this or a newer event. 404: nothing to delete.
+	if res.IsError() && res.StatusCode != 409 && res.StatusCode != 404 {
+		return c.Status(res.StatusCode).SendString("Event error: " + res.String())
 	}
 
-	return c.JSON(results)
+	return c.SendString("Applied event " + event.ID + " to video " + event.VideoID)
 }
 
-func bulkIndexHandler(c *fiber.Ctx) error {
-	body := c.Body()
+func getDocumentHandler(c *fiber.Ctx) error {
+	id := c.Params("id")
 
-	res, err := es.Bulk(bytes.NewReader(body), es.Bulk.WithIndex(indexName))
+	res, err := es.Get(indexName, id)
 	if err != nil {
-		return c.Status(500).SendString("Bulk error: " + err.Error())
+		return c.Status(500).SendString("Get error: " + err.Error())
 	}
 	defer res.Body.Close()
 
-	es.Indices.Refresh(es.Indices.Refresh.WithIndex(indexName))
-
-	return c.SendString("Bulk indexing done.")
-}
+	if res.StatusCode == 404 {
+		return c.Status(404).SendString("Video not found")
+	}
+	if res.IsError() {
+		return c.Status(res.StatusCode).SendString("Get error: " + res.String())
+	}
 
-func indexHandler(c *fiber.Ctx) error {
-	var video Video
-	if err := c.BodyParser(&video); err != nil {
-		return c.Status(400).SendString("Invalid JSON")
+	var r struct {
+		Source json.RawMessage `json:"_source"`
 	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return c.Status(500).SendString("Get error: " + err.Error())
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(r.Source)
+}
 
-	videoJSON, _ := json.Marshal(video)
+func deleteHandler(c *fiber.Ctx) error {
+	id := c.Params("id")
 
-	req := esapi.IndexRequest{
+	req := esapi.DeleteRequest{
 		Index:      indexName,
-		DocumentID: video.ID,
-		Body:       bytes.NewReader(videoJSON),
+		DocumentID: id,
 		Refresh:    "true",
 	}
 
 	res, err := req.Do(context.Background(), es)
 	if err != nil {
-		return c.Status(500).SendString("Index error: " + err.Error())
+		return c.Status(500).SendString("Delete error: " + err.Error())
 	}
 	defer res.Body.Close()
 
-	return c.SendString("Indexed video: " + video.ID)
+	// A missing document is already in the state the caller wants.
+	if res.IsError() && res.StatusCode != 404 {
+		return c.Status(res.StatusCode).SendString("Delete error: " + res.String())
+	}
+
+	return c.SendString("Deleted video: " + id)
+}
+
+type DeleteByOwnerRequest struct {
+	OwnerID string `json:"ownerId"`
+}
+
+func deleteByOwnerHandler(c *fiber.Ctx) error {
+	var reqPayload DeleteByOwnerRequest
+	if err := c.BodyParser(&reqPayload); err != nil || reqPayload.OwnerID == "" {
+		return c.Status(400).SendString("Invalid JSON")
+	}
+
+	queryBody := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{
+				"ownerId": reqPayload.OwnerID,
+			},
+		},
+	}
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(queryBody)
+
+	res, err := es.DeleteByQuery(
+		[]string{indexName},
+		&buf,
+		es.DeleteByQuery.WithRefresh(true),
+		es.DeleteByQuery.WithConflicts("proceed"),
+	)
+	if err != nil {
+		return c.Status(500).SendString("Delete error: " + err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.IsError() && res.StatusCode != 404 {
+		return c.Status(res.StatusCode).SendString("Delete error: " + res.String())
+	}
+
+	var r map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&r)
+
+	return c.JSON(fiber.Map{"deleted": r["deleted"]})
 }
 
 func sentenceSearchHandler(c *fiber.Ctx) error {
@@ -194,6 +368,12 @@ func sentenceSearchHandler(c *fiber.Ctx) error {
 							"description": query,
 						},
 					},
+					// Tags are stored lowercased by the upload service
+					map[string]interface{}{
+						"term": map[string]interface{}{
+							"tags": strings.ToLower(query),
+						},
+					},
 
 					// ✅ Fuzzy multi-field search (your original logic)
 					map[string]interface{}{
@@ -5,6 +5,7 @@ go 1.25.1
 require (
 	github.com/gofiber/fiber/v2 v2.52.9
 	go.mongodb.org/mongo-driver v1.17.6
+	stream-flow/objstore v0.0.0-00010101000000-000000000000
 )
 
 require (
@@ -29,3 +30,5 @@ require (
 	golang.org/x/sys v0.28.0 // indirect
 	golang.org/x/text v0.17.0 // indirect
 )
+
+replace stream-flow/objstore => ../go-objstore
@@ -2,36 +2,443 @@ package main
 
 import (
 	"context" // <-- Added for fmt.Sprintf
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	// "github.com/joho/godotenv" // <-- REMOVED
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"stream-flow/objstore/serviceauth"
 )
 
 // Define struct for video social info
 type VideoSocial struct {
-	ID          string    `json:"id" bson:"_id"`
-	Title       string    `json:"title" bson:"title"`
-	Description string    `json:"description" bson:"description"`
-	Author      string    `json:"author" bson:"author"`
-	Thumbnail   string    `json:"thumbnail" bson:"thumbnail"`
-	Path        string    `json:"path" bson:"path"`
-	Duration    float64   `json:"duration" bson:"duration"`
-	Views       int       `json:"views" bson:"views"`
-	Likes       int       `json:"likes" bson:"likes"`
-	Comments    []string  `json:"comments" bson:"comments"`
-	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
+	ID          string         `json:"id" bson:"_id"`
+	Title       string         `json:"title" bson:"title"`
+	Description string         `json:"description" bson:"description"`
+	Author      string         `json:"author" bson:"author"`
+	OwnerID     string         `json:"ownerId" bson:"ownerId"` // auth service user ID of the author
+	Thumbnail   string         `json:"thumbnail" bson:"thumbnail"`
+	Path        string         `json:"path" bson:"path"`
+	Duration    float64        `json:"duration" bson:"duration"`
+	Views       int            `json:"views" bson:"views"`
+	Likes       int            `json:"likes" bson:"likes"`
+	Comments    []VideoComment `json:"comments" bson:"comments"`
+	CreatedAt   time.Time      `json:"createdAt" bson:"createdAt"`
+
+	// Name the file was uploaded with; the ID is generated by the upload service
+	OriginalFilename string     `json:"originalFilename" bson:"originalFilename"`
+	SHA256           string     `json:"sha256" bson:"sha256"`
+	Size             int64      `json:"size" bson:"size"`
+	Media            *MediaInfo `json:"media,omitempty" bson:"media,omitempty"`
+
+	// Poster renditions and the scrubbing preview track, set once transcoded
+	Thumbnails   []Thumbnail `json:"thumbnails,omitempty" bson:"thumbnails,omitempty"`
+	PreviewTrack string      `json:"previewTrack,omitempty" bson:"previewTrack,omitempty"`
+
+	// Edited through the upload service, which owns the metadata; Version
+	// orders its updates. Only public videos are listed.
+	Tags       []string `json:"tags,omitempty" bson:"tags,omitempty"`
+	Visibility string   `json:"visibility,omitempty" bson:"visibility,omitempty"`
+	Version    int64    `json:"version" bson:"version"`
+
+	// Set while the video is deleted but can still be restored; deleted
+	// videos are hidden unless ?includeDeleted=true
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+
+	// Sequence number of the last upload service event applied (see /events)
+	EventSeq int64 `json:"-" bson:"eventSeq,omitempty"`
+}
+
+// VideoEvent is a change to a video, delivered by the upload service's
+// outbox at least once and in order per video. Data is the whole video as
+// the upload service sees it; Seq grows with every event of a video.
+type VideoEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	VideoID string `json:"videoId"`
+	Seq     int64  `json:"seq"`
+	Data    struct {
+		Title            string      `json:"title"`
+		Description      string      `json:"description"`
+		Author           string      `json:"author"`
+		OwnerID          string      `json:"ownerId"`
+		Tags             []string    `json:"tags"`
+		Visibility       string      `json:"visibility"`
+		Version          int64       `json:"version"`
+		Path             string      `json:"path"`
+		Thumbnail        string      `json:"thumbnail"`
+		Thumbnails       []Thumbnail `json:"thumbnails"`
+		PreviewTrack     string      `json:"previewTrack"`
+		OriginalFilename string      `json:"originalFilename"`
+		SHA256           string      `json:"sha256"`
+		Size             int64       `json:"size"`
+		Media            *MediaInfo  `json:"media"`
+		CreatedAt        time.Time   `json:"createdAt"`
+		DeletedAt        *time.Time  `json:"deletedAt"`
+	} `json:"data"`
+}
+
+// VideoComment is a comment as shown on its video. ID is the ID of its
+// record in the comments collection.
+type VideoComment struct {
+	ID        string    `json:"id" bson:"id"`
+	UserID    string    `json:"userId,omitempty" bson:"userId,omitempty"`
+	Text      string    `json:"text" bson:"text"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// Thumbnail is one size and format of a video's poster
+type Thumbnail struct {
+	URL    string `json:"url" bson:"url"`
+	Width  int    `json:"width" bson:"width"`
+	Format string `json:"format" bson:"format"`
+}
+
+// MediaInfo is what the upload service found when probing the file
+type MediaInfo struct {
+	Container     string  `json:"container" bson:"container"`
+	Duration      float64 `json:"duration" bson:"duration"`
+	Bitrate       int64   `json:"bitrate" bson:"bitrate"`
+	Width         int     `json:"width" bson:"width"`
+	Height        int     `json:"height" bson:"height"`
+	FrameRate     float64 `json:"frameRate" bson:"frameRate"`
+	Rotation      int     `json:"rotation" bson:"rotation"`
+	VideoCodec    string  `json:"videoCodec" bson:"videoCodec"`
+	AudioCodec    string  `json:"audioCodec,omitempty" bson:"audioCodec,omitempty"`
+	AudioChannels int     `json:"audioChannels,omitempty" bson:"audioChannels,omitempty"`
+	HasAudio      bool    `json:"hasAudio" bson:"hasAudio"`
 }
 
 var collection *mongo.Collection
 
+// Who liked and commented on what, so a user's engagement can be exported
+// and removed with their account. The counters and comments on the video
+// record are what is shown.
+var (
+	likesCollection    *mongo.Collection
+	commentsCollection *mongo.Collection
+)
+
+type Like struct {
+	ID        string    `json:"-" bson:"_id"` // videoId/userId
+	VideoID   string    `json:"videoId" bson:"videoId"`
+	UserID    string    `json:"-" bson:"userId"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+type Comment struct {
+	ID        primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	VideoID   string             `json:"videoId" bson:"videoId"`
+	UserID    string             `json:"-" bson:"userId"`
+	Text      string             `json:"text" bson:"text"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// Other services authenticate with HTTP Basic credentials listed in
+// SERVICE_CREDENTIALS ("auth-service:secret,upload-service:secret"). Users
+// liking and commenting send their bearer token, which is checked with the
+// auth service using this service's own SERVICE_CLIENT_CREDENTIALS
+// ("social-service:secret").
+var (
+	serviceCredentials  serviceauth.Credentials
+	authServiceURL      string
+	serviceClientID     string
+	serviceClientSecret string
+)
+
+func loadServiceCredentials() {
+	authServiceURL = os.Getenv("AUTH_SERVICE_URL")
+	if authServiceURL == "" {
+		authServiceURL = "http://go-auth-service:3000"
+	}
+	var ok bool
+	if serviceClientID, serviceClientSecret, ok = serviceauth.ParseClient(os.Getenv("SERVICE_CLIENT_CREDENTIALS")); !ok {
+		log.Println("WARN: SERVICE_CLIENT_CREDENTIALS not set, likes and comments will be rejected")
+	}
+	serviceCredentials = serviceauth.Parse(os.Getenv("SERVICE_CREDENTIALS"))
+	if len(serviceCredentials) == 0 {
+		log.Println("WARN: SERVICE_CREDENTIALS not set, service-only endpoints will reject every request")
+	}
+}
+
+// requireService lets through only other services presenting credentials
+// from SERVICE_CREDENTIALS.
+func requireService(c *fiber.Ctx) error {
+	return serviceCredentials.Require(c)
+}
+
+// isService reports whether c carries credentials from SERVICE_CREDENTIALS.
+func isService(c *fiber.Ctx) bool {
+	return serviceCredentials.Caller(c) != ""
+}
+
+// requireUser checks the request's bearer token with the auth service and
+// stores the user's ID for the handler.
+func requireUser(c *fiber.Ctx) error {
+	scheme, token, _ := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return c.Status(401).JSON(fiber.Map{"error": "Log in to like or comment"})
+	}
+	user, err := introspect(c.Context(), token)
+	if err != nil {
+		log.Println("❌ Token introspection failed:", err)
+		return c.Status(503).JSON(fiber.Map{"error": "Authentication is unavailable, please try again"})
+	}
+	if user == nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired token"})
+	}
+	c.Locals("userId", user.Sub)
+	c.Locals("user", user)
+	return c.Next()
+}
+
+// tokenUser is the account behind an active bearer token.
+type tokenUser struct {
+	Sub  string `json:"sub"`
+	Role string `json:"role"`
+}
+
+// introspect checks token with the auth service. It returns nil for a token
+// that is not active.
+func introspect(ctx context.Context, token string) (*tokenUser, error) {
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, authServiceURL+"/internal/introspect", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(serviceClientID, serviceClientSecret)
+	resp, err := authClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth service returned %s", resp.Status)
+	}
+	var result struct {
+		Active bool `json:"active"`
+		tokenUser
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || !result.Active {
+		return nil, nil
+	}
+	return &result.tokenUser, nil
+}
+
+// canSeePrivate reports whether c may see a private video of ownerID: other
+// services, the owner and admins can.
+func canSeePrivate(c *fiber.Ctx, ownerID string) (bool, error) {
+	if isService(c) {
+		return true, nil
+	}
+	user, _ := c.Locals("user").(*tokenUser) // set by requireUser
+	if user == nil {
+		scheme, token, _ := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return false, nil
+		}
+		var err error
+		user, err = introspect(c.Context(), token)
+		if err != nil || user == nil {
+			return false, err
+		}
+	}
+	return user.Sub == ownerID || user.Role == "admin", nil
+}
+
+// errAuthUnavailable means the auth service could not be asked who the
+// caller is.
+var errAuthUnavailable = fiber.NewError(503, "Authentication is unavailable, please try again")
+
+// visibleVideo loads video id if c may see it: deleted videos only with
+// includeDeleted, private ones only for their owner, admins and other
+// services. It returns nil for a video that is missing or hidden from c.
+func visibleVideo(c *fiber.Ctx, id string, includeDeleted bool) (*VideoSocial, error) {
+	filter := bson.M{"_id": id}
+	if !includeDeleted {
+		filter["deletedAt"] = bson.M{"$exists": false}
+	}
+	var video VideoSocial
+	err := collection.FindOne(c.Context(), filter).Decode(&video)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if video.Visibility == "private" {
+		allowed, err := canSeePrivate(c, video.OwnerID)
+		if err != nil {
+			log.Println("❌ Token introspection failed:", err)
+			return nil, errAuthUnavailable
+		}
+		if !allowed {
+			return nil, nil
+		}
+	}
+	return &video, nil
+}
+
+// sendLookupError answers a request whose visibleVideo call failed.
+func sendLookupError(c *fiber.Ctx, err error) error {
+	if err == errAuthUnavailable {
+		return c.Status(503).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+}
+
+var authClient = &http.Client{Timeout: 5 * time.Second}
+
+// removeComment takes the comment with commentID off its video.
+func removeComment(ctx context.Context, videoID, commentID string) error {
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": videoID}, bson.M{"$pull": bson.M{"comments": bson.M{"id": commentID}}})
+	return err
+}
+
+// migrateComments converts comments stored as bare text, before comments had
+// IDs, into VideoComments. Each text is matched to an unclaimed record in the
+// comments collection with the same text, which gives it its ID and author;
+// texts without one (from before the collection existed) get a new ID.
+func migrateComments(ctx context.Context) error {
+	cursor, err := collection.Find(ctx, bson.M{"comments": bson.M{"$type": "string"}},
+		options.Find().SetProjection(bson.M{"comments": 1}))
+	if err != nil {
+		return err
+	}
+	var videos []struct {
+		ID       string `bson:"_id"`
+		Comments bson.A `bson:"comments"`
+	}
+	if err := cursor.All(ctx, &videos); err != nil {
+		return err
+	}
+	for _, v := range videos {
+		var records []Comment
+		cursor, err := commentsCollection.Find(ctx, bson.M{"videoId": v.ID}, options.Find().SetSort(bson.M{"createdAt": 1}))
+		if err != nil {
+			return err
+		}
+		if err := cursor.All(ctx, &records); err != nil {
+			return err
+		}
+		// Comments already converted keep their records.
+		existing := make([]*VideoComment, len(v.Comments))
+		claimed := map[string]bool{}
+		for i, item := range v.Comments {
+			if _, ok := item.(string); ok {
+				continue
+			}
+			raw, err := bson.Marshal(item)
+			if err != nil {
+				return err
+			}
+			existing[i] = &VideoComment{}
+			if err := bson.Unmarshal(raw, existing[i]); err != nil {
+				return err
+			}
+			claimed[existing[i].ID] = true
+		}
+		comments := make([]VideoComment, 0, len(v.Comments))
+		for i, item := range v.Comments {
+			if existing[i] != nil {
+				comments = append(comments, *existing[i])
+				continue
+			}
+			text := item.(string)
+			comment := VideoComment{ID: primitive.NewObjectID().Hex(), Text: text}
+			for _, r := range records {
+				if r.Text == text && !claimed[r.ID.Hex()] {
+					claimed[r.ID.Hex()] = true
+					comment = VideoComment{ID: r.ID.Hex(), UserID: r.UserID, Text: text, CreatedAt: r.CreatedAt}
+					break
+				}
+			}
+			comments = append(comments, comment)
+		}
+		// Only if no comment was added meanwhile; the next start retries.
+		_, err = collection.UpdateOne(ctx, bson.M{"_id": v.ID, "comments": v.Comments}, bson.M{"$set": bson.M{"comments": comments}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteEngagementOn removes the likes and comments on videos that are gone.
+func deleteEngagementOn(ctx context.Context, videoIDs []string) error {
+	if _, err := likesCollection.DeleteMany(ctx, bson.M{"videoId": bson.M{"$in": videoIDs}}); err != nil {
+		return err
+	}
+	_, err := commentsCollection.DeleteMany(ctx, bson.M{"videoId": bson.M{"$in": videoIDs}})
+	return err
+}
+
+func userEngagement(ctx context.Context, userID string) ([]Like, []Comment, error) {
+	likes := []Like{}
+	comments := []Comment{}
+	cursor, err := likesCollection.Find(ctx, bson.M{"userId": userID})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cursor.All(ctx, &likes); err != nil {
+		return nil, nil, err
+	}
+	cursor, err = commentsCollection.Find(ctx, bson.M{"userId": userID})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cursor.All(ctx, &comments); err != nil {
+		return nil, nil, err
+	}
+	return likes, comments, nil
+}
+
+// deleteUserEngagement takes back a user's likes and comments. A like's
+// counter is only decremented by whoever removed its record, so a retry
+// never counts it twice; a comment is taken off its video before its record
+// is removed, so a retry after a failure picks up where it stopped.
+func deleteUserEngagement(ctx context.Context, userID string) (int, error) {
+	likes, comments, err := userEngagement(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	for _, like := range likes {
+		res, err := likesCollection.DeleteOne(ctx, bson.M{"_id": like.ID})
+		if err != nil {
+			return 0, err
+		}
+		if res.DeletedCount != 1 {
+			continue
+		}
+		_, err = collection.UpdateOne(ctx, bson.M{"_id": like.VideoID, "likes": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"likes": -1}})
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, comment := range comments {
+		if err := removeComment(ctx, comment.VideoID, comment.ID.Hex()); err != nil {
+			return 0, err
+		}
+		if _, err := commentsCollection.DeleteOne(ctx, bson.M{"_id": comment.ID}); err != nil {
+			return 0, err
+		}
+	}
+	return len(likes) + len(comments), nil
+}
+
 func main() {
 	// Load environment variables from .env file
 	// err := godotenv.Load() // <-- REMOVED
@@ -70,13 +477,42 @@ func main() {
 
 	// Initialize collection
 	collection = client.Database("socials_db").Collection("videos")
+	_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "author", Value: 1}, {Key: "sha256", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("❌ Failed to create sha256 index: %v", err)
+	}
+	_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "ownerId", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("❌ Failed to create ownerId index: %v", err)
+	}
+	likesCollection = client.Database("socials_db").Collection("likes")
+	commentsCollection = client.Database("socials_db").Collection("comments")
+	for _, c := range []*mongo.Collection{likesCollection, commentsCollection} {
+		_, err = c.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+			{Keys: bson.D{{Key: "userId", Value: 1}}},
+			{Keys: bson.D{{Key: "videoId", Value: 1}}},
+		})
+		if err != nil {
+			log.Printf("❌ Failed to create %s indexes: %v", c.Name(), err)
+		}
+	}
+
+	if err := migrateComments(context.Background()); err != nil {
+		log.Printf("❌ Failed to migrate comments: %v", err)
+	}
+
+	loadServiceCredentials()
 
 	// Fiber app setup
 	app := fiber.New()
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://98.70.25.253,http://98.70.25.253:3000,http://localhost:3000,http://98.70.25.253:5173,http://localhost:5173,http://98.70.25.253:8081",
-		AllowMethods:     "GET,POST,PATCH,DELETE,OPTIONS",
+		AllowMethods:     "GET,POST,DELETE,OPTIONS",
 		AllowHeaders:     "Content-Type,Authorization",
 		AllowCredentials: true,
 	}))
@@ -84,55 +520,118 @@ func main() {
 	ctx := context.Background()
 
 	// ROUTES -------------------------
-	// (All your handlers: /init, /videos/:id/like, etc. are correct)
-
-	// Create social record when video is uploaded
-	app.Post("/init", func(c *fiber.Ctx) error {
-		var payload struct {
-			ID          string  `json:"id"`
-			Title       string  `json:"title"`
-			Description string  `json:"description"`
-			Author      string  `json:"author"`
-			Thumbnail   string  `json:"thumbnail"`
-			Path        string  `json:"path"`
-			Duration    float64 `json:"duration"`
-		}
-		if err := c.BodyParser(&payload); err != nil {
-			return c.Status(400).SendString("Invalid payload")
-		}
-
-		doc := bson.M{
-			"_id":         payload.ID,
-			"title":       payload.Title,
-			"description": payload.Description,
-			"author":      payload.Author,
-			"thumbnail":   payload.Thumbnail,
-			"path":        payload.Path,
-			"duration":    payload.Duration,
-			"views":       0,
-			"likes":       0,
-			"comments":    []string{},
-			"createdAt":   time.Now(),
-		}
-
-		_, err := collection.InsertOne(ctx, doc)
-		if err != nil {
-			// Handle case where video is re-uploaded (duplicate _id)
-			if mongo.IsDuplicateKeyError(err) {
-				log.Println("Info: Video ID already exists, skipping init.")
-				return c.JSON(fiber.Map{"status": "ok (already exists)", "video": payload.ID})
+
+	// Apply an upload service event. Events older than what is stored are
+	// ignored, so redeliveries are harmless.
+	app.Post("/events", requireService, func(c *fiber.Ctx) error {
+		var event VideoEvent
+		if err := c.BodyParser(&event); err != nil || event.VideoID == "" || event.Seq <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid event"})
+		}
+		newer := bson.M{"_id": event.VideoID, "$or": bson.A{
+			bson.M{"eventSeq": bson.M{"$lt": event.Seq}},
+			bson.M{"eventSeq": bson.M{"$exists": false}},
+		}}
+
+		if event.Type == "video.purged" {
+			if _, err := collection.DeleteOne(ctx, newer); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if err := deleteEngagementOn(ctx, []string{event.VideoID}); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 			}
-			return c.Status(500).SendString("DB insert error")
+			return c.JSON(fiber.Map{"message": "Event applied"})
 		}
 
-		return c.JSON(fiber.Map{"status": "ok", "video": payload.ID})
+		d := event.Data
+		if d.Tags == nil {
+			d.Tags = []string{}
+		}
+		var duration float64
+		if d.Media != nil {
+			duration = d.Media.Duration
+		}
+		set := bson.M{
+			"title":            d.Title,
+			"description":      d.Description,
+			"author":           d.Author,
+			"ownerId":          d.OwnerID,
+			"tags":             d.Tags,
+			"visibility":       d.Visibility,
+			"version":          d.Version,
+			"path":             d.Path,
+			"thumbnail":        d.Thumbnail,
+			"duration":         duration,
+			"originalFilename": d.OriginalFilename,
+			"sha256":           d.SHA256,
+			"size":             d.Size,
+			"eventSeq":         event.Seq,
+		}
+		// Fields the upload service doesn't have (yet) are removed
+		unset := bson.M{}
+		if d.Media != nil {
+			set["media"] = d.Media
+		} else {
+			unset["media"] = ""
+		}
+		if len(d.Thumbnails) > 0 {
+			set["thumbnails"] = d.Thumbnails
+		} else {
+			unset["thumbnails"] = ""
+		}
+		if d.PreviewTrack != "" {
+			set["previewTrack"] = d.PreviewTrack
+		} else {
+			unset["previewTrack"] = ""
+		}
+		if d.DeletedAt != nil {
+			set["deletedAt"] = d.DeletedAt
+		} else {
+			unset["deletedAt"] = ""
+		}
+		update := bson.M{
+			"$set": set,
+			"$setOnInsert": bson.M{
+				"views":     0,
+				"likes":     0,
+				"comments":  []VideoComment{},
+				"createdAt": d.CreatedAt,
+			},
+		}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+
+		_, err := collection.UpdateOne(ctx, newer, update, options.Update().SetUpsert(true))
+		// The filter missed an existing record with a newer event, so the
+		// upsert tried to insert a second one.
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Event applied"})
 	})
 
-	// Like a video by ID
-	app.Post("/videos/:id/like", func(c *fiber.Ctx) error {
+	// Like a video by ID, once per user. Only videos the user can see can
+	// be liked or commented on.
+	app.Post("/videos/:id/like", requireUser, func(c *fiber.Ctx) error {
 		id := c.Params("id")
+		userID := c.Locals("userId").(string)
+		video, err := visibleVideo(c, id, false)
+		if err != nil {
+			return sendLookupError(c, err)
+		}
+		if video == nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Video not found"})
+		}
 
-		_, err := collection.UpdateOne(ctx,
+		_, err = likesCollection.InsertOne(ctx, Like{ID: id + "/" + userID, VideoID: id, UserID: userID, CreatedAt: time.Now()})
+		if mongo.IsDuplicateKeyError(err) {
+			return c.JSON(fiber.Map{"message": "Already liked"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		_, err = collection.UpdateOne(ctx,
 			bson.M{"_id": id},
 			bson.M{"$inc": bson.M{"likes": 1}},
 		)
@@ -144,7 +643,7 @@ func main() {
 	})
 
 	// Add a comment
-	app.Post("/videos/:id/comment", func(c *fiber.Ctx) error {
+	app.Post("/videos/:id/comment", requireUser, func(c *fiber.Ctx) error {
 		id := c.Params("id")
 		var body struct {
 			Text string `json:"text"`
@@ -152,16 +651,29 @@ func main() {
 		if err := c.BodyParser(&body); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 		}
+		video, err := visibleVideo(c, id, false)
+		if err != nil {
+			return sendLookupError(c, err)
+		}
+		if video == nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Video not found"})
+		}
 
-		_, err := collection.UpdateOne(ctx,
+		record := Comment{ID: primitive.NewObjectID(), VideoID: id, UserID: c.Locals("userId").(string), Text: body.Text, CreatedAt: time.Now()}
+		_, err = commentsCollection.InsertOne(ctx, record)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		comment := VideoComment{ID: record.ID.Hex(), UserID: record.UserID, Text: record.Text, CreatedAt: record.CreatedAt}
+		_, err = collection.UpdateOne(ctx,
 			bson.M{"_id": id},
-			bson.M{"$push": bson.M{"comments": body.Text}},
+			bson.M{"$push": bson.M{"comments": comment}},
 		)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		return c.JSON(fiber.Map{"message": "Comment added"})
+		return c.JSON(fiber.Map{"message": "Comment added", "comment": comment})
 	})
 
 	// Increment view count
@@ -179,12 +691,19 @@ func main() {
 		return c.JSON(fiber.Map{"message": "View count incremented"})
 	})
 
-	// Get social info for a video
+	// Get social info for a video. Private videos are only shown to their
+	// owner, admins and other services; deleted ones only to services
+	// (?includeDeleted=true).
 	app.Get("/video/:id", func(c *fiber.Ctx) error {
-		id := c.Params("id")
-		var video VideoSocial
-		err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&video)
+		includeDeleted := c.QueryBool("includeDeleted")
+		if includeDeleted && !isService(c) {
+			return c.Status(403).JSON(fiber.Map{"error": "Service credentials required"})
+		}
+		video, err := visibleVideo(c, c.Params("id"), includeDeleted)
 		if err != nil {
+			return sendLookupError(c, err)
+		}
+		if video == nil {
 			return c.Status(404).SendString("Video not found")
 		}
 		return c.JSON(video)
@@ -192,10 +711,48 @@ func main() {
 
 	// -------------------------------
 
-	// Fetch all videos
+	// Delete a video's social record (used by the upload service once a
+	// deleted video is purged)
+	app.Delete("/video/:id", requireService, func(c *fiber.Ctx) error {
+		id := c.Params("id")
+
+		res, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if res.DeletedCount == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "Video not found"})
+		}
+
+		return c.JSON(fiber.Map{"message": "Video deleted"})
+	})
+
+	// Fetch all videos, optionally only those by one author (?author=, or
+	// ?ownerId= for the author's user ID) or with given content (?sha256=).
+	// Deleted videos are left out unless ?includeDeleted=true, unlisted and
+	// private ones unless ?includePrivate=true; both are for other services.
 	app.Get("/videos", func(c *fiber.Ctx) error {
 		ctx := context.Background()
-		cursor, err := collection.Find(ctx, bson.M{})
+		if (c.QueryBool("includeDeleted") || c.QueryBool("includePrivate")) && !isService(c) {
+			return c.Status(403).JSON(fiber.Map{"error": "Service credentials required"})
+		}
+		filter := bson.M{}
+		if !c.QueryBool("includeDeleted") {
+			filter["deletedAt"] = bson.M{"$exists": false}
+		}
+		if !c.QueryBool("includePrivate") {
+			filter["visibility"] = bson.M{"$nin": bson.A{"unlisted", "private"}}
+		}
+		if author := c.Query("author"); author != "" {
+			filter["author"] = author
+		}
+		if ownerID := c.Query("ownerId"); ownerID != "" {
+			filter["ownerId"] = ownerID
+		}
+		if sum := c.Query("sha256"); sum != "" {
+			filter["sha256"] = sum
+		}
+		cursor, err := collection.Find(ctx, filter)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
@@ -209,6 +766,54 @@ func main() {
 		return c.JSON(videos)
 	})
 
+	// Delete every video of an owner and the engagement on them (used when
+	// an account is deleted)
+	app.Delete("/owners/:ownerId/videos", requireService, func(c *fiber.Ctx) error {
+		owner := c.Params("ownerId")
+
+		var videos []struct {
+			ID string `bson:"_id"`
+		}
+		cursor, err := collection.Find(ctx, bson.M{"ownerId": owner}, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := cursor.All(ctx, &videos); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		ids := []string{}
+		for _, v := range videos {
+			ids = append(ids, v.ID)
+		}
+		if err := deleteEngagementOn(ctx, ids); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		res, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{"message": "Videos deleted", "deleted": res.DeletedCount})
+	})
+
+	// A user's likes and comments on any video (for data exports)
+	app.Get("/users/:userId/engagement", requireService, func(c *fiber.Ctx) error {
+		likes, comments, err := userEngagement(ctx, c.Params("userId"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"likes": likes, "comments": comments})
+	})
+
+	// Take back a user's likes and comments (used when an account is deleted)
+	app.Delete("/users/:userId/engagement", requireService, func(c *fiber.Ctx) error {
+		n, err := deleteUserEngagement(ctx, c.Params("userId"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Engagement deleted", "deleted": n})
+	})
+
 	log.Println("🚀 Social service running on port 3002")
 	app.Listen(":3002")
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/gofiber/fiber/v2"
+	"stream-flow/objstore/serviceauth"
+)
+
+// ------------------- AUTHENTICATION --------------------
+// Uploads and changes to videos need a bearer token from the auth service.
+// Tokens are checked with the auth service's introspection endpoint using
+// this service's credentials (SERVICE_CREDENTIALS, "client-id:secret"), and
+// results are cached briefly so tus chunks don't each cost a round trip.
+//
+// Other services calling /internal authenticate the same way, with HTTP
+// Basic credentials listed in TRUSTED_SERVICE_CREDENTIALS
+// ("auth-service:secret,...").
+
+const (
+	introspectionCacheTTL  = 30 * time.Second
+	introspectionCacheSize = 10000
+)
+
+var (
+	authServiceURL    = ""
+	serviceClientID   = ""
+	serviceSecret     = ""
+	trustedServices   serviceauth.Credentials
+	introspectionMu   sync.Mutex
+	introspectionSeen = map[string]cachedIntrospection{}
+)
+
+// authUser is the account behind a request's token.
+type authUser struct {
+	ID       string
+	Username string
+	Role     string
+	Status   string
+}
+
+func (u *authUser) isAdmin() bool { return u.Role == "admin" }
+
+type cachedIntrospection struct {
+	user    *authUser // nil for inactive tokens
+	expires time.Time
+}
+
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Sub      string `json:"sub"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Status   string `json:"status"`
+	Exp      int64  `json:"exp"`
+}
+
+func loadServiceCredentials() {
+	authServiceURL = getEnv("AUTH_SERVICE_URL", "http://go-auth-service:3000")
+	var ok bool
+	if serviceClientID, serviceSecret, ok = serviceauth.ParseClient(getEnv("SERVICE_CREDENTIALS", "")); !ok {
+		log.Println("WARN: SERVICE_CREDENTIALS not set, every authenticated request will be rejected")
+	}
+}
+
+func loadTrustedServices() {
+	trustedServices = serviceauth.Parse(os.Getenv("TRUSTED_SERVICE_CREDENTIALS"))
+	if len(trustedServices) == 0 {
+		log.Println("WARN: TRUSTED_SERVICE_CREDENTIALS not set, internal endpoints will reject every request")
+	}
+}
+
+// requireService lets through only other services presenting credentials
+// from TRUSTED_SERVICE_CREDENTIALS.
+func requireService(c *fiber.Ctx) error {
+	if !isService(c) {
+		return serviceauth.Challenge(c, "Service credentials required")
+	}
+	return c.Next()
+}
+
+// isService reports whether c carries credentials from
+// TRUSTED_SERVICE_CREDENTIALS, and if so stores the service's ID.
+func isService(c *fiber.Ctx) bool {
+	id := trustedServices.Caller(c)
+	if id == "" {
+		return false
+	}
+	c.Locals("service", id)
+	return true
+}
+
+// introspect resolves token to its user, or nil if the token is not valid.
+func introspect(token string) (*authUser, error) {
+	sum := sha256.Sum256([]byte(token))
+	cacheKey := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	introspectionMu.Lock()
+	if cached, ok := introspectionSeen[cacheKey]; ok && now.Before(cached.expires) {
+		introspectionMu.Unlock()
+		return cached.user, nil
+	}
+	introspectionMu.Unlock()
+
+	var result introspectionResponse
+	resp, err := resty.New().SetTimeout(5*time.Second).R().
+		SetBasicAuth(serviceClientID, serviceSecret).
+		SetFormData(map[string]string{"token": token}).
+		SetResult(&result).
+		Post(fmt.Sprintf("%s/internal/introspect", authServiceURL))
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("auth service returned %s", resp.Status())
+	}
+
+	var user *authUser
+	expires := now.Add(introspectionCacheTTL)
+	if result.Active {
+		user = &authUser{ID: result.Sub, Username: result.Username, Role: result.Role, Status: result.Status}
+		if result.Exp > 0 && time.Unix(result.Exp, 0).Before(expires) {
+			expires = time.Unix(result.Exp, 0)
+		}
+	}
+
+	introspectionMu.Lock()
+	if len(introspectionSeen) >= introspectionCacheSize {
+		for k, v := range introspectionSeen {
+			if now.After(v.expires) {
+				delete(introspectionSeen, k)
+			}
+		}
+		if len(introspectionSeen) >= introspectionCacheSize {
+			introspectionSeen = map[string]cachedIntrospection{}
+		}
+	}
+	introspectionSeen[cacheKey] = cachedIntrospection{user: user, expires: expires}
+	introspectionMu.Unlock()
+	return user, nil
+}
+
+// requireUser rejects requests without a valid bearer token and stores the
+// user for currentUser.
+func requireUser(c *fiber.Ctx) error {
+	scheme, token, ok := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Missing authorization token"})
+	}
+	user, err := introspect(token)
+	if err != nil {
+		log.Println("❌ Token introspection failed:", err)
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Authentication is unavailable, please try again"})
+	}
+	if user == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired token"})
+	}
+	if user.Status != "" && user.Status != "active" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "This account cannot upload videos"})
+	}
+	c.Locals("user", user)
+	return c.Next()
+}
+
+// requireAdmin lets only admins through; it goes after requireUser.
+func requireAdmin(c *fiber.Ctx) error {
+	if user := currentUser(c); user == nil || !user.isAdmin() {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Admins only"})
+	}
+	return c.Next()
+}
+
+func currentUser(c *fiber.Ctx) *authUser {
+	user, _ := c.Locals("user").(*authUser)
+	return user
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"stream-flow/objstore"
+)
+
+// ------------------- VIDEO DELETION --------------------
+// DELETE /videos/:id hides a video at once (a video.deleted event makes
+// Socials mark it deleted and search drop it) and purges it once
+// videoDeleteWindow has passed: its jobs are stopped, its files removed,
+// and finally its registry record, with a video.purged event so the other
+// services remove their copies. Until then the owner can bring it back
+// with POST /videos/:id/restore.
+//
+// The purge is a list of steps queued on the video record. runVideoSteps
+// works through them in order and retries a failing step with backoff
+// until it succeeds.
+
+const (
+	stepStopJobs     = "stop-jobs"
+	stepDeleteMedia  = "delete-media"
+	stepDeleteRecord = "delete-record"
+
+	stepPollInterval = time.Minute
+	stepLease        = 5 * time.Minute
+	stepRetryBackoff = 30 * time.Second
+	stepMaxBackoff   = time.Hour
+)
+
+var (
+	videoDeleteWindow = 7 * 24 * time.Hour
+	purgeSteps        = []string{stepStopJobs, stepDeleteMedia, stepDeleteRecord}
+)
+
+// notDeleted matches videos that are not deleted.
+var notDeleted = bson.M{"$exists": false}
+
+// handleDeleteVideo soft-deletes a video of the current user.
+func handleDeleteVideo(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if _, err := ownedVideo(c, id); err != nil {
+		return err
+	}
+	now := time.Now()
+	purgeAt := now.Add(videoDeleteWindow)
+	set := appendEvent(eventVideoDeleted)
+	set["deletedAt"] = now
+	set["deletedBy"] = currentUser(c).ID
+	set["purgeAt"] = purgeAt
+	res, err := videosCollection.UpdateOne(c.Context(),
+		bson.M{"_id": id, "deletedAt": notDeleted},
+		mongo.Pipeline{{{Key: "$set", Value: set}}},
+	)
+	if err != nil {
+		log.Printf("❌ Failed to delete video %s: %v\n", id, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to delete video")
+	}
+	if res.MatchedCount == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "Video not found")
+	}
+	wake(outboxWake)
+	log.Printf("Video %s deleted by %s, purging at %s\n", id, currentUser(c).Username, purgeAt.Format(time.RFC3339))
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message":   "Video deleted",
+		"id":        id,
+		"deletedAt": now,
+		"purgeAt":   purgeAt,
+	})
+}
+
+// handleRestoreVideo undoes a deletion that has not been purged yet.
+func handleRestoreVideo(c *fiber.Ctx) error {
+	id := c.Params("id")
+	user := currentUser(c)
+	var v videoRecord
+	err := videosCollection.FindOne(c.Context(), bson.M{"_id": id, "purging": bson.M{"$ne": true}}).Decode(&v)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && v.DeletedAt == nil) {
+		return fiber.NewError(fiber.StatusNotFound, "No deleted video to restore")
+	}
+	if err != nil {
+		log.Println("❌ Failed to load video:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to restore video")
+	}
+	if v.OwnerID != user.ID && !user.isAdmin() {
+		return fiber.NewError(fiber.StatusForbidden, "You can only change your own videos")
+	}
+
+	res, err := videosCollection.UpdateOne(c.Context(),
+		bson.M{"_id": id, "deletedAt": bson.M{"$exists": true}, "purging": bson.M{"$ne": true}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: appendEvent(eventVideoRestored)}},
+			{{Key: "$unset", Value: bson.A{"deletedAt", "deletedBy", "purgeAt"}}},
+		},
+	)
+	if err != nil {
+		log.Printf("❌ Failed to restore video %s: %v\n", id, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to restore video")
+	}
+	if res.MatchedCount == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "No deleted video to restore")
+	}
+	wake(outboxWake)
+	log.Printf("Video %s restored by %s\n", id, user.Username)
+	return c.JSON(fiber.Map{"message": "Video restored", "id": id})
+}
+
+// deletedForAccount marks videos hidden because their owner's account is
+// scheduled for deletion, as opposed to deleted by a person. They have no
+// purgeAt: the account deletion purges them, or restores them if cancelled.
+const deletedForAccount = "account-deletion"
+
+// handleListOwnerVideos lists the IDs of every video of an owner, deleted
+// ones included (used by the auth service when deleting an account).
+func handleListOwnerVideos(c *fiber.Ctx) error {
+	ids, err := ownerVideoIDs(c.Context(), bson.M{"ownerId": c.Params("id")})
+	if err != nil {
+		log.Println("❌ Failed to list owner videos:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to list videos")
+	}
+	return c.JSON(ids)
+}
+
+// handleHideOwnerVideos hides every video of an owner whose account is
+// scheduled for deletion.
+func handleHideOwnerVideos(c *fiber.Ctx) error {
+	owner := c.Params("id")
+	ids, err := ownerVideoIDs(c.Context(), bson.M{"ownerId": owner, "deletedAt": notDeleted})
+	if err != nil {
+		log.Println("❌ Failed to list owner videos:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to hide videos")
+	}
+	for _, id := range ids {
+		set := appendEvent(eventVideoDeleted)
+		set["deletedAt"] = time.Now()
+		set["deletedBy"] = deletedForAccount
+		_, err := videosCollection.UpdateOne(c.Context(),
+			bson.M{"_id": id, "deletedAt": notDeleted},
+			mongo.Pipeline{{{Key: "$set", Value: set}}},
+		)
+		if err != nil {
+			log.Printf("❌ Failed to hide video %s: %v\n", id, err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to hide videos")
+		}
+	}
+	wake(outboxWake)
+	log.Printf("Hid %d video(s) of %s pending account deletion\n", len(ids), owner)
+	return c.JSON(fiber.Map{"message": "Videos hidden", "hidden": len(ids)})
+}
+
+// handleRestoreOwnerVideos brings back the videos handleHideOwnerVideos hid
+// when the account deletion is cancelled.
+func handleRestoreOwnerVideos(c *fiber.Ctx) error {
+	owner := c.Params("id")
+	ids, err := ownerVideoIDs(c.Context(), bson.M{"ownerId": owner, "deletedBy": deletedForAccount})
+	if err != nil {
+		log.Println("❌ Failed to list owner videos:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to restore videos")
+	}
+	for _, id := range ids {
+		_, err := videosCollection.UpdateOne(c.Context(),
+			bson.M{"_id": id, "deletedBy": deletedForAccount, "purging": bson.M{"$ne": true}},
+			mongo.Pipeline{
+				{{Key: "$set", Value: appendEvent(eventVideoRestored)}},
+				{{Key: "$unset", Value: bson.A{"deletedAt", "deletedBy", "purgeAt"}}},
+			},
+		)
+		if err != nil {
+			log.Printf("❌ Failed to restore video %s: %v\n", id, err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to restore videos")
+		}
+	}
+	wake(outboxWake)
+	log.Printf("Restored %d video(s) of %s\n", len(ids), owner)
+	return c.JSON(fiber.Map{"message": "Videos restored", "restored": len(ids)})
+}
+
+func ownerVideoIDs(ctx context.Context, filter bson.M) ([]string, error) {
+	cursor, err := videosCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var records []videoRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, v := range records {
+		ids = append(ids, v.ID)
+	}
+	return ids, nil
+}
+
+// runVideoSteps starts purges that are due and runs pending steps until ctx
+// ends.
+func runVideoSteps(ctx context.Context) {
+	for {
+		if err := startDuePurges(ctx); err != nil && ctx.Err() == nil {
+			log.Println("❌ Failed to start purges:", err)
+		}
+		for ctx.Err() == nil {
+			v, err := claimVideoSteps(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Println("❌ Failed to claim video steps:", err)
+			}
+			if v == nil {
+				break
+			}
+			runClaimedSteps(ctx, v)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(stepPollInterval):
+		}
+	}
+}
+
+// startDuePurges queues the purge steps of videos whose restore window has
+// passed.
+func startDuePurges(ctx context.Context) error {
+	now := time.Now()
+	res, err := videosCollection.UpdateMany(ctx,
+		bson.M{"purgeAt": bson.M{"$lte": now}, "purging": bson.M{"$ne": true}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"purging":      true,
+				"pendingSteps": bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$pendingSteps", bson.A{}}}, purgeSteps}},
+				"nextStepAt":   bson.M{"$ifNull": bson.A{"$nextStepAt", now}},
+			}}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("Purging %d deleted video(s)\n", res.ModifiedCount)
+	}
+	return nil
+}
+
+// claimVideoSteps takes a video with steps due, holding it for stepLease so
+// other nodes leave it alone.
+func claimVideoSteps(ctx context.Context) (*videoRecord, error) {
+	now := time.Now()
+	var v videoRecord
+	err := videosCollection.FindOneAndUpdate(ctx,
+		bson.M{"pendingSteps.0": bson.M{"$exists": true}, "nextStepAt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"nextStepAt": now.Add(stepLease)}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "nextStepAt", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&v)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// runClaimedSteps runs v's steps in order. The record is re-read after each
+// step, since steps may have been queued meanwhile.
+func runClaimedSteps(ctx context.Context, v *videoRecord) {
+	for len(v.PendingSteps) > 0 {
+		step := v.PendingSteps[0]
+		if err := runVideoStep(ctx, v.ID, step); err != nil {
+			next := time.Now().Add(stepBackoff(v.StepAttempts + 1))
+			_, dbErr := videosCollection.UpdateOne(context.Background(), bson.M{"_id": v.ID}, bson.M{
+				"$set": bson.M{"stepError": fmt.Sprintf("%s: %v", step, err), "nextStepAt": next},
+				"$inc": bson.M{"stepAttempts": 1},
+			})
+			if dbErr != nil {
+				log.Printf("❌ Failed to record failed step of %s: %v\n", v.ID, dbErr)
+			}
+			log.Printf("❌ Step %s of video %s failed, retrying at %s: %v\n", step, v.ID, next.Format(time.RFC3339), err)
+			return
+		}
+		if step == stepDeleteRecord {
+			log.Println("Purged video", v.ID)
+			return
+		}
+
+		var next videoRecord
+		err := videosCollection.FindOneAndUpdate(context.Background(),
+			bson.M{"_id": v.ID},
+			bson.M{
+				"$pull":  bson.M{"pendingSteps": step},
+				"$set":   bson.M{"nextStepAt": time.Now().Add(stepLease)},
+				"$unset": bson.M{"stepError": "", "stepAttempts": ""},
+			},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&next)
+		if err != nil {
+			log.Printf("❌ Failed to record step %s of %s: %v\n", step, v.ID, err)
+			return
+		}
+		v = &next
+	}
+	_, err := videosCollection.UpdateOne(context.Background(),
+		bson.M{"_id": v.ID, "pendingSteps.0": bson.M{"$exists": false}},
+		bson.M{"$unset": bson.M{"nextStepAt": ""}},
+	)
+	if err != nil {
+		log.Printf("❌ Failed to release video %s: %v\n", v.ID, err)
+	}
+}
+
+func stepBackoff(attempt int) time.Duration {
+	d := stepRetryBackoff
+	for i := 1; i < attempt && d < stepMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > stepMaxBackoff {
+		d = stepMaxBackoff
+	}
+	return d
+}
+
+func runVideoStep(ctx context.Context, id, step string) error {
+	switch step {
+	case stepStopJobs:
+		// A running worker notices when it next renews its lease.
+		_, err := jobsCollection.UpdateMany(ctx,
+			bson.M{"videoId": id, "status": bson.M{"$in": bson.A{jobQueued, jobRunning}}},
+			bson.M{"$set": bson.M{"status": jobFailed, "error": "video deleted", "finishedAt": time.Now()}},
+		)
+		return err
+	case stepDeleteMedia:
+		running, err := jobsCollection.CountDocuments(ctx, bson.M{"videoId": id, "leaseUntil": bson.M{"$gt": time.Now()}})
+		if err != nil {
+			return err
+		}
+		if running > 0 {
+			return fmt.Errorf("a transcode may still be writing files")
+		}
+		return objstore.DeletePrefix(ctx, storage, id+"/")
+	case stepDeleteRecord:
+		return purgeRecord(ctx, id)
+	}
+	return fmt.Errorf("unknown step %q", step)
+}
+
+// ------------------- SERVICE CALLS ---------------------
+
+// serviceError is a non-2xx response from another service.
+type serviceError struct {
+	Status int
+	Body   string
+}
+
+func (e *serviceError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Body)
+}
+
+// callService sends body (if any) as JSON to another service and decodes
+// the response into result (if any), with this service's credentials.
+func callService(ctx context.Context, method, target string, body, result interface{}) error {
+	req := resty.New().SetTimeout(30*time.Second).R().SetContext(ctx).
+		SetBasicAuth(serviceClientID, serviceSecret)
+	if body != nil {
+		req.SetHeader("Content-Type", "application/json").SetBody(body)
+	}
+	if result != nil {
+		req.SetResult(result)
+	}
+	resp, err := req.Execute(method, target)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return &serviceError{Status: resp.StatusCode(), Body: resp.String()}
+	}
+	return nil
+}
+
+// ignoreNotFound treats a 404 as success, for calls removing something
+// that may already be gone.
+func ignoreNotFound(err error) error {
+	var se *serviceError
+	if errors.As(err, &se) && se.Status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
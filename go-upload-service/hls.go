@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ------------------- HLS LADDER ------------------------
+// Every video is transcoded to a ladder of H.264/AAC renditions, one
+// directory each under the video's HLS prefix, plus a master playlist
+// (index.m3u8) that players use to switch between them. Keyframes are forced
+// at every segment boundary in all renditions so segments line up.
+
+const (
+	hlsSegmentSeconds = 6
+	hlsAudioKbps      = 128
+)
+
+// rendition is one rung of the ladder. Height is the short side, so a
+// portrait video's "720p" rendition is 720 pixels wide.
+type rendition struct {
+	Height    int
+	VideoKbps int
+}
+
+// defaultLadder is used unless HLS_LADDER is set
+// (e.g. "240:400,360:800,480:1400,720:2800,1080:5000", height:kbps).
+var defaultLadder = []rendition{
+	{Height: 240, VideoKbps: 400},
+	{Height: 360, VideoKbps: 800},
+	{Height: 480, VideoKbps: 1400},
+	{Height: 720, VideoKbps: 2800},
+	{Height: 1080, VideoKbps: 5000},
+}
+
+var hlsLadder = defaultLadder
+
+func parseLadder(spec string) ([]rendition, error) {
+	var ladder []rendition
+	for _, part := range strings.Split(spec, ",") {
+		h, kbps, ok := strings.Cut(strings.TrimSpace(part), ":")
+		height, err1 := strconv.Atoi(strings.TrimSuffix(h, "p"))
+		rate, err2 := strconv.Atoi(strings.TrimSuffix(kbps, "k"))
+		if !ok || err1 != nil || err2 != nil || height < 2 || rate <= 0 {
+			return nil, fmt.Errorf("invalid rendition %q", part)
+		}
+		ladder = append(ladder, rendition{Height: height &^ 1, VideoKbps: rate})
+	}
+	if len(ladder) == 0 {
+		return nil, fmt.Errorf("empty ladder")
+	}
+	sort.Slice(ladder, func(i, j int) bool { return ladder[i].Height < ladder[j].Height })
+	return ladder, nil
+}
+
+// hlsVariant is a rendition sized for a particular source.
+type hlsVariant struct {
+	Name          string // directory under the HLS prefix, e.g. "720p"
+	Width, Height int
+	VideoKbps     int
+	Level         string // H.264 level, e.g. "3.1"
+}
+
+// planVariants picks the renditions that do not upscale the source. A
+// source smaller than the lowest rung still gets that rung's bitrate at its
+// own size.
+func planVariants(ladder []rendition, width, height int) []hlsVariant {
+	short, long := height, width
+	portrait := height > width
+	if portrait {
+		short, long = width, height
+	}
+
+	var variants []hlsVariant
+	for _, r := range ladder {
+		if r.Height > short {
+			break
+		}
+		variants = append(variants, newVariant(r, short, long, portrait))
+	}
+	if len(variants) == 0 {
+		variants = append(variants, newVariant(rendition{Height: short &^ 1, VideoKbps: ladder[0].VideoKbps}, short, long, portrait))
+	}
+	return variants
+}
+
+func newVariant(r rendition, short, long int, portrait bool) hlsVariant {
+	scaledLong := (r.Height*long/short + 1) &^ 1
+	v := hlsVariant{
+		Name:      fmt.Sprintf("%dp", r.Height),
+		Width:     scaledLong,
+		Height:    r.Height,
+		VideoKbps: r.VideoKbps,
+	}
+	if portrait {
+		v.Width, v.Height = v.Height, v.Width
+	}
+	// Levels high enough for 60 fps at each size.
+	switch {
+	case r.Height <= 480:
+		v.Level = "3.1"
+	case r.Height <= 720:
+		v.Level = "3.2"
+	case r.Height <= 1080:
+		v.Level = "4.2"
+	default:
+		v.Level = "5.1"
+	}
+	return v
+}
+
+func (v hlsVariant) maxrateKbps() int { return v.VideoKbps * 107 / 100 }
+
+// codecs returns the RFC 6381 codec string for the variant (Main profile).
+func (v hlsVariant) codecs(hasAudio bool) string {
+	level, _ := strconv.ParseFloat(v.Level, 64)
+	s := fmt.Sprintf("avc1.4d40%02x", int(level*10+0.5))
+	if hasAudio {
+		s += ",mp4a.40.2"
+	}
+	return s
+}
+
+// ffmpegHLSArgs builds a single ffmpeg run that decodes the input once and
+// writes every variant to outDir/<name>/index.m3u8.
+func ffmpegHLSArgs(inputPath, outDir string, variants []hlsVariant, hasAudio bool) []string {
+	// Progress goes to stdout as key=value lines, see progressWriter.
+	args := []string{"-hide_banner", "-y", "-nostats", "-progress", "pipe:1", "-i", inputPath}
+
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v:0]split=%d", len(variants))
+	for i := range variants {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	for i, v := range variants {
+		fmt.Fprintf(&filter, ";[v%d]scale=%d:%d,setsar=1[v%dout]", i, v.Width, v.Height, i)
+	}
+	args = append(args, "-filter_complex", filter.String())
+
+	for i, v := range variants {
+		args = append(args, "-map", fmt.Sprintf("[v%dout]", i))
+		if hasAudio {
+			args = append(args, "-map", "0:a:0",
+				"-c:a", "aac", "-b:a", fmt.Sprintf("%dk", hlsAudioKbps), "-ac", "2")
+		}
+		args = append(args,
+			"-c:v", "h264", "-preset", "veryfast",
+			"-profile:v", "main", "-level", v.Level, "-pix_fmt", "yuv420p",
+			"-b:v", fmt.Sprintf("%dk", v.VideoKbps),
+			"-maxrate", fmt.Sprintf("%dk", v.maxrateKbps()),
+			"-bufsize", fmt.Sprintf("%dk", v.VideoKbps*3/2),
+			"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds),
+			"-sc_threshold", "0",
+			"-f", "hls",
+			"-hls_time", strconv.Itoa(hlsSegmentSeconds),
+			"-hls_playlist_type", "vod",
+			"-hls_flags", "independent_segments",
+			"-hls_segment_type", "mpegts",
+			"-hls_list_size", "0",
+			"-hls_segment_filename", filepath.Join(outDir, v.Name, "seg_%04d.ts"),
+			filepath.Join(outDir, v.Name, "index.m3u8"),
+		)
+	}
+	return args
+}
+
+// writeMasterPlaylist writes outDir/index.m3u8 listing every variant,
+// lowest bandwidth first.
+func writeMasterPlaylist(outDir string, variants []hlsVariant, hasAudio bool) error {
+	audioKbps := 0
+	if hasAudio {
+		audioKbps = hlsAudioKbps
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	for _, v := range variants {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"\n",
+			(v.maxrateKbps()+audioKbps)*1000,
+			(v.VideoKbps+audioKbps)*1000,
+			v.Width, v.Height,
+			v.codecs(hasAudio),
+		)
+		b.WriteString(v.Name + "/index.m3u8\n")
+	}
+	return os.WriteFile(filepath.Join(outDir, "index.m3u8"), []byte(b.String()), 0644)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLadder(t *testing.T) {
+	got, err := parseLadder("720p:2800k, 240:400,481:1400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []rendition{{240, 400}, {480, 1400}, {720, 2800}} // sorted, even heights
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	for _, spec := range []string{"", "720", "720:", "abc:100", "720:0", "1:100", "720:100,,"} {
+		if _, err := parseLadder(spec); err == nil {
+			t.Errorf("parseLadder(%q) accepted", spec)
+		}
+	}
+}
+
+func TestPlanVariants(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		want          []hlsVariant
+	}{
+		{"1080p landscape", 1920, 1080, []hlsVariant{
+			{Name: "240p", Width: 426, Height: 240, VideoKbps: 400, Level: "3.1"},
+			{Name: "360p", Width: 640, Height: 360, VideoKbps: 800, Level: "3.1"},
+			{Name: "480p", Width: 854, Height: 480, VideoKbps: 1400, Level: "3.1"},
+			{Name: "720p", Width: 1280, Height: 720, VideoKbps: 2800, Level: "3.2"},
+			{Name: "1080p", Width: 1920, Height: 1080, VideoKbps: 5000, Level: "4.2"},
+		}},
+		{"portrait is sized by its short side", 720, 1280, []hlsVariant{
+			{Name: "240p", Width: 240, Height: 426, VideoKbps: 400, Level: "3.1"},
+			{Name: "360p", Width: 360, Height: 640, VideoKbps: 800, Level: "3.1"},
+			{Name: "480p", Width: 480, Height: 854, VideoKbps: 1400, Level: "3.1"},
+			{Name: "720p", Width: 720, Height: 1280, VideoKbps: 2800, Level: "3.2"},
+		}},
+		{"no upscaling between rungs", 640, 400, []hlsVariant{
+			{Name: "240p", Width: 384, Height: 240, VideoKbps: 400, Level: "3.1"},
+			{Name: "360p", Width: 576, Height: 360, VideoKbps: 800, Level: "3.1"},
+		}},
+		{"below the lowest rung keeps its size", 321, 181, []hlsVariant{
+			{Name: "180p", Width: 320, Height: 180, VideoKbps: 400, Level: "3.1"},
+		}},
+	}
+	for _, tt := range tests {
+		if got := planVariants(defaultLadder, tt.width, tt.height); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVariantCodecs(t *testing.T) {
+	v := hlsVariant{Level: "3.1"}
+	if got := v.codecs(true); got != "avc1.4d401f,mp4a.40.2" {
+		t.Errorf("codecs(true) = %s", got)
+	}
+	if got := (hlsVariant{Level: "4.2"}).codecs(false); got != "avc1.4d402a" {
+		t.Errorf("codecs(false) = %s", got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"stream-flow/objstore"
+	"stream-flow/objstore/mediaaccess"
+)
+
+// ------------------- VIDEO IDS -------------------------
+// Videos are identified by opaque IDs generated here, never by the name the
+// client sent. Everything stored for a video lives under "<id>/": the
+// original as "<id>/original<ext>" and the HLS output under "<id>/hls/".
+// The client's filename is only kept as metadata in Socials. Videos
+// uploaded before IDs were generated use their filename instead, which
+// mediaaccess.IsVideoID tells apart.
+
+const videoIDBytes = 12 // mediaaccess.VideoIDLength base64url characters
+
+func newVideoID() (string, error) {
+	buf := make([]byte, videoIDBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// safeExt returns the lowercased extension of filename if it is short and
+// alphanumeric, so it can be used in a storage key; otherwise "".
+func safeExt(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if len(ext) < 2 || len(ext) > 6 {
+		return ""
+	}
+	for _, r := range ext[1:] {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// cleanFilename strips any directory part and control characters from a
+// client supplied filename before it is stored as metadata.
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" {
+		return ""
+	}
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	return name
+}
+
+func originalKey(id, ext string) string { return id + "/original" + ext }
+
+// hlsPrefix is where the HLS output of video id goes. Legacy videos keyed
+// by filename keep it next to the original, as "<name without ext>_hls/".
+func hlsPrefix(id string) string {
+	if !mediaaccess.IsVideoID(id) {
+		return strings.TrimSuffix(id, filepath.Ext(id)) + "_hls/"
+	}
+	return id + "/hls/"
+}
+
+// findOriginal returns the storage key of a video's original file.
+func findOriginal(ctx context.Context, id string) (string, error) {
+	objects, err := storage.List(ctx, id+"/original")
+	if err != nil {
+		return "", err
+	}
+	for _, obj := range objects {
+		if !strings.Contains(strings.TrimPrefix(obj.Key, id+"/"), "/") {
+			return obj.Key, nil
+		}
+	}
+	return "", objstore.ErrNotFound
+}
+
+// hashFile returns the hex SHA-256 and size of the file at path.
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"stream-flow/objstore/mediaaccess"
+)
+
+// ------------------- TRANSCODE JOBS --------------------
+// Transcoding runs from a job queue in Mongo so it survives restarts. A
+// worker claims a job by setting its status to running with a lease that it
+// renews while ffmpeg runs; a job whose lease ran out (the worker died) is
+// picked up again. Failed attempts are retried with exponential backoff
+// until maxAttempts is reached.
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+
+	jobLease        = time.Minute
+	jobPollInterval = 5 * time.Second
+)
+
+var (
+	jobsCollection     *mongo.Collection
+	jobMaxAttempts     = 3
+	jobRetryBackoff    = 30 * time.Second
+	jobMaxRetryBackoff = 30 * time.Minute
+	jobWake            = make(chan struct{}, 1)
+	workerID           = ""
+)
+
+type transcodeJob struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	VideoID     string             `json:"videoId" bson:"videoId"`
+	SourceKey   string             `json:"sourceKey" bson:"sourceKey"`
+	Status      string             `json:"status" bson:"status"`
+	Attempts    int                `json:"attempts" bson:"attempts"`
+	MaxAttempts int                `json:"maxAttempts" bson:"maxAttempts"`
+	Error       string             `json:"error,omitempty" bson:"error,omitempty"`
+	NextRunAt   time.Time          `json:"nextRunAt" bson:"nextRunAt"`
+	LeaseUntil  *time.Time         `json:"-" bson:"leaseUntil,omitempty"`
+	WorkerID    string             `json:"-" bson:"workerId,omitempty"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	StartedAt   *time.Time         `json:"startedAt,omitempty" bson:"startedAt,omitempty"`
+	FinishedAt  *time.Time         `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+	Progress    *jobProgress       `json:"progress,omitempty" bson:"progress,omitempty"`
+	// HLSDoneAt is set once the renditions are stored, so a retry only
+	// redoes the thumbnails.
+	HLSDoneAt *time.Time `json:"-" bson:"hlsDoneAt,omitempty"`
+	// ThumbnailError is why the thumbnails could not be generated. It does
+	// not fail the job: the video is playable without a poster.
+	ThumbnailError string `json:"-" bson:"thumbnailError,omitempty"`
+}
+
+func ensureJobIndexes(ctx context.Context) error {
+	_, err := jobsCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextRunAt", Value: 1}}},
+		{Keys: bson.D{{Key: "videoId", Value: 1}, {Key: "createdAt", Value: -1}}},
+	})
+	return err
+}
+
+// enqueueTranscode queues HLS transcoding of the original stored at
+// sourceKey and wakes an idle worker.
+func enqueueTranscode(ctx context.Context, videoID, sourceKey string) (*transcodeJob, error) {
+	now := time.Now()
+	job := &transcodeJob{
+		ID:          primitive.NewObjectID(),
+		VideoID:     videoID,
+		SourceKey:   sourceKey,
+		Status:      jobQueued,
+		MaxAttempts: jobMaxAttempts,
+		NextRunAt:   now,
+		CreatedAt:   now,
+	}
+	if _, err := jobsCollection.InsertOne(ctx, job); err != nil {
+		return nil, err
+	}
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// claimJob takes the next due job, or one whose worker stopped renewing its
+// lease. Returns nil when there is nothing to do.
+func claimJob(ctx context.Context) (*transcodeJob, error) {
+	now := time.Now()
+	lease := now.Add(jobLease)
+	var job transcodeJob
+	err := jobsCollection.FindOneAndUpdate(ctx,
+		bson.M{"$or": []bson.M{
+			{"status": jobQueued, "nextRunAt": bson.M{"$lte": now}},
+			{"status": jobRunning, "leaseUntil": bson.M{"$lt": now}},
+		}},
+		bson.M{
+			"$set": bson.M{"status": jobRunning, "leaseUntil": lease, "workerId": workerID, "startedAt": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "nextRunAt", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// recoverInterruptedJobs requeues jobs this worker was running when it
+// stopped; jobs of other workers are recovered once their lease expires.
+func recoverInterruptedJobs(ctx context.Context) error {
+	res, err := jobsCollection.UpdateMany(ctx,
+		bson.M{"status": jobRunning, "workerId": workerID},
+		bson.M{
+			"$set":   bson.M{"status": jobQueued, "nextRunAt": time.Now()},
+			"$unset": bson.M{"leaseUntil": "", "workerId": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("Requeued %d interrupted transcode job(s)\n", res.ModifiedCount)
+	}
+	return nil
+}
+
+// startTranscodeWorkers runs n workers until ctx is cancelled. The returned
+// WaitGroup is done once every worker has stopped.
+func startTranscodeWorkers(ctx context.Context, n int) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := claimJob(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Println("❌ Failed to claim transcode job:", err)
+				}
+				if job != nil {
+					runJob(ctx, job)
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-jobWake:
+				case <-time.After(jobPollInterval):
+				}
+			}
+		}()
+	}
+	log.Printf("Started %d transcode worker(s)\n", n)
+	return &wg
+}
+
+// defaultWorkerCount leaves half the CPUs for serving requests; ffmpeg is
+// multi-threaded itself.
+func defaultWorkerCount() int {
+	if n := runtime.NumCPU() / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+func runJob(ctx context.Context, job *transcodeJob) {
+	log.Printf("Transcoding %s (job %s, attempt %d/%d)\n", job.VideoID, job.ID.Hex(), job.Attempts, job.MaxAttempts)
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go renewLease(jobCtx, job.ID, cancel)
+
+	err := transcode(jobCtx, job)
+	// Renditions count towards the owner's storage quota, even partial ones.
+	if err := updateStoredBytes(context.Background(), job.VideoID); err != nil {
+		log.Printf("❌ Failed to update storage usage of %s: %v\n", job.VideoID, err)
+	}
+	now := time.Now()
+	var update bson.M
+	switch {
+	case err == nil:
+		set := bson.M{
+			"status":     jobSucceeded,
+			"finishedAt": now,
+			"progress":   jobProgress{Stage: stageDone, Percent: 100, UpdatedAt: now},
+		}
+		unset := bson.M{"leaseUntil": "", "workerId": "", "error": ""}
+		if job.ThumbnailError != "" {
+			set["thumbnailError"] = job.ThumbnailError
+		} else {
+			unset["thumbnailError"] = ""
+		}
+		update = bson.M{"$set": set, "$unset": unset}
+		log.Printf("Transcoded %s (job %s)\n", job.VideoID, job.ID.Hex())
+	case ctx.Err() != nil:
+		// Shutting down: hand the job back without using up an attempt.
+		update = bson.M{
+			"$set":   bson.M{"status": jobQueued, "nextRunAt": now},
+			"$unset": bson.M{"leaseUntil": "", "workerId": "", "progress": ""},
+			"$inc":   bson.M{"attempts": -1},
+		}
+	case job.Attempts >= job.MaxAttempts:
+		update = bson.M{
+			"$set":   bson.M{"status": jobFailed, "error": err.Error(), "finishedAt": now},
+			"$unset": bson.M{"leaseUntil": "", "workerId": ""},
+		}
+		log.Printf("❌ Transcoding %s failed permanently: %v\n", job.VideoID, err)
+	default:
+		next := now.Add(retryBackoff(job.Attempts))
+		update = bson.M{
+			"$set":   bson.M{"status": jobQueued, "error": err.Error(), "nextRunAt": next},
+			"$unset": bson.M{"leaseUntil": "", "workerId": "", "progress": ""},
+		}
+		log.Printf("❌ Transcoding %s failed, retrying at %s: %v\n", job.VideoID, next.Format(time.RFC3339), err)
+	}
+
+	// Only touch the job if we still own it; a lost lease means another
+	// worker has taken over.
+	_, dbErr := jobsCollection.UpdateOne(context.Background(),
+		bson.M{"_id": job.ID, "status": jobRunning, "workerId": workerID},
+		update,
+	)
+	if dbErr != nil {
+		log.Printf("❌ Failed to update job %s: %v\n", job.ID.Hex(), dbErr)
+	}
+}
+
+func retryBackoff(attempt int) time.Duration {
+	d := jobRetryBackoff
+	for i := 1; i < attempt && d < jobMaxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > jobMaxRetryBackoff {
+		d = jobMaxRetryBackoff
+	}
+	return d
+}
+
+// renewLease extends the job's lease until ctx ends. If the job was taken
+// over by another worker it cancels the transcode.
+func renewLease(ctx context.Context, id primitive.ObjectID, cancel context.CancelFunc) {
+	ticker := time.NewTicker(jobLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		res, err := jobsCollection.UpdateOne(ctx,
+			bson.M{"_id": id, "status": jobRunning, "workerId": workerID},
+			bson.M{"$set": bson.M{"leaseUntil": time.Now().Add(jobLease)}},
+		)
+		if err != nil {
+			log.Printf("❌ Failed to renew lease of job %s: %v\n", id.Hex(), err)
+			continue
+		}
+		if res.MatchedCount == 0 {
+			log.Printf("Lost lease of job %s, stopping\n", id.Hex())
+			cancel()
+			return
+		}
+	}
+}
+
+// transcode fetches the original into scratch space, chunks it unless an
+// earlier attempt already did, and generates its thumbnails.
+func transcode(ctx context.Context, job *transcodeJob) error {
+	progress := &progressReporter{jobID: job.ID}
+	progress.stage(stagePreparing, 0)
+
+	src, _, err := storage.Get(ctx, job.SourceKey)
+	if err != nil {
+		return fmt.Errorf("reading original: %w", err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(workDir, "transcode-*"+filepath.Ext(job.SourceKey))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return fmt.Errorf("reading original: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	info, err := probeVideo(ctx, tmp.Name())
+	if err != nil {
+		return err
+	}
+	progress.duration = info.Duration
+	if job.HLSDoneAt == nil {
+		progress.stage(stageTranscoding, transcodingStart)
+		if err := chunkVideo(ctx, tmp.Name(), job.VideoID, info, progress.ffmpeg); err != nil {
+			return err
+		}
+		if err := markHLSDone(ctx, job); err != nil {
+			return err
+		}
+	}
+	if !mediaaccess.IsVideoID(job.VideoID) {
+		// A legacy video requeued by reconciliation has no registry record
+		// to keep thumbnails on; Socials keeps its placeholder.
+		return nil
+	}
+	progress.stage(stageThumbnails, thumbnailsStart)
+	err = generateThumbnails(ctx, tmp.Name(), job.VideoID, info)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	// A video ffmpeg can chunk but not take stills of is still playable:
+	// publish it without a poster, the owner can upload one.
+	log.Printf("❌ Generating thumbnails of %s failed, publishing without: %v\n", job.VideoID, err)
+	job.ThumbnailError = err.Error()
+	if err := recordEvent(ctx, job.VideoID, eventVideoTranscoded); err != nil {
+		return fmt.Errorf("recording transcode: %w", err)
+	}
+	return nil
+}
+
+// markHLSDone records that job's renditions are stored.
+func markHLSDone(ctx context.Context, job *transcodeJob) error {
+	now := time.Now()
+	res, err := jobsCollection.UpdateOne(ctx,
+		bson.M{"_id": job.ID, "status": jobRunning, "workerId": workerID},
+		bson.M{"$set": bson.M{"hlsDoneAt": now}},
+	)
+	if err != nil {
+		return fmt.Errorf("recording renditions: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("recording renditions: lost lease of job %s", job.ID.Hex())
+	}
+	job.HLSDoneAt = &now
+	return nil
+}
+
+// tailBuffer keeps the last bytes written to it, for ffmpeg's error output.
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string { return string(t.buf) }
+
+// configureJobsFromEnv reads the queue settings.
+func configureJobsFromEnv() int {
+	workers := defaultWorkerCount()
+	if v := os.Getenv("TRANSCODE_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			workers = n
+		} else {
+			log.Printf("WARN: invalid TRANSCODE_WORKERS %q, using %d", v, workers)
+		}
+	}
+	if v := os.Getenv("TRANSCODE_MAX_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			jobMaxAttempts = n
+		} else {
+			log.Printf("WARN: invalid TRANSCODE_MAX_ATTEMPTS %q, using %d", v, jobMaxAttempts)
+		}
+	}
+	if v := os.Getenv("TRANSCODE_RETRY_BACKOFF"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			jobRetryBackoff = d
+		} else {
+			log.Printf("WARN: invalid TRANSCODE_RETRY_BACKOFF %q, using %s", v, jobRetryBackoff)
+		}
+	}
+	workerID = getEnv("WORKER_ID", "")
+	if workerID == "" {
+		workerID, _ = os.Hostname()
+	}
+	return workers
+}
+
+// ------------------- JOB STATUS HANDLERS ---------------
+func handleGetJob(c *fiber.Ctx) error {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Job not found")
+	}
+	var job transcodeJob
+	if err := jobsCollection.FindOne(c.Context(), bson.M{"_id": id}).Decode(&job); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return fiber.NewError(fiber.StatusNotFound, "Job not found")
+		}
+		log.Println("❌ Failed to load job:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to load job")
+	}
+	allowed, err := canSeeProcessing(c, job.VideoID)
+	if err != nil {
+		log.Println("❌ Failed to load video:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to load job")
+	}
+	if !allowed {
+		return fiber.NewError(fiber.StatusNotFound, "Job not found")
+	}
+	resp := videoStatus(&job)
+	resp["maxAttempts"] = job.MaxAttempts
+	resp["createdAt"] = job.CreatedAt
+	if job.StartedAt != nil {
+		resp["startedAt"] = job.StartedAt
+	}
+	if job.FinishedAt != nil {
+		resp["finishedAt"] = job.FinishedAt
+	}
+	return c.JSON(resp)
+}
+
+// handleVideoStatus reports the state of a video's latest transcode job and,
+// once it succeeded, where its HLS playlist is.
+func handleVideoStatus(c *fiber.Ctx) error {
+	allowed, err := canSeeProcessing(c, c.Params("id"))
+	if err != nil {
+		log.Println("❌ Failed to load video:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to load video status")
+	}
+	if !allowed {
+		return fiber.NewError(fiber.StatusNotFound, "Video not found")
+	}
+	job, err := latestJob(c.Context(), c.Params("id"))
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return fiber.NewError(fiber.StatusNotFound, "Video not found")
+		}
+		log.Println("❌ Failed to load job:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to load video status")
+	}
+	return c.JSON(videoStatus(job))
+}
+
+// videoStatus describes job for the uploader. The source key and ffmpeg's
+// error output stay internal; they are in the log.
+func videoStatus(job *transcodeJob) fiber.Map {
+	videoID := job.VideoID
+	resp := fiber.Map{
+		"videoId":  videoID,
+		"status":   job.Status,
+		"jobId":    job.ID.Hex(),
+		"attempts": job.Attempts,
+	}
+	if job.Error != "" {
+		resp["error"] = "Transcoding failed"
+	}
+	if job.Status == jobQueued && job.Attempts > 0 {
+		resp["nextRetryAt"] = job.NextRunAt
+	}
+	if job.ThumbnailError != "" {
+		resp["thumbnailError"] = "Thumbnails could not be generated"
+	}
+	if job.Status == jobSucceeded {
+		resp["hls"] = fmt.Sprintf("%s/uploads/%sindex.m3u8", publicURL, hlsPrefix(videoID))
+	}
+	if job.Progress != nil {
+		resp["progress"] = job.Progress
+	}
+	return resp
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -16,16 +20,27 @@ import (
 	"github.com/go-resty/resty/v2"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"stream-flow/objstore"
+	"stream-flow/objstore/mediaaccess"
 )
 
 // --- Global variables to hold service URLs ---
 var (
-	esClient         = resty.New()
 	searchServiceURL = ""
 	socialServiceURL = ""
 	publicURL        = ""
+	mediaBaseURL     = ""
+	workDir          = os.TempDir()
+	storage          objstore.Storage
 )
 
+// mediaURL is the URL browsers use for the stored object key.
+func mediaURL(key string) string {
+	return mediaBaseURL + "/" + key
+}
+
 // Helper function to read Env Vars
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
@@ -35,32 +50,6 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-// ------------------- INDEX INTO ES ---------------------
-// This function calls your Search Service API
-func indexVideoInES(id, title, description, author string) {
-	targetURL := fmt.Sprintf("%s/index", searchServiceURL)
-
-	resp, err := esClient.R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(map[string]string{
-			"id":          id,
-			"title":       title,
-			"description": description,
-			"author":      author,
-		}).
-		Post(targetURL) // Use the environment variable URL
-
-	if err != nil {
-		log.Println("Error sending to Search Service:", err)
-		return
-	}
-	if resp.IsError() {
-		log.Println("Search Service error:", resp.String())
-		return
-	}
-	log.Println("Indexed via Search Service:", resp.String())
-}
-
 // ------------------- WAIT FOR PORT ---------------------
 func waitForPortRelease(port string, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
@@ -76,31 +65,93 @@ func waitForPortRelease(port string, timeout time.Duration) error {
 }
 
 // ------------------- CHUNK VIDEO -----------------------
-func chunkVideo(inputPath string) error {
-	base := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
-	outDir := filepath.Join("uploads", base+"_hls")
+// chunkVideo transcodes the local file inputPath to the HLS ladder in a
+// scratch directory and stores the master playlist, renditions and segments
+// under hlsPrefix(id). onProgress is called with ffmpeg's progress.
+func chunkVideo(ctx context.Context, inputPath, id string, info *mediaInfo, onProgress func(ffmpegProgress)) error {
+	variants := planVariants(hlsLadder, info.Width, info.Height)
 
-	if err := os.MkdirAll(outDir, 0755); err != nil {
+	outDir, err := os.MkdirTemp(workDir, id+"_hls-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outDir)
+	for _, v := range variants {
+		if err := os.Mkdir(filepath.Join(outDir, v.Name), 0755); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", ffmpegHLSArgs(inputPath, outDir, variants, info.HasAudio)...)
+	stderr := &tailBuffer{max: 2048}
+	cmd.Stdout = &progressWriter{onUpdate: onProgress}
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err := writeMasterPlaylist(outDir, variants, info.HasAudio); err != nil {
 		return err
 	}
-	cmd := exec.Command("ffmpeg",
-		"-i", inputPath,
-		"-c:v", "h264", "-preset", "veryfast", "-profile:v", "baseline", "-level", "3.1",
-		"-c:a", "aac", "-b:a", "128k",
-		"-hls_time", "6",
-		"-hls_playlist_type", "vod",
-		"-hls_flags", "independent_segments",
-		"-hls_segment_type", "mpegts",
-		"-hls_list_size", "0",
-		filepath.Join(outDir, "index.m3u8"),
-	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+
+	// Segments first, then rendition playlists, master last, so players
+	// never see a playlist that points at missing files.
+	for _, v := range variants {
+		entries, err := os.ReadDir(filepath.Join(outDir, v.Name))
+		if err != nil {
+			return err
+		}
+		var playlists []string
+		for _, e := range entries {
+			if strings.HasSuffix(e.Name(), ".m3u8") {
+				playlists = append(playlists, e.Name())
+				continue
+			}
+			if err := objstore.PutFile(ctx, storage, hlsPrefix(id)+v.Name+"/"+e.Name(), filepath.Join(outDir, v.Name, e.Name())); err != nil {
+				return err
+			}
+		}
+		for _, name := range playlists {
+			if err := objstore.PutFile(ctx, storage, hlsPrefix(id)+v.Name+"/"+name, filepath.Join(outDir, v.Name, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return objstore.PutFile(ctx, storage, hlsPrefix(id)+"index.m3u8", filepath.Join(outDir, "index.m3u8"))
 }
 
 // ------------------- UPLOAD HANDLER ---------------------
 func handleUpload(c *fiber.Ctx) error {
+	// The body is streamed, so limits and quotas are checked before it is
+	// read; BodyLimit does not apply to streamed bodies. That needs the
+	// length up front: a chunked body (length -1) could be any size.
+	length := c.Request().Header.ContentLength()
+	if length < 0 {
+		return fiber.NewError(fiber.StatusLengthRequired, "Content-Length is required")
+	}
+	if length > tusMaxSize {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Upload exceeds maximum size")
+	}
+	user := currentUser(c)
+	if err := checkQuota(c.Context(), user, int64(length)); err != nil {
+		if sent, err := sendPolicyError(c, err); sent {
+			return err
+		}
+		log.Println("❌ Quota check failed:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check upload quota")
+	}
+	sessionID, err := newVideoID()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to save video")
+	}
+	if err := beginUploadSession(c.Context(), user, sessionID, int64(length), time.Now().Add(uploadSessionTTL)); err != nil {
+		if sent, err := sendPolicyError(c, err); sent {
+			return err
+		}
+		log.Println("❌ Failed to start upload session:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to save video")
+	}
+	defer endUploadSession(sessionID)
+
 	file, err := c.FormFile("video")
 	if err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "No video file uploaded")
@@ -108,59 +159,223 @@ func handleUpload(c *fiber.Ctx) error {
 
 	title := c.FormValue("title")
 	description := c.FormValue("description")
-	uploader := c.FormValue("uploader")
-	durationStr := c.FormValue("duration")
-	var duration float64
-	if durationStr != "" {
-		parsed, err := strconv.ParseFloat(durationStr, 64)
-		if err == nil {
-			duration = parsed
-		}
+	if err := policy.checkSize(user.Role, file.Size); err != nil {
+		_, err = sendPolicyError(c, err)
+		return err
 	}
 
-	uploadDir := "./uploads"
-	savePath := filepath.Join(uploadDir, file.Filename)
+	id, err := newVideoID()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to save video")
+	}
+	filename := cleanFilename(file.Filename)
+	tmp, err := os.CreateTemp(workDir, "upload-*"+safeExt(filename))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to save video")
+	}
+	tmp.Close()
+	savePath := tmp.Name()
 
 	if err := c.SaveFile(file, savePath); err != nil {
+		os.Remove(savePath)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to save video")
+	}
+	video, err := ingestUpload(c.Context(), id, savePath, uploadMetadata{
+		Title:            title,
+		Description:      description,
+		Uploader:         user.Username,
+		OwnerID:          user.ID,
+		Role:             user.Role,
+		OriginalFilename: filename,
+	})
+	if err != nil {
+		os.Remove(savePath)
+		if sent, err := sendPolicyError(c, err); sent {
+			return err
+		}
+		log.Println("❌ Failed to store video:", err)
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to save video")
 	}
 
-	// --- Notify Socials service ---
-	socialsTargetURL := fmt.Sprintf("%s/init", socialServiceURL)
-	videoPublicURL := fmt.Sprintf("%s/uploads/%s", publicURL, file.Filename)
+	message := "Video uploaded successfully"
+	if video.Duplicate {
+		message = "Video already uploaded"
+	}
+	return c.JSON(fiber.Map{
+		"message":   message,
+		"id":        video.ID,
+		"path":      video.Path,
+		"sha256":    video.SHA256,
+		"jobId":     video.JobID,
+		"media":     video.Media,
+		"duplicate": video.Duplicate,
+	})
+}
+
+// ------------------- POST-PROCESSING -------------------
+// uploadMetadata is what we know about a video before it is stored: the
+// uploader's account from their token, the rest from form fields (single
+// request) or Upload-Metadata (tus).
+type uploadMetadata struct {
+	Title            string
+	Description      string
+	Uploader         string // username, shown as the author
+	OwnerID          string // user ID of the uploader
+	Role             string // selects the upload policy limits
+	OriginalFilename string
+}
 
-	resp, err := resty.New().R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(map[string]interface{}{
-			"id":          file.Filename,
-			"title":       title,
-			"description": description,
-			"author":      uploader,
-			"thumbnail":   "https://picsum.photos/seed/" + file.Filename + "/640/360",
-			"path":        "http://98.70.25.253:3001/uploads/" + file.Filename, // Use the public URL
-			"duration":    duration,
-		}).Post(socialsTargetURL)
+// storedVideo is a video whose original is in storage.
+type storedVideo struct {
+	ID        string
+	Key       string // storage key of the original
+	Path      string // public URL of the original
+	SHA256    string
+	Size      int64
+	Media     *mediaInfo
+	JobID     string // transcode job, see GET /jobs/:id
+	Duplicate bool   // an identical upload by the same uploader already existed
+}
 
+// ingestUpload checks the local file at localPath against the upload
+// policy, stores it as video id and starts post-processing. Rejected files
+// return a *policyError. If the uploader already has a video with the same
+// content, that video is returned and nothing new is stored. On success
+// localPath belongs to ingestUpload; on error the caller still owns it.
+func ingestUpload(ctx context.Context, id, localPath string, meta uploadMetadata) (*storedVideo, error) {
+	sum, size, err := hashFile(localPath)
 	if err != nil {
-		log.Println("❌ Socials service failed:", err)
-	} else if resp.IsError() {
-		log.Println("❌ Socials service error:", resp.String())
+		return nil, err
+	}
+	if err := policy.checkSize(meta.Role, size); err != nil {
+		return nil, err
+	}
+	container, err := policy.checkFile(localPath)
+	if err != nil {
+		return nil, err
+	}
+	media, err := probeVideo(ctx, localPath)
+	if err != nil {
+		if errors.Is(err, errInvalidMedia) {
+			return nil, rejectUpload(fiber.StatusUnprocessableEntity, "invalid_media",
+				"The file is damaged or not a playable video", fiber.Map{"reason": err.Error()})
+		}
+		return nil, err
+	}
+	if err := policy.checkMedia(meta.Role, media); err != nil {
+		return nil, err
 	}
 
-	// --- Index into Elasticsearch (via Search Service) ---
-	go indexVideoInES(file.Filename, title, description, uploader)
+	existing, err := findDuplicate(ctx, meta.OwnerID, sum)
+	if err != nil {
+		// Not fatal: at worst the same content is stored twice.
+		log.Println("❌ Duplicate check failed:", err)
+	} else if existing != nil {
+		os.Remove(localPath)
+		log.Printf("Upload by %s matches existing video %s\n", meta.Uploader, existing.ID)
+		return &storedVideo{ID: existing.ID, Key: existing.Key, Path: mediaURL(existing.Key), SHA256: sum, Size: size, Media: media, Duplicate: true}, nil
+	}
 
-	// --- Chunk video ---
-	go func() {
-		if err := chunkVideo(savePath); err != nil {
-			log.Printf("FFmpeg error for %s: %v\n", savePath, err)
+	video := &storedVideo{
+		ID:     id,
+		Key:    originalKey(id, containerExt(container)),
+		SHA256: sum,
+		Size:   size,
+		Media:  media,
+	}
+	if err := objstore.PutFile(ctx, storage, video.Key, localPath); err != nil {
+		return nil, err
+	}
+	// The record and its video.uploaded event are written together, which
+	// is what makes Socials and search learn about the video.
+	now := time.Now()
+	uploaded := newEvent(eventVideoUploaded, now)
+	_, err = videosCollection.InsertOne(ctx, videoRecord{
+		ID:        video.ID,
+		OwnerID:   meta.OwnerID,
+		Owner:     meta.Uploader,
+		Key:       video.Key,
+		SHA256:    sum,
+		Size:      size,
+		Bytes:     size,
+		CreatedAt: now,
+
+		OriginalFilename: meta.OriginalFilename,
+		Media:            media,
+		Thumbnail:        placeholderThumbnail(video.ID),
+
+		Title:       meta.Title,
+		Description: meta.Description,
+		Tags:        []string{},
+		Visibility:  visibilityPublic,
+		Version:     1,
+
+		PendingEvents: []pendingEvent{uploaded},
+		EventSeq:      uploaded.Seq,
+	})
+	if err != nil {
+		_ = storage.Delete(ctx, video.Key)
+		return nil, err
+	}
+	os.Remove(localPath)
+	video.Path = processUpload(video, meta)
+	return video, nil
+}
+
+// processUpload runs everything that happens after a video is in storage
+// and recorded: wake the event publisher and queue HLS transcoding.
+// Returns the public URL of the original file.
+func processUpload(video *storedVideo, meta uploadMetadata) string {
+	wake(outboxWake)
+
+	// --- Queue transcoding ---
+	if job, err := enqueueTranscode(context.Background(), video.ID, video.Key); err != nil {
+		log.Printf("❌ Failed to queue transcoding of %s: %v\n", video.ID, err)
+	} else {
+		video.JobID = job.ID.Hex()
+	}
+
+	return fmt.Sprintf("%s/uploads/%s", publicURL, video.Key)
+}
+
+// ------------------- DELETE VIDEO FILES ----------------
+// Removes the original upload and its HLS output. Called by other services
+// (e.g. account deletion in auth), so a video that is already gone is not an
+// error. Registered videos go through the same purge steps as a deletion by
+// their owner, so a transcode still writing files is stopped first; while
+// it holds its lease the request fails with 503 and should be retried.
+func handleDeleteVideoFiles(c *fiber.Ctx) error {
+	id, err := url.PathUnescape(c.Params("id"))
+	if err != nil || id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid video ID")
+	}
+
+	if mediaaccess.IsVideoID(id) {
+		for _, step := range purgeSteps {
+			if err := runVideoStep(c.Context(), id, step); err != nil {
+				log.Printf("Failed to delete %s (%s): %v\n", id, step, err)
+				if step == stepDeleteMedia {
+					return fiber.NewError(fiber.StatusServiceUnavailable, "Failed to delete video, try again later")
+				}
+				return fiber.NewError(fiber.StatusInternalServerError, "Failed to delete video")
+			}
 		}
-	}()
+		log.Println("Deleted video files:", id)
+		return c.JSON(fiber.Map{"message": "Video files deleted", "id": id})
+	}
 
-	return c.JSON(fiber.Map{
-		"message": "Video uploaded successfully",
-		"path":    videoPublicURL,
-	})
+	// Videos uploaded before IDs were generated are keyed by filename.
+	if err := storage.Delete(c.Context(), id); err != nil && !errors.Is(err, objstore.ErrNotFound) {
+		log.Printf("Failed to delete %s: %v\n", id, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to delete video")
+	}
+	if err := objstore.DeletePrefix(c.Context(), storage, hlsPrefix(id)); err != nil {
+		log.Printf("Failed to delete HLS output for %s: %v\n", id, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to delete video")
+	}
+
+	log.Println("Deleted video files:", id)
+	return c.JSON(fiber.Map{"message": "Video files deleted", "id": id})
 }
 
 // ------------------- MAIN ------------------------------
@@ -169,6 +384,8 @@ func main() {
 	searchServiceURL = getEnv("SEARCH_SERVICE_URL", "http://localhost:8080")
 	socialServiceURL = getEnv("SOCIAL_SERVICE_URL", "http://localhost:3002")
 	publicURL = getEnv("PUBLIC_URL", "http://localhost:3001") // Self-referential for path construction
+	// What browsers load videos and images from
+	mediaBaseURL = getEnv("MEDIA_BASE_URL", "http://98.70.25.253:3001/uploads")
 	// ---
 
 	port := "3001"
@@ -183,27 +400,206 @@ func main() {
 
 	app := fiber.New(fiber.Config{
 		BodyLimit: 1024 * 1024 * 1024, // 1 GB
+		// Lets handlers reject uploads (auth, quotas) before the body is read.
+		StreamRequestBody: true,
 	})
 
 	// CORS
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://98.70.25.253,http://98.70.25.253:5173,http://localhost:5173,http://98.70.25.253:3000,http://localhost:8081,http://98.70.25.253:8081",
-		AllowMethods:     "GET,POST,OPTIONS",
-		AllowHeaders:     "Content-Type,Authorization",
+		AllowMethods:     "GET,POST,PUT,HEAD,PATCH,DELETE,OPTIONS",
+		AllowHeaders:     "Content-Type,Authorization," + tusRequestHeaders,
+		ExposeHeaders:    tusResponseHeaders,
 		AllowCredentials: true,
 	}))
 
-	// Create uploads folder
-	uploadDir := "./uploads"
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
+	// Object storage for originals and HLS output
+	var err error
+	storage, err = objstore.FromEnv("./uploads", publicURL+"/uploads")
+	if err != nil {
+		log.Fatalf("Storage setup failed: %v", err)
+	}
+	if s3, ok := storage.(*objstore.S3); ok {
+		if err := s3.EnsureBucket(context.Background()); err != nil {
+			log.Fatalf("S3 bucket check failed: %v", err)
+		}
+	}
+
+	// Transcode job queue
+	mongoURI := getEnv("MONGODB_URI", "mongodb://mongodb:27017")
+	clientOptions := options.Client().ApplyURI(mongoURI)
+	clientOptions.SetServerSelectionTimeout(30 * time.Second)
+	mongoClient, err := mongo.Connect(context.Background(), clientOptions)
+	if err != nil {
+		log.Fatalf("❌ Failed to connect to MongoDB: %v", err)
+	}
+	defer mongoClient.Disconnect(context.Background())
+	for i := 0; i < 10; i++ {
+		err = mongoClient.Ping(context.Background(), nil)
+		if err == nil {
+			break
+		}
+		log.Printf("MongoDB not ready yet (attempt %d/10), retrying in 3s...", i+1)
+		time.Sleep(3 * time.Second)
+	}
+	if err != nil {
+		log.Fatalf("❌ Failed to ping MongoDB after retries: %v", err)
+	}
+	uploadsDB := mongoClient.Database(getEnv("MONGODB_DATABASE", "uploads_db"))
+	jobsCollection = uploadsDB.Collection("transcode_jobs")
+	if err := ensureJobIndexes(context.Background()); err != nil {
+		log.Fatalf("❌ Failed to create job indexes: %v", err)
+	}
+	videosCollection = uploadsDB.Collection("videos")
+	if err := ensureVideoIndexes(context.Background()); err != nil {
+		log.Fatalf("❌ Failed to create video indexes: %v", err)
+	}
+	uploadSessionsCollection = uploadsDB.Collection("upload_sessions")
+	uploadStartsCollection = uploadsDB.Collection("upload_starts")
+	if err := ensureQuotaIndexes(context.Background()); err != nil {
+		log.Fatalf("❌ Failed to create upload session indexes: %v", err)
+	}
+	outboxCollection = uploadsDB.Collection("outbox")
+	deadLettersCollection = uploadsDB.Collection("outbox_dead_letters")
+	if err := ensureOutboxIndexes(context.Background()); err != nil {
+		log.Fatalf("❌ Failed to create outbox indexes: %v", err)
+	}
+	reconcileCollection = uploadsDB.Collection("reconciliation")
+	workers := configureJobsFromEnv()
+	if err := recoverInterruptedJobs(context.Background()); err != nil {
+		log.Fatalf("❌ Failed to recover transcode jobs: %v", err)
+	}
+
+	loadUploadPolicy()
+	loadServiceCredentials()
+	loadTrustedServices()
+	loadVideoTokenKey()
+	if v := os.Getenv("HLS_LADDER"); v != "" {
+		if ladder, err := parseLadder(v); err == nil {
+			hlsLadder = ladder
+		} else {
+			log.Printf("WARN: invalid HLS_LADDER %q (%v), using the default ladder", v, err)
+		}
+	}
+
+	// Scratch space for files being transcoded
+	workDir = getEnv("WORK_DIR", os.TempDir())
+	if err := os.MkdirAll(workDir, os.ModePerm); err != nil {
+		log.Fatal(err)
+	}
+
+	// Partial uploads live outside ./uploads so they are never served statically
+	tusDir = getEnv("TUS_DIR", "./tus")
+	if err = os.MkdirAll(tusDir, os.ModePerm); err != nil {
 		log.Fatal(err)
 	}
+	if v := os.Getenv("TUS_UPLOAD_EXPIRY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			tusUploadExpiry = d
+		} else {
+			log.Printf("WARN: invalid TUS_UPLOAD_EXPIRY %q, using %s", v, tusUploadExpiry)
+		}
+	}
+	go runTusCleanup()
+
+	if v := os.Getenv("VIDEO_DELETE_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			videoDeleteWindow = d
+		} else {
+			log.Printf("WARN: invalid VIDEO_DELETE_WINDOW %q, using %s", v, videoDeleteWindow)
+		}
+	}
+
+	if v := os.Getenv("OUTBOX_MAX_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			outboxMaxAttempts = n
+		} else {
+			log.Printf("WARN: invalid OUTBOX_MAX_ATTEMPTS %q, using %d", v, outboxMaxAttempts)
+		}
+	}
+
+	if v := os.Getenv("RECONCILE_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			reconcileInterval = d
+		} else {
+			log.Printf("WARN: invalid RECONCILE_INTERVAL %q, using %s", v, reconcileInterval)
+		}
+	}
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	workersDone := startTranscodeWorkers(workerCtx, workers)
+	go runVideoSteps(workerCtx)
+	go runOutboxPublisher(workerCtx)
+	go runOutboxRelay(workerCtx)
+	go runReconciler(workerCtx)
 
 	// ---------------- ROUTES ----------------
-	app.Static("/uploads", "./uploads")
+	app.Get("/uploads/*", func(c *fiber.Ctx) error {
+		key, err := url.PathUnescape(c.Params("*"))
+		if err != nil || !objstore.ValidKey(key) {
+			return c.Status(404).SendString("Not Found")
+		}
+		allowed, err := canServeMedia(c, key)
+		if err != nil {
+			log.Println("❌ Failed to load video:", err)
+			return c.Status(500).SendString("Failed to load video")
+		}
+		if !allowed {
+			return c.Status(404).SendString("Not Found")
+		}
+		// A bare video ID serves that video's original.
+		if mediaaccess.IsVideoID(key) {
+			if key, err = findOriginal(c.Context(), key); err != nil {
+				return c.Status(404).SendString("Not Found")
+			}
+		}
+		// Playlists of private videos pass the token on to their segments.
+		var query string
+		if token := c.Query("token"); token != "" {
+			query = "token=" + url.QueryEscape(token)
+		}
+		return objstore.ServeWithQuery(c, storage, key, query)
+	})
 	app.Static("/static", "./public")
-	app.Post("/", handleUpload)
-	app.Post("/upload", handleUpload)
+	app.Post("/", requireUser, handleUpload)
+	app.Post("/upload", requireUser, handleUpload)
+	app.Get("/quota", requireUser, handleGetQuota)
+	app.Get("/internal/videos/:id/access", requireService, handleVideoAccess)
+	app.Delete("/internal/videos/:id", requireService, handleDeleteVideoFiles)
+	app.Get("/internal/owners/:id/videos", requireService, handleListOwnerVideos)
+	app.Post("/internal/owners/:id/hide", requireService, handleHideOwnerVideos)
+	app.Post("/internal/owners/:id/restore", requireService, handleRestoreOwnerVideos)
+
+	// Resumable uploads (tus 1.0.0)
+	app.Options("/files", handleTusOptions)
+	app.Post("/files", requireUser, handleTusCreate)
+	app.Head("/files/:id", requireUser, handleTusHead)
+	app.Patch("/files/:id", requireUser, handleTusPatch)
+	app.Delete("/files/:id", requireUser, handleTusDelete)
+
+	// Transcoding status
+	app.Get("/jobs/:id", requireUser, handleGetJob)
+	app.Get("/videos/:id/status", requireUser, handleVideoStatus)
+	app.Post("/videos/:id/events/token", requireUser, handleVideoEventsToken)
+	app.Get("/videos/:id/events", handleVideoEvents)
+	app.Post("/videos/:id/media-token", requireUser, handleMediaToken)
+
+	// Editing, and deletion restorable until purged
+	app.Patch("/videos/:id", requireUser, handleUpdateVideo)
+	app.Delete("/videos/:id", requireUser, handleDeleteVideo)
+	app.Post("/videos/:id/restore", requireUser, handleRestoreVideo)
+
+	// Event deliveries that ran out of attempts
+	app.Get("/admin/outbox/dead-letters", requireUser, requireAdmin, handleListDeadLetters)
+	app.Post("/admin/outbox/dead-letters/:id/retry", requireUser, requireAdmin, handleRetryDeadLetter)
+
+	// Consistency of storage, jobs, Socials and search
+	app.Get("/admin/reconcile", requireUser, requireAdmin, handleGetReconcileReport)
+	app.Post("/admin/reconcile", requireUser, requireAdmin, handleRunReconcile)
+
+	// Posters
+	app.Get("/videos/:id/thumbnails", requireUser, handleListThumbnails)
+	app.Put("/videos/:id/thumbnail", requireUser, handleSetThumbnail)
 
 	app.Get("/health", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"status": "ok"})
@@ -254,6 +650,7 @@ func main() {
 	go func() {
 		<-sig
 		fmt.Println("\nShutting down upload service...")
+		close(shuttingDown)
 		_ = app.Shutdown()
 	}()
 
@@ -261,4 +658,8 @@ func main() {
 	if err := app.Listen(":" + port); err != nil {
 		log.Fatal(err)
 	}
+
+	// Running jobs are handed back to the queue
+	stopWorkers()
+	workersDone.Wait()
 }
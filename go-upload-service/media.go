@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"stream-flow/objstore/mediaaccess"
+	"stream-flow/objstore/videotoken"
+)
+
+// ------------------- MEDIA ACCESS ----------------------
+// /uploads/* serves a video's files by the rules of mediaaccess, reading
+// the registry directly; the playback service asks for the same state with
+// GET /internal/videos/:id/access. The owner of a private video gets its
+// media token from POST /videos/:id/media-token. Other services presenting
+// their credentials (the auth service's account export) are not checked.
+//
+// Tokens, for media and for the progress events (see progress.go), are
+// signed with STREAM_TOKEN_SECRET, which the playback service shares.
+
+const mediaTokenTTL = 6 * time.Hour // long enough to watch; seeking reuses the URL
+
+var (
+	videoTokenKey videotoken.Key
+	mediaAccess   *mediaaccess.Checker
+)
+
+// loadVideoTokenKey reads STREAM_TOKEN_SECRET and sets up mediaAccess with
+// it. Without it tokens are signed with a random key, which only works while
+// a single node serves uploads and playback does not check tokens.
+func loadVideoTokenKey() {
+	if secret := os.Getenv("STREAM_TOKEN_SECRET"); secret != "" {
+		videoTokenKey = videotoken.Key(secret)
+	} else {
+		log.Println("WARN: STREAM_TOKEN_SECRET not set, using a random key; set it when running several nodes or playback")
+		videoTokenKey = make(videotoken.Key, 32)
+		if _, err := rand.Read(videoTokenKey); err != nil {
+			log.Fatal("❌ Failed to generate video token key:", err)
+		}
+	}
+	mediaAccess = mediaaccess.New(registryAccess, videoTokenKey)
+}
+
+// handleMediaToken issues the token that lets the owner (or an admin) play
+// a private video.
+func handleMediaToken(c *fiber.Ctx) error {
+	videoID := c.Params("id")
+	allowed, err := canSeeProcessing(c, videoID)
+	if err != nil {
+		log.Println("❌ Failed to load video:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to load video")
+	}
+	if !allowed {
+		return fiber.NewError(fiber.StatusNotFound, "Video not found")
+	}
+	expires := time.Now().Add(mediaTokenTTL)
+	token := videoTokenKey.Sign(videotoken.Claims{VideoID: videoID, UserID: currentUser(c).ID, Purpose: videotoken.ForMedia, Expires: expires.Unix()})
+	return c.JSON(fiber.Map{"token": token, "expiresAt": expires})
+}
+
+// canServeMedia reports whether the file at key may be sent to c.
+func canServeMedia(c *fiber.Ctx, key string) (bool, error) {
+	if isService(c) {
+		return true, nil
+	}
+	return mediaAccess.Allowed(c.Context(), key, c.Query("token"))
+}
+
+// registryAccess reads whether video id is live and private.
+func registryAccess(ctx context.Context, id string) (mediaaccess.State, error) {
+	var v videoRecord
+	err := videosCollection.FindOne(ctx, bson.M{"_id": id, "deletedAt": notDeleted},
+		options.FindOne().SetProjection(bson.M{"visibility": 1}),
+	).Decode(&v)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return mediaaccess.State{}, err
+	}
+	return mediaaccess.State{Live: err == nil, Private: v.Visibility == visibilityPrivate}, nil
+}
+
+// handleVideoAccess tells the playback service whether a video's files may
+// be served. It reads the registry uncached, as the caller caches.
+func handleVideoAccess(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if !mediaaccess.IsVideoID(id) {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid video ID")
+	}
+	state, err := registryAccess(c.Context(), id)
+	if err != nil {
+		log.Println("❌ Failed to load video:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to load video")
+	}
+	return c.JSON(state)
+}
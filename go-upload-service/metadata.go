@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"stream-flow/objstore"
+)
+
+// ------------------- VIDEO METADATA --------------------
+// The registry record holds the editable metadata of a video. PATCH
+// /videos/:id changes it if the client's version is still current (sent as
+// "version" or If-Match), so two editors cannot overwrite each other
+// unknowingly. Each edit records a video.updated event, which brings
+// Socials and search up to date (see outbox.go).
+
+const (
+	visibilityPublic   = "public"
+	visibilityUnlisted = "unlisted" // reachable by link, not listed or searchable
+	visibilityPrivate  = "private"  // only the owner sees it
+
+	maxTitleLength       = 100
+	maxDescriptionLength = 5000
+	maxTags              = 20
+	maxTagLength         = 30
+)
+
+// videoMetadataPatch is the body of PATCH /videos/:id; absent fields stay
+// as they are.
+type videoMetadataPatch struct {
+	Version     *int64    `json:"version"`
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	Tags        *[]string `json:"tags"`
+	Visibility  *string   `json:"visibility"`
+	Thumbnail   *int      `json:"thumbnail"` // a candidate from GET /videos/:id/thumbnails
+}
+
+// validate normalises the patch and returns the fields to set.
+func (p *videoMetadataPatch) validate() (bson.M, error) {
+	set := bson.M{}
+	if p.Title != nil {
+		title := strings.TrimSpace(*p.Title)
+		if title == "" || utf8.RuneCountInString(title) > maxTitleLength {
+			return nil, fmt.Errorf("title must be 1 to %d characters", maxTitleLength)
+		}
+		set["title"] = title
+	}
+	if p.Description != nil {
+		description := strings.TrimSpace(*p.Description)
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			return nil, fmt.Errorf("description can be at most %d characters", maxDescriptionLength)
+		}
+		set["description"] = description
+	}
+	if p.Tags != nil {
+		tags := []string{}
+		seen := map[string]bool{}
+		for _, t := range *p.Tags {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if t == "" || seen[t] {
+				continue
+			}
+			if utf8.RuneCountInString(t) > maxTagLength {
+				return nil, fmt.Errorf("tags can be at most %d characters", maxTagLength)
+			}
+			seen[t] = true
+			tags = append(tags, t)
+		}
+		if len(tags) > maxTags {
+			return nil, fmt.Errorf("a video can have at most %d tags", maxTags)
+		}
+		set["tags"] = tags
+	}
+	if p.Visibility != nil {
+		switch *p.Visibility {
+		case visibilityPublic, visibilityUnlisted, visibilityPrivate:
+			set["visibility"] = *p.Visibility
+		default:
+			return nil, fmt.Errorf("visibility must be public, unlisted or private")
+		}
+	}
+	return set, nil
+}
+
+// handleUpdateVideo serves PATCH /videos/:id.
+func handleUpdateVideo(c *fiber.Ctx) error {
+	id := c.Params("id")
+	v, err := ownedVideo(c, id)
+	if err != nil {
+		return err
+	}
+
+	var patch videoMetadataPatch
+	if err := c.BodyParser(&patch); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid request")
+	}
+	if patch.Version == nil {
+		if etag := strings.Trim(c.Get(fiber.HeaderIfMatch), `"`); etag != "" {
+			if n, err := strconv.ParseInt(etag, 10, 64); err == nil {
+				patch.Version = &n
+			}
+		}
+	}
+	if patch.Version == nil {
+		return c.Status(fiber.StatusPreconditionRequired).JSON(fiber.Map{
+			"error": "Send the version you edited (\"version\" or If-Match)",
+			"code":  "version_required",
+		})
+	}
+	set, err := patch.validate()
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error(), "code": "invalid_metadata"})
+	}
+	if len(set) == 0 && patch.Thumbnail == nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Nothing to update")
+	}
+	// Fail fast before the expensive part; the update below checks again.
+	if *patch.Version != v.Version {
+		return sendVersionConflict(c, v)
+	}
+
+	if v.Version == 0 {
+		// Recorded before metadata was kept here: start from Socials' copy so
+		// fields not in this patch are not blanked.
+		if err := seedMetadata(c.Context(), v, set); err != nil {
+			log.Printf("❌ Failed to load metadata of %s: %v\n", id, err)
+			return fiber.NewError(fiber.StatusBadGateway, "Failed to update video")
+		}
+	}
+
+	// The poster is rendered first but only becomes the video's in the
+	// versioned update below, so a conflicting edit changes nothing.
+	var thumbs []thumbnail
+	if patch.Thumbnail != nil {
+		tmp, err := os.CreateTemp(workDir, "poster-*")
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to update video")
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		if err := fetchCandidate(c.Context(), id, *patch.Thumbnail, tmp.Name()); err != nil {
+			if errors.Is(err, objstore.ErrNotFound) {
+				return fiber.NewError(fiber.StatusNotFound, "Thumbnail candidate not found")
+			}
+			log.Println("❌ Failed to read thumbnail candidate:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to update video")
+		}
+		thumbs, err = renderPosters(c.Context(), tmp.Name(), id)
+		if err != nil {
+			log.Printf("❌ Failed to render poster of %s: %v\n", id, err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to update video")
+		}
+	}
+
+	// Values in a pipeline update are expressions; keep user text literal.
+	for field, value := range set {
+		set[field] = bson.M{"$literal": value}
+	}
+	if thumbs != nil {
+		for field, value := range posterFields(thumbs) {
+			set[field] = value
+		}
+	}
+	for field, value := range appendEvent(eventVideoUpdated) {
+		set[field] = value
+	}
+	set["version"] = bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}}
+	set["updatedAt"] = time.Now()
+	filter := bson.M{"_id": id, "deletedAt": notDeleted, "version": *patch.Version}
+	if *patch.Version == 0 {
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	var updated videoRecord
+	err = videosCollection.FindOneAndUpdate(c.Context(), filter,
+		mongo.Pipeline{{{Key: "$set", Value: set}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Someone else got there first, or the video was deleted meanwhile.
+		current, err := ownedVideo(c, id)
+		if err != nil {
+			return err
+		}
+		if thumbs != nil {
+			removeOtherPosters(c.Context(), id, current.Thumbnails)
+		}
+		return sendVersionConflict(c, current)
+	}
+	if err != nil {
+		log.Printf("❌ Failed to update video %s: %v\n", id, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to update video")
+	}
+	wake(outboxWake)
+	if thumbs != nil {
+		removeOtherPosters(c.Context(), id, thumbs)
+		if err := updateStoredBytes(c.Context(), id); err != nil {
+			log.Printf("❌ Failed to update storage usage of %s: %v\n", id, err)
+		}
+	}
+
+	c.Set(fiber.HeaderETag, fmt.Sprintf(`"%d"`, updated.Version))
+	return c.JSON(viewOf(&updated))
+}
+
+func sendVersionConflict(c *fiber.Ctx, current *videoRecord) error {
+	c.Set(fiber.HeaderETag, fmt.Sprintf(`"%d"`, current.Version))
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error":   "The video was changed by someone else; reload it and try again",
+		"code":    "version_conflict",
+		"version": current.Version,
+		"video":   viewOf(current),
+	})
+}
+
+// seedMetadata adds Socials' title, description, tags and visibility to set
+// where the patch leaves them out.
+func seedMetadata(ctx context.Context, v *videoRecord, set bson.M) error {
+	var social struct {
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Tags        []string `json:"tags"`
+		Visibility  string   `json:"visibility"`
+	}
+	target := fmt.Sprintf("%s/video/%s", socialServiceURL, url.PathEscape(v.ID))
+	if err := callService(ctx, http.MethodGet, target, nil, &social); err != nil {
+		return err
+	}
+	if social.Visibility == "" {
+		social.Visibility = visibilityPublic
+	}
+	if social.Tags == nil {
+		social.Tags = []string{}
+	}
+	for field, value := range map[string]interface{}{
+		"title":       social.Title,
+		"description": social.Description,
+		"tags":        social.Tags,
+		"visibility":  social.Visibility,
+	} {
+		if _, ok := set[field]; !ok {
+			set[field] = value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ------------------- EVENT OUTBOX ----------------------
+// Socials and search learn about videos from events. An event is written
+// into the video record in the same update as the change it describes, so
+// it cannot be lost: Mongo updates one document atomically, and that is
+// all the transaction we need. The publisher then copies every pending
+// event into the outbox collection, once per consumer, and the relay
+// delivers those with retries and backoff. Deliveries that keep failing
+// end up in the dead-letter collection, from where an admin can retry
+// them.
+//
+// Every event carries a snapshot of the video as it is when published and
+// a sequence number that grows with each event of the video. Consumers
+// apply a snapshot only if its sequence is newer than what they have, so
+// duplicates and retries are harmless. The relay also delivers a video's
+// events to each consumer in order.
+
+const (
+	eventVideoUploaded   = "video.uploaded"
+	eventVideoTranscoded = "video.transcoded"
+	eventVideoUpdated    = "video.updated"
+	eventVideoDeleted    = "video.deleted" // soft delete, can be restored
+	eventVideoRestored   = "video.restored"
+	eventVideoPurged     = "video.purged"
+
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+
+	outboxPollInterval   = 5 * time.Second
+	outboxLease          = time.Minute
+	outboxRetryBackoff   = 5 * time.Second
+	outboxMaxBackoff     = time.Hour
+	outboxDeliveredTTL   = 7 * 24 * time.Hour
+	maxDeadLettersListed = 100
+)
+
+var (
+	outboxCollection      *mongo.Collection
+	deadLettersCollection *mongo.Collection
+	outboxMaxAttempts     = 10
+	outboxWake            = make(chan struct{}, 1)
+	relayWake             = make(chan struct{}, 1)
+)
+
+// pendingEvent is an event in a video record that is not published yet.
+type pendingEvent struct {
+	ID         string    `bson:"id"`
+	Type       string    `bson:"type"`
+	Seq        int64     `bson:"seq"`
+	OccurredAt time.Time `bson:"occurredAt"`
+}
+
+// videoSnapshot is what consumers get to know about a video.
+type videoSnapshot struct {
+	ID               string      `json:"id" bson:"id"`
+	Title            string      `json:"title" bson:"title"`
+	Description      string      `json:"description" bson:"description"`
+	Author           string      `json:"author" bson:"author"`
+	OwnerID          string      `json:"ownerId" bson:"ownerId"`
+	Tags             []string    `json:"tags" bson:"tags"`
+	Visibility       string      `json:"visibility" bson:"visibility"`
+	Version          int64       `json:"version" bson:"version"`
+	Path             string      `json:"path" bson:"path"`
+	Thumbnail        string      `json:"thumbnail" bson:"thumbnail"`
+	Thumbnails       []thumbnail `json:"thumbnails,omitempty" bson:"thumbnails,omitempty"`
+	PreviewTrack     string      `json:"previewTrack,omitempty" bson:"previewTrack,omitempty"`
+	OriginalFilename string      `json:"originalFilename" bson:"originalFilename"`
+	SHA256           string      `json:"sha256" bson:"sha256"`
+	Size             int64       `json:"size" bson:"size"`
+	Media            *mediaInfo  `json:"media,omitempty" bson:"media,omitempty"`
+	CreatedAt        time.Time   `json:"createdAt" bson:"createdAt"`
+	DeletedAt        *time.Time  `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+}
+
+// outboxDelivery is one event on its way to one consumer.
+type outboxDelivery struct {
+	ID            string        `json:"id" bson:"_id"` // event ID + "/" + consumer
+	EventID       string        `json:"eventId" bson:"eventId"`
+	Consumer      string        `json:"consumer" bson:"consumer"`
+	Type          string        `json:"type" bson:"type"`
+	VideoID       string        `json:"videoId" bson:"videoId"`
+	Seq           int64         `json:"seq" bson:"seq"`
+	OccurredAt    time.Time     `json:"occurredAt" bson:"occurredAt"`
+	Data          videoSnapshot `json:"data" bson:"data"`
+	Status        string        `json:"status" bson:"status"`
+	Attempts      int           `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time     `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	LastError     string        `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	DeliveredAt   *time.Time    `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"`
+	DeadAt        *time.Time    `json:"deadAt,omitempty" bson:"deadAt,omitempty"`
+}
+
+// eventConsumers maps each consumer to the URL its events are posted to.
+func eventConsumers() map[string]string {
+	return map[string]string{
+		"social": socialServiceURL + "/events",
+		"search": searchServiceURL + "/events",
+	}
+}
+
+func ensureOutboxIndexes(ctx context.Context) error {
+	_, err := outboxCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "consumer", Value: 1}, {Key: "videoId", Value: 1}, {Key: "seq", Value: 1}}},
+		{Keys: bson.D{{Key: "deliveredAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(outboxDeliveredTTL.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = videosCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "pendingEvents.seq", Value: 1}},
+	})
+	return err
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// newEvent returns a pending event for a record that has no events yet.
+func newEvent(eventType string, now time.Time) pendingEvent {
+	return pendingEvent{ID: primitive.NewObjectID().Hex(), Type: eventType, Seq: now.UnixMilli(), OccurredAt: now}
+}
+
+// appendEvent returns the fields of a pipeline $set stage that add an
+// event of eventType to a video record. The sequence is at least the time
+// in milliseconds, so it also orders after versions the consumers stored
+// before there were events.
+func appendEvent(eventType string) bson.M {
+	now := time.Now()
+	seq := bson.M{"$max": bson.A{bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$eventSeq", 0}}, 1}}, now.UnixMilli()}}
+	return bson.M{
+		"eventSeq": seq,
+		"pendingEvents": bson.M{"$concatArrays": bson.A{
+			bson.M{"$ifNull": bson.A{"$pendingEvents", bson.A{}}},
+			bson.A{bson.M{
+				"id":         primitive.NewObjectID().Hex(),
+				"type":       eventType,
+				"seq":        seq,
+				"occurredAt": now,
+			}},
+		}},
+	}
+}
+
+// recordEvent adds an event to video id without changing anything else.
+func recordEvent(ctx context.Context, id, eventType string) error {
+	_, err := videosCollection.UpdateOne(ctx, bson.M{"_id": id}, mongo.Pipeline{{{Key: "$set", Value: appendEvent(eventType)}}})
+	if err == nil {
+		wake(outboxWake)
+	}
+	return err
+}
+
+// snapshotOf is the consumers' view of v.
+func snapshotOf(v *videoRecord) videoSnapshot {
+	tags := v.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return videoSnapshot{
+		ID:               v.ID,
+		Title:            v.Title,
+		Description:      v.Description,
+		Author:           v.Owner,
+		OwnerID:          v.OwnerID,
+		Tags:             tags,
+		Visibility:       v.Visibility,
+		Version:          v.Version,
+		Path:             mediaURL(v.Key),
+		Thumbnail:        v.Thumbnail,
+		Thumbnails:       v.Thumbnails,
+		PreviewTrack:     v.PreviewTrack,
+		OriginalFilename: v.OriginalFilename,
+		SHA256:           v.SHA256,
+		Size:             v.Size,
+		Media:            v.Media,
+		CreatedAt:        v.CreatedAt,
+		DeletedAt:        v.DeletedAt,
+	}
+}
+
+// ------------------- PUBLISHER -------------------------
+
+// runOutboxPublisher moves pending events from video records into the
+// outbox until ctx ends.
+func runOutboxPublisher(ctx context.Context) {
+	for {
+		for ctx.Err() == nil {
+			var v videoRecord
+			err := videosCollection.FindOne(ctx, bson.M{"pendingEvents.seq": bson.M{"$gt": 0}}).Decode(&v)
+			if err != nil {
+				if !errors.Is(err, mongo.ErrNoDocuments) && ctx.Err() == nil {
+					log.Println("❌ Failed to find events to publish:", err)
+				}
+				break
+			}
+			if err := publishEvents(ctx, &v); err != nil {
+				log.Printf("❌ Failed to publish events of %s: %v\n", v.ID, err)
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-outboxWake:
+		case <-time.After(outboxPollInterval):
+		}
+	}
+}
+
+// publishEvents copies v's pending events into the outbox and removes them
+// from the record. Doing it twice is harmless: delivery IDs are derived
+// from the event ID.
+func publishEvents(ctx context.Context, v *videoRecord) error {
+	if len(v.PendingEvents) == 0 {
+		return nil
+	}
+	if v.Version == 0 || v.Thumbnail == "" {
+		if err := backfillRecord(ctx, v); err != nil {
+			return err
+		}
+	}
+	snapshot := snapshotOf(v)
+	var ids []string
+	for _, e := range v.PendingEvents {
+		if err := enqueueDeliveries(ctx, e, v.ID, snapshot); err != nil {
+			return err
+		}
+		ids = append(ids, e.ID)
+	}
+	_, err := videosCollection.UpdateOne(ctx, bson.M{"_id": v.ID},
+		bson.M{"$pull": bson.M{"pendingEvents": bson.M{"id": bson.M{"$in": ids}}}},
+	)
+	return err
+}
+
+// backfillRecord copies what a record made before events were published
+// is missing from Socials, so the first event doesn't blank it there.
+func backfillRecord(ctx context.Context, v *videoRecord) error {
+	var social struct {
+		Title            string      `json:"title"`
+		Description      string      `json:"description"`
+		Tags             []string    `json:"tags"`
+		Visibility       string      `json:"visibility"`
+		Thumbnail        string      `json:"thumbnail"`
+		Thumbnails       []thumbnail `json:"thumbnails"`
+		PreviewTrack     string      `json:"previewTrack"`
+		OriginalFilename string      `json:"originalFilename"`
+		Media            *mediaInfo  `json:"media"`
+	}
+	target := fmt.Sprintf("%s/video/%s?includeDeleted=true", socialServiceURL, url.PathEscape(v.ID))
+	if err := ignoreNotFound(callService(ctx, http.MethodGet, target, nil, &social)); err != nil {
+		return err
+	}
+
+	// Each part only if nothing was set meanwhile
+	if v.Version == 0 {
+		if social.Visibility == "" {
+			social.Visibility = visibilityPublic
+		}
+		if social.Tags == nil {
+			social.Tags = []string{}
+		}
+		v.Title, v.Description, v.Tags, v.Visibility = social.Title, social.Description, social.Tags, social.Visibility
+		_, err := videosCollection.UpdateOne(ctx,
+			bson.M{"_id": v.ID, "version": bson.M{"$in": bson.A{0, nil}}},
+			bson.M{"$set": bson.M{"title": v.Title, "description": v.Description, "tags": v.Tags, "visibility": v.Visibility}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if v.Thumbnail == "" {
+		v.Thumbnail = social.Thumbnail
+		if v.Thumbnail == "" {
+			v.Thumbnail = placeholderThumbnail(v.ID)
+		}
+		v.Thumbnails, v.PreviewTrack, v.OriginalFilename = social.Thumbnails, social.PreviewTrack, social.OriginalFilename
+		set := bson.M{
+			"thumbnail":        v.Thumbnail,
+			"thumbnails":       v.Thumbnails,
+			"previewTrack":     v.PreviewTrack,
+			"originalFilename": v.OriginalFilename,
+		}
+		if v.Media == nil && social.Media != nil {
+			v.Media = social.Media
+			set["media"] = v.Media
+		}
+		_, err := videosCollection.UpdateOne(ctx,
+			bson.M{"_id": v.ID, "thumbnail": bson.M{"$in": bson.A{"", nil}}},
+			bson.M{"$set": set},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueueDeliveries writes one delivery of e per consumer.
+func enqueueDeliveries(ctx context.Context, e pendingEvent, videoID string, snapshot videoSnapshot) error {
+	var docs []interface{}
+	for consumer := range eventConsumers() {
+		docs = append(docs, outboxDelivery{
+			ID:            e.ID + "/" + consumer,
+			EventID:       e.ID,
+			Consumer:      consumer,
+			Type:          e.Type,
+			VideoID:       videoID,
+			Seq:           e.Seq,
+			OccurredAt:    e.OccurredAt,
+			Data:          snapshot,
+			Status:        deliveryPending,
+			NextAttemptAt: time.Now(),
+		})
+	}
+	_, err := outboxCollection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil && !onlyDuplicateKeys(err) {
+		return err
+	}
+	wake(relayWake)
+	return nil
+}
+
+// onlyDuplicateKeys reports whether err is a bulk write error where every
+// failure is a duplicate key, i.e. those documents were already written.
+func onlyDuplicateKeys(err error) bool {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		return false
+	}
+	for _, we := range bwe.WriteErrors {
+		if we.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// purgeRecord deletes the record of video id. Its pending events are
+// published first, followed by a video.purged event, so the other services
+// remove their copies after applying everything before it.
+func purgeRecord(ctx context.Context, id string) error {
+	var v videoRecord
+	err := videosCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&v)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := publishEvents(ctx, &v); err != nil {
+		return err
+	}
+	if err := enqueueDeliveries(ctx, purgeEvent(&v, time.Now()), id, snapshotOf(&v)); err != nil {
+		return err
+	}
+	_, err = videosCollection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// purgeEvent is the video.purged event of v, ordered after every event v
+// has had. The ID is fixed so that purging again doesn't add another.
+func purgeEvent(v *videoRecord, now time.Time) pendingEvent {
+	e := pendingEvent{ID: v.ID + ":purged", Type: eventVideoPurged, Seq: v.EventSeq + 1, OccurredAt: now}
+	if e.Seq < now.UnixMilli() {
+		e.Seq = now.UnixMilli()
+	}
+	return e
+}
+
+// ------------------- RELAY -----------------------------
+
+// runOutboxRelay delivers outbox entries until ctx ends.
+func runOutboxRelay(ctx context.Context) {
+	for {
+		for ctx.Err() == nil {
+			d, err := claimDelivery(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Println("❌ Failed to claim event delivery:", err)
+			}
+			if d == nil {
+				break
+			}
+			deliver(ctx, d)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-relayWake:
+		case <-time.After(outboxPollInterval):
+		}
+	}
+}
+
+// claimDelivery takes a due delivery, holding it for outboxLease.
+func claimDelivery(ctx context.Context) (*outboxDelivery, error) {
+	now := time.Now()
+	var d outboxDelivery
+	err := outboxCollection.FindOneAndUpdate(ctx,
+		bson.M{"status": deliveryPending, "nextAttemptAt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"nextAttemptAt": now.Add(outboxLease)}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}, {Key: "seq", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func deliver(ctx context.Context, d *outboxDelivery) {
+	// Earlier events of the video go to this consumer first.
+	var earlier outboxDelivery
+	err := outboxCollection.FindOne(ctx,
+		bson.M{"consumer": d.Consumer, "videoId": d.VideoID, "status": deliveryPending, "seq": bson.M{"$lt": d.Seq}},
+		options.FindOne().SetSort(bson.D{{Key: "seq", Value: 1}}),
+	).Decode(&earlier)
+	if err == nil {
+		_, err = outboxCollection.UpdateOne(ctx, bson.M{"_id": d.ID},
+			bson.M{"$set": bson.M{"nextAttemptAt": earlier.NextAttemptAt.Add(time.Millisecond)}})
+		if err != nil {
+			log.Printf("❌ Failed to postpone delivery %s: %v\n", d.ID, err)
+		}
+		return
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		log.Printf("❌ Failed to check order of delivery %s: %v\n", d.ID, err)
+		return
+	}
+
+	target, ok := eventConsumers()[d.Consumer]
+	if !ok {
+		err = fmt.Errorf("unknown consumer %q", d.Consumer)
+	} else {
+		err = callService(ctx, http.MethodPost, target, fiber.Map{
+			"id":         d.EventID,
+			"type":       d.Type,
+			"videoId":    d.VideoID,
+			"seq":        d.Seq,
+			"occurredAt": d.OccurredAt,
+			"data":       d.Data,
+		}, nil)
+	}
+	now := time.Now()
+	if err == nil {
+		_, err = outboxCollection.UpdateOne(context.Background(), bson.M{"_id": d.ID}, bson.M{
+			"$set":   bson.M{"status": deliveryDelivered, "deliveredAt": now},
+			"$inc":   bson.M{"attempts": 1},
+			"$unset": bson.M{"lastError": ""},
+		})
+		if err != nil {
+			log.Printf("❌ Failed to mark delivery %s done: %v\n", d.ID, err)
+		}
+		return
+	}
+	if ctx.Err() != nil {
+		// Shutting down; the lease runs out and someone retries.
+		return
+	}
+
+	d.Attempts++
+	d.LastError = err.Error()
+	if d.Attempts >= outboxMaxAttempts {
+		d.Status = deliveryDead
+		d.DeadAt = &now
+		if err := deadLetter(d); err != nil {
+			log.Printf("❌ Failed to dead-letter delivery %s: %v\n", d.ID, err)
+		}
+		log.Printf("❌ Giving up on %s of %s to %s after %d attempts: %v\n", d.Type, d.VideoID, d.Consumer, d.Attempts, d.LastError)
+		return
+	}
+	next := now.Add(outboxBackoff(d.Attempts))
+	_, dbErr := outboxCollection.UpdateOne(context.Background(), bson.M{"_id": d.ID}, bson.M{
+		"$set": bson.M{"attempts": d.Attempts, "lastError": d.LastError, "nextAttemptAt": next},
+	})
+	if dbErr != nil {
+		log.Printf("❌ Failed to reschedule delivery %s: %v\n", d.ID, dbErr)
+	}
+	log.Printf("❌ Delivering %s of %s to %s failed, retrying at %s: %v\n", d.Type, d.VideoID, d.Consumer, next.Format(time.RFC3339), err)
+}
+
+func outboxBackoff(attempt int) time.Duration {
+	d := outboxRetryBackoff
+	for i := 1; i < attempt && d < outboxMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > outboxMaxBackoff {
+		d = outboxMaxBackoff
+	}
+	return d
+}
+
+// deadLetter moves d from the outbox to the dead letters.
+func deadLetter(d *outboxDelivery) error {
+	ctx := context.Background()
+	_, err := deadLettersCollection.ReplaceOne(ctx, bson.M{"_id": d.ID}, d, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	_, err = outboxCollection.DeleteOne(ctx, bson.M{"_id": d.ID})
+	return err
+}
+
+// ------------------- DEAD LETTER HANDLERS --------------
+
+// handleListDeadLetters serves GET /admin/outbox/dead-letters.
+func handleListDeadLetters(c *fiber.Ctx) error {
+	filter := bson.M{}
+	if consumer := c.Query("consumer"); consumer != "" {
+		filter["consumer"] = consumer
+	}
+	if videoID := c.Query("videoId"); videoID != "" {
+		filter["videoId"] = videoID
+	}
+	cursor, err := deadLettersCollection.Find(c.Context(), filter,
+		options.Find().SetSort(bson.D{{Key: "deadAt", Value: -1}}).SetLimit(maxDeadLettersListed))
+	if err != nil {
+		log.Println("❌ Failed to list dead letters:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to list dead letters")
+	}
+	deliveries := []outboxDelivery{}
+	if err := cursor.All(c.Context(), &deliveries); err != nil {
+		log.Println("❌ Failed to list dead letters:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to list dead letters")
+	}
+	return c.JSON(deliveries)
+}
+
+// handleRetryDeadLetter serves POST /admin/outbox/dead-letters/:id/retry:
+// the delivery goes back into the outbox with a fresh set of attempts.
+func handleRetryDeadLetter(c *fiber.Ctx) error {
+	var d outboxDelivery
+	err := deadLettersCollection.FindOne(c.Context(), bson.M{"_id": c.Params("id")}).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fiber.NewError(fiber.StatusNotFound, "Dead letter not found")
+	}
+	if err != nil {
+		log.Println("❌ Failed to load dead letter:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to retry delivery")
+	}
+	d.Status = deliveryPending
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now()
+	d.DeadAt = nil
+	if _, err := outboxCollection.ReplaceOne(c.Context(), bson.M{"_id": d.ID}, d, options.Replace().SetUpsert(true)); err != nil {
+		log.Println("❌ Failed to requeue dead letter:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to retry delivery")
+	}
+	if _, err := deadLettersCollection.DeleteOne(c.Context(), bson.M{"_id": d.ID}); err != nil {
+		log.Println("❌ Failed to remove dead letter:", err)
+	}
+	wake(relayWake)
+	return c.JSON(fiber.Map{"message": "Delivery queued", "id": d.ID})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestPurgeEventOrdersLast(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	tests := []struct {
+		name     string
+		eventSeq int64
+		want     int64
+	}{
+		{"no events", 0, now.UnixMilli()},
+		{"older events", now.UnixMilli() - 5000, now.UnixMilli()},
+		// Sequences run ahead of the clock when events come faster than
+		// one per millisecond, or the clock went back.
+		{"events ahead of the clock", now.UnixMilli() + 10, now.UnixMilli() + 11},
+	}
+	for _, tt := range tests {
+		v := &videoRecord{ID: "AbCdEfGhIjKlMnOp", EventSeq: tt.eventSeq}
+		e := purgeEvent(v, now)
+		if e.Seq != tt.want || e.Seq <= tt.eventSeq {
+			t.Errorf("%s: seq %d, want %d", tt.name, e.Seq, tt.want)
+		}
+		if e.Type != eventVideoPurged || e.ID != "AbCdEfGhIjKlMnOp:purged" {
+			t.Errorf("%s: got %+v", tt.name, e)
+		}
+	}
+
+	// Purging again yields the same delivery IDs.
+	v := &videoRecord{ID: "AbCdEfGhIjKlMnOp"}
+	if a, b := purgeEvent(v, now), purgeEvent(v, now.Add(time.Minute)); a.ID != b.ID {
+		t.Errorf("IDs differ: %s, %s", a.ID, b.ID)
+	}
+}
+
+func TestNewEventOrdersAfterLegacyVersions(t *testing.T) {
+	now := time.Now()
+	if e := newEvent(eventVideoUploaded, now); e.Seq != now.UnixMilli() || e.ID == "" {
+		t.Fatalf("got %+v", e)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, outboxRetryBackoff},
+		{2, 2 * outboxRetryBackoff},
+		{3, 4 * outboxRetryBackoff},
+		{30, outboxMaxBackoff},
+		{1000, outboxMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempt); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestOnlyDuplicateKeys(t *testing.T) {
+	dup := mongo.BulkWriteError{WriteError: mongo.WriteError{Code: 11000}}
+	other := mongo.BulkWriteError{WriteError: mongo.WriteError{Code: 121}}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"all duplicates", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{dup, dup}}, true},
+		{"one other error", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{dup, other}}, false},
+		{"write concern", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{dup}, WriteConcernError: &mongo.WriteConcernError{}}, false},
+		{"not a bulk error", errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		if got := onlyDuplicateKeys(tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ------------------- UPLOAD POLICY ---------------------
+// Every upload is checked before it is stored: the first bytes must look
+// like an allowed container, ffprobe must find allowed codecs, and size,
+// duration and resolution must be within the limits of the uploader's role.
+// The policy also holds the storage and upload quotas (see quota.go).
+// The policy comes from UPLOAD_POLICY (JSON) or UPLOAD_POLICY_FILE; see
+// defaultUploadPolicy for the shape.
+
+// uploadLimits are the limits of one role. Resolution limits apply to the
+// long and short side, so portrait videos are treated like landscape ones.
+type uploadLimits struct {
+	MaxBytes     int64   `json:"maxBytes"`
+	MaxDuration  float64 `json:"maxDurationSeconds"`
+	MaxLongSide  int     `json:"maxLongSide"`
+	MaxShortSide int     `json:"maxShortSide"`
+	MaxFrameRate float64 `json:"maxFrameRate"`
+	AllowNoAudio bool    `json:"allowNoAudio"`
+
+	quotaLimits
+}
+
+type uploadPolicy struct {
+	Containers  []string                `json:"containers"` // as detected by sniffContainer
+	VideoCodecs []string                `json:"videoCodecs"`
+	AudioCodecs []string                `json:"audioCodecs"`
+	Roles       map[string]uploadLimits `json:"roles"`
+	Users       map[string]quotaLimits  `json:"users"` // quota overrides by user ID
+}
+
+const defaultUploadRole = "user"
+
+var defaultUploadPolicy = uploadPolicy{
+	Containers:  []string{"mp4", "mov", "webm", "mkv"},
+	VideoCodecs: []string{"h264", "hevc", "vp8", "vp9", "av1", "mpeg4"},
+	AudioCodecs: []string{"aac", "mp3", "opus", "vorbis", "ac3", "eac3", "flac", "pcm_s16le"},
+	Roles: map[string]uploadLimits{
+		"user": {
+			MaxBytes:     1024 * 1024 * 1024,
+			MaxDuration:  2 * 60 * 60,
+			MaxLongSide:  3840,
+			MaxShortSide: 2160,
+			MaxFrameRate: 60,
+			AllowNoAudio: true,
+			quotaLimits: quotaLimits{
+				MaxStorageBytes:      10 * 1024 * 1024 * 1024,
+				MaxUploadsPerDay:     20,
+				MaxConcurrentUploads: 3,
+			},
+		},
+		"admin": {
+			MaxBytes:     1024 * 1024 * 1024,
+			MaxDuration:  6 * 60 * 60,
+			MaxLongSide:  7680,
+			MaxShortSide: 4320,
+			MaxFrameRate: 120,
+			AllowNoAudio: true,
+		},
+	},
+}
+
+var policy = defaultUploadPolicy
+
+func loadUploadPolicy() {
+	raw := os.Getenv("UPLOAD_POLICY")
+	if raw == "" {
+		path := os.Getenv("UPLOAD_POLICY_FILE")
+		if path == "" {
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("WARN: failed to read UPLOAD_POLICY_FILE, using the default policy: %v", err)
+			return
+		}
+		raw = string(data)
+	}
+	var p uploadPolicy
+	if err := json.Unmarshal([]byte(raw), &p); err != nil {
+		log.Printf("WARN: invalid upload policy, using the default policy: %v", err)
+		return
+	}
+	if len(p.Containers) == 0 {
+		p.Containers = defaultUploadPolicy.Containers
+	}
+	if len(p.VideoCodecs) == 0 {
+		p.VideoCodecs = defaultUploadPolicy.VideoCodecs
+	}
+	if len(p.AudioCodecs) == 0 {
+		p.AudioCodecs = defaultUploadPolicy.AudioCodecs
+	}
+	if _, ok := p.Roles[defaultUploadRole]; !ok {
+		log.Printf("WARN: upload policy has no %q role, using the default policy", defaultUploadRole)
+		return
+	}
+	policy = p
+	log.Printf("Loaded upload policy for roles %v", mapKeys(p.Roles))
+}
+
+func mapKeys(m map[string]uploadLimits) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// limitsFor returns the limits of role, falling back to the default role.
+func (p *uploadPolicy) limitsFor(role string) uploadLimits {
+	if l, ok := p.Roles[role]; ok {
+		return l
+	}
+	return p.Roles[defaultUploadRole]
+}
+
+// policyError is an upload rejection the UI can show: a stable code, a
+// message and the values involved.
+type policyError struct {
+	Status  int
+	Code    string
+	Message string
+	Details fiber.Map
+}
+
+func (e *policyError) Error() string { return e.Message }
+
+func rejectUpload(status int, code, message string, details fiber.Map) *policyError {
+	return &policyError{Status: status, Code: code, Message: message, Details: details}
+}
+
+// sendPolicyError writes err as JSON if it is a policy rejection and
+// reports whether it did.
+func sendPolicyError(c *fiber.Ctx, err error) (bool, error) {
+	var pe *policyError
+	if !errors.As(err, &pe) {
+		return false, nil
+	}
+	return true, c.Status(pe.Status).JSON(fiber.Map{
+		"error":   pe.Message,
+		"code":    pe.Code,
+		"details": pe.Details,
+	})
+}
+
+// checkSize rejects uploads above the role's size limit; used before the
+// body is read as well as after.
+func (p *uploadPolicy) checkSize(role string, size int64) error {
+	limits := p.limitsFor(role)
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		return rejectUpload(fiber.StatusRequestEntityTooLarge, "file_too_large",
+			fmt.Sprintf("Videos can be at most %d MB", limits.MaxBytes/(1024*1024)),
+			fiber.Map{"limit": limits.MaxBytes, "actual": size})
+	}
+	return nil
+}
+
+// checkFile sniffs the container of the local file at path.
+func (p *uploadPolicy) checkFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, 1024)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	container := sniffContainer(header[:n])
+	if container == "" {
+		return "", rejectUpload(fiber.StatusUnsupportedMediaType, "unknown_format",
+			"The file is not in a recognised video format", nil)
+	}
+	if !contains(p.Containers, container) {
+		return "", rejectUpload(fiber.StatusUnsupportedMediaType, "unsupported_container",
+			fmt.Sprintf("%s files are not accepted", strings.ToUpper(container)),
+			fiber.Map{"actual": container, "allowed": p.Containers})
+	}
+	return container, nil
+}
+
+// checkMedia applies the codec allowlists and the role's limits to what
+// ffprobe found.
+func (p *uploadPolicy) checkMedia(role string, info *mediaInfo) error {
+	limits := p.limitsFor(role)
+	if !contains(p.VideoCodecs, info.VideoCodec) {
+		return rejectUpload(fiber.StatusUnsupportedMediaType, "unsupported_video_codec",
+			fmt.Sprintf("Video codec %s is not accepted", info.VideoCodec),
+			fiber.Map{"actual": info.VideoCodec, "allowed": p.VideoCodecs})
+	}
+	if info.HasAudio && !contains(p.AudioCodecs, info.AudioCodec) {
+		return rejectUpload(fiber.StatusUnsupportedMediaType, "unsupported_audio_codec",
+			fmt.Sprintf("Audio codec %s is not accepted", info.AudioCodec),
+			fiber.Map{"actual": info.AudioCodec, "allowed": p.AudioCodecs})
+	}
+	if !info.HasAudio && !limits.AllowNoAudio {
+		return rejectUpload(fiber.StatusUnprocessableEntity, "missing_audio",
+			"Videos must have an audio track", nil)
+	}
+	if limits.MaxDuration > 0 && info.Duration > limits.MaxDuration {
+		return rejectUpload(fiber.StatusUnprocessableEntity, "duration_too_long",
+			fmt.Sprintf("Videos can be at most %s long", formatDuration(limits.MaxDuration)),
+			fiber.Map{"limit": limits.MaxDuration, "actual": info.Duration})
+	}
+	long, short := info.Width, info.Height
+	if short > long {
+		long, short = short, long
+	}
+	if (limits.MaxLongSide > 0 && long > limits.MaxLongSide) || (limits.MaxShortSide > 0 && short > limits.MaxShortSide) {
+		return rejectUpload(fiber.StatusUnprocessableEntity, "resolution_too_high",
+			fmt.Sprintf("Videos can be at most %dx%d", limits.MaxLongSide, limits.MaxShortSide),
+			fiber.Map{"limit": fmt.Sprintf("%dx%d", limits.MaxLongSide, limits.MaxShortSide), "actual": fmt.Sprintf("%dx%d", info.Width, info.Height)})
+	}
+	if limits.MaxFrameRate > 0 && info.FrameRate > limits.MaxFrameRate+0.5 {
+		return rejectUpload(fiber.StatusUnprocessableEntity, "frame_rate_too_high",
+			fmt.Sprintf("Videos can have at most %g frames per second", limits.MaxFrameRate),
+			fiber.Map{"limit": limits.MaxFrameRate, "actual": info.FrameRate})
+	}
+	return nil
+}
+
+// sniffContainer identifies the container from the file's first bytes.
+func sniffContainer(b []byte) string {
+	switch {
+	case len(b) >= 12 && string(b[4:8]) == "ftyp":
+		if string(b[8:12]) == "qt  " {
+			return "mov"
+		}
+		return "mp4"
+	case len(b) >= 8 && (string(b[4:8]) == "moov" || string(b[4:8]) == "mdat" || string(b[4:8]) == "wide" || string(b[4:8]) == "free"):
+		// QuickTime files without an ftyp box
+		return "mov"
+	case len(b) >= 4 && bytes.Equal(b[:4], []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		// EBML; the DocType says which flavour
+		if bytes.Contains(b[:min(len(b), 64)], []byte("webm")) {
+			return "webm"
+		}
+		return "mkv"
+	case len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "AVI ":
+		return "avi"
+	case len(b) >= 377 && b[0] == 0x47 && b[188] == 0x47 && b[376] == 0x47:
+		return "mpegts"
+	}
+	return ""
+}
+
+// containerExt is the file extension originals of a container are stored
+// with.
+func containerExt(container string) string {
+	if container == "mpegts" {
+		return ".ts"
+	}
+	return "." + container
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func formatDuration(seconds float64) string {
+	s := int(seconds)
+	n, unit := s, "second"
+	if s%3600 == 0 {
+		n, unit = s/3600, "hour"
+	} else if s%60 == 0 {
+		n, unit = s/60, "minute"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSniffContainer(t *testing.T) {
+	ts := make([]byte, 400)
+	ts[0], ts[188], ts[376] = 0x47, 0x47, 0x47
+
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"mp4", []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00"), "mp4"},
+		{"mov with ftyp", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00"), "mov"},
+		{"mov without ftyp", []byte("\x00\x00\x00\x08wide\x00\x00"), "mov"},
+		{"webm", append([]byte{0x1a, 0x45, 0xdf, 0xa3, 0x9f, 0x42, 0x82, 0x84}, "webm"...), "webm"},
+		{"mkv", append([]byte{0x1a, 0x45, 0xdf, 0xa3, 0xa3, 0x42, 0x82, 0x88}, "matroska"...), "mkv"},
+		{"avi", []byte("RIFF\x00\x00\x00\x00AVI LIST"), "avi"},
+		{"mpeg-ts", ts, "mpegts"},
+		{"short mpeg-ts", ts[:200], ""},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), ""},
+		{"too short", []byte("\x00\x00\x00"), ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := sniffContainer(tt.head); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	p := defaultUploadPolicy
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	if got, err := p.checkFile(write("a.mp4", []byte("\x00\x00\x00\x20ftypisom"))); got != "mp4" || err != nil {
+		t.Errorf("mp4: got %q, %v", got, err)
+	}
+	_, err := p.checkFile(write("a.avi", []byte("RIFF\x00\x00\x00\x00AVI LIST")))
+	wantPolicyError(t, "avi", err, "unsupported_container")
+	_, err = p.checkFile(write("a.txt", bytes.Repeat([]byte("text"), 10)))
+	wantPolicyError(t, "text", err, "unknown_format")
+}
+
+func TestCheckMedia(t *testing.T) {
+	p := defaultUploadPolicy
+	p.Roles = map[string]uploadLimits{
+		"user": {
+			MaxDuration:  600,
+			MaxLongSide:  1920,
+			MaxShortSide: 1080,
+			MaxFrameRate: 30,
+		},
+		"admin": {AllowNoAudio: true},
+	}
+	ok := mediaInfo{Duration: 60, Width: 1920, Height: 1080, FrameRate: 29.97, VideoCodec: "h264", AudioCodec: "aac", HasAudio: true}
+	with := func(change func(*mediaInfo)) *mediaInfo {
+		info := ok
+		change(&info)
+		return &info
+	}
+
+	tests := []struct {
+		name string
+		role string
+		info *mediaInfo
+		want string // policy error code, "" for accepted
+	}{
+		{"within limits", "user", &ok, ""},
+		{"portrait within limits", "user", with(func(i *mediaInfo) { i.Width, i.Height = 1080, 1920 }), ""},
+		{"unknown role uses the default", "guest", &ok, ""},
+		{"video codec", "user", with(func(i *mediaInfo) { i.VideoCodec = "prores" }), "unsupported_video_codec"},
+		{"audio codec", "user", with(func(i *mediaInfo) { i.AudioCodec = "dts" }), "unsupported_audio_codec"},
+		{"missing audio", "user", with(func(i *mediaInfo) { i.HasAudio, i.AudioCodec = false, "" }), "missing_audio"},
+		{"no audio allowed", "admin", with(func(i *mediaInfo) { i.HasAudio, i.AudioCodec = false, "" }), ""},
+		{"too long", "user", with(func(i *mediaInfo) { i.Duration = 601 }), "duration_too_long"},
+		{"long side", "user", with(func(i *mediaInfo) { i.Width = 2560 }), "resolution_too_high"},
+		{"short side", "user", with(func(i *mediaInfo) { i.Width, i.Height = 1440, 1440 }), "resolution_too_high"},
+		{"frame rate within rounding", "user", with(func(i *mediaInfo) { i.FrameRate = 30.4 }), ""},
+		{"frame rate", "user", with(func(i *mediaInfo) { i.FrameRate = 60 }), "frame_rate_too_high"},
+	}
+	for _, tt := range tests {
+		err := p.checkMedia(tt.role, tt.info)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: rejected: %v", tt.name, err)
+			}
+			continue
+		}
+		wantPolicyError(t, tt.name, err, tt.want)
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	p := defaultUploadPolicy
+	limit := p.limitsFor("user").MaxBytes
+	if err := p.checkSize("user", limit); err != nil {
+		t.Errorf("at the limit: %v", err)
+	}
+	wantPolicyError(t, "over the limit", p.checkSize("user", limit+1), "file_too_large")
+}
+
+func wantPolicyError(t *testing.T, name string, err error, code string) {
+	t.Helper()
+	var pe *policyError
+	if !errors.As(err, &pe) {
+		t.Errorf("%s: got %v, want policy error %s", name, err, code)
+		return
+	}
+	if pe.Code != code {
+		t.Errorf("%s: got %s, want %s", name, pe.Code, code)
+	}
+}
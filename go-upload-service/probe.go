@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ------------------- MEDIA PROBE -----------------------
+// Every upload is inspected with ffprobe; what the client says about the
+// file (duration, type) is not trusted.
+
+var errInvalidMedia = errors.New("not a decodable video")
+
+// mediaInfo is what ffprobe tells us about a file. Width and Height are the
+// display size, i.e. after applying Rotation.
+type mediaInfo struct {
+	Container     string  `json:"container"`
+	Duration      float64 `json:"duration"` // seconds
+	Bitrate       int64   `json:"bitrate"`  // bits per second, whole file
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	FrameRate     float64 `json:"frameRate"`
+	Rotation      int     `json:"rotation"` // degrees clockwise: 0, 90, 180 or 270
+	VideoCodec    string  `json:"videoCodec"`
+	AudioCodec    string  `json:"audioCodec,omitempty"`
+	AudioChannels int     `json:"audioChannels,omitempty"`
+	HasAudio      bool    `json:"hasAudio"`
+}
+
+type ffprobeStream struct {
+	CodecType    string            `json:"codec_type"`
+	CodecName    string            `json:"codec_name"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	AvgFrameRate string            `json:"avg_frame_rate"`
+	RFrameRate   string            `json:"r_frame_rate"`
+	Channels     int               `json:"channels"`
+	Tags         map[string]string `json:"tags"`
+	SideData     []struct {
+		Rotation *float64 `json:"rotation"`
+	} `json:"side_data_list"`
+	Disposition struct {
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+}
+
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// probeVideo runs ffprobe on the local file at path and checks that its
+// first video frame decodes. Files that are not video, or are too damaged
+// to read, return an error wrapping errInvalidMedia.
+func probeVideo(ctx context.Context, path string) (*mediaInfo, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_format",
+		"-show_streams",
+		"-of", "json",
+		path,
+	)
+	stderr := &tailBuffer{max: 1024}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%w: %s", errInvalidMedia, strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	var probe ffprobeOutput
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	info := &mediaInfo{Container: probe.Format.FormatName}
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	var video *ffprobeStream
+	for i, s := range probe.Streams {
+		switch s.CodecType {
+		case "video":
+			// Cover art in audio files shows up as a one-frame video stream.
+			if video == nil && s.Disposition.AttachedPic == 0 {
+				video = &probe.Streams[i]
+			}
+		case "audio":
+			if !info.HasAudio {
+				info.HasAudio = true
+				info.AudioCodec = s.CodecName
+				info.AudioChannels = s.Channels
+			}
+		}
+	}
+	if video == nil || video.Width == 0 || video.Height == 0 {
+		return nil, fmt.Errorf("%w: no video stream found", errInvalidMedia)
+	}
+	if info.Duration <= 0 {
+		return nil, fmt.Errorf("%w: unknown duration", errInvalidMedia)
+	}
+
+	info.VideoCodec = video.CodecName
+	info.Width, info.Height = video.Width, video.Height
+	info.FrameRate = parseFrameRate(video.AvgFrameRate)
+	if info.FrameRate == 0 {
+		info.FrameRate = parseFrameRate(video.RFrameRate)
+	}
+	info.Rotation = streamRotation(video)
+	if info.Rotation == 90 || info.Rotation == 270 {
+		info.Width, info.Height = info.Height, info.Width
+	}
+
+	// The first frame shows the stream is decodable, the last seconds that
+	// the file is not truncated.
+	if err := checkDecodes(ctx, path, 0, 1); err != nil {
+		return nil, err
+	}
+	if err := checkDecodes(ctx, path, math.Max(0, info.Duration-2), 0); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// checkDecodes decodes the video from start (seconds), at most frames
+// frames or to the end if frames is 0, and fails on any decoding error.
+func checkDecodes(ctx context.Context, path string, start float64, frames int) error {
+	args := []string{"-v", "error", "-xerror"}
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start, 'f', 3, 64))
+	}
+	args = append(args, "-i", path, "-map", "0:v:0")
+	if frames > 0 {
+		args = append(args, "-frames:v", strconv.Itoa(frames))
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(args, "-f", "null", "-")...)
+	stderr := &tailBuffer{max: 1024}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %s", errInvalidMedia, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// parseFrameRate parses ffprobe's "30000/1001" style rates.
+func parseFrameRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !ok {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return math.Round(n/d*1000) / 1000
+}
+
+// streamRotation returns the clockwise display rotation of a stream, from
+// the display matrix (newer ffprobe) or the legacy "rotate" tag.
+func streamRotation(s *ffprobeStream) int {
+	var deg float64
+	found := false
+	for _, sd := range s.SideData {
+		if sd.Rotation != nil {
+			// The display matrix rotation is counter-clockwise.
+			deg, found = -*sd.Rotation, true
+			break
+		}
+	}
+	if !found {
+		if v, err := strconv.ParseFloat(s.Tags["rotate"], 64); err == nil {
+			deg = v
+		}
+	}
+	r := int(math.Round(deg/90)) * 90 % 360
+	if r < 0 {
+		r += 360
+	}
+	return r
+}
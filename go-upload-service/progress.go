@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"stream-flow/objstore/videotoken"
+)
+
+// ------------------- TRANSCODE PROGRESS ----------------
+// ffmpeg reports how far it got as key=value lines (-progress pipe:1). The
+// worker turns them into a percentage and ETA and stores them on the job,
+// at most once a second. GET /videos/:id/events streams a video's job
+// status to the uploader as Server-Sent Events until it succeeds or fails.
+// Going through the job document means this works whichever node runs the
+// transcode.
+//
+// EventSource cannot send an Authorization header, so the uploader first
+// asks POST /videos/:id/events/token for a short-lived token (see
+// media.go) and passes it in the query string. The number of open streams
+// is capped overall and per user.
+//
+// A stream ends after eventStreamMaxTime, and any network error ends it
+// too. EventSource would reconnect with the same URL, whose token has
+// expired by then, so clients must close it on error and connect again
+// with a fresh token.
+
+const (
+	progressInterval   = time.Second
+	eventPollInterval  = time.Second
+	eventKeepAlive     = 15 * time.Second
+	eventStreamMaxTime = 30 * time.Minute // then the client reconnects with a new token
+	streamTokenTTL     = 2 * time.Minute  // only needs to last until connected
+	maxEventStreams    = 1000
+	maxUserStreams     = 5
+)
+
+// Progress stages and where each starts in the overall percentage.
+const (
+	stagePreparing   = "preparing"   // fetching and probing the original
+	stageTranscoding = "transcoding" // ffmpeg running
+	stagePublishing  = "publishing"  // storing playlists and segments
+	stageThumbnails  = "thumbnails"
+	stageDone        = "done"
+
+	transcodingStart = 5
+	publishingStart  = 90
+	thumbnailsStart  = 95
+)
+
+// shuttingDown is closed when the server stops so open event streams end
+// instead of holding up the shutdown.
+var shuttingDown = make(chan struct{})
+
+var (
+	eventStreamsMu sync.Mutex
+	eventStreams   = 0
+	userStreams    = map[string]int{}
+)
+
+type jobProgress struct {
+	Stage     string    `json:"stage" bson:"stage"`
+	Percent   float64   `json:"percent" bson:"percent"`                         // of the whole job
+	Processed float64   `json:"processed,omitempty" bson:"processed,omitempty"` // seconds of video transcoded
+	Duration  float64   `json:"duration,omitempty" bson:"duration,omitempty"`
+	FPS       float64   `json:"fps,omitempty" bson:"fps,omitempty"`
+	Speed     float64   `json:"speed,omitempty" bson:"speed,omitempty"` // multiple of real time
+	ETA       float64   `json:"etaSeconds,omitempty" bson:"eta,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// ffmpegProgress is one block of ffmpeg's -progress output.
+type ffmpegProgress struct {
+	Processed float64 // seconds
+	FPS       float64
+	Speed     float64
+	Done      bool
+}
+
+// progressWriter parses ffmpeg's -progress output written to it and calls
+// onUpdate at the end of every block.
+type progressWriter struct {
+	buf      []byte
+	cur      ffmpegProgress
+	onUpdate func(ffmpegProgress)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		key, value, _ := strings.Cut(strings.TrimSpace(string(w.buf[:i])), "=")
+		w.buf = w.buf[i+1:]
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// Both are in microseconds, despite the name.
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				w.cur.Processed = float64(us) / 1e6
+			}
+		case "fps":
+			w.cur.FPS, _ = strconv.ParseFloat(value, 64)
+		case "speed":
+			w.cur.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "progress":
+			w.cur.Done = value == "end"
+			if w.onUpdate != nil {
+				w.onUpdate(w.cur)
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// progressReporter stores a running job's progress. duration is set once
+// the original has been probed.
+type progressReporter struct {
+	jobID    primitive.ObjectID
+	duration float64
+	last     time.Time
+}
+
+// stage records the start of a stage.
+func (r *progressReporter) stage(stage string, percent float64) {
+	r.save(jobProgress{Stage: stage, Percent: percent, Duration: r.duration}, true)
+}
+
+// ffmpeg records ffmpeg's progress through the transcoding stage.
+func (r *progressReporter) ffmpeg(p ffmpegProgress) {
+	if p.Done {
+		r.stage(stagePublishing, publishingStart)
+		return
+	}
+	prog := jobProgress{
+		Stage:     stageTranscoding,
+		Percent:   transcodingStart,
+		Processed: p.Processed,
+		Duration:  r.duration,
+		FPS:       p.FPS,
+		Speed:     p.Speed,
+	}
+	if r.duration > 0 {
+		done := math.Min(p.Processed/r.duration, 1)
+		prog.Percent = math.Round((transcodingStart+done*(publishingStart-transcodingStart))*10) / 10
+		if p.Speed > 0 {
+			prog.ETA = math.Round((r.duration - p.Processed) / p.Speed)
+		}
+	}
+	r.save(prog, false)
+}
+
+func (r *progressReporter) save(p jobProgress, force bool) {
+	now := time.Now()
+	if !force && now.Sub(r.last) < progressInterval {
+		return
+	}
+	r.last = now
+	p.UpdatedAt = now
+	_, err := jobsCollection.UpdateOne(context.Background(),
+		bson.M{"_id": r.jobID, "status": jobRunning, "workerId": workerID},
+		bson.M{"$set": bson.M{"progress": p}},
+	)
+	if err != nil {
+		log.Printf("❌ Failed to save progress of job %s: %v\n", r.jobID.Hex(), err)
+	}
+}
+
+// latestJob returns the most recent transcode job of a video.
+func latestJob(ctx context.Context, videoID string) (*transcodeJob, error) {
+	var job transcodeJob
+	err := jobsCollection.FindOne(ctx,
+		bson.M{"videoId": videoID},
+		options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}}),
+	).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// handleVideoEventsToken issues the token the uploader passes to
+// GET /videos/:id/events.
+func handleVideoEventsToken(c *fiber.Ctx) error {
+	videoID := c.Params("id")
+	allowed, err := canSeeProcessing(c, videoID)
+	if err != nil {
+		log.Println("❌ Failed to load video:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to load video status")
+	}
+	if !allowed {
+		return fiber.NewError(fiber.StatusNotFound, "Video not found")
+	}
+	expires := time.Now().Add(streamTokenTTL)
+	token := videoTokenKey.Sign(videotoken.Claims{VideoID: videoID, UserID: currentUser(c).ID, Purpose: videotoken.ForEvents, Expires: expires.Unix()})
+	return c.JSON(fiber.Map{"token": token, "expiresAt": expires})
+}
+
+// acquireEventStream counts a new stream of userID against the limits.
+// It returns false when either is reached; otherwise the caller must call
+// releaseEventStream once the stream ends.
+func acquireEventStream(userID string) bool {
+	eventStreamsMu.Lock()
+	defer eventStreamsMu.Unlock()
+	if eventStreams >= maxEventStreams || userStreams[userID] >= maxUserStreams {
+		return false
+	}
+	eventStreams++
+	userStreams[userID]++
+	return true
+}
+
+func releaseEventStream(userID string) {
+	eventStreamsMu.Lock()
+	defer eventStreamsMu.Unlock()
+	eventStreams--
+	if userStreams[userID]--; userStreams[userID] <= 0 {
+		delete(userStreams, userID)
+	}
+}
+
+// handleVideoEvents streams the status of a video's latest job as
+// Server-Sent Events: one "status" event whenever it changes, the same
+// shape as GET /videos/:id/status, until the job succeeds or fails. It
+// needs a token from handleVideoEventsToken in the "token" query parameter.
+func handleVideoEvents(c *fiber.Ctx) error {
+	videoID := c.Params("id")
+	token, ok := videoTokenKey.Verify(c.Query("token"), videoID, videotoken.ForEvents)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid or expired stream token")
+	}
+	if _, err := latestJob(c.Context(), videoID); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return fiber.NewError(fiber.StatusNotFound, "Video not found")
+		}
+		log.Println("❌ Failed to load job:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to load video status")
+	}
+	if !acquireEventStream(token.UserID) {
+		return fiber.NewError(fiber.StatusTooManyRequests, "Too many open event streams")
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no") // don't let proxies hold events back
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer releaseEventStream(token.UserID)
+		ctx, cancel := context.WithTimeout(context.Background(), eventStreamMaxTime)
+		defer cancel()
+		ticker := time.NewTicker(eventPollInterval)
+		defer ticker.Stop()
+
+		var last []byte
+		lastWrite := time.Now()
+		for {
+			job, err := latestJob(ctx, videoID)
+			if err != nil && ctx.Err() == nil {
+				log.Println("❌ Failed to load job:", err)
+			}
+			if job != nil {
+				data, err := json.Marshal(videoStatus(job))
+				if err == nil && !bytes.Equal(data, last) {
+					fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+					last, lastWrite = data, time.Now()
+					if w.Flush() != nil {
+						return // client went away
+					}
+				}
+				if job.Status == jobSucceeded || job.Status == jobFailed {
+					return
+				}
+			}
+			if time.Since(lastWrite) >= eventKeepAlive {
+				fmt.Fprint(w, ": keep-alive\n\n")
+				lastWrite = time.Now()
+				if w.Flush() != nil {
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-shuttingDown:
+				return
+			}
+		}
+	})
+	return nil
+}
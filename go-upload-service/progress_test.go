@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProgressWriter(t *testing.T) {
+	var updates []ffmpegProgress
+	w := &progressWriter{onUpdate: func(p ffmpegProgress) { updates = append(updates, p) }}
+
+	// ffmpeg's output arrives in arbitrary pieces, lines split across writes.
+	output := "frame=10\nfps=25.0\nout_time_us=400000\nspeed=1.5x\nprogress=continue\n" +
+		"fps=30.00\r\nout_time_ms=2500000\r\nspeed=N/A\r\nprogress=continue\r\n" +
+		"out_time_us=N/A\nprogress=end\n"
+	for _, chunk := range []string{output[:7], output[7:40], output[40:41], output[41:]} {
+		if n, err := w.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+
+	want := []ffmpegProgress{
+		{Processed: 0.4, FPS: 25, Speed: 1.5},
+		{Processed: 2.5, FPS: 30},
+		{Processed: 2.5, FPS: 30, Done: true}, // N/A keeps the last time
+	}
+	if !reflect.DeepEqual(updates, want) {
+		t.Fatalf("got %+v, want %+v", updates, want)
+	}
+}
+
+func TestProgressWriterHoldsPartialLines(t *testing.T) {
+	called := false
+	w := &progressWriter{onUpdate: func(ffmpegProgress) { called = true }}
+	w.Write([]byte("out_time_us=1000000\nprogress=cont"))
+	if called {
+		t.Fatal("update before the progress line was complete")
+	}
+	w.Write([]byte("inue\n"))
+	if !called || w.cur.Processed != 1 {
+		t.Fatalf("called %v, processed %v", called, w.cur.Processed)
+	}
+}
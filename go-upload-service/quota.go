@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ------------------- QUOTAS ----------------------------
+// Each account may store a limited number of bytes (originals plus HLS
+// renditions and thumbnails), start a limited number of uploads per day and
+// have a limited number of uploads in progress. Limits come from the upload
+// policy, per role with optional per-user overrides.
+//
+// Stored bytes are those of the video registry, so they follow finished
+// transcodes and deletions, plus the full length of every upload still in
+// progress, so parallel uploads cannot together go over the quota. Uploads
+// per day are counted from upload_starts, which keeps one record per
+// accepted upload for uploadWindow: purging a video does not give its
+// upload back.
+
+const (
+	uploadWindow = 24 * time.Hour
+	// A single-request upload session outlives a crashed request by this
+	// much before it stops counting.
+	uploadSessionTTL = time.Hour
+)
+
+var (
+	uploadSessionsCollection *mongo.Collection
+	uploadStartsCollection   *mongo.Collection
+)
+
+// quotaLimits are the quotas of one role or user; 0 means unlimited.
+type quotaLimits struct {
+	MaxStorageBytes      int64 `json:"maxStorageBytes"`
+	MaxUploadsPerDay     int64 `json:"maxUploadsPerDay"`
+	MaxConcurrentUploads int64 `json:"maxConcurrentUploads"`
+}
+
+type quotaUsage struct {
+	StoredBytes   int64 `json:"storedBytes"`
+	UploadsToday  int64 `json:"uploadsToday"`
+	ActiveUploads int64 `json:"activeUploads"`
+}
+
+// uploadSession is an upload in progress: a tus upload from creation until
+// it is finished or dropped, or a single request while it runs.
+type uploadSession struct {
+	ID        string    `bson:"_id"`
+	OwnerID   string    `bson:"ownerId"`
+	Bytes     int64     `bson:"bytes"` // the length of the whole upload
+	StartedAt time.Time `bson:"startedAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// uploadStart counts an accepted upload towards the daily limit.
+type uploadStart struct {
+	ID        string    `bson:"_id"` // the upload session's
+	OwnerID   string    `bson:"ownerId"`
+	StartedAt time.Time `bson:"startedAt"`
+}
+
+func ensureQuotaIndexes(ctx context.Context) error {
+	_, err := uploadSessionsCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "expiresAt", Value: 1}}},
+		// Sessions of uploads that were never finished or dropped.
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = uploadStartsCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "startedAt", Value: 1}}},
+		{Keys: bson.D{{Key: "startedAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(uploadWindow.Seconds()))},
+	})
+	return err
+}
+
+// quotaFor returns the quotas of user: their override if they have one,
+// else those of their role.
+func (p *uploadPolicy) quotaFor(user *authUser) quotaLimits {
+	if q, ok := p.Users[user.ID]; ok {
+		return q
+	}
+	return p.limitsFor(user.Role).quotaLimits
+}
+
+func usageOf(ctx context.Context, ownerID string) (*quotaUsage, error) {
+	usage := &quotaUsage{}
+	stored, err := sumBytes(ctx, videosCollection, bson.M{"ownerId": ownerID})
+	if err != nil {
+		return nil, err
+	}
+	active := bson.M{"ownerId": ownerID, "expiresAt": bson.M{"$gt": time.Now()}}
+	uploading, err := sumBytes(ctx, uploadSessionsCollection, active)
+	if err != nil {
+		return nil, err
+	}
+	usage.StoredBytes = stored + uploading
+
+	usage.UploadsToday, err = uploadStartsCollection.CountDocuments(ctx, bson.M{
+		"ownerId":   ownerID,
+		"startedAt": bson.M{"$gte": time.Now().Add(-uploadWindow)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	usage.ActiveUploads, err = uploadSessionsCollection.CountDocuments(ctx, active)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// sumBytes adds up the "bytes" of the documents of coll matching filter.
+func sumBytes(ctx context.Context, coll *mongo.Collection, filter bson.M) (int64, error) {
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "bytes": bson.M{"$sum": "$bytes"}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var totals []struct {
+		Bytes int64 `bson:"bytes"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil || len(totals) == 0 {
+		return 0, err
+	}
+	return totals[0].Bytes, nil
+}
+
+// checkQuota rejects a new upload of size bytes (0 if not known yet) by
+// user if it would take them over a quota.
+func checkQuota(ctx context.Context, user *authUser, size int64) error {
+	usage, err := usageOf(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	return quotaError(policy.quotaFor(user), usage, size)
+}
+
+// quotaError returns the error for the first of limits a new upload of size
+// bytes would exceed, given usage without it, or nil.
+func quotaError(limits quotaLimits, usage *quotaUsage, size int64) error {
+	if limits.MaxConcurrentUploads > 0 && usage.ActiveUploads >= limits.MaxConcurrentUploads {
+		return rejectUpload(fiber.StatusTooManyRequests, "too_many_uploads",
+			fmt.Sprintf("You can have at most %d uploads in progress", limits.MaxConcurrentUploads),
+			fiber.Map{"limit": limits.MaxConcurrentUploads, "actual": usage.ActiveUploads})
+	}
+	if limits.MaxUploadsPerDay > 0 && usage.UploadsToday >= limits.MaxUploadsPerDay {
+		return rejectUpload(fiber.StatusTooManyRequests, "daily_upload_limit",
+			fmt.Sprintf("You can upload at most %d videos per day", limits.MaxUploadsPerDay),
+			fiber.Map{"limit": limits.MaxUploadsPerDay, "actual": usage.UploadsToday})
+	}
+	if limits.MaxStorageBytes > 0 && usage.StoredBytes+size > limits.MaxStorageBytes {
+		return rejectUpload(fiber.StatusRequestEntityTooLarge, "storage_quota_exceeded",
+			fmt.Sprintf("Your videos can use at most %d MB of storage", limits.MaxStorageBytes/(1024*1024)),
+			fiber.Map{"limit": limits.MaxStorageBytes, "used": usage.StoredBytes, "actual": size})
+	}
+	return nil
+}
+
+// beginUploadSession records an upload of size bytes in progress and counts
+// it towards the daily limit. Both are inserted before the quotas are
+// checked again, so two uploads racing for the last slot or the last bytes
+// cannot both get them.
+func beginUploadSession(ctx context.Context, user *authUser, id string, size int64, expires time.Time) error {
+	now := time.Now()
+	_, err := uploadSessionsCollection.InsertOne(ctx, uploadSession{
+		ID:        id,
+		OwnerID:   user.ID,
+		Bytes:     size,
+		StartedAt: now,
+		ExpiresAt: expires,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = uploadStartsCollection.InsertOne(ctx, uploadStart{ID: id, OwnerID: user.ID, StartedAt: now})
+	if err == nil {
+		var usage *quotaUsage
+		if usage, err = usageOf(ctx, user.ID); err == nil {
+			err = quotaError(policy.quotaFor(user), withoutUpload(usage, size), size)
+		}
+	}
+	if err != nil {
+		endUploadSession(id)
+		if _, delErr := uploadStartsCollection.DeleteOne(context.Background(), bson.M{"_id": id}); delErr != nil {
+			log.Printf("❌ Failed to drop upload start %s: %v\n", id, delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// withoutUpload takes one upload of size bytes, counted in usage, back out.
+func withoutUpload(usage *quotaUsage, size int64) *quotaUsage {
+	return &quotaUsage{
+		StoredBytes:   usage.StoredBytes - size,
+		UploadsToday:  usage.UploadsToday - 1,
+		ActiveUploads: usage.ActiveUploads - 1,
+	}
+}
+
+func endUploadSession(id string) {
+	if _, err := uploadSessionsCollection.DeleteOne(context.Background(), bson.M{"_id": id}); err != nil {
+		log.Printf("❌ Failed to end upload session %s: %v\n", id, err)
+	}
+}
+
+// updateStoredBytes recounts what video id takes up in storage, after
+// transcoding or a poster change.
+func updateStoredBytes(ctx context.Context, id string) error {
+	objects, err := storage.List(ctx, id+"/")
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, obj := range objects {
+		total += obj.Size
+	}
+	_, err = videosCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"bytes": total}})
+	return err
+}
+
+// handleGetQuota serves GET /quota: the caller's quotas and usage.
+func handleGetQuota(c *fiber.Ctx) error {
+	user := currentUser(c)
+	usage, err := usageOf(c.Context(), user.ID)
+	if err != nil {
+		log.Println("❌ Failed to load quota usage:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to load quota")
+	}
+	return c.JSON(fiber.Map{
+		"limits": policy.quotaFor(user),
+		"usage":  usage,
+	})
+}
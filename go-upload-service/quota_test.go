@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestQuotaFor(t *testing.T) {
+	p := defaultUploadPolicy
+	p.Users = map[string]quotaLimits{"u-vip": {MaxStorageBytes: 1 << 40}}
+
+	if got := p.quotaFor(&authUser{ID: "u-vip", Role: "user"}); got != p.Users["u-vip"] {
+		t.Errorf("override: got %+v", got)
+	}
+	if got := p.quotaFor(&authUser{ID: "u1", Role: "user"}); got != p.Roles["user"].quotaLimits {
+		t.Errorf("role: got %+v", got)
+	}
+	if got := p.quotaFor(&authUser{ID: "u2", Role: "admin"}); got != (quotaLimits{}) {
+		t.Errorf("admin should be unlimited, got %+v", got)
+	}
+}
+
+func TestQuotaError(t *testing.T) {
+	limits := quotaLimits{MaxStorageBytes: 1000, MaxUploadsPerDay: 5, MaxConcurrentUploads: 2}
+	tests := []struct {
+		name  string
+		usage quotaUsage
+		size  int64
+		want  string
+	}{
+		{"room left", quotaUsage{StoredBytes: 400, UploadsToday: 4, ActiveUploads: 1}, 600, ""},
+		{"size not known yet", quotaUsage{StoredBytes: 1000}, 0, ""},
+		{"too many in progress", quotaUsage{ActiveUploads: 2}, 1, "too_many_uploads"},
+		{"daily limit", quotaUsage{UploadsToday: 5}, 1, "daily_upload_limit"},
+		{"storage", quotaUsage{StoredBytes: 400}, 601, "storage_quota_exceeded"},
+	}
+	for _, tt := range tests {
+		err := quotaError(limits, &tt.usage, tt.size)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: rejected: %v", tt.name, err)
+			}
+			continue
+		}
+		wantPolicyError(t, tt.name, err, tt.want)
+	}
+
+	if err := quotaError(quotaLimits{}, &quotaUsage{StoredBytes: 1 << 40, UploadsToday: 1000, ActiveUploads: 100}, 1<<30); err != nil {
+		t.Errorf("unlimited: %v", err)
+	}
+}
+
+// beginUploadSession checks the usage read after recording the new upload,
+// with the upload itself taken out again.
+func TestQuotaCountsUploadsInProgress(t *testing.T) {
+	limits := quotaLimits{MaxStorageBytes: 1000}
+
+	// 300 stored, and two 400 byte uploads started at the same time: each
+	// sees the other in progress, so the second to count is refused.
+	usage := &quotaUsage{StoredBytes: 300 + 400 + 400, UploadsToday: 2, ActiveUploads: 2}
+	wantPolicyError(t, "racing uploads", quotaError(limits, withoutUpload(usage, 400), 400), "storage_quota_exceeded")
+
+	// One upload alone fits.
+	usage = &quotaUsage{StoredBytes: 300 + 400, UploadsToday: 1, ActiveUploads: 1}
+	if err := quotaError(limits, withoutUpload(usage, 400), 400); err != nil {
+		t.Errorf("single upload: %v", err)
+	}
+
+	limits = quotaLimits{MaxUploadsPerDay: 3}
+	usage = &quotaUsage{UploadsToday: 3, ActiveUploads: 1}
+	if err := quotaError(limits, withoutUpload(usage, 0), 0); err != nil {
+		t.Errorf("third upload of the day: %v", err)
+	}
+	usage = &quotaUsage{UploadsToday: 4, ActiveUploads: 1}
+	wantPolicyError(t, "fourth upload of the day", quotaError(limits, withoutUpload(usage, 0), 0), "daily_upload_limit")
+}
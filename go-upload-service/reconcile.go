@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"stream-flow/objstore"
+	"stream-flow/objstore/mediaaccess"
+)
+
+// ------------------- RECONCILIATION --------------------
+// A crash can leave a video half done: stored but never transcoded, or
+// missing from Socials or search. A reconciliation pass, at startup and
+// then every reconcileInterval, compares storage, the registry, the
+// transcode jobs, Socials and search. It queues transcodes that are
+// missing, republishes videos the other services have wrong (as a
+// video.updated event, see outbox.go), and reports what it cannot fix,
+// like files no video owns, for GET /admin/reconcile.
+//
+// Videos younger than reconcileGrace or with events still on their way
+// are left alone. Files stored under legacy filename keys, from before
+// video IDs, have no registry record to fix up: they are reported, and
+// those never chunked get their transcode queued.
+
+const (
+	reconcileGrace        = 10 * time.Minute
+	reconcileStartupDelay = 30 * time.Second // let the other services come up
+	reconcileLease        = 30 * time.Minute
+	maxReportedIssues     = 1000
+)
+
+// Kinds of reconciliation issues
+const (
+	issueOrphanFiles     = "orphan_files"     // stored under a video ID nothing knows
+	issueOrphanSocial    = "orphan_social"    // social record of a video that doesn't exist
+	issueMissingOriginal = "missing_original" // recorded, but the original is gone
+	issueMissingHLS      = "missing_hls"      // never transcoded, or its output is gone
+	issueTranscodeFailed = "transcode_failed" // transcoding gave up; needs a look
+	issueSocialMissing   = "social_missing"
+	issueSocialStale     = "social_stale"
+	issueSearchMissing   = "search_missing"
+	issueSearchStale     = "search_stale" // searchable although deleted or not public
+	issueLegacyFiles     = "legacy_files" // stored under a filename key, from before video IDs
+)
+
+var (
+	reconcileCollection *mongo.Collection
+	reconcileInterval   = time.Hour
+
+	errReconcileRunning = errors.New("a reconciliation pass is already running")
+)
+
+type reconcileIssue struct {
+	Kind    string `json:"kind" bson:"kind"`
+	VideoID string `json:"videoId" bson:"videoId"`
+	Detail  string `json:"detail,omitempty" bson:"detail,omitempty"`
+	Action  string `json:"action,omitempty" bson:"action,omitempty"` // what the pass did about it
+}
+
+type reconcileReport struct {
+	ID            string           `json:"-" bson:"_id"`
+	Node          string           `json:"node" bson:"node"`
+	StartedAt     time.Time        `json:"startedAt" bson:"startedAt"`
+	FinishedAt    time.Time        `json:"finishedAt" bson:"finishedAt"`
+	VideosChecked int              `json:"videosChecked" bson:"videosChecked"`
+	Requeued      int              `json:"requeued" bson:"requeued"`
+	Republished   int              `json:"republished" bson:"republished"`
+	Issues        []reconcileIssue `json:"issues" bson:"issues"`
+	Truncated     bool             `json:"truncated,omitempty" bson:"truncated,omitempty"` // more than maxReportedIssues
+	Error         string           `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+func (r *reconcileReport) add(kind, videoID, detail, action string) {
+	log.Printf("Reconcile: %s %s %s %s\n", kind, videoID, detail, action)
+	if len(r.Issues) >= maxReportedIssues {
+		r.Truncated = true
+		return
+	}
+	r.Issues = append(r.Issues, reconcileIssue{Kind: kind, VideoID: videoID, Detail: detail, Action: action})
+}
+
+// storedVideoFiles is what storage holds under one video ID.
+type storedVideoFiles struct {
+	Original bool
+	HLS      bool
+	Objects  int
+	Newest   time.Time
+}
+
+// runReconciler runs a pass shortly after startup and then every
+// reconcileInterval until ctx ends.
+func runReconciler(ctx context.Context) {
+	delay := reconcileStartupDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = reconcileInterval
+		if _, err := reconcile(ctx); err != nil && !errors.Is(err, errReconcileRunning) && ctx.Err() == nil {
+			log.Println("❌ Reconciliation failed:", err)
+		}
+	}
+}
+
+// reconcile runs one pass, unless another node is running one, and saves
+// its report.
+func reconcile(ctx context.Context) (*reconcileReport, error) {
+	held, err := acquireReconcileLease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !held {
+		return nil, errReconcileRunning
+	}
+	defer releaseReconcileLease()
+
+	report := &reconcileReport{ID: "latest", Node: workerID, StartedAt: time.Now(), Issues: []reconcileIssue{}}
+	err = reconcilePass(ctx, report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.FinishedAt = time.Now()
+	if _, dbErr := reconcileCollection.ReplaceOne(context.Background(), bson.M{"_id": report.ID}, report, options.Replace().SetUpsert(true)); dbErr != nil {
+		log.Println("❌ Failed to save reconciliation report:", dbErr)
+	}
+	log.Printf("Reconciled %d videos: %d issue(s), %d transcode(s) queued, %d republished\n",
+		report.VideosChecked, len(report.Issues), report.Requeued, report.Republished)
+	return report, err
+}
+
+func acquireReconcileLease(ctx context.Context) (bool, error) {
+	now := time.Now()
+	_, err := reconcileCollection.UpdateOne(ctx,
+		bson.M{"_id": "lease", "leaseUntil": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"leaseUntil": now.Add(reconcileLease), "holder": workerID}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// The lease exists and has not run out.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func releaseReconcileLease() {
+	_, err := reconcileCollection.UpdateOne(context.Background(),
+		bson.M{"_id": "lease", "holder": workerID},
+		bson.M{"$set": bson.M{"leaseUntil": time.Now()}},
+	)
+	if err != nil {
+		log.Println("❌ Failed to release reconciliation lease:", err)
+	}
+}
+
+func reconcilePass(ctx context.Context, report *reconcileReport) error {
+	cutoff := time.Now().Add(-reconcileGrace)
+
+	files, legacy, err := scanStorage(ctx)
+	if err != nil {
+		return fmt.Errorf("listing storage: %w", err)
+	}
+
+	var social []struct {
+		ID        string     `json:"_id"`
+		DeletedAt *time.Time `json:"deletedAt"`
+		CreatedAt time.Time  `json:"createdAt"`
+	}
+	target := fmt.Sprintf("%s/videos?includeDeleted=true&includePrivate=true", socialServiceURL)
+	if err := callService(ctx, http.MethodGet, target, nil, &social); err != nil {
+		return fmt.Errorf("listing Socials: %w", err)
+	}
+	socialDeleted := map[string]bool{}
+	for _, s := range social {
+		socialDeleted[s.ID] = s.DeletedAt != nil
+	}
+
+	// Videos whose events are still on their way to the other services
+	inFlight := map[string]bool{}
+	pending, err := outboxCollection.Distinct(ctx, "videoId", bson.M{"status": deliveryPending})
+	if err != nil {
+		return err
+	}
+	for _, id := range pending {
+		if s, ok := id.(string); ok {
+			inFlight[s] = true
+		}
+	}
+
+	cursor, err := videosCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	recorded := map[string]bool{}
+	for cursor.Next(ctx) {
+		var v videoRecord
+		if err := cursor.Decode(&v); err != nil {
+			return err
+		}
+		recorded[v.ID] = true
+		if v.CreatedAt.After(cutoff) || v.Purging {
+			continue
+		}
+		report.VideosChecked++
+		reconcileVideo(ctx, report, &v, files[v.ID], socialDeleted, inFlight[v.ID] || len(v.PendingEvents) > 0)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	// Videos stored before the registry existed have social records but no
+	// registry record; only what nothing knows about is an orphan.
+	for id, f := range files {
+		if !recorded[id] && f.Newest.Before(cutoff) {
+			if _, ok := socialDeleted[id]; !ok {
+				report.add(issueOrphanFiles, id, fmt.Sprintf("%d object(s)", f.Objects), "")
+			}
+		}
+	}
+	for _, s := range social {
+		if !recorded[s.ID] && files[s.ID] == nil && mediaaccess.IsVideoID(s.ID) && s.CreatedAt.Before(cutoff) {
+			report.add(issueOrphanSocial, s.ID, "no registry record or files", "")
+		}
+	}
+
+	for name, f := range legacy {
+		if f.Newest.After(cutoff) {
+			continue
+		}
+		report.VideosChecked++
+		reconcileLegacy(ctx, report, name, f, socialDeleted)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// reconcileLegacy reports what is stored for a legacy video keyed by
+// filename (name is the original's key) and queues its transcode if it was
+// never chunked.
+func reconcileLegacy(ctx context.Context, report *reconcileReport, name string, f *storedVideoFiles, socialDeleted map[string]bool) {
+	state := "no registry record"
+	switch _, known := socialDeleted[name]; {
+	case !f.Original:
+		state = "HLS output without original"
+	case !known:
+		state = "no registry or social record"
+	}
+	report.add(issueLegacyFiles, name, fmt.Sprintf("%d object(s), %s", f.Objects, state), "")
+	if f.Original && !f.HLS {
+		reconcileTranscode(ctx, report, &videoRecord{ID: name, Key: name})
+	}
+}
+
+// scanStorage groups the stored objects by video ID, and those under
+// legacy filename keys by the original's key.
+func scanStorage(ctx context.Context) (files, legacy map[string]*storedVideoFiles, err error) {
+	objects, err := storage.List(ctx, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	files = map[string]*storedVideoFiles{}
+	legacy = map[string]*storedVideoFiles{}
+	group := func(m map[string]*storedVideoFiles, key string, obj objstore.ObjectInfo) *storedVideoFiles {
+		f := m[key]
+		if f == nil {
+			f = &storedVideoFiles{}
+			m[key] = f
+		}
+		f.Objects++
+		if obj.LastModified.After(f.Newest) {
+			f.Newest = obj.LastModified
+		}
+		return f
+	}
+	// Legacy HLS output is named after the original without its extension.
+	legacyHLS := map[string][]objstore.ObjectInfo{}
+	for _, obj := range objects {
+		id, rest, ok := strings.Cut(obj.Key, "/")
+		switch {
+		case !ok:
+			if !mediaaccess.IsVideoID(id) {
+				group(legacy, id, obj).Original = true
+			}
+		case mediaaccess.IsVideoID(id):
+			f := group(files, id, obj)
+			if strings.HasPrefix(rest, "original") && !strings.Contains(rest, "/") {
+				f.Original = true
+			}
+			if obj.Key == hlsPrefix(id)+"index.m3u8" {
+				f.HLS = true
+			}
+		case strings.HasSuffix(id, "_hls"):
+			legacyHLS[id+"/"] = append(legacyHLS[id+"/"], obj)
+		}
+	}
+	for name, f := range legacy {
+		prefix := hlsPrefix(name)
+		for _, obj := range legacyHLS[prefix] {
+			group(legacy, name, obj)
+			if obj.Key == prefix+"index.m3u8" {
+				f.HLS = true
+			}
+		}
+		delete(legacyHLS, prefix)
+	}
+	// HLS output whose original is gone is reported under its directory.
+	for prefix, objs := range legacyHLS {
+		for _, obj := range objs {
+			if f := group(legacy, prefix, obj); obj.Key == prefix+"index.m3u8" {
+				f.HLS = true
+			}
+		}
+	}
+	return files, legacy, nil
+}
+
+// reconcileVideo checks one recorded video against storage, its jobs,
+// Socials and search.
+func reconcileVideo(ctx context.Context, report *reconcileReport, v *videoRecord, f *storedVideoFiles, socialDeleted map[string]bool, inFlight bool) {
+	if f == nil || !f.Original {
+		report.add(issueMissingOriginal, v.ID, v.Key, "")
+	} else if !f.HLS && v.DeletedAt == nil {
+		reconcileTranscode(ctx, report, v)
+	}
+
+	if inFlight {
+		return
+	}
+	var problems []string
+	deleted, ok := socialDeleted[v.ID]
+	switch {
+	case !ok:
+		problems = append(problems, issueSocialMissing)
+	case deleted != (v.DeletedAt != nil):
+		problems = append(problems, issueSocialStale)
+	}
+	searchable := v.DeletedAt == nil && (v.Visibility == "" || v.Visibility == visibilityPublic)
+	target := fmt.Sprintf("%s/index/%s", searchServiceURL, url.PathEscape(v.ID))
+	err := callService(ctx, http.MethodGet, target, nil, nil)
+	var se *serviceError
+	indexed := err == nil
+	if err != nil && !(errors.As(err, &se) && se.Status == http.StatusNotFound) {
+		log.Printf("❌ Failed to look up %s in search: %v\n", v.ID, err)
+	} else if searchable && !indexed {
+		problems = append(problems, issueSearchMissing)
+	} else if !searchable && indexed {
+		problems = append(problems, issueSearchStale)
+	}
+	if len(problems) == 0 {
+		return
+	}
+
+	// The next event carries the whole video, which fixes both.
+	action := "republished"
+	if err := recordEvent(ctx, v.ID, eventVideoUpdated); err != nil {
+		log.Printf("❌ Failed to republish %s: %v\n", v.ID, err)
+		action = ""
+	} else {
+		report.Republished++
+	}
+	for _, kind := range problems {
+		report.add(kind, v.ID, "", action)
+	}
+}
+
+// reconcileTranscode queues a transcode for a video without HLS output,
+// unless one is on its way or has failed for good.
+func reconcileTranscode(ctx context.Context, report *reconcileReport, v *videoRecord) {
+	job, err := latestJob(ctx, v.ID)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		log.Printf("❌ Failed to load jobs of %s: %v\n", v.ID, err)
+		return
+	}
+	if job != nil {
+		switch job.Status {
+		case jobQueued, jobRunning:
+			return
+		case jobFailed:
+			report.add(issueTranscodeFailed, v.ID, job.Error, "")
+			return
+		}
+	}
+	// No job, or it succeeded but its output is gone
+	if _, err := enqueueTranscode(ctx, v.ID, v.Key); err != nil {
+		log.Printf("❌ Failed to queue transcoding of %s: %v\n", v.ID, err)
+		report.add(issueMissingHLS, v.ID, "", "")
+		return
+	}
+	report.Requeued++
+	report.add(issueMissingHLS, v.ID, "", "transcode queued")
+}
+
+// ------------------- RECONCILIATION HANDLERS -----------
+
+// handleGetReconcileReport serves GET /admin/reconcile: the report of the
+// last pass.
+func handleGetReconcileReport(c *fiber.Ctx) error {
+	var report reconcileReport
+	err := reconcileCollection.FindOne(c.Context(), bson.M{"_id": "latest"}).Decode(&report)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fiber.NewError(fiber.StatusNotFound, "No reconciliation has run yet")
+	}
+	if err != nil {
+		log.Println("❌ Failed to load reconciliation report:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to load report")
+	}
+	return c.JSON(report)
+}
+
+// handleRunReconcile serves POST /admin/reconcile: run a pass now and
+// return its report.
+func handleRunReconcile(c *fiber.Ctx) error {
+	report, err := reconcile(c.Context())
+	if errors.Is(err, errReconcileRunning) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if report == nil {
+		log.Println("❌ Reconciliation failed:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Reconciliation failed")
+	}
+	return c.JSON(report)
+}
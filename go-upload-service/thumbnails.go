@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"stream-flow/objstore"
+)
+
+// ------------------- THUMBNAILS ------------------------
+// After transcoding, a few candidate poster frames are extracted from the
+// video and the most representative one (not black, not blurry) becomes the
+// poster, rendered in several sizes as JPEG and WebP. A sprite sheet of
+// small frames with a WebVTT track lets the player show previews while
+// scrubbing. Creators can later pick another candidate or upload their own
+// poster. Everything lives under "<id>/thumbs/".
+
+const (
+	thumbCandidates   = 6
+	spriteMaxFrames   = 100
+	spriteColumns     = 10
+	spriteTileWidth   = 160
+	maxPosterUpload   = 10 * 1024 * 1024
+	posterSourceWidth = 1280
+)
+
+var posterWidths = []int{320, 640, 1280}
+
+// thumbnail is one rendered poster image.
+type thumbnail struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Format string `json:"format"` // "jpeg" or "webp"
+}
+
+func thumbsPrefix(id string) string     { return id + "/thumbs/" }
+func candidatesPrefix(id string) string { return thumbsPrefix(id) + "candidates/" }
+
+// generateThumbnails extracts candidates from the local video at inputPath,
+// renders the best one as the poster, builds the scrubbing sprite and
+// records them, which marks the video as transcoded.
+func generateThumbnails(ctx context.Context, inputPath, id string, info *mediaInfo) error {
+	outDir, err := os.MkdirTemp(workDir, id+"_thumbs-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outDir)
+
+	best, bestScore := -1, math.Inf(-1)
+	for i := 0; i < thumbCandidates; i++ {
+		// Spread over 10%..85% of the video, away from intros and credits.
+		at := info.Duration * (0.1 + 0.75*float64(i)/float64(thumbCandidates-1))
+		path := filepath.Join(outDir, fmt.Sprintf("candidate-%d.jpg", i))
+		if err := runFFmpeg(ctx,
+			"-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", inputPath,
+			"-frames:v", "1",
+			"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", posterSourceWidth),
+			"-q:v", "2",
+			path,
+		); err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			// Seeking past the last keyframe of a short video yields nothing.
+			continue
+		}
+		if err := objstore.PutFile(ctx, storage, fmt.Sprintf("%s%d.jpg", candidatesPrefix(id), i), path); err != nil {
+			return err
+		}
+		score, err := frameScore(path)
+		if err != nil {
+			return err
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		return fmt.Errorf("no poster candidates could be extracted")
+	}
+
+	thumbs, err := renderPosters(ctx, filepath.Join(outDir, fmt.Sprintf("candidate-%d.jpg", best)), id)
+	if err != nil {
+		return err
+	}
+	track, err := generateSprite(ctx, inputPath, outDir, id, info)
+	if err != nil {
+		return err
+	}
+	return recordThumbnails(ctx, id, thumbs, track, eventVideoTranscoded)
+}
+
+// frameScore rates how well a frame works as a poster: sharper is better,
+// and frames that are nearly black, white or flat are ruled out.
+func frameScore(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+
+	// Sample a grid of at most 160 columns to keep this cheap.
+	b := img.Bounds()
+	step := b.Dx()/160 + 1
+	cols, rows := b.Dx()/step, b.Dy()/step
+	if cols < 3 || rows < 3 {
+		return 0, nil
+	}
+	luma := make([]float64, cols*rows)
+	var sum, sumSq float64
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x*step, b.Min.Y+y*step).RGBA()
+			l := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+			luma[y*cols+x] = l
+			sum += l
+			sumSq += l * l
+		}
+	}
+	n := float64(len(luma))
+	mean := sum / n
+	stddev := math.Sqrt(math.Max(sumSq/n-mean*mean, 0))
+
+	// Variance of the Laplacian: low for blurry frames.
+	var lapSum, lapSq float64
+	for y := 1; y < rows-1; y++ {
+		for x := 1; x < cols-1; x++ {
+			i := y*cols + x
+			lap := luma[i-1] + luma[i+1] + luma[i-cols] + luma[i+cols] - 4*luma[i]
+			lapSum += lap
+			lapSq += lap * lap
+		}
+	}
+	m := float64((rows - 2) * (cols - 2))
+	sharpness := lapSq/m - (lapSum/m)*(lapSum/m)
+
+	if mean < 20 || mean > 235 || stddev < 10 {
+		return sharpness - 1e9, nil
+	}
+	return sharpness, nil
+}
+
+// renderPosters stores the poster at srcPath in every size and format and
+// returns where they are. Earlier renders are left in place until the new
+// one is recorded; see removeOtherPosters.
+func renderPosters(ctx context.Context, srcPath, id string) ([]thumbnail, error) {
+	outDir, err := os.MkdirTemp(workDir, id+"_poster-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(outDir)
+
+	// A new revision per render so browsers and CDNs never show a stale
+	// poster under an old URL.
+	rev := strconv.FormatInt(time.Now().Unix(), 36)
+	var thumbs []thumbnail
+	for _, w := range posterWidths {
+		for _, format := range []string{"jpeg", "webp"} {
+			ext := map[string]string{"jpeg": ".jpg", "webp": ".webp"}[format]
+			name := fmt.Sprintf("poster-%s-%d%s", rev, w, ext)
+			path := filepath.Join(outDir, name)
+			args := []string{"-i", srcPath, "-vf", fmt.Sprintf("scale='min(%d,iw)':-2", w), "-frames:v", "1"}
+			if format == "jpeg" {
+				args = append(args, "-q:v", "3")
+			} else {
+				args = append(args, "-c:v", "libwebp", "-quality", "80")
+			}
+			if err := runFFmpeg(ctx, append(args, path)...); err != nil {
+				if format == "webp" {
+					// Not every ffmpeg build has libwebp; JPEG is enough.
+					log.Printf("WARN: WebP poster for %s failed: %v\n", id, err)
+					continue
+				}
+				return nil, err
+			}
+			key := thumbsPrefix(id) + name
+			if err := objstore.PutFile(ctx, storage, key, path); err != nil {
+				return nil, err
+			}
+			thumbs = append(thumbs, thumbnail{URL: mediaURL(key), Width: w, Format: format})
+		}
+	}
+	return thumbs, nil
+}
+
+// removeOtherPosters deletes the poster renders of video id that are not in
+// keep: older ones once a new render is recorded, or a new one that could
+// not be. Files are matched by name, so a change of MEDIA_BASE_URL does not
+// make the current ones look unreferenced.
+func removeOtherPosters(ctx context.Context, id string, keep []thumbnail) {
+	names := map[string]bool{}
+	for _, t := range keep {
+		names[path.Base(t.URL)] = true
+	}
+	objects, err := storage.List(ctx, thumbsPrefix(id)+"poster-")
+	if err != nil {
+		log.Printf("❌ Failed to list posters of %s: %v\n", id, err)
+		return
+	}
+	for _, obj := range objects {
+		if !names[path.Base(obj.Key)] {
+			_ = storage.Delete(ctx, obj.Key)
+		}
+	}
+}
+
+// posterFields are the record fields that make thumbs the poster, as
+// pipeline update values.
+func posterFields(thumbs []thumbnail) bson.M {
+	set := bson.M{"thumbnails": bson.M{"$literal": thumbs}}
+	for _, t := range thumbs {
+		if t.Width == 640 && t.Format == "jpeg" {
+			set["thumbnail"] = bson.M{"$literal": t.URL}
+		}
+	}
+	return set
+}
+
+// generateSprite renders up to spriteMaxFrames evenly spaced frames into
+// one tiled image and writes a WebVTT track mapping time ranges to tiles.
+// Returns the URL of the track.
+func generateSprite(ctx context.Context, inputPath, outDir, id string, info *mediaInfo) (string, error) {
+	interval := math.Max(1, info.Duration/spriteMaxFrames)
+	frames := int(math.Ceil(info.Duration / interval))
+	if frames > spriteMaxFrames {
+		frames = spriteMaxFrames
+	}
+	if frames < 1 {
+		frames = 1
+	}
+	rows := (frames + spriteColumns - 1) / spriteColumns
+	tileW := spriteTileWidth
+	tileH := (tileW*info.Height/info.Width + 1) &^ 1
+
+	spritePath := filepath.Join(outDir, "sprite.jpg")
+	if err := runFFmpeg(ctx,
+		"-i", inputPath,
+		"-vf", fmt.Sprintf("fps=1/%s,scale=%d:%d,tile=%dx%d", strconv.FormatFloat(interval, 'f', 3, 64), tileW, tileH, spriteColumns, rows),
+		"-frames:v", "1",
+		"-q:v", "5",
+		spritePath,
+	); err != nil {
+		return "", err
+	}
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n\n")
+	for i := 0; i < frames; i++ {
+		start := float64(i) * interval
+		end := math.Min(start+interval, info.Duration)
+		fmt.Fprintf(&vtt, "%s --> %s\nsprite.jpg#xywh=%d,%d,%d,%d\n\n",
+			vttTimestamp(start), vttTimestamp(end),
+			(i%spriteColumns)*tileW, (i/spriteColumns)*tileH, tileW, tileH)
+	}
+	vttPath := filepath.Join(outDir, "sprite.vtt")
+	if err := os.WriteFile(vttPath, []byte(vtt.String()), 0644); err != nil {
+		return "", err
+	}
+
+	if err := objstore.PutFile(ctx, storage, thumbsPrefix(id)+"sprite.jpg", spritePath); err != nil {
+		return "", err
+	}
+	if err := objstore.PutFile(ctx, storage, thumbsPrefix(id)+"sprite.vtt", vttPath); err != nil {
+		return "", err
+	}
+	return mediaURL(thumbsPrefix(id) + "sprite.vtt"), nil
+}
+
+func vttTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func runFFmpeg(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-hide_banner", "-v", "error", "-y"}, args...)...)
+	stderr := &tailBuffer{max: 1024}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// recordThumbnails stores the new poster (the 640px JPEG is the default
+// thumbnail) and, if given, the preview track on the video record, with an
+// event of eventType telling the other services.
+func recordThumbnails(ctx context.Context, id string, thumbs []thumbnail, previewTrack, eventType string) error {
+	set := appendEvent(eventType)
+	for field, value := range posterFields(thumbs) {
+		set[field] = value
+	}
+	if previewTrack != "" {
+		set["previewTrack"] = bson.M{"$literal": previewTrack}
+	}
+	res, err := videosCollection.UpdateOne(ctx, bson.M{"_id": id}, mongo.Pipeline{{{Key: "$set", Value: set}}})
+	if err != nil {
+		return fmt.Errorf("recording thumbnails: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("recording thumbnails: video %s not found", id)
+	}
+	wake(outboxWake)
+	removeOtherPosters(ctx, id, thumbs)
+	return nil
+}
+
+// ------------------- THUMBNAIL HANDLERS ----------------
+// handleListThumbnails returns the candidate frames a creator can choose
+// from.
+func handleListThumbnails(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if _, err := ownedVideo(c, id); err != nil {
+		return err
+	}
+	objects, err := storage.List(c.Context(), candidatesPrefix(id))
+	if err != nil {
+		log.Println("❌ Failed to list thumbnails:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to list thumbnails")
+	}
+	candidates := []fiber.Map{}
+	for _, obj := range objects {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(obj.Key, candidatesPrefix(id)), ".jpg"))
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, fiber.Map{"candidate": n, "url": mediaURL(obj.Key)})
+	}
+	return c.JSON(fiber.Map{"videoId": id, "candidates": candidates})
+}
+
+// handleSetThumbnail replaces the poster with a candidate frame
+// ({"candidate": n}) or an uploaded JPEG/PNG image (multipart "poster").
+func handleSetThumbnail(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if _, err := ownedVideo(c, id); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(workDir, "poster-*")
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to set thumbnail")
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if file, err := c.FormFile("poster"); err == nil {
+		if file.Size > maxPosterUpload {
+			return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Poster image is too large")
+		}
+		if err := c.SaveFile(file, tmp.Name()); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to set thumbnail")
+		}
+		if err := checkPosterImage(tmp.Name()); err != nil {
+			return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+		}
+	} else {
+		var body struct {
+			Candidate *int `json:"candidate"`
+		}
+		if err := c.BodyParser(&body); err != nil || body.Candidate == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Send a candidate number or a poster image")
+		}
+		if err := fetchCandidate(c.Context(), id, *body.Candidate, tmp.Name()); err != nil {
+			if errors.Is(err, objstore.ErrNotFound) {
+				return fiber.NewError(fiber.StatusNotFound, "Thumbnail candidate not found")
+			}
+			log.Println("❌ Failed to read thumbnail candidate:", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to set thumbnail")
+		}
+	}
+
+	thumbs, err := applyPoster(c.Context(), id, tmp.Name())
+	if err != nil {
+		log.Printf("❌ Failed to set poster of %s: %v\n", id, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to set thumbnail")
+	}
+	return c.JSON(fiber.Map{"videoId": id, "thumbnails": thumbs})
+}
+
+// fetchCandidate copies thumbnail candidate n of video id to path.
+func fetchCandidate(ctx context.Context, id string, n int, path string) error {
+	src, _, err := storage.Get(ctx, fmt.Sprintf("%s%d.jpg", candidatesPrefix(id), n))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeFile(path, src)
+}
+
+// applyPoster makes the image at path the poster of video id.
+func applyPoster(ctx context.Context, id, path string) ([]thumbnail, error) {
+	thumbs, err := renderPosters(ctx, path, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordThumbnails(ctx, id, thumbs, "", eventVideoUpdated); err != nil {
+		return nil, err
+	}
+	if err := updateStoredBytes(ctx, id); err != nil {
+		log.Printf("❌ Failed to update storage usage of %s: %v\n", id, err)
+	}
+	return thumbs, nil
+}
+
+// checkPosterImage accepts JPEG and PNG images of a sensible size.
+func checkPosterImage(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png") {
+		return fmt.Errorf("poster must be a JPEG or PNG image")
+	}
+	if cfg.Width < 160 || cfg.Height < 90 || cfg.Width > 8192 || cfg.Height > 8192 {
+		return fmt.Errorf("poster must be between 160x90 and 8192x8192 pixels")
+	}
+	return nil
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ------------------- TUS RESUMABLE UPLOADS -------------
+// Implements tus 1.0.0 (https://tus.io/protocols/resumable-upload) with the
+// creation, creation-with-upload, termination and expiration extensions.
+// Each upload is two files in tusDir: <id>.info (JSON state) and <id>.part
+// (bytes received so far). A finished upload is put into storage and goes
+// through processUpload like a regular form upload.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	tusMaxSize    = 1024 * 1024 * 1024 // same as the form upload limit
+
+	tusRequestHeaders  = "Tus-Resumable,Upload-Length,Upload-Metadata,Upload-Offset"
+	tusResponseHeaders = "Location,Tus-Resumable,Tus-Version,Tus-Extension,Tus-Max-Size,Upload-Offset,Upload-Length,Upload-Metadata,Upload-Expires,Video-Id"
+)
+
+var (
+	tusDir          = "./tus"
+	tusUploadExpiry = 24 * time.Hour
+	tusLocks        sync.Map // upload id -> *sync.Mutex
+)
+
+type tusUpload struct {
+	ID        string            `json:"id"`
+	VideoID   string            `json:"videoId"` // ID the finished video is stored under
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Metadata  map[string]string `json:"metadata"`
+	RawMeta   string            `json:"rawMetadata"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+
+	// The account that created the upload; only it may resume it.
+	OwnerID string `json:"ownerId"`
+	Owner   string `json:"owner"`
+	Role    string `json:"role"`
+}
+
+// ownedBy reports whether c's user may continue upload u. Uploads of other
+// users look like they don't exist.
+func (u *tusUpload) ownedBy(c *fiber.Ctx) bool {
+	user := currentUser(c)
+	return user != nil && u.OwnerID == user.ID
+}
+
+func tusInfoPath(id string) string { return filepath.Join(tusDir, id+".info") }
+func tusPartPath(id string) string { return filepath.Join(tusDir, id+".part") }
+
+func tusLock(id string) func() {
+	mu, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func loadTusUpload(id string) (*tusUpload, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(tusInfoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var u tusUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// save writes the info file atomically so a crash never leaves it half
+// written.
+func (u *tusUpload) save() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := tusInfoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, tusInfoPath(u.ID))
+}
+
+func removeTusUpload(id string) {
+	endUploadSession(id)
+	_ = os.Remove(tusPartPath(id))
+	_ = os.Remove(tusInfoPath(id))
+	tusLocks.Delete(id)
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2".
+func parseTusMetadata(raw string) (map[string]string, error) {
+	meta := map[string]string{}
+	if strings.TrimSpace(raw) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q is not base64", key)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+func setTusHeaders(c *fiber.Ctx) {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+}
+
+// checkTusVersion rejects requests from clients speaking another protocol
+// version.
+func checkTusVersion(c *fiber.Ctx) error {
+	if c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return c.SendStatus(fiber.StatusPreconditionFailed)
+	}
+	return nil
+}
+
+func handleTusOptions(c *fiber.Ctx) error {
+	setTusHeaders(c)
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Max-Size", strconv.Itoa(tusMaxSize))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func handleTusCreate(c *fiber.Ctx) error {
+	setTusHeaders(c)
+	if err := checkTusVersion(c); err != nil {
+		return err
+	}
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Upload-Length is required")
+	}
+	if length > tusMaxSize {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Upload exceeds maximum size")
+	}
+	// A chunked body has no length to check here (-1); writeTusChunk stops
+	// reading it at Upload-Length.
+	if int64(c.Request().Header.ContentLength()) > length {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length")
+	}
+	user := currentUser(c)
+	if err := policy.checkSize(user.Role, length); err != nil {
+		_, err = sendPolicyError(c, err)
+		return err
+	}
+	if err := checkQuota(c.Context(), user, length); err != nil {
+		if sent, err := sendPolicyError(c, err); sent {
+			return err
+		}
+		log.Println("❌ tus: quota check failed:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check upload quota")
+	}
+	rawMeta := c.Get("Upload-Metadata")
+	meta, err := parseTusMetadata(rawMeta)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid Upload-Metadata: "+err.Error())
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create upload")
+	}
+	videoID, err := newVideoID()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create upload")
+	}
+	now := time.Now()
+	u := &tusUpload{
+		ID:        hex.EncodeToString(buf),
+		VideoID:   videoID,
+		Length:    length,
+		Metadata:  meta,
+		RawMeta:   rawMeta,
+		CreatedAt: now,
+		ExpiresAt: now.Add(tusUploadExpiry),
+		OwnerID:   user.ID,
+		Owner:     user.Username,
+		Role:      user.Role,
+	}
+	if err := beginUploadSession(c.Context(), user, u.ID, u.Length, u.ExpiresAt); err != nil {
+		if sent, err := sendPolicyError(c, err); sent {
+			return err
+		}
+		log.Println("❌ tus: failed to start upload session:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create upload")
+	}
+	if err := os.WriteFile(tusPartPath(u.ID), nil, 0644); err != nil {
+		log.Println("❌ tus: failed to create part file:", err)
+		endUploadSession(u.ID)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create upload")
+	}
+	if err := u.save(); err != nil {
+		log.Println("❌ tus: failed to save upload info:", err)
+		removeTusUpload(u.ID)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create upload")
+	}
+	log.Printf("tus: created upload %s (%d bytes)\n", u.ID, length)
+
+	c.Set(fiber.HeaderLocation, fmt.Sprintf("%s/files/%s", publicURL, u.ID))
+	c.Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Set("Video-Id", u.VideoID)
+
+	// creation-with-upload: the first chunk may come with the POST
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), "application/offset+octet-stream") && c.Request().Header.ContentLength() != 0 {
+		unlock := tusLock(u.ID)
+		defer unlock()
+		if err := writeTusChunk(u, requestBody(c)); err != nil {
+			if err == errTusTooLarge {
+				return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length")
+			}
+			if sent, err := sendPolicyError(c, err); sent {
+				return err
+			}
+			log.Printf("❌ tus: failed to write first chunk of %s: %v\n", u.ID, err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to store upload data")
+		}
+		c.Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		c.Set("Video-Id", u.VideoID)
+	}
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+func handleTusHead(c *fiber.Ctx) error {
+	setTusHeaders(c)
+	if err := checkTusVersion(c); err != nil {
+		return err
+	}
+	u, err := loadTusUpload(c.Params("id"))
+	if err != nil || !u.ownedBy(c) || time.Now().After(u.ExpiresAt) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	c.Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	c.Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	if u.RawMeta != "" {
+		c.Set("Upload-Metadata", u.RawMeta)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func handleTusPatch(c *fiber.Ctx) error {
+	setTusHeaders(c)
+	if err := checkTusVersion(c); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), "application/offset+octet-stream") {
+		return fiber.NewError(fiber.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Upload-Offset is required")
+	}
+
+	id := c.Params("id")
+	unlock := tusLock(id)
+	defer unlock()
+
+	u, err := loadTusUpload(id)
+	if err != nil || !u.ownedBy(c) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if time.Now().After(u.ExpiresAt) {
+		return c.SendStatus(fiber.StatusGone)
+	}
+	if offset != u.Offset {
+		return fiber.NewError(fiber.StatusConflict, "Upload-Offset does not match the current offset")
+	}
+	// Refuse oversized chunks before the streamed body is read.
+	if int64(c.Request().Header.ContentLength()) > u.Length-u.Offset {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length")
+	}
+	if err := writeTusChunk(u, requestBody(c)); err != nil {
+		if err == errTusTooLarge {
+			return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length")
+		}
+		if sent, err := sendPolicyError(c, err); sent {
+			return err
+		}
+		log.Printf("❌ tus: failed to write chunk of %s: %v\n", id, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to store upload data")
+	}
+	c.Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	// Once complete this may name an existing identical video instead.
+	c.Set("Video-Id", u.VideoID)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func handleTusDelete(c *fiber.Ctx) error {
+	setTusHeaders(c)
+	if err := checkTusVersion(c); err != nil {
+		return err
+	}
+	id := c.Params("id")
+	unlock := tusLock(id)
+	defer unlock()
+	if u, err := loadTusUpload(id); err != nil || !u.ownedBy(c) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	removeTusUpload(id)
+	log.Println("tus: terminated upload", id)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+var errTusTooLarge = fmt.Errorf("chunk exceeds upload length")
+
+// requestBody returns the request body as a stream. Fiber only sets up a
+// stream when the body did not arrive with the headers.
+func requestBody(c *fiber.Ctx) io.Reader {
+	if stream := c.Context().RequestBodyStream(); stream != nil {
+		return stream
+	}
+	return bytes.NewReader(c.Body())
+}
+
+// writeTusChunk streams body into the part file at the upload's current
+// offset and finishes the upload once all bytes are there. If the client
+// goes away mid-chunk, the bytes that arrived are kept and the offset
+// records them, so it can resume from there. The caller holds the upload's
+// lock.
+func writeTusChunk(u *tusUpload, body io.Reader) error {
+	f, err := os.OpenFile(tusPartPath(u.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// Write at the recorded offset: bytes past it are left over from a
+	// request that failed before the info file was updated.
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	remaining := u.Length - u.Offset
+	// Read one byte more than fits to notice oversized chunks, whatever
+	// Content-Length said (chunked requests have none).
+	n, copyErr := io.Copy(f, io.LimitReader(body, remaining+1))
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if n > remaining {
+		// Drop the whole chunk; the offset stays where it was.
+		return errTusTooLarge
+	}
+	if n > 0 {
+		u.Offset += n
+		if err := u.save(); err != nil {
+			return err
+		}
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+	if u.Offset == u.Length {
+		return finishTusUpload(u)
+	}
+	return nil
+}
+
+// finishTusUpload stores the completed file and runs the same
+// post-processing as handleUpload.
+func finishTusUpload(u *tusUpload) error {
+	if err := os.Truncate(tusPartPath(u.ID), u.Length); err != nil {
+		return err
+	}
+	if u.VideoID == "" {
+		// Created before video IDs were assigned at creation.
+		id, err := newVideoID()
+		if err != nil {
+			return err
+		}
+		u.VideoID = id
+	}
+	filename := cleanFilename(u.Metadata["filename"])
+	// Keep a scratch copy for transcoding; the part file is dropped below.
+	savePath := filepath.Join(workDir, u.ID+safeExt(filename))
+	if err := moveFile(tusPartPath(u.ID), savePath); err != nil {
+		return err
+	}
+	video, err := ingestUpload(context.Background(), u.VideoID, savePath, uploadMetadata{
+		Title:            u.Metadata["title"],
+		Description:      u.Metadata["description"],
+		Uploader:         u.Owner,
+		OwnerID:          u.OwnerID,
+		Role:             u.Role,
+		OriginalFilename: filename,
+	})
+	var rejected *policyError
+	if errors.As(err, &rejected) {
+		// Retrying cannot help; drop the upload.
+		os.Remove(savePath)
+		removeTusUpload(u.ID)
+		return err
+	}
+	if err != nil {
+		// Put the bytes back so the client can retry the final PATCH later.
+		// At the full offset a client would take the upload as done, so
+		// the last byte is reported missing: sending it again finishes
+		// the upload again.
+		if moveErr := moveFile(savePath, tusPartPath(u.ID)); moveErr != nil {
+			log.Printf("❌ tus: lost data of upload %s: %v\n", u.ID, moveErr)
+		}
+		if u.Length > 0 {
+			u.Offset = u.Length - 1
+			if saveErr := u.save(); saveErr != nil {
+				log.Printf("❌ tus: failed to reopen upload %s: %v\n", u.ID, saveErr)
+			}
+		}
+		return err
+	}
+	removeTusUpload(u.ID)
+	u.VideoID = video.ID
+	log.Printf("tus: upload %s complete, stored as video %s\n", u.ID, video.ID)
+	return nil
+}
+
+// moveFile renames src to dst, copying when they are on different
+// filesystems (e.g. separate Docker volumes).
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// runTusCleanup removes unfinished uploads past their expiry.
+func runTusCleanup() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		entries, err := os.ReadDir(tusDir)
+		if err != nil {
+			log.Println("❌ tus: cleanup failed:", err)
+			continue
+		}
+		for _, e := range entries {
+			id, ok := strings.CutSuffix(e.Name(), ".info")
+			if !ok {
+				continue
+			}
+			unlock := tusLock(id)
+			u, err := loadTusUpload(id)
+			if err == nil && time.Now().After(u.ExpiresAt) {
+				removeTusUpload(id)
+				log.Println("tus: removed expired upload", id)
+			}
+			unlock()
+		}
+	}
+}
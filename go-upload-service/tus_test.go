@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	got, err := parseTusMetadata("filename bXkgY2xpcC5tcDQ=, title 8J+OrCBEZW1v,is_confidential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"filename": "my clip.mp4", "title": "🎬 Demo", "is_confidential": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if got, err := parseTusMetadata("  "); err != nil || len(got) != 0 {
+		t.Fatalf("empty: got %v, %v", got, err)
+	}
+	for _, raw := range []string{"filename not*base64", "a YQ==,,b Yg==", ", YQ=="} {
+		if _, err := parseTusMetadata(raw); err == nil {
+			t.Errorf("parseTusMetadata(%q) accepted", raw)
+		}
+	}
+}
+
+// failingReader returns data and then err, like a client that goes away.
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func newTestTusUpload(t *testing.T, length int64) *tusUpload {
+	t.Helper()
+	tusDir = t.TempDir()
+	u := &tusUpload{ID: "0123456789abcdef", Length: length}
+	if err := os.WriteFile(tusPartPath(u.ID), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.save(); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// wantTusState checks the offset in memory and in the info file, and the
+// first offset bytes of the part file.
+func wantTusState(t *testing.T, u *tusUpload, offset int64, data string) {
+	t.Helper()
+	saved, err := loadTusUpload(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Offset != offset || saved.Offset != offset {
+		t.Fatalf("offset %d, saved %d, want %d", u.Offset, saved.Offset, offset)
+	}
+	part, err := os.ReadFile(tusPartPath(u.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(part)) < offset || string(part[:offset]) != data {
+		t.Fatalf("part file %q, want %q first", part, data)
+	}
+}
+
+func TestWriteTusChunk(t *testing.T) {
+	u := newTestTusUpload(t, 10)
+
+	if err := writeTusChunk(u, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	wantTusState(t, u, 5, "hello")
+
+	// A chunk past Upload-Length is dropped entirely.
+	if err := writeTusChunk(u, strings.NewReader("-world!")); !errors.Is(err, errTusTooLarge) {
+		t.Fatalf("oversized chunk: %v, want errTusTooLarge", err)
+	}
+	wantTusState(t, u, 5, "hello")
+
+	// The client goes away mid-chunk: what arrived is kept.
+	lost := errors.New("connection reset")
+	if err := writeTusChunk(u, &failingReader{data: "-w", err: lost}); !errors.Is(err, lost) {
+		t.Fatalf("interrupted chunk: %v", err)
+	}
+	wantTusState(t, u, 7, "hello-w")
+
+	// Resuming overwrites what the oversized chunk left past the offset.
+	if err := writeTusChunk(u, strings.NewReader("or")); err != nil {
+		t.Fatal(err)
+	}
+	wantTusState(t, u, 9, "hello-wor")
+
+	// An empty chunk changes nothing.
+	if err := writeTusChunk(u, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	wantTusState(t, u, 9, "hello-wor")
+}
+
+func TestWriteTusChunkMissingPart(t *testing.T) {
+	u := newTestTusUpload(t, 10)
+	os.Remove(tusPartPath(u.ID))
+	if err := writeTusChunk(u, strings.NewReader("hello")); err == nil {
+		t.Fatal("wrote to a missing part file")
+	}
+	if u.Offset != 0 {
+		t.Fatalf("offset moved to %d", u.Offset)
+	}
+}
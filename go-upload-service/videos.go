@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ------------------- VIDEO REGISTRY --------------------
+// The upload service keeps its own record of every video it stored: who
+// owns it, where its original is and its public metadata. Social and
+// search hold copies, kept up to date by events (see outbox.go); ownership
+// checks use this record.
+
+var videosCollection *mongo.Collection
+
+type videoRecord struct {
+	ID        string    `json:"id" bson:"_id"`
+	OwnerID   string    `json:"ownerId" bson:"ownerId"`
+	Owner     string    `json:"owner" bson:"owner"` // username at upload time
+	Key       string    `json:"key" bson:"key"`     // storage key of the original
+	SHA256    string    `json:"sha256" bson:"sha256"`
+	Size      int64     `json:"size" bson:"size"`
+	Bytes     int64     `json:"bytes" bson:"bytes"` // everything stored for the video
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+
+	OriginalFilename string     `json:"originalFilename" bson:"originalFilename"`
+	Media            *mediaInfo `json:"media,omitempty" bson:"media,omitempty"`
+
+	// Poster and scrubbing previews; a placeholder until transcoded
+	Thumbnail    string      `json:"thumbnail" bson:"thumbnail"`
+	Thumbnails   []thumbnail `json:"thumbnails,omitempty" bson:"thumbnails,omitempty"`
+	PreviewTrack string      `json:"previewTrack,omitempty" bson:"previewTrack,omitempty"`
+
+	// Editable metadata; Version goes up with every edit (see metadata.go)
+	Title       string     `json:"title" bson:"title"`
+	Description string     `json:"description" bson:"description"`
+	Tags        []string   `json:"tags" bson:"tags"`
+	Visibility  string     `json:"visibility" bson:"visibility"`
+	Version     int64      `json:"version" bson:"version"`
+	UpdatedAt   *time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+
+	// Set while the video is deleted but can still be restored
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	DeletedBy string     `json:"deletedBy,omitempty" bson:"deletedBy,omitempty"`
+	PurgeAt   *time.Time `json:"purgeAt,omitempty" bson:"purgeAt,omitempty"`
+	Purging   bool       `json:"-" bson:"purging,omitempty"`
+
+	// Events not yet in the outbox, and the sequence number of the last
+	// event (see outbox.go)
+	PendingEvents []pendingEvent `json:"-" bson:"pendingEvents,omitempty"`
+	EventSeq      int64          `json:"-" bson:"eventSeq,omitempty"`
+
+	// Purge work still to be done, in order (see deletion.go)
+	PendingSteps []string   `json:"-" bson:"pendingSteps,omitempty"`
+	StepAttempts int        `json:"-" bson:"stepAttempts,omitempty"`
+	StepError    string     `json:"-" bson:"stepError,omitempty"`
+	NextStepAt   *time.Time `json:"-" bson:"nextStepAt,omitempty"`
+}
+
+// videoView is what clients see of a video record: its metadata and
+// posters, without storage keys, hashes, usage or deletion details.
+type videoView struct {
+	ID           string      `json:"id"`
+	OwnerID      string      `json:"ownerId"`
+	Owner        string      `json:"owner"`
+	Title        string      `json:"title"`
+	Description  string      `json:"description"`
+	Tags         []string    `json:"tags"`
+	Visibility   string      `json:"visibility"`
+	Version      int64       `json:"version"`
+	Thumbnail    string      `json:"thumbnail"`
+	Thumbnails   []thumbnail `json:"thumbnails,omitempty"`
+	PreviewTrack string      `json:"previewTrack,omitempty"`
+	Media        *mediaInfo  `json:"media,omitempty"`
+	CreatedAt    time.Time   `json:"createdAt"`
+	UpdatedAt    *time.Time  `json:"updatedAt,omitempty"`
+}
+
+func viewOf(v *videoRecord) videoView {
+	return videoView{
+		ID:           v.ID,
+		OwnerID:      v.OwnerID,
+		Owner:        v.Owner,
+		Title:        v.Title,
+		Description:  v.Description,
+		Tags:         v.Tags,
+		Visibility:   v.Visibility,
+		Version:      v.Version,
+		Thumbnail:    v.Thumbnail,
+		Thumbnails:   v.Thumbnails,
+		PreviewTrack: v.PreviewTrack,
+		Media:        v.Media,
+		CreatedAt:    v.CreatedAt,
+		UpdatedAt:    v.UpdatedAt,
+	}
+}
+
+// placeholderThumbnail stands in for the poster until the transcode job
+// renders one.
+func placeholderThumbnail(id string) string {
+	return "https://picsum.photos/seed/" + id + "/640/360"
+}
+
+func ensureVideoIndexes(ctx context.Context) error {
+	_, err := videosCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "sha256", Value: 1}}},
+		{Keys: bson.D{{Key: "ownerId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "nextStepAt", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "purgeAt", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	return err
+}
+
+// findDuplicate returns a video of ownerID with the same content, if any.
+// Deleted videos don't count: uploading one again makes a new video.
+func findDuplicate(ctx context.Context, ownerID, sum string) (*videoRecord, error) {
+	var v videoRecord
+	err := videosCollection.FindOne(ctx, bson.M{"ownerId": ownerID, "sha256": sum, "deletedAt": notDeleted},
+		options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: 1}}),
+	).Decode(&v)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// ownedVideo loads video id for a change by the current user, who must own
+// it or be an admin. Deleted videos are not found.
+func ownedVideo(c *fiber.Ctx, id string) (*videoRecord, error) {
+	user := currentUser(c)
+	var v videoRecord
+	err := videosCollection.FindOne(c.Context(), bson.M{"_id": id, "deletedAt": notDeleted}).Decode(&v)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Video not found")
+		}
+		log.Println("❌ Failed to load video:", err)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to load video")
+	}
+	if user == nil || (v.OwnerID != user.ID && !user.isAdmin()) {
+		return nil, fiber.NewError(fiber.StatusForbidden, "You can only change your own videos")
+	}
+	return &v, nil
+}
+
+// canSeeProcessing reports whether the current user may follow the
+// processing of video id: only its owner and admins can. Videos of other
+// users look like they don't exist.
+func canSeeProcessing(c *fiber.Ctx, id string) (bool, error) {
+	user := currentUser(c)
+	if user == nil {
+		return false, nil
+	}
+	var v videoRecord
+	err := videosCollection.FindOne(c.Context(), bson.M{"_id": id, "deletedAt": notDeleted},
+		options.FindOne().SetProjection(bson.M{"ownerId": 1}),
+	).Decode(&v)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return v.OwnerID == user.ID || user.isAdmin(), nil
+}